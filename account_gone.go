@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// errAccountGone is returned when OGS reports a player doesn't exist (404) or
+// no longer exists (410): the account was deleted or banned
+var errAccountGone = errors.New("OGS account not found")
+
+// accountGoneAfterMisses is how many checks in a row must find the account
+// missing before it's treated as gone, so a passing OGS glitch doesn't count
+const accountGoneAfterMisses = 3
+
+// AccountGone tracks a user whose OGS account can't be found
+type AccountGone struct {
+	Misses      int   `json:"misses"`        // checks in a row that found no account
+	FirstMissAt int64 `json:"first_miss_at"` // unix time of the first of them
+	GoneAt      int64 `json:"gone_at,omitempty"`
+}
+
+// accountGoneGrace reads ACCOUNT_GONE_CLEANUP_DAYS, how long a gone account's
+// data is kept before it's deleted (default 7 days), in case the account
+// comes back
+func accountGoneGrace() time.Duration {
+	if daysStr := os.Getenv("ACCOUNT_GONE_CLEANUP_DAYS"); daysStr != "" {
+		if days, err := strconv.Atoi(daysStr); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return 7 * 24 * time.Hour
+}
+
+// accountGone reports whether the user's OGS account has been found gone.
+// Gone users aren't polled.
+func (srv *Server) accountGone(userID string) bool {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	gone := shard.accountsGone[userID]
+	return gone != nil && gone.GoneAt != 0
+}
+
+// recordAccountMiss counts a check that found the user's account missing.
+// On the miss that marks it gone, the user's device is told once.
+func (srv *Server) recordAccountMiss(userID string, now time.Time, send func(userID, title, body, action string, custom map[string]interface{}) error) bool {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	gone := shard.accountsGone[userID]
+	if gone == nil {
+		gone = &AccountGone{FirstMissAt: now.Unix()}
+		shard.accountsGone[userID] = gone
+	}
+	gone.Misses++
+	markedGone := gone.GoneAt == 0 && gone.Misses >= accountGoneAfterMisses
+	if markedGone {
+		gone.GoneAt = now.Unix()
+	}
+	shard.mu.Unlock()
+
+	if !markedGone {
+		return false
+	}
+
+	log.Printf("OGS account for user %s not found in %d checks since %s; no longer checking it", userID, gone.Misses, time.Unix(gone.FirstMissAt, 0).UTC().Format(time.RFC3339))
+	body := "We can't find your OGS account, so we've stopped checking for turns. Register again if this is a mistake."
+	if err := send(userID, "OGS account not found", body, "account_gone", nil); err != nil {
+		log.Printf("Could not tell user %s their account is gone: %v", userID, err)
+	}
+	srv.saveStorage()
+	return true
+}
+
+// pruneGoneAccounts deletes the data of users whose accounts have been gone
+// for longer than the grace period
+func (srv *Server) pruneGoneAccounts(now time.Time) int {
+	cutoff := now.Add(-accountGoneGrace()).Unix()
+
+	srv.storage.lockAll()
+	removed := make(map[string]string)
+	for _, shard := range srv.storage.shards {
+		for userID, gone := range shard.accountsGone {
+			if gone.GoneAt != 0 && gone.GoneAt <= cutoff {
+				removed[userID] = ""
+			}
+		}
+	}
+	if len(removed) == 0 {
+		srv.storage.unlockAll()
+		return 0
+	}
+	err := srv.storage.replaceDocs(storageDocs{Users: removed})
+	srv.storage.unlockAll()
+
+	if err != nil {
+		log.Printf("Error deleting %d gone accounts: %v", len(removed), err)
+		return 0
+	}
+
+	log.Printf("Deleted data for %d users whose OGS accounts are gone", len(removed))
+	srv.saveStorage()
+	return len(removed)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token. The
+// admin API is disabled entirely when ADMIN_TOKEN isn't set.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminToken)) != 1 {
+			log.Printf("Rejected admin request to %s from %s", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// CheckRecord is the outcome of the most recent check of a user
+type CheckRecord struct {
+	CheckedAt int64       `json:"checked_at"`
+	Status    *TurnStatus `json:"status,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func (srv *Server) recordCheckResult(userID string, status *TurnStatus, err error) {
+	record := CheckRecord{CheckedAt: time.Now().Unix(), Status: status}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	srv.lastChecks.Store(userID, record)
+
+	if err == nil {
+		srv.recordSuccessfulCheck(userID, time.Now())
+	}
+}
+
+// ViewAsUser is what the user-facing endpoints would currently return for a
+// user, rendered for support without sending anything
+type ViewAsUser struct {
+	UserID      string               `json:"user_id"`
+	Check       *TurnStatus          `json:"check"`
+	Diagnostics UserDiagnostics      `json:"diagnostics"`
+	LastCheck   *CheckRecord         `json:"last_check,omitempty"`
+	Pending     *PendingNotification `json:"pending_notification,omitempty"`
+	LastTrace   *DecisionTrace       `json:"last_decision_trace,omitempty"`
+}
+
+// viewAsUser renders /check and /diagnostics for a user without side effects:
+// no notifications are reserved or sent and stored state is left untouched.
+func (srv *Server) viewAsUser(w http.ResponseWriter, r *http.Request) {
+	userIDStr := mux.Vars(r)["userID"]
+
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin view-as request for user %s from %s", userIDStr, r.RemoteAddr)
+
+	games, err := srv.getActiveGames(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user games", http.StatusServiceUnavailable)
+		return
+	}
+
+	status, _ := srv.classifyTurns(userID, games)
+
+	view := ViewAsUser{
+		UserID:      userIDStr,
+		Check:       status,
+		Diagnostics: srv.buildUserDiagnostics(userID, games),
+	}
+
+	if record, exists := srv.lastChecks.Load(userIDStr); exists {
+		view.LastCheck = &record
+	}
+
+	if traces := srv.decisions.recent(userIDStr, 1); len(traces) > 0 {
+		view.LastTrace = &traces[0]
+	}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	if pending := shard.pendingNotifications[userIDStr]; pending != nil {
+		view.Pending = pending.clone()
+	}
+	shard.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// Left to the library, every push goes out at priority 10 with no expiration,
+// so APNs holds it for an offline device and delivers it whenever the device
+// comes back, even once the game has moved on. These settings choose how each
+// event type is delivered, and turn pushes expire when the player's clock
+// would run out, since after that the turn is gone.
+
+// apnsEventSet reads a comma-separated list of event types from an
+// environment variable
+func apnsEventSet(name string) map[string]bool {
+	events := make(map[string]bool)
+	for _, event := range strings.Split(os.Getenv(name), ",") {
+		if event = strings.TrimSpace(event); routingEvents[event] {
+			events[event] = true
+		}
+	}
+	return events
+}
+
+// apnsBackgroundEvent reports whether the event is listed in
+// APNS_BACKGROUND_EVENTS. Those are sent as silent background pushes, for
+// the app to decide whether to show, and always at priority 5, as APNs
+// requires.
+func apnsBackgroundEvent(event string) bool {
+	return apnsEventSet("APNS_BACKGROUND_EVENTS")[event]
+}
+
+// apnsPriority returns the event's priority: 5 for events listed in
+// APNS_LOW_PRIORITY_EVENTS, which iOS may deliver in batches to save power,
+// and 10, delivered straight away, for the rest
+func apnsPriority(event string) int {
+	if apnsBackgroundEvent(event) || apnsEventSet("APNS_LOW_PRIORITY_EVENTS")[event] {
+		return apns2.PriorityLow
+	}
+	return apns2.PriorityHigh
+}
+
+// apnsExpiration reads APNS_EXPIRATION_HOURS, how long APNs keeps a push for
+// an offline device (default 24; 0 delivers once and doesn't keep it)
+func apnsExpiration() time.Duration {
+	if value := os.Getenv("APNS_EXPIRATION_HOURS"); value != "" {
+		if hours, err := strconv.Atoi(value); err == nil && hours >= 0 {
+			return time.Duration(hours) * time.Hour
+		}
+	}
+	return 24 * time.Hour
+}
+
+// newAPNsPayload starts the payload for an event: an alert, or for background
+// events, a silent push carrying the title and body for the app to show
+func newAPNsPayload(event, title, body string) *payload.Payload {
+	if apnsBackgroundEvent(event) {
+		return payload.NewPayload().ContentAvailable().Custom("title", title).Custom("body", body)
+	}
+	return payload.NewPayload().AlertTitle(title).AlertBody(body).Sound("default")
+}
+
+// setAPNsDelivery sets the push type, priority and expiration of a push about
+// the event. A non-zero deadline, when the player's clock runs out, expires
+// the push early.
+func setAPNsDelivery(notification *apns2.Notification, event string, deadline, now time.Time) {
+	notification.PushType = apns2.PushTypeAlert
+	if apnsBackgroundEvent(event) {
+		notification.PushType = apns2.PushTypeBackground
+	}
+	notification.Priority = apnsPriority(event)
+
+	ttl := apnsExpiration()
+	if ttl == 0 {
+		// APNs reads an expiration of 0 as deliver once, don't store
+		notification.Expiration = time.Unix(0, 0)
+		return
+	}
+	expiration := now.Add(ttl)
+	if !deadline.IsZero() && deadline.After(now) && deadline.Before(expiration) {
+		expiration = deadline
+	}
+	notification.Expiration = expiration
+}
+
+// turnDeadline returns when the last of the games' clocks runs out, or zero
+// if any of them has no known deadline
+func turnDeadline(games []Game) time.Time {
+	var latest time.Time
+	for _, game := range games {
+		deadline, ok := clockDeadline(game)
+		if !ok {
+			return time.Time{}
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return latest
+}
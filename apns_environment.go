@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/sideshow/apns2"
+)
+
+// Device tokens belong to one APNs environment: builds from Xcode get sandbox
+// tokens, TestFlight and App Store builds production ones. The server pushes
+// to its configured environment, and a device registered with its own
+// apns_environment is pushed to that one instead, so both kinds of build can
+// use the same server.
+
+const (
+	apnsSandbox    = "sandbox"
+	apnsProduction = "production"
+)
+
+// apnsHosts maps each APNs environment to its host
+var apnsHosts = map[string]string{
+	apnsSandbox:    apns2.HostDevelopment,
+	apnsProduction: apns2.HostProduction,
+}
+
+// validAPNsEnvironment reports whether a device's environment is one the
+// server knows. Empty means the server's environment.
+func validAPNsEnvironment(environment string) bool {
+	_, known := apnsHosts[environment]
+	return environment == "" || known
+}
+
+// productionDeployment reports whether ENVIRONMENT names production, where
+// APNs credentials come from Secret Manager
+func productionDeployment() bool {
+	environment := strings.ToLower(os.Getenv("ENVIRONMENT"))
+	return environment == "production" || environment == "prod"
+}
+
+// apnsDevelopment reads APNS_DEVELOPMENT, whether pushes go to the sandbox
+// unless the device says otherwise. It defaults to false in production and
+// true elsewhere.
+func apnsDevelopment() bool {
+	switch strings.ToLower(os.Getenv("APNS_DEVELOPMENT")) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return !productionDeployment()
+}
+
+// setDevice stores the user's device token and its APNs environment. Callers
+// must hold mu.
+func (s *storageShard) setDevice(userID, deviceToken, environment string) {
+	s.deviceTokens[userID] = deviceToken
+	if environment == "" {
+		delete(s.deviceEnvironments, userID)
+	} else {
+		s.deviceEnvironments[userID] = environment
+	}
+}
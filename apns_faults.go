@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sideshow/apns2"
+)
+
+// faultSendError injects a transport error instead of an APNs response
+const faultSendError = "SendError"
+
+// faultStatusCodes maps injectable APNs reasons to the status APNs uses
+var faultStatusCodes = map[string]int{
+	apns2.ReasonBadDeviceToken:         http.StatusBadRequest,
+	apns2.ReasonDeviceTokenNotForTopic: http.StatusBadRequest,
+	apns2.ReasonExpiredProviderToken:   http.StatusForbidden,
+	apns2.ReasonUnregistered:           http.StatusGone,
+	apns2.ReasonTooManyRequests:        http.StatusTooManyRequests,
+	apns2.ReasonInternalServerError:    http.StatusInternalServerError,
+	apns2.ReasonServiceUnavailable:     http.StatusServiceUnavailable,
+}
+
+var apnsFaultsInjected atomic.Int64
+
+// apnsFaultConfig reads APNS_FAULT_RATE (0-1) and APNS_FAULT_REASONS (comma
+// separated, default ServiceUnavailable). Injection is refused when
+// ENVIRONMENT is production, so a stray variable can't break real pushes.
+func apnsFaultConfig() (float64, []string) {
+	rate, err := strconv.ParseFloat(os.Getenv("APNS_FAULT_RATE"), 64)
+	if err != nil || rate <= 0 {
+		return 0, nil
+	}
+	if environment := strings.ToLower(os.Getenv("ENVIRONMENT")); environment == "production" || environment == "prod" {
+		return 0, nil
+	}
+	rate = min(rate, 1)
+
+	var reasons []string
+	for _, reason := range strings.Split(os.Getenv("APNS_FAULT_REASONS"), ",") {
+		reason = strings.TrimSpace(reason)
+		if _, known := faultStatusCodes[reason]; known || reason == faultSendError {
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = []string{apns2.ReasonServiceUnavailable}
+	}
+	return rate, reasons
+}
+
+// injectAPNsFault decides whether a send fails, given a roll in [0, 1). It
+// returns the failure to report in place of calling APNs, if any.
+func injectAPNsFault(roll float64) (*apns2.Response, bool, error) {
+	rate, reasons := apnsFaultConfig()
+	if roll >= rate {
+		return nil, false, nil
+	}
+
+	apnsFaultsInjected.Add(1)
+	reason := reasons[int(roll/rate*float64(len(reasons)))%len(reasons)]
+	log.Printf("Injecting APNs fault: %s", reason)
+
+	if reason == faultSendError {
+		return nil, true, fmt.Errorf("injected APNs send error")
+	}
+	return &apns2.Response{StatusCode: faultStatusCodes[reason], Reason: reason}, true, nil
+}
+
+// pushAPNs sends a notification through the APNs client to the device's
+// environment, failing a share of sends when fault injection is configured
+func (srv *Server) pushAPNs(notification *apns2.Notification, environment string) (*apns2.Response, error) {
+	if res, injected, err := injectAPNsFault(rand.Float64()); injected {
+		return res, err
+	}
+	return srv.apns.Push(notification, environment)
+}
+
+// writeAPNsFaultMetrics writes fault injection counts in the Prometheus text format
+func writeAPNsFaultMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP ogs_notifications_apns_injected_faults_total APNs sends failed on purpose by APNS_FAULT_RATE.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_apns_injected_faults_total counter")
+	fmt.Fprintf(w, "ogs_notifications_apns_injected_faults_total %d\n", apnsFaultsInjected.Load())
+}
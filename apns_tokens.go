@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sideshow/apns2"
+)
+
+// APNs answers 410 Unregistered once the app is uninstalled or its
+// notifications are revoked, and BadDeviceToken for a token it will never
+// accept. Retrying either can't succeed, so the token is removed as soon as
+// APNs says so.
+
+var apnsTokensRemoved atomic.Int64
+
+// deadDeviceToken reports whether APNs rejected the push because the token
+// can never receive one
+func deadDeviceToken(res *apns2.Response) bool {
+	return res.StatusCode == http.StatusGone ||
+		res.Reason == apns2.ReasonUnregistered ||
+		res.Reason == apns2.ReasonBadDeviceToken
+}
+
+// removeDeadDeviceToken deletes the user's device token after APNs rejected
+// it for good. Without a device the user is no longer checked, unless they
+// also have ntfy or web push. A token registered again since the push was
+// sent is kept.
+func (srv *Server) removeDeadDeviceToken(userID, deviceToken string, res *apns2.Response) bool {
+	if !deadDeviceToken(res) {
+		return false
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	current, exists := shard.deviceTokens[userID]
+	removed := exists && current == deviceToken
+	if removed {
+		delete(shard.deviceTokens, userID)
+		delete(shard.deviceEnvironments, userID)
+		delete(shard.badgeCounts, userID)
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !removed {
+		return false
+	}
+	apnsTokensRemoved.Add(1)
+	log.Printf("Removed device token for user %s: APNs answered %d %s", userID, res.StatusCode, res.Reason)
+	srv.saveStorage()
+	return true
+}
+
+// writeAPNsTokenMetrics writes the count of removed tokens in the Prometheus text format
+func writeAPNsTokenMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP ogs_notifications_apns_tokens_removed_total Device tokens removed after APNs reported them unregistered or invalid.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_apns_tokens_removed_total counter")
+	fmt.Fprintf(w, "ogs_notifications_apns_tokens_removed_total %d\n", apnsTokensRemoved.Load())
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// App Store Server Notifications tell the server when a user's subscription
+// starts, renews, lapses or is refunded. Each is a JWS signed with a
+// certificate chain that must lead to Apple's root CA. The app attaches the
+// user's app account token to purchases, which is how a notification is
+// matched to a user.
+
+// appleLeafOID marks certificates Apple issues for signing App Store data
+var appleLeafOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+
+// appStoreRootCAs reads APP_STORE_ROOT_CA, a PEM file holding Apple's root
+// certificate (Apple Root CA - G3). Without it App Store notifications are
+// refused.
+func appStoreRootCAs() (*x509.CertPool, error) {
+	path := os.Getenv("APP_STORE_ROOT_CA")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		// Apple publishes the root in DER
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("no certificates in %s", path)
+		}
+		roots.AddCert(cert)
+	}
+	return roots, nil
+}
+
+// verifyAppleJWS checks a JWS signed by Apple and decodes its payload into v:
+// the x5c chain must lead to one of roots, the leaf must be an App Store
+// signing certificate, and the ES256 signature must match
+func verifyAppleJWS(jws string, roots *x509.CertPool, v interface{}) error {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWS")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed JWS header")
+	}
+	var header struct {
+		Alg string   `json:"alg"`
+		X5C []string `json:"x5c"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return errors.New("malformed JWS header")
+	}
+	if header.Alg != "ES256" || len(header.X5C) < 2 {
+		return errors.New("JWS must be ES256 with a certificate chain")
+	}
+
+	var chain []*x509.Certificate
+	for _, encoded := range header.X5C {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return errors.New("malformed certificate in chain")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.New("malformed certificate in chain")
+		}
+		chain = append(chain, cert)
+	}
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("certificate chain not trusted: %v", err)
+	}
+	appleLeaf := false
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(appleLeafOID) {
+			appleLeaf = true
+		}
+	}
+	if !appleLeaf {
+		return errors.New("signing certificate is not for App Store data")
+	}
+
+	key, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("signing certificate has no ECDSA key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return errors.New("malformed JWS signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return errors.New("JWS signature does not match")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed JWS payload")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// AppStoreNotification is the decoded payload of an App Store Server
+// Notification (version 2)
+type AppStoreNotification struct {
+	NotificationType string `json:"notificationType"`
+	Subtype          string `json:"subtype"`
+	NotificationUUID string `json:"notificationUUID"`
+	SignedDate       int64  `json:"signedDate"` // ms
+	Data             struct {
+		BundleID              string `json:"bundleId"`
+		Environment           string `json:"environment"`
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+		SignedRenewalInfo     string `json:"signedRenewalInfo"`
+	} `json:"data"`
+}
+
+// AppStoreTransaction is the decoded signedTransactionInfo
+type AppStoreTransaction struct {
+	OriginalTransactionID string `json:"originalTransactionId"`
+	ProductID             string `json:"productId"`
+	AppAccountToken       string `json:"appAccountToken"`
+	ExpiresDate           int64  `json:"expiresDate"`    // ms
+	RevocationDate        int64  `json:"revocationDate"` // ms; set when refunded or revoked
+}
+
+// AppStoreRenewal is the decoded signedRenewalInfo
+type AppStoreRenewal struct {
+	GracePeriodExpiresDate int64 `json:"gracePeriodExpiresDate"` // ms; billing retry keeps the subscription
+}
+
+// userForAppAccountToken finds the user who owns an app account token,
+// locking each shard in turn. Callers must hold no shard's lock.
+func (s *MoveStorage) userForAppAccountToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for userID, userToken := range shard.appAccountTokens {
+			if strings.EqualFold(userToken, token) {
+				shard.mu.RUnlock()
+				return userID, true
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return "", false
+}
+
+// receiveAppStoreNotification handles POST /app-store/notifications. Apple
+// retries anything but 200, so notifications that verify but don't concern a
+// known user are still acknowledged.
+func (srv *Server) receiveAppStoreNotification(w http.ResponseWriter, r *http.Request) {
+	roots, err := appStoreRootCAs()
+	if err != nil {
+		log.Printf("App Store root CA error: %v", err)
+	}
+	if roots == nil {
+		http.Error(w, "App Store notifications are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var body struct {
+		SignedPayload string `json:"signedPayload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.SignedPayload == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var notification AppStoreNotification
+	if err := verifyAppleJWS(body.SignedPayload, roots, &notification); err != nil {
+		log.Printf("Rejected App Store notification from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+	if bundleID := os.Getenv("APNS_BUNDLE_ID"); bundleID != "" && notification.Data.BundleID != bundleID {
+		log.Printf("Ignoring App Store notification %s for bundle %s", notification.NotificationUUID, notification.Data.BundleID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if notification.Data.SignedTransactionInfo == "" {
+		log.Printf("App Store notification %s (%s) has no transaction", notification.NotificationUUID, notification.NotificationType)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var transaction AppStoreTransaction
+	if err := verifyAppleJWS(notification.Data.SignedTransactionInfo, roots, &transaction); err != nil {
+		log.Printf("Rejected App Store transaction in notification %s: %v", notification.NotificationUUID, err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+	var renewal AppStoreRenewal
+	if notification.Data.SignedRenewalInfo != "" {
+		if err := verifyAppleJWS(notification.Data.SignedRenewalInfo, roots, &renewal); err != nil {
+			log.Printf("Rejected App Store renewal info in notification %s: %v", notification.NotificationUUID, err)
+			http.Error(w, "Invalid signature", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if srv.applyAppStoreTransaction(notification, transaction, renewal) {
+		srv.saveStorage()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyAppStoreTransaction updates the entitlement of the user the
+// transaction belongs to, unless a newer notification has already been
+// applied. It reports whether anything changed.
+func (srv *Server) applyAppStoreTransaction(notification AppStoreNotification, transaction AppStoreTransaction, renewal AppStoreRenewal) bool {
+	userID, found := srv.storage.userForAppAccountToken(transaction.AppAccountToken)
+	if !found {
+		log.Printf("App Store notification %s (%s) is for an unknown app account token", notification.NotificationUUID, notification.NotificationType)
+		return false
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if current := shard.entitlements[userID]; current != nil && current.SignedAt > notification.SignedDate {
+		log.Printf("Ignoring out-of-order App Store notification %s for user %s", notification.NotificationUUID, userID)
+		return false
+	}
+
+	expiresAt := transaction.ExpiresDate
+	if renewal.GracePeriodExpiresDate > expiresAt {
+		expiresAt = renewal.GracePeriodExpiresDate
+	}
+	entitlement := &Entitlement{
+		Tier:                  tierPremium,
+		Source:                "app_store",
+		ProductID:             transaction.ProductID,
+		OriginalTransactionID: transaction.OriginalTransactionID,
+		ExpiresAt:             expiresAt / 1000,
+		Revoked:               transaction.RevocationDate != 0,
+		SignedAt:              notification.SignedDate,
+	}
+	shard.entitlements[userID] = entitlement
+
+	log.Printf("App Store %s %s for user %s: %s, active=%v", notification.NotificationType, notification.Subtype,
+		userID, transaction.ProductID, entitlement.active(time.Now()))
+	return true
+}
+
+// getAppAccountToken handles GET /app-account-token/{userID}: the UUID the
+// app passes to StoreKit as appAccountToken, created on first request
+func (srv *Server) getAppAccountToken(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	token, exists := shard.appAccountTokens[userID]
+	if !exists {
+		token = newUUID()
+		shard.appAccountTokens[userID] = token
+	}
+	shard.mu.Unlock()
+	if !exists {
+		srv.saveStorage()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"app_account_token": token})
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// Counters for the background subsystems: push sends run in their own
+// goroutines, OGS requests queue for a slot, and presence events are dropped
+// for slow streams. A gauge that only ever grows is the usual sign of a leak.
+var (
+	pushesInFlight        atomic.Int64
+	ogsRequestsWaiting    atomic.Int64
+	ogsRequestsDropped    atomic.Int64
+	presenceEventsDropped atomic.Int64
+)
+
+// writeAsyncMetrics writes queue depth, in-flight work and drop counts in the
+// Prometheus text format
+func (srv *Server) writeAsyncMetrics(w http.ResponseWriter) {
+	pending, pendingInFlight := 0, 0
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		pending += len(shard.pendingNotifications)
+		for _, notification := range shard.pendingNotifications {
+			if notification.inFlight {
+				pendingInFlight++
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	srv.presence.mu.Lock()
+	streams := 0
+	for _, subscribers := range srv.presence.subscribers {
+		streams += len(subscribers)
+	}
+	srv.presence.mu.Unlock()
+
+	srv.writer.mu.Lock()
+	unflushed := 0
+	if srv.writer.dirty {
+		unflushed = 1
+	}
+	srv.writer.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_goroutines Goroutines currently running.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_goroutines gauge")
+	fmt.Fprintf(w, "ogs_notifications_goroutines %d\n", runtime.NumGoroutine())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_pending_notifications Users with turns reserved for a push that hasn't been delivered (the retry queue).")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_pending_notifications gauge")
+	fmt.Fprintf(w, "ogs_notifications_pending_notifications{state=\"queued\"} %d\n", pending-pendingInFlight)
+	fmt.Fprintf(w, "ogs_notifications_pending_notifications{state=\"sending\"} %d\n", pendingInFlight)
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_push_sends_in_flight Turn push goroutines currently sending.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_push_sends_in_flight gauge")
+	fmt.Fprintf(w, "ogs_notifications_push_sends_in_flight %d\n", pushesInFlight.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_ogs_requests OGS API requests holding or waiting for a concurrency slot.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_ogs_requests gauge")
+	fmt.Fprintf(w, "ogs_notifications_ogs_requests{state=\"active\"} %d\n", len(srv.ogsSlots))
+	fmt.Fprintf(w, "ogs_notifications_ogs_requests{state=\"waiting\"} %d\n", ogsRequestsWaiting.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_ogs_not_modified_total Player requests OGS answered with 304, served from the cached profile.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_ogs_not_modified_total counter")
+	fmt.Fprintf(w, "ogs_notifications_ogs_not_modified_total %d\n", ogsNotModified.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_game_state_cache_hits_total Game fetches served from a state another user's check fetched this cycle.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_game_state_cache_hits_total counter")
+	fmt.Fprintf(w, "ogs_notifications_game_state_cache_hits_total %d\n", gameStateCacheHits.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_ogs_circuit_trips_total Times the OGS circuit breaker opened after failures in a row.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_ogs_circuit_trips_total counter")
+	fmt.Fprintf(w, "ogs_notifications_ogs_circuit_trips_total %d\n", srv.ogsBreaker.trips.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_ogs_overview_checks_total Turn checks served from the lighter ui/overview endpoint instead of the full profile.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_ogs_overview_checks_total counter")
+	fmt.Fprintf(w, "ogs_notifications_ogs_overview_checks_total %d\n", ogsOverviewChecks.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_idle_checks_skipped_total Scheduled checks skipped for users whose recent checks found no games.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_idle_checks_skipped_total counter")
+	fmt.Fprintf(w, "ogs_notifications_idle_checks_skipped_total %d\n", idleChecksSkipped.Load())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_presence_streams Open presence event streams.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_presence_streams gauge")
+	fmt.Fprintf(w, "ogs_notifications_presence_streams %d\n", streams)
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_storage_unflushed Whether storage has changes waiting for the background writer.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_storage_unflushed gauge")
+	fmt.Fprintf(w, "ogs_notifications_storage_unflushed %d\n", unflushed)
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_dropped_total Work dropped because a queue was full.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_dropped_total counter")
+	fmt.Fprintf(w, "ogs_notifications_dropped_total{source=\"ogs_request\"} %d\n", ogsRequestsDropped.Load())
+	fmt.Fprintf(w, "ogs_notifications_dropped_total{source=\"presence_event\"} %d\n", presenceEventsDropped.Load())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// The app icon's badge is the number of games awaiting the user's move. Turn
+// pushes set it, and as the user plays, a silent push with only the badge
+// brings it down, since nothing else would until the next turn push.
+
+// BadgeCount tracks the user's badge
+type BadgeCount struct {
+	Awaiting int `json:"awaiting"` // games awaiting the user's move at the last check
+	Shown    int `json:"shown"`    // the badge last pushed to the device
+}
+
+// recordAwaitingMoves stores how many games await the user's move
+func (srv *Server) recordAwaitingMoves(userID string, awaiting int) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	badge := shard.badgeCounts[userID]
+	if badge == nil {
+		if awaiting == 0 {
+			return
+		}
+		badge = &BadgeCount{}
+		shard.badgeCounts[userID] = badge
+	}
+	badge.Awaiting = awaiting
+}
+
+// turnBadge returns the badge for a turn push: every game awaiting the user's
+// move, and at least the new turns being pushed
+func (srv *Server) turnBadge(userID string, newTurns int) int {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if badge := shard.badgeCounts[userID]; badge != nil && badge.Awaiting > newTurns {
+		return badge.Awaiting
+	}
+	return newTurns
+}
+
+// setBadgeShown records the badge the device was pushed
+func (srv *Server) setBadgeShown(userID string, shown int) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	badge := shard.badgeCounts[userID]
+	if badge == nil {
+		badge = &BadgeCount{}
+		shard.badgeCounts[userID] = badge
+	}
+	badge.Shown = shown
+	if badge.Shown == 0 && badge.Awaiting == 0 {
+		delete(shard.badgeCounts, userID)
+	}
+}
+
+// updateBadge sends a silent push lowering the badge once fewer games await
+// the user's move than it shows. It's left to a turn push in flight, which
+// carries the badge itself, and a failed push is tried again on the next
+// check.
+func (srv *Server) updateBadge(userID string) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	badge := shard.badgeCounts[userID]
+	var awaiting, shown int
+	if badge != nil {
+		awaiting, shown = badge.Awaiting, badge.Shown
+	}
+	deviceToken, hasDevice := shard.deviceTokens[userID]
+	environment := shard.deviceEnvironments[userID]
+	_, disabled := shard.notificationsDisabled[userID]
+	pending := shard.pendingNotifications[userID]
+	turnInFlight := pending != nil && pending.inFlight
+	shard.mu.RUnlock()
+
+	if awaiting >= shown || !hasDevice || disabled || turnInFlight || srv.apns == nil {
+		return
+	}
+
+	expiration := time.Unix(0, 0)
+	if ttl := apnsExpiration(); ttl > 0 {
+		expiration = time.Now().Add(ttl)
+	}
+	notification := &apns2.Notification{
+		DeviceToken: deviceToken,
+		Topic:       apnsTopic(),
+		PushType:    apns2.PushTypeAlert,
+		Priority:    apns2.PriorityLow,
+		CollapseID:  "badge",
+		Expiration:  expiration,
+		Payload:     payload.NewPayload().Badge(awaiting),
+	}
+	res, err := srv.pushAPNs(notification, environment)
+	if err != nil {
+		log.Printf("Badge update for user %s failed: %v", userID, err)
+		return
+	}
+	if !res.Sent() {
+		log.Printf("Badge update for user %s rejected: %s", userID, res.Reason)
+		srv.removeDeadDeviceToken(userID, deviceToken, res)
+		return
+	}
+	log.Printf("Lowered badge for user %s from %d to %d", userID, shown, awaiting)
+	srv.setBadgeShown(userID, awaiting)
+}
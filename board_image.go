@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sideshow/apns2/payload"
+)
+
+// Rich notifications show the board: pushes about a game carry
+// mutable-content and an image_url, and the app's notification service
+// extension downloads the image from /board/{gameID}.png and attaches it.
+// The image is OGS's thumbnail when BOARD_THUMBNAIL_URL names one, and
+// otherwise is drawn here from the game's SGF.
+
+// ogsGameSGFURL is a game's SGF, formatted with the game ID
+var ogsGameSGFURL = "https://online-go.com/api/v1/games/%d/sgf"
+
+// boardImageTTL is how long a rendered board is served before it's redrawn
+const boardImageTTL = 30 * time.Second
+
+// maxBoardSize is the largest board SGF coordinates can describe
+const maxBoardSize = 25
+
+type boardImage struct {
+	png        []byte
+	renderedAt time.Time
+}
+
+// boardImageURL returns the board image to attach to a push about the game,
+// or "" when PUBLIC_URL, where devices can reach the server, isn't set.
+// moves makes the URL change with the position, so a cached image of an
+// earlier one isn't reused.
+func boardImageURL(gameID, moves int) string {
+	base := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if base == "" || gameID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/board/%d.png?move=%d", base, gameID, moves)
+}
+
+// attachBoardImage marks an alert for the app's notification service
+// extension to show the game's board
+func attachBoardImage(alert *payload.Payload, gameID, moves int) {
+	if url := boardImageURL(gameID, moves); url != "" {
+		alert.MutableContent().Custom("image_url", url)
+	}
+}
+
+func (srv *Server) getBoardImage(w http.ResponseWriter, r *http.Request) {
+	gameID, err := strconv.Atoi(mux.Vars(r)["gameID"])
+	if err != nil || gameID <= 0 {
+		http.Error(w, "Invalid game ID", http.StatusBadRequest)
+		return
+	}
+
+	board, err := srv.renderedBoard(gameID, time.Now())
+	if errors.Is(err, errGameNotFound) {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Board image for game %d failed: %v", gameID, err)
+		http.Error(w, "Failed to render board", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(boardImageTTL.Seconds())))
+	w.Write(board)
+}
+
+// renderedBoard returns the game's board as a PNG, drawing it again once the
+// cached one is older than boardImageTTL
+func (srv *Server) renderedBoard(gameID int, now time.Time) ([]byte, error) {
+	if cached, exists := srv.boardImages.Load(gameID); exists && now.Sub(cached.renderedAt) < boardImageTTL {
+		return cached.png, nil
+	}
+
+	var rendered []byte
+	var err error
+	if thumbnailURL := os.Getenv("BOARD_THUMBNAIL_URL"); thumbnailURL != "" {
+		rendered, err = srv.fetchBoardThumbnail(fmt.Sprintf(thumbnailURL, gameID))
+	} else {
+		rendered, err = srv.renderBoardFromSGF(gameID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	srv.boardImages.Store(gameID, boardImage{png: rendered, renderedAt: now})
+	return rendered, nil
+}
+
+// fetchBoardThumbnail downloads a PNG of the board
+func (srv *Server) fetchBoardThumbnail(url string) ([]byte, error) {
+	resp, err := srv.ogsGet(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errGameNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ogsStatusError(resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+}
+
+// renderBoardFromSGF draws the game's current position from its SGF
+func (srv *Server) renderBoardFromSGF(gameID int) ([]byte, error) {
+	resp, err := srv.ogsGet(fmt.Sprintf(ogsGameSGFURL, gameID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errGameNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ogsStatusError(resp.StatusCode)
+	}
+	sgf, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SGF")
+	}
+
+	board, err := boardFromSGF(string(sgf))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, board.draw()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// goBoard is a position: stones[y][x] is 0 for empty, or stoneBlack or
+// stoneWhite
+type goBoard struct {
+	width, height int
+	stones        [][]int
+	lastX, lastY  int // -1 before the first move or after a pass
+}
+
+const (
+	stoneBlack = 1
+	stoneWhite = 2
+)
+
+func newGoBoard(width, height int) *goBoard {
+	stones := make([][]int, height)
+	for y := range stones {
+		stones[y] = make([]int, width)
+	}
+	return &goBoard{width: width, height: height, stones: stones, lastX: -1, lastY: -1}
+}
+
+// sgfPoint parses SGF coordinates like "pd". ok is false for a pass.
+func (b *goBoard) sgfPoint(value string) (x, y int, ok bool) {
+	if len(value) != 2 {
+		return 0, 0, false
+	}
+	x, y = int(value[0]-'a'), int(value[1]-'a')
+	return x, y, x >= 0 && y >= 0 && x < b.width && y < b.height
+}
+
+// play places a stone and removes the groups it captures
+func (b *goBoard) play(x, y, stone int) {
+	b.stones[y][x] = stone
+	b.lastX, b.lastY = x, y
+	for _, n := range b.neighbors(x, y) {
+		if b.stones[n[1]][n[0]] == 3-stone {
+			b.captureIfDead(n[0], n[1])
+		}
+	}
+	b.captureIfDead(x, y) // suicide, where the rules allow it
+}
+
+func (b *goBoard) neighbors(x, y int) [][2]int {
+	var points [][2]int
+	for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		nx, ny := x+d[0], y+d[1]
+		if nx >= 0 && ny >= 0 && nx < b.width && ny < b.height {
+			points = append(points, [2]int{nx, ny})
+		}
+	}
+	return points
+}
+
+// captureIfDead removes the group at x, y if it has no liberties
+func (b *goBoard) captureIfDead(x, y int) {
+	stone := b.stones[y][x]
+	group := [][2]int{{x, y}}
+	seen := map[[2]int]bool{{x, y}: true}
+	for i := 0; i < len(group); i++ {
+		for _, n := range b.neighbors(group[i][0], group[i][1]) {
+			switch neighbor := b.stones[n[1]][n[0]]; {
+			case neighbor == 0:
+				return
+			case neighbor == stone && !seen[n]:
+				seen[n] = true
+				group = append(group, n)
+			}
+		}
+	}
+	for _, p := range group {
+		b.stones[p[1]][p[0]] = 0
+	}
+}
+
+// boardFromSGF plays out the main line of an SGF game
+func boardFromSGF(sgf string) (*goBoard, error) {
+	start := strings.IndexByte(sgf, '(')
+	if start < 0 {
+		return nil, fmt.Errorf("not an SGF game")
+	}
+
+	var board *goBoard
+	ensureBoard := func() {
+		if board == nil {
+			board = newGoBoard(19, 19)
+		}
+	}
+
+	property := ""
+	for i := start + 1; i < len(sgf); i++ {
+		switch c := sgf[i]; {
+		case c == ')':
+			// The main line runs through each first variation, so it
+			// ends where the first one does
+			ensureBoard()
+			return board, nil
+		case c >= 'A' && c <= 'Z':
+			if sgf[i-1] >= 'A' && sgf[i-1] <= 'Z' {
+				property += string(c)
+			} else {
+				property = string(c)
+			}
+		case c == '[':
+			end := i + 1
+			for end < len(sgf) && sgf[end] != ']' {
+				if sgf[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(sgf) {
+				return nil, fmt.Errorf("unterminated SGF value")
+			}
+			value := sgf[i+1 : end]
+			i = end
+
+			switch property {
+			case "SZ":
+				if board != nil {
+					continue
+				}
+				width, height, square := strings.Cut(value, ":")
+				if !square {
+					height = width
+				}
+				w, errW := strconv.Atoi(strings.TrimSpace(width))
+				h, errH := strconv.Atoi(strings.TrimSpace(height))
+				if errW != nil || errH != nil || w < 2 || h < 2 || w > maxBoardSize || h > maxBoardSize {
+					return nil, fmt.Errorf("unsupported board size %q", value)
+				}
+				board = newGoBoard(w, h)
+			case "AB", "AW":
+				ensureBoard()
+				if x, y, ok := board.sgfPoint(value); ok {
+					board.stones[y][x] = map[string]int{"AB": stoneBlack, "AW": stoneWhite}[property]
+				}
+			case "B", "W":
+				ensureBoard()
+				if x, y, ok := board.sgfPoint(value); ok {
+					board.play(x, y, map[string]int{"B": stoneBlack, "W": stoneWhite}[property])
+				} else {
+					board.lastX, board.lastY = -1, -1
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unterminated SGF game")
+}
+
+var (
+	boardColor      = color.RGBA{220, 179, 92, 255}
+	lineColor       = color.RGBA{60, 45, 20, 255}
+	blackStoneColor = color.RGBA{20, 20, 20, 255}
+	whiteStoneColor = color.RGBA{245, 245, 240, 255}
+	lastMoveColor   = color.RGBA{200, 40, 40, 255}
+)
+
+// draw renders the position, with star points and the last move marked
+func (b *goBoard) draw() image.Image {
+	const cell = 24
+	img := image.NewRGBA(image.Rect(0, 0, (b.width+1)*cell, (b.height+1)*cell))
+	for i := range img.Pix {
+		img.Pix[i] = []uint8{boardColor.R, boardColor.G, boardColor.B, boardColor.A}[i%4]
+	}
+
+	point := func(x, y int) (float64, float64) {
+		return float64((x + 1) * cell), float64((y + 1) * cell)
+	}
+	for x := 0; x < b.width; x++ {
+		px, top := point(x, 0)
+		_, bottom := point(x, b.height-1)
+		for y := int(top); y <= int(bottom); y++ {
+			img.Set(int(px), y, lineColor)
+		}
+	}
+	for y := 0; y < b.height; y++ {
+		left, py := point(0, y)
+		right, _ := point(b.width-1, y)
+		for x := int(left); x <= int(right); x++ {
+			img.Set(x, int(py), lineColor)
+		}
+	}
+	for _, star := range b.starPoints() {
+		cx, cy := point(star[0], star[1])
+		fillCircle(img, cx, cy, 3, lineColor)
+	}
+
+	for y, row := range b.stones {
+		for x, stone := range row {
+			cx, cy := point(x, y)
+			switch stone {
+			case stoneBlack:
+				fillCircle(img, cx, cy, cell/2-1, blackStoneColor)
+			case stoneWhite:
+				fillCircle(img, cx, cy, cell/2-1, lineColor)
+				fillCircle(img, cx, cy, cell/2-2, whiteStoneColor)
+			}
+		}
+	}
+	if b.lastX >= 0 && b.stones[b.lastY][b.lastX] != 0 {
+		cx, cy := point(b.lastX, b.lastY)
+		fillCircle(img, cx, cy, cell/5, lastMoveColor)
+	}
+	return img
+}
+
+// starPoints returns the hoshi for the board's size
+func (b *goBoard) starPoints() [][2]int {
+	if b.width != b.height || b.width < 9 {
+		return nil
+	}
+	edge := 3
+	if b.width < 13 {
+		edge = 2
+	}
+	far, mid := b.width-1-edge, b.width/2
+	points := [][2]int{{edge, edge}, {far, edge}, {edge, far}, {far, far}}
+	if b.width%2 == 1 {
+		points = append(points, [2]int{mid, mid})
+		if b.width >= 19 {
+			points = append(points, [2]int{mid, edge}, [2]int{mid, far}, [2]int{edge, mid}, [2]int{far, mid})
+		}
+	}
+	return points
+}
+
+// fillCircle draws a filled circle, blending its edge for smoothness
+func fillCircle(img *image.RGBA, cx, cy, radius float64, c color.RGBA) {
+	for y := int(cy - radius - 1); y <= int(cy+radius+1); y++ {
+		for x := int(cx - radius - 1); x <= int(cx+radius+1); x++ {
+			coverage := radius + 0.5 - math.Hypot(float64(x)-cx, float64(y)-cy)
+			if coverage <= 0 || !(image.Point{x, y}.In(img.Rect)) {
+				continue
+			}
+			coverage = min(coverage, 1)
+			under := img.RGBAAt(x, y)
+			blend := func(top, bottom uint8) uint8 {
+				return uint8(float64(top)*coverage + float64(bottom)*(1-coverage))
+			}
+			img.SetRGBA(x, y, color.RGBA{blend(c.R, under.R), blend(c.G, under.G), blend(c.B, under.B), 255})
+		}
+	}
+}
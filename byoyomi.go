@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// minCorrespondencePeriod is the shortest byo-yomi period we treat as
+// correspondence-like; shorter periods are live play where a push is useless.
+const minCorrespondencePeriod = time.Hour
+
+// ByoyomiTime is a player's clock under the byo-yomi system, as of the last move
+type ByoyomiTime struct {
+	ThinkingTime float64 `json:"thinking_time"`
+	Periods      int     `json:"periods"`
+	PeriodTime   float64 `json:"period_time"`
+}
+
+// playerClock returns the raw clock entry for the given player's side
+func (g Game) playerClock(playerID int) json.RawMessage {
+	black, ok := g.colorOf(playerID)
+	switch {
+	case !ok:
+		return nil
+	case black:
+		return g.JSON.Clock.BlackTime
+	default:
+		return g.JSON.Clock.WhiteTime
+	}
+}
+
+// remainingByoyomiPeriods projects how many byo-yomi periods the player has
+// left at the given time, accounting for time elapsed since the last move when
+// it's their turn. ok is false for games that don't use byo-yomi or where the
+// player's clock can't be parsed.
+func remainingByoyomiPeriods(game Game, playerID int, now time.Time) (periods int, inByoyomi bool, ok bool) {
+	if game.JSON.TimeControl.System != "byoyomi" {
+		return 0, false, false
+	}
+
+	raw := game.playerClock(playerID)
+	if len(raw) == 0 {
+		return 0, false, false
+	}
+
+	var clock ByoyomiTime
+	if err := json.Unmarshal(raw, &clock); err != nil {
+		return 0, false, false
+	}
+
+	periodTime := clock.PeriodTime
+	if periodTime <= 0 {
+		periodTime = game.JSON.TimeControl.PeriodTime
+	}
+	if periodTime <= 0 {
+		return 0, false, false
+	}
+
+	thinking := clock.ThinkingTime
+	periods = clock.Periods
+
+	// The clock only runs for the side whose turn it is
+	if game.sideToMove(playerID) && game.JSON.Clock.LastMove > 0 && !game.IsPaused() {
+		elapsed := now.Sub(time.UnixMilli(game.JSON.Clock.LastMove)).Seconds()
+		if elapsed > thinking {
+			overflow := elapsed - thinking
+			thinking = 0
+			periods -= int(math.Floor(overflow / periodTime))
+		} else {
+			thinking -= elapsed
+		}
+	}
+
+	return periods, thinking <= 0, true
+}
+
+// checkFinalByoyomiPeriod warns the user once per game when they enter their
+// final byo-yomi period in a correspondence-paced game. Returns true if a
+// warning was issued.
+func (srv *Server) checkFinalByoyomiPeriod(userIDStr string, userID int, game Game, now time.Time) bool {
+	tc := game.JSON.TimeControl
+	if tc.Speed != "correspondence" && time.Duration(tc.PeriodTime)*time.Second < minCorrespondencePeriod {
+		return false
+	}
+
+	periods, inByoyomi, ok := remainingByoyomiPeriods(game, userID, now)
+	if !ok || !inByoyomi || periods != 1 {
+		return false
+	}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.Lock()
+	if _, warned := shard.periodWarnings[userIDStr][game.ID]; warned {
+		shard.mu.Unlock()
+		return false
+	}
+	if shard.periodWarnings[userIDStr] == nil {
+		shard.periodWarnings[userIDStr] = make(map[int]int64)
+	}
+	shard.periodWarnings[userIDStr][game.ID] = now.Unix()
+	shard.mu.Unlock()
+
+	log.Printf("User %s entered final byo-yomi period in game %d", userIDStr, game.ID)
+
+	if os.Getenv("NOTIFY_BYOYOMI_FINAL_PERIOD") == "true" {
+		go func() {
+			body := fmt.Sprintf("You're in your final byo-yomi period in %s", game.Name)
+			if err := srv.sendGamePushNotification(userIDStr, game.ID, "Final period!", body, "final_period"); err != nil {
+				log.Printf("Final period warning not sent to user %s: %v", userIDStr, err)
+			}
+		}()
+	}
+
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The canary is a fake user whose single game the server plays internally.
+// Every interval the game's turn toggles; on the canary's turn the game goes
+// through the same detection, reservation and push path as a real user, to an
+// operator's device. A recent canary success proves the pipeline end-to-end.
+
+const (
+	canaryUserID    = -1
+	canaryGameID    = -1
+	canaryOpponent  = -2
+	canaryGameTitle = "Canary"
+)
+
+type canaryState struct {
+	mu          sync.Mutex
+	moves       int
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastError   string
+}
+
+func isCanaryUser(userID string) bool {
+	return userID == strconv.Itoa(canaryUserID)
+}
+
+// canaryGame builds the canary's game after the given number of moves. Even
+// move counts are the canary's turn.
+func canaryGame(moves int, now time.Time) Game {
+	currentPlayer := canaryUserID
+	if moves%2 == 1 {
+		currentPlayer = canaryOpponent
+	}
+
+	game := Game{ID: canaryGameID, Name: canaryGameTitle}
+	game.JSON.Clock = Clock{
+		CurrentPlayer: currentPlayer,
+		LastMove:      now.UnixMilli(),
+		BlackPlayerID: canaryUserID,
+		WhitePlayerID: canaryOpponent,
+	}
+	game.JSON.Moves = make([]json.RawMessage, moves)
+	for i := range game.JSON.Moves {
+		game.JSON.Moves[i] = json.RawMessage("[]")
+	}
+	return game
+}
+
+// runCanary plays one move in the canary game and, when that makes it the
+// canary's turn, sends it through turn detection and the push pipeline using
+// send. Returns whether a push was attempted.
+func (srv *Server) runCanary(deviceToken string, now time.Time, send func(userID string, games []Game, waiting int)) bool {
+	userIDStr := strconv.Itoa(canaryUserID)
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.Lock()
+	shard.deviceTokens[userIDStr] = deviceToken
+	shard.mu.Unlock()
+
+	srv.canary.mu.Lock()
+	srv.canary.moves++
+	game := canaryGame(srv.canary.moves, now)
+	srv.canary.lastRun = now
+	srv.canary.mu.Unlock()
+
+	_, newTurnGames := srv.classifyTurns(canaryUserID, []Game{game})
+	if len(newTurnGames) == 0 {
+		return false
+	}
+
+	reserved := srv.reserveNotification(userIDStr, newTurnGames)
+	if len(reserved) == 0 {
+		return false
+	}
+	send(userIDStr, reserved, 0)
+
+	// The pipeline commits the move only once APNs has accepted the push
+	shard.mu.RLock()
+	record := shard.game(userIDStr, canaryGameID)
+	delivered := record != nil && record.LastMove == game.JSON.Clock.LastMove
+	shard.mu.RUnlock()
+
+	srv.canary.mu.Lock()
+	if delivered {
+		srv.canary.lastSuccess = now
+		srv.canary.lastError = ""
+		log.Printf("Canary push delivered")
+	} else {
+		srv.canary.lastError = "push not delivered"
+		log.Printf("Canary push was not delivered")
+	}
+	srv.canary.mu.Unlock()
+	return true
+}
+
+// canaryInterval reads CANARY_INTERVAL_MINUTES (default 30)
+func canaryInterval() time.Duration {
+	if value := os.Getenv("CANARY_INTERVAL_MINUTES"); value != "" {
+		if minutes, err := strconv.Atoi(value); err == nil && minutes > 0 {
+			return time.Duration(minutes) * time.Minute
+		}
+	}
+	return 30 * time.Minute
+}
+
+// startCanary runs the canary every interval when CANARY_DEVICE_TOKEN is set
+func (srv *Server) startCanary() {
+	deviceToken := os.Getenv("CANARY_DEVICE_TOKEN")
+	if deviceToken == "" {
+		return
+	}
+
+	interval := canaryInterval()
+	log.Printf("Starting canary every %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		srv.runCanary(deviceToken, time.Now(), srv.sendConsolidatedPushNotification)
+	}
+}
+
+// writeCanaryMetrics writes canary metrics in the Prometheus text format
+func (srv *Server) writeCanaryMetrics(w http.ResponseWriter) {
+	srv.canary.mu.Lock()
+	lastRun, lastSuccess := srv.canary.lastRun, srv.canary.lastSuccess
+	srv.canary.mu.Unlock()
+
+	if lastRun.IsZero() {
+		return
+	}
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_canary_last_run_timestamp_seconds When the canary last played a move.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_canary_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ogs_notifications_canary_last_run_timestamp_seconds %d\n", lastRun.Unix())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_canary_last_success_timestamp_seconds When a canary push was last accepted by APNs.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_canary_last_success_timestamp_seconds gauge")
+	var successUnix int64
+	if !lastSuccess.IsZero() {
+		successUnix = lastSuccess.Unix()
+	}
+	fmt.Fprintf(w, "ogs_notifications_canary_last_success_timestamp_seconds %d\n", successUnix)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Challenges sent to a user are only visible to them, so a user who wants
+// challenge notifications gives an OGS access token with PUT
+// /challenges/{userID}. Each check of the user then reads their challenges
+// and pushes the incoming ones it hasn't seen, with accept and decline links
+// for the app. A token OGS rejects is dropped, which turns the notifications
+// off until the user sets a new one.
+
+// eventChallenge is the routing event and push action for incoming challenges
+const eventChallenge = "challenge"
+
+// ogsChallengesURL lists the challenges of the player an access token belongs to
+var ogsChallengesURL = "https://online-go.com/api/v1/me/challenges?page_size=50"
+
+var errChallengeTokenRejected = errors.New("OGS rejected the challenge access token")
+
+// ChallengeSubscription is the body of PUT /challenges/{userID}
+type ChallengeSubscription struct {
+	AccessToken string `json:"ogs_access_token"`
+}
+
+// ogsChallenge is the subset of an OGS challenge used in notifications
+type ogsChallenge struct {
+	ID         int `json:"id"`
+	Challenger struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	} `json:"challenger"`
+	Challenged struct {
+		ID int `json:"id"`
+	} `json:"challenged"`
+	Game struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+		// an object, or the same object encoded as a string
+		TimeControlParameters json.RawMessage `json:"time_control_parameters"`
+	} `json:"game"`
+}
+
+// speed returns the challenge's speed, e.g. "correspondence", if OGS gave one
+func (c ogsChallenge) speed() string {
+	raw := c.Game.TimeControlParameters
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		raw = json.RawMessage(encoded)
+	}
+	var params struct {
+		Speed string `json:"speed"`
+	}
+	json.Unmarshal(raw, &params)
+	return params.Speed
+}
+
+// summary describes the challenge, e.g. "New challenge from X (19x19, correspondence)"
+func (c ogsChallenge) summary() string {
+	details := fmt.Sprintf("%dx%d", c.Game.Width, c.Game.Height)
+	if speed := c.speed(); speed != "" {
+		details += ", " + speed
+	}
+	return fmt.Sprintf("New challenge from %s (%s)", c.Challenger.Username, details)
+}
+
+// getChallenges fetches the challenges of the token's player
+func (srv *Server) getChallenges(accessToken string) ([]ogsChallenge, error) {
+	req, err := http.NewRequest(http.MethodGet, ogsChallengesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := srv.ogsDo(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, errChallengeTokenRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ogsStatusError(resp.StatusCode)
+	}
+
+	var page struct {
+		Results []ogsChallenge `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to process response")
+	}
+	return page.Results, nil
+}
+
+// incomingChallengeIDs returns the IDs of the challenges sent to the user
+func incomingChallengeIDs(userID string, challenges []ogsChallenge) []int {
+	var ids []int
+	for _, challenge := range challenges {
+		if strconv.Itoa(challenge.Challenged.ID) == userID {
+			ids = append(ids, challenge.ID)
+		}
+	}
+	return ids
+}
+
+// checkChallenges pushes the user's incoming challenges that haven't been
+// notified yet. Only challenges still open are remembered, so the list stays
+// as short as the user's pending challenges. It returns how many were sent.
+func (srv *Server) checkChallenges(userID string, send func(userID, title, body, action string, custom map[string]interface{}) error) int {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	accessToken := shard.challengeTokens[userID]
+	seen := make(map[int]bool, len(shard.seenChallenges[userID]))
+	for _, id := range shard.seenChallenges[userID] {
+		seen[id] = true
+	}
+	shard.mu.RUnlock()
+	if accessToken == "" {
+		return 0
+	}
+
+	challenges, err := srv.getChallenges(accessToken)
+	if errors.Is(err, errChallengeTokenRejected) {
+		log.Printf("OGS rejected the challenge token of user %s, turning challenge notifications off", userID)
+		shard.mu.Lock()
+		delete(shard.challengeTokens, userID)
+		delete(shard.seenChallenges, userID)
+		shard.mu.Unlock()
+		srv.saveStorage()
+		return 0
+	}
+	if err != nil {
+		log.Printf("Could not fetch challenges for user %s: %v", userID, err)
+		return 0
+	}
+
+	sent := 0
+	var open []int
+	for _, challenge := range challenges {
+		if strconv.Itoa(challenge.Challenged.ID) != userID {
+			continue
+		}
+		open = append(open, challenge.ID)
+		if seen[challenge.ID] {
+			continue
+		}
+		err := send(userID, "New challenge", challenge.summary(), eventChallenge, map[string]interface{}{
+			"challenge_id": challenge.ID,
+			"accept_url":   fmt.Sprintf("ogs://challenge/%d/accept", challenge.ID),
+			"decline_url":  fmt.Sprintf("ogs://challenge/%d/decline", challenge.ID),
+			"web_url":      ogsWebURL + "/",
+		})
+		if err != nil {
+			log.Printf("Could not send challenge %d to user %s: %v", challenge.ID, userID, err)
+			continue
+		}
+		sent++
+	}
+
+	shard.mu.Lock()
+	if _, enabled := shard.challengeTokens[userID]; enabled {
+		shard.seenChallenges[userID] = open
+	}
+	shard.mu.Unlock()
+	if sent > 0 || len(open) != len(seen) {
+		srv.saveStorage()
+	}
+	return sent
+}
+
+// setChallengeToken handles PUT /challenges/{userID}. The token must belong
+// to the user. Challenges already open when it's set aren't pushed.
+func (srv *Server) setChallengeToken(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var subscription ChallengeSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if subscription.AccessToken == "" {
+		http.Error(w, "ogs_access_token is required", http.StatusBadRequest)
+		return
+	}
+	if err := srv.verifyAccountLink(userID, subscription.AccessToken); err != nil {
+		writeAccountLinkError(w, err)
+		return
+	}
+
+	challenges, err := srv.getChallenges(subscription.AccessToken)
+	if err != nil {
+		log.Printf("Could not fetch challenges for user %s: %v", userID, err)
+		http.Error(w, "Could not read challenges from OGS", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.challengeTokens[userID] = subscription.AccessToken
+	shard.seenChallenges[userID] = incomingChallengeIDs(userID, challenges)
+	shard.recordAccountLink(userID, time.Now())
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	log.Printf("Enabled challenge notifications for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteChallengeToken handles DELETE /challenges/{userID}, turning challenge
+// notifications off and forgetting the token
+func (srv *Server) deleteChallengeToken(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.challengeTokens[userID]
+	delete(shard.challengeTokens, userID)
+	delete(shard.seenChallenges, userID)
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Challenge notifications not enabled", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Disabled challenge notifications for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
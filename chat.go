@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Chat messages in a user's games come over the OGS real-time connection,
+// which subscribes to each game's chat. A message from the opponent in the
+// game chat, or a Malkovich log line OGS shows the user, is pushed as its own
+// event, which users can turn off with chat_muted in their preferences.
+
+// eventChat is the routing event and push action for chat messages
+const eventChat = "chat"
+
+// maxChatPreview bounds how much of a message is shown in the push
+const maxChatPreview = 200
+
+// apnsCategories are the notification categories of actions the app shows
+// with their own actions or grouping
+var apnsCategories = map[string]string{
+	eventTurn:      "GAME_TURN", // has the "Snooze 1h" action
+	eventChat:      "CHAT_MESSAGE",
+	eventChallenge: "CHALLENGE",
+}
+
+// gameChat is the data of a game/{id}/chat event
+type gameChat struct {
+	Channel string `json:"channel"` // "main" or "malkovich"; other channels aren't pushed
+	Line    struct {
+		ChatID     string          `json:"chat_id"`
+		Body       json.RawMessage `json:"body"` // text, or an object for shared positions
+		Date       int64           `json:"date"` // unix seconds
+		MoveNumber int             `json:"move_number"`
+		PlayerID   int             `json:"player_id"`
+		Username   string          `json:"username"`
+	} `json:"line"`
+}
+
+// text returns the message as shown in a push
+func (c gameChat) text() string {
+	var text string
+	if err := json.Unmarshal(c.Line.Body, &text); err != nil {
+		return "Shared a position"
+	}
+	if utf8.RuneCountInString(text) > maxChatPreview {
+		runes := []rune(text)
+		text = string(runes[:maxChatPreview]) + "…"
+	}
+	return text
+}
+
+// realtimeChatEvent parses a game/{id}/chat event
+func realtimeChatEvent(message string) (int, gameChat, bool) {
+	var chat gameChat
+	event, data, ok := parseRealtimeFrame(message)
+	if !ok {
+		return 0, chat, false
+	}
+	gameID, ok := gameEventID(event, "chat")
+	if !ok || json.Unmarshal(data, &chat) != nil {
+		return 0, chat, false
+	}
+	return gameID, chat, true
+}
+
+// handleChat pushes a chat line to the game's other players. Lines from
+// before the game was subscribed are the history OGS replays on connect.
+func (rt *ogsRealtime) handleChat(gameID int, chat gameChat) {
+	if chat.Channel != "main" && chat.Channel != "malkovich" {
+		return
+	}
+	rt.mu.Lock()
+	since, subscribed := rt.chatSince[gameID]
+	rt.mu.Unlock()
+	if !subscribed || chat.Line.Date < since {
+		return
+	}
+
+	for _, userID := range rt.playersOf(gameID) {
+		if userID == strconv.Itoa(chat.Line.PlayerID) {
+			continue
+		}
+		if rt.srv.preferencesFor(userID).ChatMuted {
+			continue
+		}
+		go rt.chat(userID, gameID, chat)
+	}
+}
+
+// sendChatNotification pushes one chat line to the user
+func (srv *Server) sendChatNotification(userID string, gameID int, chat gameChat) {
+	title := fmt.Sprintf("%s says", chat.Line.Username)
+	if chat.Channel == "malkovich" {
+		title = fmt.Sprintf("Malkovich log from %s", chat.Line.Username)
+	}
+
+	err := srv.sendUserPushNotification(userID, title, chat.text(), eventChat, map[string]interface{}{
+		"web_url": ogsGameLink(gameID),
+		"app_url": fmt.Sprintf("ogs://game/%d", gameID),
+		"game_id": gameID,
+		"channel": chat.Channel,
+	})
+	if err != nil {
+		log.Printf("Could not send chat message in game %d to user %s: %v", gameID, userID, err)
+	}
+}
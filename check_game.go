@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errGameNotFound is returned when OGS has no game with the requested ID
+var errGameNotFound = errors.New("game not found")
+
+// CheckGameRequest is the body of POST /check-game
+type CheckGameRequest struct {
+	UserID string `json:"user_id"`
+	GameID int    `json:"game_id"`
+}
+
+// GameCheck is the result of checking one game for a user
+type GameCheck struct {
+	GameID   int  `json:"game_id"`
+	YourTurn bool `json:"your_turn"`
+	NewTurn  bool `json:"new_turn"`
+	Finished bool `json:"finished"`
+}
+
+// ogsGame is a game as returned by the OGS games API, which nests the
+// players and state that the player API lists inline
+type ogsGame struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Ended   string `json:"ended"`
+	Players struct {
+		Black GamePlayer `json:"black"`
+		White GamePlayer `json:"white"`
+	} `json:"players"`
+	Gamedata GameState `json:"gamedata"`
+}
+
+// getGame fetches one game from OGS, or reuses its state from earlier in the
+// check cycle. It reports whether the game has ended.
+func (srv *Server) getGame(gameID int) (Game, bool, error) {
+	state, err := srv.fetchGameState(gameID, false)
+	if err != nil {
+		return Game{}, false, err
+	}
+	return state.game, state.ended, nil
+}
+
+// checkGame handles POST /check-game: a targeted refresh of one game, for when
+// the user thinks their opponent just moved. It runs the same detection and
+// notification as a full check, for that game only. Finished games are left
+// to the next full check, which records their result.
+func (srv *Server) checkGame(w http.ResponseWriter, r *http.Request) {
+	var req CheckGameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(req.UserID)
+	if err != nil || userID <= 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if req.GameID <= 0 {
+		http.Error(w, "game_id is required", http.StatusBadRequest)
+		return
+	}
+	if !srv.requestReachesUser(r, req.UserID) || srv.accountGone(req.UserID) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// The user expects their opponent's latest move, so always ask OGS
+	srv.gameStates.Delete(req.GameID)
+	game, finished, err := srv.getGame(req.GameID)
+	if errors.Is(err, errGameNotFound) {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking game %d for user %d: %v", req.GameID, userID, err)
+		http.Error(w, "Failed to fetch game", http.StatusServiceUnavailable)
+		return
+	}
+	if _, playing := game.colorOf(userID); !playing {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	result := GameCheck{GameID: game.ID, Finished: finished}
+	if !finished {
+		result.YourTurn, result.NewTurn = srv.checkSingleGame(userID, game)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkSingleGame runs turn detection on one of the user's games and notifies
+// a new turn. High-volume players' turns are left to the next full check,
+// which groups them with the rest.
+func (srv *Server) checkSingleGame(userID int, game Game) (yourTurn, newTurn bool) {
+	userIDStr := strconv.Itoa(userID)
+	log.Printf("Checking game %d for user %d", game.ID, userID)
+
+	srv.rollbackUndoneMoves(userIDStr, game)
+	srv.trackClockPause(userIDStr, game)
+	srv.checkFinalByoyomiPeriod(userIDStr, userID, game, srv.ogsNow(time.Now()))
+
+	games := []Game{game}
+	status, newTurnGames := srv.classifyTurns(userID, games)
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	trackedGames := len(shard.games[userIDStr])
+	shard.mu.RUnlock()
+	if !srv.highVolumeModeActive(userIDStr, trackedGames) {
+		srv.notifyNewTurns(userID, games, status, newTurnGames, false, 0)
+	}
+
+	srv.saveStorage()
+	return len(status.YourTurnNew)+len(status.YourTurnOld) > 0, len(status.YourTurnNew) > 0
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// overdueAfterIntervals is how many check intervals can pass without a
+// successful check before the user and operator are warned
+const overdueAfterIntervals = 3
+
+// CheckHealth tracks when a user's games were last checked successfully
+type CheckHealth struct {
+	LastSuccess int64 `json:"last_success"`
+	WarnedAt    int64 `json:"warned_at,omitempty"` // overdue warning sent, cleared on success
+}
+
+func (srv *Server) recordSuccessfulCheck(userID string, now time.Time) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	health := shard.checkHealth[userID]
+	if health == nil {
+		health = &CheckHealth{}
+		shard.checkHealth[userID] = health
+	}
+	if health.WarnedAt != 0 {
+		log.Printf("Checks for user %s are succeeding again", userID)
+	}
+	health.LastSuccess = now.Unix()
+	health.WarnedAt = 0
+	delete(shard.accountsGone, userID)
+}
+
+// checkOverdue reports whether a user last checked at lastSuccess has missed
+// too many check intervals
+func checkOverdue(lastSuccess int64, now time.Time) bool {
+	if lastSuccess == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(lastSuccess, 0)) > overdueAfterIntervals*checkInterval()
+}
+
+// warnOverdueChecks warns each registered user whose checks have been failing
+// for too long, once per outage, so they don't silently miss turns. Users the
+// server has never checked successfully are measured from registration.
+func (srv *Server) warnOverdueChecks(now time.Time, send func(userID, title, body, action string, custom map[string]interface{}) error) int {
+	srv.storage.lockAll()
+	var overdue []string
+	for userID := range srv.storage.notifiedUsers() {
+		if isCanaryUser(userID) || !srv.partition.owns(userID) {
+			continue
+		}
+		shard := srv.storage.shard(userID)
+		if gone := shard.accountsGone[userID]; gone != nil && gone.GoneAt != 0 {
+			continue
+		}
+		// Idle users are checked less often on purpose
+		if srv.userIdle(userID, now) {
+			continue
+		}
+		health := shard.checkHealth[userID]
+		if health == nil {
+			funnel := shard.onboarding[userID]
+			if funnel == nil {
+				continue
+			}
+			health = &CheckHealth{LastSuccess: funnel.RegisteredAt}
+			shard.checkHealth[userID] = health
+		}
+		if health.WarnedAt != 0 || !checkOverdue(health.LastSuccess, now) {
+			continue
+		}
+		health.WarnedAt = now.Unix()
+		overdue = append(overdue, userID)
+	}
+	srv.storage.unlockAll()
+
+	for _, userID := range overdue {
+		log.Printf("WARNING: user %s has not been checked successfully in over %d intervals", userID, overdueAfterIntervals)
+		body := "We're having trouble checking your OGS games, so turn notifications may be delayed. We'll keep trying."
+		if err := send(userID, "Turn notifications delayed", body, "checks_overdue", nil); err != nil {
+			log.Printf("Could not warn user %s about overdue checks: %v", userID, err)
+		}
+	}
+
+	if len(overdue) > 0 {
+		srv.saveStorage()
+	}
+	return len(overdue)
+}
+
+// writeCheckHealthMetrics writes check freshness metrics in the Prometheus text format
+func (srv *Server) writeCheckHealthMetrics(w http.ResponseWriter, now time.Time) {
+	srv.storage.rlockAll()
+	overdue := 0
+	registered := srv.storage.notifiedUsers()
+	for _, shard := range srv.storage.shards {
+		for userID, health := range shard.checkHealth {
+			if registered[userID] && checkOverdue(health.LastSuccess, now) {
+				overdue++
+			}
+		}
+	}
+	srv.storage.runlockAll()
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_users_check_overdue Registered users not checked successfully in the last three intervals.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_users_check_overdue gauge")
+	fmt.Fprintf(w, "ogs_notifications_users_check_overdue %d\n", overdue)
+}
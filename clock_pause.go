@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GamePause records when we first saw a game's clock paused and why
+type GamePause struct {
+	Since  int64  `json:"since"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// IsPaused reports whether the game clock is currently paused
+func (g Game) IsPaused() bool {
+	return g.JSON.Clock.PausedSince > 0 || len(g.JSON.PauseControl) > 0
+}
+
+// PauseReason summarizes the OGS pause_control keys, e.g. "weekend",
+// "vacation" or "moderator". It returns "" for games that aren't paused.
+func (g Game) PauseReason() string {
+	if !g.IsPaused() {
+		return ""
+	}
+
+	reasons := make(map[string]bool)
+	for key := range g.JSON.PauseControl {
+		switch {
+		case strings.HasPrefix(key, "vacation"):
+			reasons["vacation"] = true
+		case strings.HasPrefix(key, "moderator"):
+			reasons["moderator"] = true
+		case key == "weekend":
+			reasons["weekend"] = true
+		default:
+			reasons[key] = true
+		}
+	}
+	if len(reasons) == 0 {
+		return "paused"
+	}
+
+	names := make([]string, 0, len(reasons))
+	for name := range reasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// trackClockPause records pause transitions for a game. It returns true when
+// a previously paused game has resumed, in which case the user is notified if
+// NOTIFY_CLOCK_RESUMED is enabled.
+func (srv *Server) trackClockPause(userID string, game Game) bool {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	pause, wasPaused := shard.pausedGames[userID][game.ID]
+
+	if game.IsPaused() {
+		if !wasPaused {
+			since := game.JSON.Clock.PausedSince / 1000 // OGS clock times are in ms
+			if since == 0 {
+				since = time.Now().Unix()
+			}
+			if shard.pausedGames[userID] == nil {
+				shard.pausedGames[userID] = make(map[int]GamePause)
+			}
+			shard.pausedGames[userID][game.ID] = GamePause{Since: since, Reason: game.PauseReason()}
+			log.Printf("Game %d for user %s paused (%s)", game.ID, userID, game.PauseReason())
+		}
+		shard.mu.Unlock()
+		return false
+	}
+
+	if !wasPaused {
+		shard.mu.Unlock()
+		return false
+	}
+
+	delete(shard.pausedGames[userID], game.ID)
+	shard.mu.Unlock()
+
+	log.Printf("Game %d for user %s resumed after %s pause", game.ID, userID, pause.Reason)
+
+	if os.Getenv("NOTIFY_CLOCK_RESUMED") == "true" {
+		go srv.sendClockResumedNotification(userID, game, pause)
+	}
+
+	return true
+}
+
+func (srv *Server) sendClockResumedNotification(userID string, game Game, pause GamePause) {
+	pausedFor := time.Since(time.Unix(pause.Since, 0)).Round(time.Hour)
+	body := fmt.Sprintf("Clock resumed in %s", game.Name)
+	if pausedFor >= time.Hour {
+		body = fmt.Sprintf("%s after %s paused", body, pausedFor)
+	}
+
+	if err := srv.sendGamePushNotification(userID, game.ID, "Clock resumed", body, "clock_resumed"); err != nil {
+		log.Printf("Clock resumed notification not sent to user %s: %v", userID, err)
+	}
+}
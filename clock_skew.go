@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OGS stamps last_move with its own clock. A move can't have been played in
+// the future, so a last_move ahead of the server's clock means the server is
+// behind OGS by at least that much. The largest such offset seen recently is
+// used as the skew estimate and added to "now" wherever time since a move is
+// computed. A server running ahead of OGS can't be told apart from moves that
+// are simply old, so that direction is reported in the metric but not corrected.
+
+const (
+	clockSkewWindow    = time.Hour
+	clockSkewWarnAfter = 5 * time.Second
+)
+
+type skewSample struct {
+	at     time.Time
+	offset time.Duration // freshest last_move minus server time
+}
+
+type skewTracker struct {
+	mu      sync.Mutex
+	samples []skewSample
+	warned  bool
+}
+
+// observe records the freshest last_move in a batch of games fetched at now
+func (s *skewTracker) observe(games []Game, now time.Time) {
+	found := false
+	var offset time.Duration
+	for _, game := range games {
+		if game.JSON.Clock.LastMove <= 0 {
+			continue
+		}
+		gameOffset := time.UnixMilli(game.JSON.Clock.LastMove).Sub(now)
+		if !found || gameOffset > offset {
+			offset = gameOffset
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, skewSample{at: now, offset: offset})
+	cutoff := now.Add(-clockSkewWindow)
+	for len(s.samples) > 0 && s.samples[0].at.Before(cutoff) {
+		s.samples = s.samples[1:]
+	}
+
+	if offset > clockSkewWarnAfter && !s.warned {
+		log.Printf("Server clock appears to be %v behind OGS; adjusting time-since-move calculations", offset.Round(time.Second))
+		s.warned = true
+	} else if offset <= clockSkewWarnAfter {
+		s.warned = false
+	}
+}
+
+// maxOffset is the largest offset in the window, and whether there were any samples
+func (s *skewTracker) maxOffset() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.samples) == 0 {
+		return 0, false
+	}
+	max := s.samples[0].offset
+	for _, sample := range s.samples[1:] {
+		if sample.offset > max {
+			max = sample.offset
+		}
+	}
+	return max, true
+}
+
+// estimate is how far the server's clock is behind OGS, or 0 when there's no
+// evidence it is
+func (s *skewTracker) estimate() time.Duration {
+	if offset, ok := s.maxOffset(); ok && offset > 0 {
+		return offset
+	}
+	return 0
+}
+
+// ogsNow converts a server time to OGS's clock
+func (srv *Server) ogsNow(now time.Time) time.Time {
+	return now.Add(srv.clockSkew.estimate())
+}
+
+// writeClockSkewMetrics writes clock skew metrics in the Prometheus text format
+func (srv *Server) writeClockSkewMetrics(w http.ResponseWriter) {
+	offset, ok := srv.clockSkew.maxOffset()
+	if !ok {
+		return
+	}
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_clock_skew_seconds Freshest OGS last_move minus server time over the last hour; positive means the server clock is behind.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_clock_skew_seconds gauge")
+	fmt.Fprintf(w, "ogs_notifications_clock_skew_seconds %g\n", offset.Seconds())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_clock_skew_correction_seconds Correction added to server time in time-since-move calculations.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_clock_skew_correction_seconds gauge")
+	fmt.Fprintf(w, "ogs_notifications_clock_skew_correction_seconds %g\n", srv.clockSkew.estimate().Seconds())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// cycleLogRetention is how long check cycle summaries are kept
+const cycleLogRetention = 7 * 24 * time.Hour
+
+// maxCycleListLimit bounds how many cycles /admin/cycles returns at once
+const maxCycleListLimit = 5000
+
+// CycleSummary is a compact record of one background check cycle
+type CycleSummary struct {
+	StartedAt     int64  `json:"started_at"` // unix seconds
+	DurationMs    int64  `json:"duration_ms"`
+	Region        string `json:"region,omitempty"`
+	UsersChecked  int    `json:"users_checked"`
+	UsersSkipped  int    `json:"users_skipped"` // gone, backed off or idle users
+	Errors        int    `json:"errors"`
+	Notifications int64  `json:"notifications"`         // turn pushes queued while the cycle ran
+	EndedEarly    bool   `json:"ended_early,omitempty"` // OGS asked us to slow down
+}
+
+// turnPushesQueued counts consolidated turn pushes handed to a sender
+var turnPushesQueued atomic.Int64
+
+// cycleLogKey groups a region's cycles by UTC day, so document backends only
+// rewrite the current day
+func cycleLogKey(day time.Time, region string) string {
+	key := day.UTC().Format("2006-01-02")
+	if region != "" {
+		key += "/" + region
+	}
+	return key
+}
+
+// recordCycle stores a cycle summary and drops days past the retention
+func (srv *Server) recordCycle(cycle CycleSummary, now time.Time) {
+	started := time.Unix(cycle.StartedAt, 0)
+	oldest := cycleLogKey(now.Add(-cycleLogRetention), "")
+
+	srv.storage.cycleLog.Update(cycleLogKey(started, cycle.Region), func(day []CycleSummary, _ bool) ([]CycleSummary, bool) {
+		return append(day, cycle), true
+	})
+	srv.storage.cycleLog.DeleteFunc(func(key string, _ []CycleSummary) bool {
+		return key[:len(oldest)] < oldest
+	})
+
+	srv.saveStorage()
+}
+
+// getCycles handles GET /admin/cycles: recorded check cycles, newest first.
+// since (unix seconds) and limit (default 100) narrow the list.
+func (srv *Server) getCycles(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since := now.Add(-cycleLogRetention).Unix()
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = max(since, parsed)
+	}
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 1 || parsed > maxCycleListLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	cycles := []CycleSummary{}
+	srv.storage.cycleLog.Range(func(_ string, day []CycleSummary) bool {
+		for _, cycle := range day {
+			if cycle.StartedAt >= since {
+				cycles = append(cycles, cycle)
+			}
+		}
+		return true
+	})
+
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i].StartedAt > cycles[j].StartedAt })
+	if len(cycles) > limit {
+		cycles = cycles[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cycles)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dataDir is where persisted state lives. Empty means the working directory,
+// which is what tests and legacy deployments use.
+var dataDir string
+
+const appDirName = "ogs-notifications-server"
+
+// dataFilePath returns the path of a state file inside the data directory
+func dataFilePath(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+// configureDataDir resolves the data directory from the -data-dir flag,
+// DATA_DIR, or the XDG data home, creates it, and verifies it's writable.
+// An existing moves.json in the working directory is kept in place when no
+// directory is configured, so upgrading doesn't lose state.
+func configureDataDir(flagValue string) error {
+	dir := flagValue
+	if dir == "" {
+		dir = os.Getenv("DATA_DIR")
+	}
+
+	if dir == "" {
+		if _, err := os.Stat("moves.json"); err == nil {
+			log.Println("Found moves.json in the working directory; using it as the data directory (set DATA_DIR to move it)")
+			dataDir = ""
+			return nil
+		}
+
+		xdgDir, err := xdgDataDir()
+		if err != nil {
+			return err
+		}
+		dir = xdgDir
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create data directory %s: %v", dir, err)
+	}
+
+	if err := checkWritable(dir); err != nil {
+		return err
+	}
+
+	dataDir = dir
+	log.Printf("Using data directory %s", dir)
+	return nil
+}
+
+// xdgDataDir returns $XDG_DATA_HOME/ogs-notifications-server, falling back to
+// ~/.local/share as the XDG base directory spec prescribes
+func xdgDataDir() (string, error) {
+	if xdgHome := os.Getenv("XDG_DATA_HOME"); xdgHome != "" && filepath.IsAbs(xdgHome) {
+		return filepath.Join(xdgHome, appDirName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine data directory (set DATA_DIR): %v", err)
+	}
+	return filepath.Join(home, ".local", "share", appDirName), nil
+}
+
+// checkWritable fails if a file can't be created in dir
+func checkWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %v", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultDecisionTraceSize = 500
+
+// GameDecision explains how a single game was handled during a check
+type GameDecision struct {
+	GameID            int    `json:"game_id"`
+	StoredMove        int64  `json:"stored_move"`
+	StoredMoveNumber  int    `json:"stored_move_number,omitempty"`
+	FetchedMove       int64  `json:"fetched_move"`
+	FetchedMoveNumber int    `json:"fetched_move_number,omitempty"`
+	Classification    string `json:"classification"` // not_your_turn, your_turn_new, your_turn_old, not_started
+	Action            string `json:"action"`         // none, notify, suppressed
+}
+
+// DecisionTrace is the set of decisions made for one user in one check
+type DecisionTrace struct {
+	UserID    string         `json:"user_id"`
+	CheckedAt int64          `json:"checked_at"`
+	Decisions []GameDecision `json:"decisions"`
+}
+
+// decisionTraceBuffer is a fixed-size in-memory ring of recent traces
+type decisionTraceBuffer struct {
+	mu      sync.RWMutex
+	entries []DecisionTrace
+	next    int
+	full    bool
+}
+
+func newDecisionTraceBuffer(size int) *decisionTraceBuffer {
+	return &decisionTraceBuffer{entries: make([]DecisionTrace, size)}
+}
+
+// decisionTraceEnabled reports whether checks should record decision traces
+func decisionTraceEnabled() bool {
+	return os.Getenv("DECISION_TRACE") == "true"
+}
+
+func decisionTraceSize() int {
+	if sizeStr := os.Getenv("DECISION_TRACE_SIZE"); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil && size > 0 {
+			return size
+		}
+	}
+	return defaultDecisionTraceSize
+}
+
+func (b *decisionTraceBuffer) add(trace DecisionTrace) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[b.next] = trace
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// recent returns up to limit traces, newest first, optionally for one user
+func (b *decisionTraceBuffer) recent(userID string, limit int) []DecisionTrace {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+
+	traces := make([]DecisionTrace, 0)
+	for i := 0; i < count && len(traces) < limit; i++ {
+		index := (b.next - 1 - i + len(b.entries)) % len(b.entries)
+		if userID == "" || b.entries[index].UserID == userID {
+			traces = append(traces, b.entries[index])
+		}
+	}
+	return traces
+}
+
+// buildDecisionTrace records what a check decided for each game, alongside the
+// stored move state. reserved is the set of games a notification was reserved for.
+func (srv *Server) buildDecisionTrace(userID int, games []Game, status *TurnStatus, reserved []Game) DecisionTrace {
+	userIDStr := strconv.Itoa(userID)
+
+	classification := make(map[int]string)
+	for _, id := range status.NotYourTurn {
+		classification[id] = "not_your_turn"
+	}
+	for _, id := range status.YourTurnNew {
+		classification[id] = "your_turn_new"
+	}
+	for _, id := range status.YourTurnOld {
+		classification[id] = "your_turn_old"
+	}
+	for _, id := range status.NotStarted {
+		classification[id] = "not_started"
+	}
+
+	notified := make(map[int]bool, len(reserved))
+	for _, game := range reserved {
+		notified[game.ID] = true
+	}
+
+	trace := DecisionTrace{UserID: userIDStr, CheckedAt: time.Now().Unix(), Decisions: make([]GameDecision, 0, len(games))}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	for _, game := range games {
+		var stored GameRecord
+		if record := shard.game(userIDStr, game.ID); record != nil {
+			stored = *record
+		}
+		decision := GameDecision{
+			GameID:            game.ID,
+			StoredMove:        stored.LastMove,
+			StoredMoveNumber:  stored.MoveNumber,
+			FetchedMove:       game.JSON.Clock.LastMove,
+			FetchedMoveNumber: game.MoveNumber(),
+			Classification:    classification[game.ID],
+			Action:            "none",
+		}
+		if decision.Classification == "your_turn_new" {
+			if notified[game.ID] {
+				decision.Action = "notify"
+			} else {
+				decision.Action = "suppressed"
+			}
+		}
+		trace.Decisions = append(trace.Decisions, decision)
+	}
+
+	return trace
+}
+
+// getDecisionTraces serves recent decision traces, newest first.
+// Query parameters: user_id (optional filter) and limit (default 50).
+func (srv *Server) getDecisionTraces(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID != "" {
+		if _, err := strconv.Atoi(userID); err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": decisionTraceEnabled(),
+		"traces":  srv.decisions.recent(userID, limit),
+	})
+}
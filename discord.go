@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Discord notifications are posted to a channel through an incoming webhook.
+// A user can link their own webhook, which works like any other channel, and
+// an admin can set one up for a Go club: the club's channel then gets its
+// members' turn and game result notifications, each marked with the member's
+// name.
+
+const maxDiscordClubMembers = 200
+
+// discordWebhookPrefixes are the URLs Discord's webhooks live under. Nothing
+// else is accepted, so the server can't be pointed at other hosts.
+var discordWebhookPrefixes = []string{
+	"https://discord.com/api/webhooks/",
+	"https://discordapp.com/api/webhooks/",
+	"https://ptb.discord.com/api/webhooks/",
+	"https://canary.discord.com/api/webhooks/",
+}
+
+// discordWebhookPath matches the webhook ID and token after the prefix
+var discordWebhookPath = regexp.MustCompile(`^[0-9]{1,20}/[A-Za-z0-9_-]{1,100}$`)
+
+var discordClient = &http.Client{Timeout: 10 * time.Second}
+
+// errDiscordWebhookGone is returned when Discord no longer knows the webhook,
+// because it was deleted from the channel
+var errDiscordWebhookGone = errors.New("discord webhook was deleted")
+
+// discordClubEvents are the events posted to club channels
+var discordClubEvents = map[string]bool{eventTurn: true, "game_result": true}
+
+// DiscordClub is a Go club's channel and the members whose notifications it gets
+type DiscordClub struct {
+	WebhookURL string            `json:"webhook_url"`
+	Members    map[string]string `json:"members"` // userID -> name shown on their posts
+}
+
+// DiscordWebhook links a Discord webhook
+type DiscordWebhook struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+// discordTarget is a webhook a notification is posted to
+type discordTarget struct {
+	url    string
+	clubID string // empty for the user's own webhook
+	author string // the member's name, on club posts
+}
+
+// validDiscordWebhookURL reports whether the URL is a Discord webhook
+func validDiscordWebhookURL(webhookURL string) bool {
+	for _, prefix := range discordWebhookPrefixes {
+		if rest, ok := strings.CutPrefix(webhookURL, prefix); ok {
+			return discordWebhookPath.MatchString(rest)
+		}
+	}
+	return false
+}
+
+// postDiscord posts a notification as an embed linking to gameURL, if set.
+// Mentions are turned off, so names from OGS can't ping anyone.
+func postDiscord(webhookURL, author, title, body, gameURL string) error {
+	embed := map[string]interface{}{"title": title, "description": body}
+	if gameURL != "" {
+		embed["url"] = gameURL
+	}
+	if author != "" {
+		embed["author"] = map[string]string{"name": author}
+	}
+	encoded, err := json.Marshal(map[string]interface{}{
+		"embeds":           []interface{}{embed},
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := discordClient.Post(webhookURL, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		// The error's URL carries the webhook token
+		return fmt.Errorf("discord request failed")
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized:
+		return errDiscordWebhookGone
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("discord returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// discordTargetsFor returns the webhooks a notification about the event is
+// posted to: the user's own, and for turns and results, their clubs'
+func (srv *Server) discordTargetsFor(userID, event string) []discordTarget {
+	var targets []discordTarget
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	if webhookURL, exists := shard.discordWebhooks[userID]; exists {
+		targets = append(targets, discordTarget{url: webhookURL})
+	}
+	shard.mu.RUnlock()
+	if !discordClubEvents[event] {
+		return targets
+	}
+
+	srv.storage.discordClubs.Range(func(clubID string, club *DiscordClub) bool {
+		if name, member := club.Members[userID]; member {
+			targets = append(targets, discordTarget{url: club.WebhookURL, clubID: clubID, author: name})
+		}
+		return true
+	})
+	sort.Slice(targets, func(i, j int) bool { return targets[i].clubID < targets[j].clubID })
+	return targets
+}
+
+// sendDiscord posts a notification to each target. It's delivered if any of
+// them accepts it. Deleted webhooks are removed, so they aren't tried again.
+func (srv *Server) sendDiscord(userID string, targets []discordTarget, title, body, gameURL string) error {
+	var failure error
+	delivered := false
+	for _, target := range targets {
+		err := postDiscord(target.url, target.author, title, body, gameURL)
+		if err == nil {
+			delivered = true
+			continue
+		}
+		failure = err
+		if errors.Is(err, errDiscordWebhookGone) {
+			srv.removeDiscordWebhook(userID, target)
+		}
+	}
+	if delivered {
+		return nil
+	}
+	return failure
+}
+
+// removeDiscordWebhook forgets a webhook Discord deleted, unless it was
+// replaced since
+func (srv *Server) removeDiscordWebhook(userID string, target discordTarget) {
+	removed := false
+	if target.clubID == "" {
+		shard := srv.storage.shard(userID)
+		shard.mu.Lock()
+		if removed = shard.discordWebhooks[userID] == target.url; removed {
+			delete(shard.discordWebhooks, userID)
+			shard.bumpSettingsVersion(userID)
+		}
+		shard.mu.Unlock()
+	} else {
+		srv.storage.discordClubs.Update(target.clubID, func(club *DiscordClub, exists bool) (*DiscordClub, bool) {
+			removed = exists && club.WebhookURL == target.url
+			return club, exists && !removed
+		})
+	}
+
+	if !removed {
+		return
+	}
+	srv.saveStorage()
+	if target.clubID == "" {
+		log.Printf("Removed deleted Discord webhook for user %s", userID)
+	} else {
+		log.Printf("Removed Discord club %s: its webhook was deleted", target.clubID)
+	}
+}
+
+// setDiscordWebhook handles PUT /discord/{userID}. A test message is posted
+// first, so a webhook that doesn't work is rejected rather than silently
+// dropping turns.
+func (srv *Server) setDiscordWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var webhook DiscordWebhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !validDiscordWebhookURL(webhook.WebhookURL) {
+		http.Error(w, "webhook_url must be a Discord webhook URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := postDiscord(webhook.WebhookURL, "", "OGS notifications", "You'll get a message here when it's your turn.", ""); err != nil {
+		log.Printf("Discord test message for user %s failed: %v", userID, err)
+		http.Error(w, "Could not post to this webhook", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.discordWebhooks[userID] = webhook.WebhookURL
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Set Discord webhook for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteDiscordWebhook handles DELETE /discord/{userID}
+func (srv *Server) deleteDiscordWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.discordWebhooks[userID]
+	delete(shard.discordWebhooks, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No Discord webhook set", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Removed Discord webhook for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setDiscordClub handles PUT /admin/discord-clubs/{clubID}, creating or
+// replacing a club's webhook and members
+func (srv *Server) setDiscordClub(w http.ResponseWriter, r *http.Request) {
+	clubID := mux.Vars(r)["clubID"]
+
+	var club DiscordClub
+	if err := json.NewDecoder(r.Body).Decode(&club); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !validDiscordWebhookURL(club.WebhookURL) {
+		http.Error(w, "webhook_url must be a Discord webhook URL", http.StatusBadRequest)
+		return
+	}
+	if len(club.Members) == 0 || len(club.Members) > maxDiscordClubMembers {
+		http.Error(w, "members must list 1 to 200 users", http.StatusBadRequest)
+		return
+	}
+	for userID, name := range club.Members {
+		if id, err := strconv.Atoi(userID); err != nil || id <= 0 || strconv.Itoa(id) != userID {
+			http.Error(w, "members keys must be user IDs", http.StatusBadRequest)
+			return
+		}
+		if name == "" || len(name) > 80 {
+			http.Error(w, "members names must be 1 to 80 characters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := postDiscord(club.WebhookURL, "", "OGS notifications", "Club members' turns and results will be posted here.", ""); err != nil {
+		log.Printf("Discord test message for club %s failed: %v", clubID, err)
+		http.Error(w, "Could not post to this webhook", http.StatusBadGateway)
+		return
+	}
+
+	srv.storage.discordClubs.Store(clubID, &club)
+	srv.saveStorage()
+
+	log.Printf("Admin set Discord club %s with %d members", clubID, len(club.Members))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteDiscordClub handles DELETE /admin/discord-clubs/{clubID}
+func (srv *Server) deleteDiscordClub(w http.ResponseWriter, r *http.Request) {
+	clubID := mux.Vars(r)["clubID"]
+
+	exists := false
+	srv.storage.discordClubs.Update(clubID, func(club *DiscordClub, found bool) (*DiscordClub, bool) {
+		exists = found
+		return club, false
+	})
+
+	if !exists {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	srv.saveStorage()
+	log.Printf("Admin removed Discord club %s", clubID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDiscordClubs handles GET /admin/discord-clubs. Webhook URLs carry their
+// token, so they're left out.
+func (srv *Server) listDiscordClubs(w http.ResponseWriter, r *http.Request) {
+	type clubSummary struct {
+		ClubID  string            `json:"club_id"`
+		Members map[string]string `json:"members"`
+	}
+
+	list := make([]clubSummary, 0, srv.storage.discordClubs.Len())
+	srv.storage.discordClubs.Range(func(clubID string, club *DiscordClub) bool {
+		list = append(list, clubSummary{ClubID: clubID, Members: maps.Clone(club.Members)})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ClubID < list[j].ClubID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
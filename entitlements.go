@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tiers a user can be on. Everyone is free unless an App Store subscription
+// or an admin grants premium.
+const (
+	tierFree    = "free"
+	tierPremium = "premium"
+)
+
+// Features that can be reserved for premium users with PREMIUM_FEATURES
+const (
+	featureDigests     = "digests"      // the user's own digest rules for labels, opponents and bots
+	featureEventStream = "event_stream" // the presence event stream
+)
+
+var knownFeatures = []string{featureDigests, featureEventStream}
+
+// Entitlement is a tier granted to a user and where it came from
+type Entitlement struct {
+	Tier                  string `json:"tier"`
+	Source                string `json:"source"` // "app_store" or "admin"
+	ProductID             string `json:"product_id,omitempty"`
+	OriginalTransactionID string `json:"original_transaction_id,omitempty"`
+	ExpiresAt             int64  `json:"expires_at"`          // unix time; 0 = doesn't expire
+	Revoked               bool   `json:"revoked,omitempty"`   // refunded or revoked
+	SignedAt              int64  `json:"signed_at,omitempty"` // of the App Store notification applied, in ms; older ones are ignored
+}
+
+// active reports whether the entitlement grants its tier now
+func (e *Entitlement) active(now time.Time) bool {
+	return e != nil && !e.Revoked && (e.ExpiresAt == 0 || now.Unix() < e.ExpiresAt)
+}
+
+// premiumFeatures reads PREMIUM_FEATURES, a comma-separated list of the
+// features only premium users get. By default every feature is free.
+func premiumFeatures() map[string]bool {
+	known := make(map[string]bool, len(knownFeatures))
+	for _, feature := range knownFeatures {
+		known[feature] = true
+	}
+
+	premium := make(map[string]bool)
+	for _, feature := range strings.Split(os.Getenv("PREMIUM_FEATURES"), ",") {
+		feature = strings.TrimSpace(feature)
+		if feature == "" {
+			continue
+		}
+		if !known[feature] {
+			log.Printf("Ignoring unknown feature %q in PREMIUM_FEATURES", feature)
+			continue
+		}
+		premium[feature] = true
+	}
+	return premium
+}
+
+// entitlementFor returns the entitlement in force for the user: an admin
+// override, then an App Store subscription. It returns nil for free users.
+func (srv *Server) entitlementFor(userID string, now time.Time) *Entitlement {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if override := shard.entitlementOverrides[userID]; override.active(now) {
+		return override
+	}
+	if subscription := shard.entitlements[userID]; subscription.active(now) {
+		return subscription
+	}
+	return nil
+}
+
+// tierFor returns the user's tier
+func (srv *Server) tierFor(userID string, now time.Time) string {
+	if entitlement := srv.entitlementFor(userID, now); entitlement != nil {
+		return entitlement.Tier
+	}
+	return tierFree
+}
+
+// hasPremium reports whether the user is on the premium tier
+func (srv *Server) hasPremium(userID string, now time.Time) bool {
+	return srv.tierFor(userID, now) == tierPremium
+}
+
+// featureEnabled reports whether the user's tier includes a feature
+func (srv *Server) featureEnabled(userID, feature string, now time.Time) bool {
+	return !premiumFeatures()[feature] || srv.hasPremium(userID, now)
+}
+
+// withoutDigestRules turns the user's own digest rules into normal ones, for
+// users whose tier doesn't include digests. Bot games keep the default.
+func withoutDigestRules(prefs UserPreferences) UserPreferences {
+	demote := func(rule string) string {
+		if rule == priorityDigest {
+			return priorityNormal
+		}
+		return rule
+	}
+
+	labelRules := make(map[string]string, len(prefs.LabelRules))
+	for label, rule := range prefs.LabelRules {
+		labelRules[label] = demote(rule)
+	}
+	opponentRules := make(map[int]string, len(prefs.OpponentRules))
+	for opponentID, rule := range prefs.OpponentRules {
+		opponentRules[opponentID] = demote(rule)
+	}
+	prefs.LabelRules, prefs.OpponentRules = labelRules, opponentRules
+	if prefs.BotGames == priorityDigest {
+		prefs.BotGames = ""
+	}
+	return prefs
+}
+
+// UserFeatures is what GET /features/{userID} returns, for the app to show
+// what the user's tier includes
+type UserFeatures struct {
+	Tier      string          `json:"tier"`
+	Source    string          `json:"source,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+	Features  map[string]bool `json:"features"`
+}
+
+// getFeatures handles GET /features/{userID}
+func (srv *Server) getFeatures(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	now := time.Now()
+
+	result := UserFeatures{Tier: tierFree, Features: make(map[string]bool, len(knownFeatures))}
+	if entitlement := srv.entitlementFor(userID, now); entitlement != nil {
+		result.Tier, result.Source, result.ExpiresAt = entitlement.Tier, entitlement.Source, entitlement.ExpiresAt
+	}
+	for _, feature := range knownFeatures {
+		result.Features[feature] = srv.featureEnabled(userID, feature, now)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// EntitlementOverride is the body of PUT /admin/entitlements/{userID}
+type EntitlementOverride struct {
+	Tier      string `json:"tier"`
+	ExpiresAt int64  `json:"expires_at"` // unix time; 0 = doesn't expire
+}
+
+// setEntitlementOverride handles PUT /admin/entitlements/{userID}: a tier
+// that takes precedence over the user's subscription, for support and
+// testing. Granting free takes premium away.
+func (srv *Server) setEntitlementOverride(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var req EntitlementOverride
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Tier != tierFree && req.Tier != tierPremium {
+		http.Error(w, "tier must be free or premium", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != 0 && req.ExpiresAt <= time.Now().Unix() {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.entitlementOverrides[userID] = &Entitlement{Tier: req.Tier, Source: "admin", ExpiresAt: req.ExpiresAt}
+	shard.mu.Unlock()
+	srv.saveStorage()
+
+	log.Printf("Admin set tier %s for user %s (expires %d)", req.Tier, userID, req.ExpiresAt)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteEntitlementOverride handles DELETE /admin/entitlements/{userID}
+func (srv *Server) deleteEntitlementOverride(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.entitlementOverrides[userID]
+	delete(shard.entitlementOverrides, userID)
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	srv.saveStorage()
+	log.Printf("Admin removed the tier override for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listEntitlements handles GET /admin/entitlements: every user with a tier
+// granted, active or not
+func (srv *Server) listEntitlements(w http.ResponseWriter, r *http.Request) {
+	type userEntitlements struct {
+		UserID       string       `json:"user_id"`
+		Override     *Entitlement `json:"override,omitempty"`
+		Subscription *Entitlement `json:"subscription,omitempty"`
+	}
+
+	byUser := make(map[string]*userEntitlements)
+	entry := func(userID string) *userEntitlements {
+		if byUser[userID] == nil {
+			byUser[userID] = &userEntitlements{UserID: userID}
+		}
+		return byUser[userID]
+	}
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for userID, override := range shard.entitlementOverrides {
+			entry(userID).Override = override
+		}
+		for userID, subscription := range shard.entitlements {
+			entry(userID).Subscription = subscription
+		}
+		shard.mu.RUnlock()
+	}
+
+	list := make([]*userEntitlements, 0, len(byUser))
+	for _, entitlements := range byUser {
+		list = append(list, entitlements)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// firestoreBackend stores one document per user in a Firestore collection,
+// and one per shared map in a second collection named after it. It remembers
+// the documents it last wrote, so each save only touches those that changed.
+type firestoreBackend struct {
+	client     *firestore.Client
+	collection string
+
+	mu    sync.Mutex
+	saved storageDocs
+}
+
+// firestoreUserDoc is the stored form of a user's state, or of a shared map.
+// State is the JSON document from splitByUser, kept as a string so
+// integer-keyed maps survive unchanged.
+type firestoreUserDoc struct {
+	State     string    `firestore:"state"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+}
+
+func newFirestoreBackend(projectID, collection string) (*firestoreBackend, error) {
+	if projectID == "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=firestore requires GOOGLE_CLOUD_PROJECT")
+	}
+	if collection == "" {
+		collection = "ogs_notification_users"
+	}
+
+	client, err := firestore.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create firestore client: %v", err)
+	}
+
+	return &firestoreBackend{client: client, collection: collection}, nil
+}
+
+func (b *firestoreBackend) Name() string {
+	return "firestore/" + b.collection
+}
+
+func (b *firestoreBackend) sharedCollection() string { return b.collection + "_shared" }
+
+func (b *firestoreBackend) Load() (*storageFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	users, err := b.readCollection(ctx, b.collection)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := b.readCollection(ctx, b.sharedCollection())
+	if err != nil {
+		return nil, err
+	}
+
+	docs := storageDocs{Users: users, Shared: shared}
+	data, err := joinUsers(docs)
+	if err != nil {
+		return nil, err
+	}
+	b.saved = docs
+	return data, nil
+}
+
+// readCollection reads every document's state in the named collection
+func (b *firestoreBackend) readCollection(ctx context.Context, name string) (map[string]string, error) {
+	docs := make(map[string]string)
+	iter := b.client.Collection(name).Documents(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var doc firestoreUserDoc
+		if err := snap.DataTo(&doc); err != nil {
+			return nil, fmt.Errorf("invalid firestore document %s/%s: %v", name, snap.Ref.ID, err)
+		}
+		docs[snap.Ref.ID] = doc.State
+	}
+}
+
+func (b *firestoreBackend) Save(data *storageFile) error {
+	docs, err := splitByUser(data)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	now := time.Now()
+	writer := b.client.BulkWriter(ctx)
+	jobs, err := writeCollection(writer, b.client.Collection(b.collection), b.saved.Users, docs.Users, now)
+	if err == nil {
+		var shared []*firestore.BulkWriterJob
+		shared, err = writeCollection(writer, b.client.Collection(b.sharedCollection()), b.saved.Shared, docs.Shared, now)
+		jobs = append(jobs, shared...)
+	}
+	writer.End()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			// Keep the previous snapshot so the next save retries every change
+			return fmt.Errorf("firestore write failed: %v", err)
+		}
+	}
+
+	b.saved = docs
+	return nil
+}
+
+// writeCollection queues writing the documents in docs that differ from saved
+// to collection, and deleting those docs no longer has
+func writeCollection(writer *firestore.BulkWriter, collection *firestore.CollectionRef, saved, docs map[string]string, now time.Time) ([]*firestore.BulkWriterJob, error) {
+	changed, removed := changedDocs(saved, docs)
+	var jobs []*firestore.BulkWriterJob
+	for _, id := range changed {
+		job, err := writer.Set(collection.Doc(id), firestoreUserDoc{State: docs[id], UpdatedAt: now})
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+	for _, id := range removed {
+		job, err := writer.Delete(collection.Doc(id))
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
@@ -2,23 +2,43 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image/png"
+	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/websocket"
 )
 
 // HIGH PRIORITY FUNCTIONALITY TESTS
 
 // Test: Registration endpoint
 func TestRegistrationEndpoint(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	srv := newTestServer(t)
+	accessToken := fakeOGSAccount(t, "12345")
 
 	tests := []struct {
 		name         string
@@ -29,8 +49,9 @@ func TestRegistrationEndpoint(t *testing.T) {
 		{
 			name: "Valid registration",
 			payload: DeviceRegistration{
-				UserID:      "12345",
-				DeviceToken: testDeviceToken,
+				UserID:         "12345",
+				DeviceToken:    testDeviceToken,
+				OGSAccessToken: accessToken,
 			},
 			expectedCode: http.StatusOK,
 			description:  "Should successfully register valid device",
@@ -54,8 +75,9 @@ func TestRegistrationEndpoint(t *testing.T) {
 		{
 			name: "Update existing registration",
 			payload: DeviceRegistration{
-				UserID:      "12345",
-				DeviceToken: testDeviceToken + "updated",
+				UserID:         "12345",
+				DeviceToken:    testDeviceToken + "updated",
+				OGSAccessToken: accessToken,
 			},
 			expectedCode: http.StatusOK,
 			description:  "Should update existing registration",
@@ -63,7 +85,7 @@ func TestRegistrationEndpoint(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/register", registerDevice).Methods("POST")
+	r.HandleFunc("/register", srv.registerDevice).Methods("POST")
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -79,9 +101,9 @@ func TestRegistrationEndpoint(t *testing.T) {
 
 			// Verify registration in storage
 			if w.Code == http.StatusOK && tt.payload.UserID != "" {
-				storage.mu.RLock()
-				token, exists := storage.deviceTokens[tt.payload.UserID]
-				storage.mu.RUnlock()
+				srv.storage.rlockAll()
+				token, exists := srv.storage.shard(tt.payload.UserID).deviceTokens[tt.payload.UserID]
+				srv.storage.runlockAll()
 
 				if !exists {
 					t.Errorf("Device token not stored after successful registration")
@@ -96,9 +118,7 @@ func TestRegistrationEndpoint(t *testing.T) {
 
 // Test: Turn detection logic
 func TestTurnDetection(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
-
+	t.Parallel()
 	userID := "12345"
 
 	tests := []struct {
@@ -141,17 +161,17 @@ func TestTurnDetection(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Reset storage for each test
-			setupTestStorage()
+			srv := newTestServer(t)
 
 			// Set up stored move if needed
 			if tt.storedMove > 0 {
-				storage.mu.Lock()
-				storage.moves[userID] = map[int]int64{123: tt.storedMove}
-				storage.mu.Unlock()
+				srv.storage.lockAll()
+				srv.storage.shard(userID).games[userID] = gameRecords(map[int]int64{123: tt.storedMove})
+				srv.storage.unlockAll()
 			}
 
 			// Check if new turn
-			isNew := isNewTurn(userID, 123, tt.currentMove)
+			isNew := srv.isNewTurn(userID, 123, tt.currentMove)
 
 			if isNew != tt.expectedNewTurn {
 				t.Errorf("%s: Expected new turn = %v, got %v", tt.description, tt.expectedNewTurn, isNew)
@@ -160,48 +180,224 @@ func TestTurnDetection(t *testing.T) {
 	}
 }
 
+// Test: Move number is the primary turn key, timestamp the fallback
+func TestTurnDetectionByMoveNumber(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	srv.storage.lockAll()
+	srv.storage.shard(userID).games[userID] = gameRecords(map[int]int64{123: 2000})
+	setMoveNumbers(srv, userID, map[int]int{123: 40})
+	srv.storage.unlockAll()
+
+	tests := []struct {
+		name        string
+		moveNumber  int
+		lastMove    int64
+		expectedNew bool
+	}{
+		{"More moves, same timestamp", 41, 2000, true},
+		{"More moves, regressed timestamp", 42, 1500, true},
+		{"Same moves, newer timestamp", 40, 3000, false},
+		{"No move list, newer timestamp", 0, 3000, true},
+		{"No move list, same timestamp", 0, 2000, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if isNew := srv.isNewTurnAt(userID, 123, tt.moveNumber, tt.lastMove); isNew != tt.expectedNew {
+				t.Errorf("Expected new turn = %v, got %v", tt.expectedNew, isNew)
+			}
+		})
+	}
+
+	// Games without a stored move number fall back to the timestamp
+	if !srv.isNewTurnAt(userID, 456, 10, 1000) {
+		t.Error("Unseen game should be a new turn")
+	}
+}
+
+// Test: Undo rolls back stored state so the re-played move notifies again
+func TestUndoRollback(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	gameAt := func(moves int, lastMove int64) Game {
+		game := Game{ID: 123, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, LastMove: lastMove}}}
+		game.JSON.Moves = make([]json.RawMessage, moves)
+		return game
+	}
+
+	// Notified at move 41
+	srv.reserveNotification(userID, []Game{gameAt(41, 2000)})
+	srv.commitNotification(userID, true)
+
+	// Opponent's move is undone: 40 moves, opponent to play
+	undone := gameAt(40, 2100)
+	undone.JSON.Clock.CurrentPlayer = 999
+	if !srv.rollbackUndoneMoves(userID, undone) {
+		t.Fatal("Expected undo to be detected")
+	}
+
+	// Re-played move 41 must be a new turn even though the count matches what we notified
+	replayed := gameAt(41, 2200)
+	if !srv.isNewTurnAt(userID, 123, replayed.MoveNumber(), replayed.JSON.Clock.LastMove) {
+		t.Error("Re-played move after undo should be a new turn")
+	}
+
+	// Normal progress is not treated as an undo
+	if srv.rollbackUndoneMoves(userID, gameAt(42, 2300)) {
+		t.Error("Increasing move count should not trigger a rollback")
+	}
+}
+
 // Test: Notification deduplication
 func TestNotificationDeduplication(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	userID := "12345"
 	gameID := 123
 
 	// Register device
-	storage.mu.Lock()
-	storage.deviceTokens[userID] = testDeviceToken
-	storage.mu.Unlock()
+	srv.storage.lockAll()
+	srv.storage.shard(userID).deviceTokens[userID] = testDeviceToken
+	srv.storage.unlockAll()
 
 	// First notification - should be new
-	isNew := isNewTurn(userID, gameID, 1000)
+	isNew := srv.isNewTurn(userID, gameID, 1000)
 	if !isNew {
 		t.Error("First game check should be detected as new turn")
 	}
 
 	// Update stored move
-	updateStoredMove(userID, gameID, 1000)
+	srv.updateStoredMove(userID, gameID, 1000)
 
 	// Same move timestamp - should not be new
-	isNew = isNewTurn(userID, gameID, 1000)
+	isNew = srv.isNewTurn(userID, gameID, 1000)
 	if isNew {
 		t.Error("Same move timestamp should not trigger new notification")
 	}
 
 	// Updated move timestamp - should be new
-	isNew = isNewTurn(userID, gameID, 2000)
+	isNew = srv.isNewTurn(userID, gameID, 2000)
 	if !isNew {
 		t.Error("Updated move timestamp should trigger new notification")
 	}
 }
 
+// Test: Two-phase reserve -> send -> commit notification flow
+func TestNotificationReserveCommit(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	games := []Game{{ID: 123, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, LastMove: 1000}}}}
+
+	// Reserving must not mark the move as seen yet
+	if reserved := srv.reserveNotification(userID, games); len(reserved) != 1 {
+		t.Fatalf("Expected 1 reserved game, got %d", len(reserved))
+	}
+	if !srv.isNewTurn(userID, 123, 1000) {
+		t.Error("Reserved but unsent turn should still be new")
+	}
+
+	// A second reservation while the first is in flight is suppressed
+	if reserved := srv.reserveNotification(userID, games); len(reserved) != 0 {
+		t.Error("Overlapping reservation should be suppressed while a send is in flight")
+	}
+
+	// A failed send keeps the pending record and the turn stays new
+	srv.releaseNotification(userID, "BadDeviceToken")
+	srv.storage.rlockAll()
+	pending := srv.storage.shard(userID).pendingNotifications[userID]
+	srv.storage.runlockAll()
+	if pending == nil || pending.LastError != "BadDeviceToken" {
+		t.Fatal("Failed send should leave a pending notification with its error")
+	}
+	if !srv.isNewTurn(userID, 123, 1000) {
+		t.Error("Turn should remain new after a failed send")
+	}
+
+	// Retrying reserves again and counts the attempt
+	if reserved := srv.reserveNotification(userID, games); len(reserved) != 1 {
+		t.Fatal("Failed notification should be reservable again")
+	}
+	srv.storage.rlockAll()
+	attempts := srv.storage.shard(userID).pendingNotifications[userID].Attempts
+	srv.storage.runlockAll()
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+
+	// Commit advances the stored move and clears the pending record
+	srv.commitNotification(userID, true)
+	if srv.isNewTurn(userID, 123, 1000) {
+		t.Error("Committed turn should no longer be new")
+	}
+
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+	if _, exists := srv.storage.shard(userID).pendingNotifications[userID]; exists {
+		t.Error("Pending notification not cleared after commit")
+	}
+	if srv.storage.shard(userID).lastNotificationTime[userID] == 0 {
+		t.Error("Last notification time not updated after commit")
+	}
+}
+
 // Test: Concurrent registrations
+func TestRegistrationByUsername(t *testing.T) {
+	srv := newTestServer(t)
+
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("username") {
+		case "Go Player":
+			w.Write([]byte(`{"results": [{"id": 4242, "username": "go player"}]}`))
+		case "down":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"results": []}`))
+		}
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsPlayerSearchURL = url }(ogsPlayerSearchURL)
+	ogsPlayerSearchURL = ogs.URL + "/players?username=%s"
+	accessToken := fakeOGSAccount(t, "4242")
+
+	register := func(username string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(DeviceRegistration{Username: username, DeviceToken: testDeviceToken, OGSAccessToken: accessToken})
+		w := httptest.NewRecorder()
+		srv.registerDevice(w, httptest.NewRequest("POST", "/register", bytes.NewReader(body)))
+		return w
+	}
+
+	w := register("Go Player")
+	var response map[string]string
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response["user_id"] != "4242" {
+		t.Fatalf("Expected the username to register player 4242, got %d %v", w.Code, response)
+	}
+	if srv.storage.shard("4242").deviceTokens["4242"] != testDeviceToken {
+		t.Error("Expected the device stored under the player ID")
+	}
+
+	if w := register("nobody"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown username to be refused, got %d", w.Code)
+	}
+	if w := register("down"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a failed lookup to be reported as unavailable, got %d", w.Code)
+	}
+}
+
 func TestConcurrentRegistrations(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	srv := newTestServer(t)
 
+	fakeOGSAccount(t, "")
 	r := mux.NewRouter()
-	r.HandleFunc("/register", registerDevice).Methods("POST")
+	r.HandleFunc("/register", srv.registerDevice).Methods("POST")
 
 	const numRequests = 50
 	var wg sync.WaitGroup
@@ -215,8 +411,9 @@ func TestConcurrentRegistrations(t *testing.T) {
 			defer wg.Done()
 
 			payload := DeviceRegistration{
-				UserID:      fmt.Sprintf("user%d", id),
-				DeviceToken: fmt.Sprintf("%064d", id), // 64 char string
+				UserID:         strconv.Itoa(1000 + id),
+				DeviceToken:    fmt.Sprintf("%064d", id), // 64 char string
+				OGSAccessToken: "token-" + strconv.Itoa(1000+id),
 			}
 
 			body, _ := json.Marshal(payload)
@@ -241,29 +438,29 @@ func TestConcurrentRegistrations(t *testing.T) {
 	}
 
 	// Verify all registrations were stored
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if len(storage.deviceTokens) != numRequests {
-		t.Errorf("Expected %d registered users, got %d", numRequests, len(storage.deviceTokens))
+	if len(srv.storage.snapshot().DeviceTokens) != numRequests {
+		t.Errorf("Expected %d registered users, got %d", numRequests, len(srv.storage.snapshot().DeviceTokens))
 	}
 }
 
 // Test: Diagnostics endpoint
 func TestDiagnosticsEndpoint(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	userID := "12345"
 
 	// Set up test data
-	storage.mu.Lock()
-	storage.deviceTokens[userID] = testDeviceToken
-	storage.lastNotificationTime[userID] = 1000
-	storage.mu.Unlock()
+	srv.storage.lockAll()
+	srv.storage.shard(userID).deviceTokens[userID] = testDeviceToken
+	srv.storage.shard(userID).lastNotificationTime[userID] = 1000
+	srv.storage.unlockAll()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/diagnostics/{userID}", getUserDiagnostics).Methods("GET")
+	r.HandleFunc("/diagnostics/{userID}", srv.getUserDiagnostics).Methods("GET")
 
 	// Test invalid user ID
 	req := httptest.NewRequest("GET", "/diagnostics/invalid", nil)
@@ -279,4 +476,4209 @@ func TestDiagnosticsEndpoint(t *testing.T) {
 	if strings.Contains(body, testDeviceToken) {
 		t.Error("Diagnostics response contains full device token - security issue!")
 	}
-}
\ No newline at end of file
+}
+
+// Test: Games that leave active_games are cleaned up and recorded
+func TestRemovedGameCleanup(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	srv.storage.lockAll()
+	srv.storage.shard(userID).games[userID] = gameRecords(map[int]int64{123: 1000, 456: 2000})
+	setMoveNumbers(srv, userID, map[int]int{123: 10, 456: 20})
+	srv.storage.unlockAll()
+
+	active := []Game{{ID: 123}}
+	finished := srv.detectRemovedGames(userID, active)
+
+	if len(finished) != 1 || finished[0].GameID != 456 {
+		t.Fatalf("Expected game 456 to be detected as removed, got %+v", finished)
+	}
+
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+
+	if _, exists := srv.storage.shard(userID).games[userID][456]; exists {
+		t.Error("Removed game still has a stored record")
+	}
+	if _, exists := srv.storage.shard(userID).games[userID][123]; !exists {
+		t.Error("Active game should not be removed")
+	}
+	if len(srv.storage.shard(userID).finishedGames[userID]) != 1 {
+		t.Errorf("Expected 1 finished game recorded, got %d", len(srv.storage.shard(userID).finishedGames[userID]))
+	}
+}
+
+// Test: Game outcome from the user's point of view
+func TestGameResultFor(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		details  GameDetails
+		expected string
+	}{
+		{GameDetails{Winner: 12345, Outcome: "Resignation"}, "won"},
+		{GameDetails{Winner: 999, Outcome: "Timeout"}, "lost"},
+		{GameDetails{Winner: 12345, Annulled: true}, "annulled"},
+		{GameDetails{}, "unknown"},
+	}
+
+	for _, tt := range tests {
+		if result := gameResultFor("12345", &tt.details); result != tt.expected {
+			t.Errorf("Expected %s for %+v, got %s", tt.expected, tt.details, result)
+		}
+	}
+}
+
+// Test: Opponent resignations and timeouts are described from the winner's side
+func TestOpponentForfeitNotification(t *testing.T) {
+	t.Parallel()
+	details := GameDetails{ID: 77, Name: "Friendly match", Winner: 12345, Outcome: "Resignation"}
+	details.Players.Black = GamePlayer{ID: 12345, Username: "me"}
+	details.Players.White = GamePlayer{ID: 999, Username: "PlayerX"}
+
+	title, body, ok := opponentForfeitNotification("12345", &details)
+	if !ok || title != "Opponent resigned" || body != "You won Friendly match against PlayerX" {
+		t.Errorf("Unexpected resignation notification: %v %q %q", ok, title, body)
+	}
+
+	details.Outcome, details.Name = "Timeout", ""
+	title, body, ok = opponentForfeitNotification("12345", &details)
+	if !ok || title != "Opponent ran out of time" || body != "You won game 77 against PlayerX" {
+		t.Errorf("Unexpected timeout notification: %v %q %q", ok, title, body)
+	}
+
+	// Losses and other endings aren't forfeits
+	if _, _, ok := opponentForfeitNotification("999", &details); ok {
+		t.Error("Expected no forfeit notification for the player who timed out")
+	}
+	details.Outcome = "7.5 points"
+	if _, _, ok := opponentForfeitNotification("12345", &details); ok {
+		t.Error("Expected no forfeit notification for a counted game")
+	}
+}
+
+// Test: Clock pause and resume transitions
+func TestClockPauseTracking(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	paused := Game{ID: 123, Name: "test game"}
+	paused.JSON.PauseControl = map[string]json.RawMessage{"vacation-999": json.RawMessage("true")}
+
+	if paused.PauseReason() != "vacation" {
+		t.Errorf("Expected vacation pause reason, got %q", paused.PauseReason())
+	}
+
+	if srv.trackClockPause(userID, paused) {
+		t.Error("Pausing should not be reported as a resume")
+	}
+
+	srv.storage.rlockAll()
+	pause, tracked := srv.storage.shard(userID).pausedGames[userID][123]
+	srv.storage.runlockAll()
+	if !tracked || pause.Reason != "vacation" {
+		t.Fatalf("Pause not recorded: %+v", pause)
+	}
+
+	// Still paused on the next check is not a transition
+	if srv.trackClockPause(userID, paused) {
+		t.Error("Ongoing pause should not be reported as a resume")
+	}
+
+	running := Game{ID: 123, Name: "test game"}
+	if !srv.trackClockPause(userID, running) {
+		t.Error("Expected resume to be detected")
+	}
+
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+	if _, tracked := srv.storage.shard(userID).pausedGames[userID][123]; tracked {
+		t.Error("Pause should be cleared after resume")
+	}
+}
+
+// Test: Final byo-yomi period warning
+func TestFinalByoyomiPeriodWarning(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Unix(1700000000, 0)
+	makeGame := func(clock string, elapsed time.Duration) Game {
+		game := Game{ID: 123, Name: "test game"}
+		game.JSON.TimeControl = TimeControl{System: "byoyomi", Speed: "correspondence", Periods: 5, PeriodTime: 86400}
+		game.JSON.Clock = Clock{
+			CurrentPlayer: 12345,
+			BlackPlayerID: 12345,
+			WhitePlayerID: 999,
+			LastMove:      now.Add(-elapsed).UnixMilli(),
+			BlackTime:     json.RawMessage(clock),
+		}
+		return game
+	}
+
+	tests := []struct {
+		name     string
+		clock    string
+		elapsed  time.Duration
+		expected bool
+	}{
+		{"Main time remaining", `{"thinking_time": 172800, "periods": 5, "period_time": 86400}`, time.Hour, false},
+		{"Two periods left", `{"thinking_time": 0, "periods": 2, "period_time": 86400}`, time.Hour, false},
+		{"Final period at last move", `{"thinking_time": 0, "periods": 1, "period_time": 86400}`, time.Hour, true},
+		{"Final period after elapsed time", `{"thinking_time": 3600, "periods": 3, "period_time": 86400}`, 49 * time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			warned := srv.checkFinalByoyomiPeriod("12345", 12345, makeGame(tt.clock, tt.elapsed), now)
+			if warned != tt.expected {
+				t.Errorf("Expected warning = %v, got %v", tt.expected, warned)
+			}
+		})
+	}
+
+	// Only warn once per game
+	srv = newTestServer(t)
+	game := makeGame(`{"thinking_time": 0, "periods": 1, "period_time": 86400}`, time.Hour)
+	srv.checkFinalByoyomiPeriod("12345", 12345, game, now)
+	if srv.checkFinalByoyomiPeriod("12345", 12345, game, now) {
+		t.Error("Final period warning should only be issued once per game")
+	}
+
+	// Live games are ignored
+	live := makeGame(`{"thinking_time": 0, "periods": 1, "period_time": 30}`, time.Second)
+	live.ID = 456
+	live.JSON.TimeControl.Speed = "live"
+	live.JSON.TimeControl.PeriodTime = 30
+	if srv.checkFinalByoyomiPeriod("12345", 12345, live, now) {
+		t.Error("Live games should not produce final period warnings")
+	}
+}
+
+// Test: Classifying turns has no side effects
+func TestClassifyTurnsIsReadOnly(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	games := []Game{
+		{ID: 1, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, LastMove: 1000}}},
+		{ID: 2, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, LastMove: 2000}}},
+		{ID: 3, JSON: GameState{Clock: Clock{CurrentPlayer: 999, LastMove: 3000}}},
+	}
+	srv.updateStoredMove("12345", 2, 2000)
+
+	status, newTurnGames := srv.classifyTurns(12345, games)
+
+	if len(status.YourTurnNew) != 1 || status.YourTurnNew[0] != 1 {
+		t.Errorf("Expected game 1 as new turn, got %v", status.YourTurnNew)
+	}
+	if len(status.YourTurnOld) != 1 || status.YourTurnOld[0] != 2 {
+		t.Errorf("Expected game 2 as old turn, got %v", status.YourTurnOld)
+	}
+	if len(status.NotYourTurn) != 1 || len(newTurnGames) != 1 {
+		t.Errorf("Unexpected classification: %+v", status)
+	}
+
+	// Classification must not reserve notifications or store moves
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+	if len(srv.storage.snapshot().PendingNotifications) != 0 {
+		t.Error("classifyTurns should not reserve notifications")
+	}
+	if _, exists := srv.storage.shard("12345").games["12345"][1]; exists {
+		t.Error("classifyTurns should not store moves")
+	}
+}
+
+// Test: Decision trace ring buffer and classification actions
+func TestDecisionTrace(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	games := []Game{
+		{ID: 1, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, LastMove: 1000}}},
+		{ID: 2, JSON: GameState{Clock: Clock{CurrentPlayer: 999, LastMove: 2000}}},
+	}
+	srv.updateStoredMove("12345", 2, 1500)
+
+	status, newTurnGames := srv.classifyTurns(12345, games)
+	trace := srv.buildDecisionTrace(12345, games, status, newTurnGames)
+
+	if len(trace.Decisions) != 2 {
+		t.Fatalf("Expected 2 decisions, got %d", len(trace.Decisions))
+	}
+	if d := trace.Decisions[0]; d.Classification != "your_turn_new" || d.Action != "notify" {
+		t.Errorf("Unexpected decision for new turn: %+v", d)
+	}
+	if d := trace.Decisions[1]; d.Classification != "not_your_turn" || d.StoredMove != 1500 || d.FetchedMove != 2000 {
+		t.Errorf("Unexpected decision for opponent's turn: %+v", d)
+	}
+
+	// Suppressed when the reservation didn't go through
+	trace = srv.buildDecisionTrace(12345, games, status, nil)
+	if trace.Decisions[0].Action != "suppressed" {
+		t.Errorf("Expected suppressed action, got %s", trace.Decisions[0].Action)
+	}
+
+	// Ring buffer keeps only the newest entries
+	buffer := newDecisionTraceBuffer(3)
+	for i := 1; i <= 5; i++ {
+		buffer.add(DecisionTrace{UserID: fmt.Sprintf("%d", i%2), CheckedAt: int64(i)})
+	}
+	recent := buffer.recent("", 10)
+	if len(recent) != 3 || recent[0].CheckedAt != 5 || recent[2].CheckedAt != 3 {
+		t.Errorf("Unexpected ring buffer contents: %+v", recent)
+	}
+	if filtered := buffer.recent("1", 10); len(filtered) != 2 {
+		t.Errorf("Expected 2 traces for user 1, got %d", len(filtered))
+	}
+}
+
+// Test: Daily notification cap with a single coalesced overflow push
+func TestNotificationBudget(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// No cap configured
+	if decision := srv.checkNotificationBudget(userID, now); decision != budgetSend {
+		t.Errorf("Expected send without a cap, got %v", decision)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard(userID).preferences[userID] = &UserPreferences{DailyNotificationCap: 2}
+	srv.storage.unlockAll()
+
+	for i := 0; i < 2; i++ {
+		if decision := srv.checkNotificationBudget(userID, now); decision != budgetSend {
+			t.Fatalf("Push %d should be under the cap, got %v", i+1, decision)
+		}
+		srv.recordNotificationSent(userID, budgetSend, now)
+	}
+
+	if decision := srv.checkNotificationBudget(userID, now); decision != budgetOverflow {
+		t.Fatalf("Expected coalesced overflow push once the cap is reached, got %v", decision)
+	}
+	srv.recordNotificationSent(userID, budgetOverflow, now)
+
+	if decision := srv.checkNotificationBudget(userID, now); decision != budgetSuppress {
+		t.Errorf("Expected suppression after the overflow push, got %v", decision)
+	}
+
+	// Budget resets the next day
+	if decision := srv.checkNotificationBudget(userID, now.Add(24*time.Hour)); decision != budgetSend {
+		t.Errorf("Expected budget to reset on a new day, got %v", decision)
+	}
+}
+
+// Test: Preferences endpoint
+func TestPreferencesEndpoint(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/preferences/{userID}", srv.getPreferences).Methods("GET")
+	r.HandleFunc("/preferences/{userID}", srv.updatePreferences).Methods("PUT")
+
+	put := func(body string) int {
+		req := httptest.NewRequest("PUT", "/preferences/12345", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put(`{"daily_notification_cap": 20}`); code != http.StatusOK {
+		t.Fatalf("Expected 200 for valid preferences, got %d", code)
+	}
+	if code := put(`{"daily_notification_cap": -1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for negative cap, got %d", code)
+	}
+	if code := put(`not json`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/preferences/12345", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var prefs UserPreferences
+	json.NewDecoder(w.Body).Decode(&prefs)
+	if prefs.DailyNotificationCap != 20 {
+		t.Errorf("Expected stored cap of 20, got %d", prefs.DailyNotificationCap)
+	}
+}
+
+// Test: High-volume mode selection and batch windows
+func TestHighVolumeMode(t *testing.T) {
+	srv := newTestServer(t)
+
+	userID := "12345"
+	t.Setenv("HIGH_VOLUME_GAME_THRESHOLD", "10")
+
+	if srv.highVolumeModeActive(userID, 10) {
+		t.Error("Auto mode should not activate at the threshold")
+	}
+	if !srv.highVolumeModeActive(userID, 11) {
+		t.Error("Auto mode should activate above the threshold")
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard(userID).preferences[userID] = &UserPreferences{HighVolumeMode: "off", BatchWindowMinutes: 30}
+	srv.storage.unlockAll()
+	if srv.highVolumeModeActive(userID, 50) {
+		t.Error("High-volume mode should respect the off preference")
+	}
+
+	now := time.Unix(1700000000, 0)
+	srv.storage.lockAll()
+	srv.storage.shard(userID).lastNotificationTime[userID] = now.Add(-20 * time.Minute).Unix()
+	srv.storage.unlockAll()
+	if srv.batchWindowElapsed(userID, now) {
+		t.Error("Batch window of 30 minutes should not have elapsed after 20 minutes")
+	}
+	if !srv.batchWindowElapsed(userID, now.Add(10*time.Minute)) {
+		t.Error("Batch window should have elapsed after 30 minutes")
+	}
+}
+
+// Test: Presence hints are opt-in and streamed as server-sent events
+func TestPresenceEventStream(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	server := httptest.NewServer(srv.newRouter())
+	defer server.Close()
+	get := func(token string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", server.URL+"/events/12345", nil)
+		req.Header.Set(deviceTokenHeader, token)
+		return http.DefaultClient.Do(req)
+	}
+
+	// Not opted in
+	resp, err := get(testDeviceToken)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 without opt-in, got %d", resp.StatusCode)
+	}
+	if srv.publishPresenceEvent("12345", PresenceEvent{Type: "opponent_online", OpponentID: 999}) != 0 {
+		t.Error("Events should not be delivered without opt-in")
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{PresenceHints: true}
+	srv.storage.unlockAll()
+
+	resp, err = get(testDeviceToken)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	// Wait for the stream to subscribe before publishing
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.publishPresenceEvent("12345", PresenceEvent{Type: "opponent_online", OpponentID: 999, GameID: 123}) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Stream never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	buf := make([]byte, 512)
+	n, _ := resp.Body.Read(buf)
+	if !strings.Contains(string(buf[:n]), `"type":"opponent_online"`) {
+		t.Errorf("Expected presence event in stream, got %q", string(buf[:n]))
+	}
+}
+
+// Test: Presence hints come from the OGS real-time connection
+func TestRealtimePresence(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	srv.storage.shard("12345").games["12345"] = gameRecords(map[int]int64{42: 1, 43: 1})
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{PresenceHints: true}
+	events := srv.presence.subscribe("12345")
+	defer srv.presence.unsubscribe("12345", events)
+
+	rt := newOGSRealtime(srv, "")
+	rt.players = rt.trackedGames()
+	rt.handleMessage(`["game/42/gamedata",{"black_player_id":12345,"white_player_id":999}]`)
+	rt.handleMessage(`["game/43/gamedata",{"black_player_id":999,"white_player_id":12345}]`)
+	if !rt.monitored[999] || rt.monitored[12345] {
+		t.Errorf("Expected the opponent to be monitored, got %v", rt.monitored)
+	}
+
+	// The first state only sets a baseline; coming online is pushed once
+	rt.handleMessage(`["user/state",{"999":false}]`)
+	rt.handleMessage(`["user/state",{"999":true}]`)
+	rt.handleMessage(`["user/state",{"999":true}]`)
+	select {
+	case event := <-events:
+		if event.Type != "opponent_online" || event.OpponentID != 999 || event.GameID != 42 {
+			t.Errorf("Expected opponent 999 online in game 42, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a presence event")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected one event, got another: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Opponents of users without presence hints aren't monitored
+	rt = newOGSRealtime(srv, "")
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{}
+	rt.players = rt.trackedGames()
+	rt.handleMessage(`["game/42/gamedata",{"black_player_id":12345,"white_player_id":999}]`)
+	if len(rt.monitored) != 0 {
+		t.Errorf("Expected no monitoring without presence hints, got %v", rt.monitored)
+	}
+}
+
+// Test: Reminder CRUD endpoints
+func TestReminderEndpoints(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/reminders/{userID}", srv.createReminder).Methods("POST")
+	r.HandleFunc("/reminders/{userID}", srv.listReminders).Methods("GET")
+	r.HandleFunc("/reminders/{userID}/{reminderID}", srv.deleteReminder).Methods("DELETE")
+
+	future := time.Now().Add(time.Hour).Unix()
+
+	invalid := map[string]string{
+		fmt.Sprintf(`{"game_id": 123, "remind_at": %d}`, future): "/reminders/abc",
+		fmt.Sprintf(`{"remind_at": %d}`, future):                 "/reminders/12345",
+		`{"game_id": 123, "remind_at": 1000}`:                    "/reminders/12345",
+	}
+	for body, path := range invalid {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s to %s, got %d", body, path, w.Code)
+		}
+	}
+
+	body := fmt.Sprintf(`{"game_id": 123, "remind_at": %d, "note": "study this position"}`, future)
+	req := httptest.NewRequest("POST", "/reminders/12345", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+
+	var created Reminder
+	json.NewDecoder(w.Body).Decode(&created)
+
+	req = httptest.NewRequest("GET", "/reminders/12345", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var listed []Reminder
+	json.NewDecoder(w.Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Note != "study this position" {
+		t.Errorf("Unexpected reminders list: %+v", listed)
+	}
+
+	req = httptest.NewRequest("DELETE", "/reminders/12345/"+created.ID, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/reminders/12345/"+created.ID, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a missing reminder, got %d", w.Code)
+	}
+}
+
+// Test: Due reminders are delivered once and failures are retried
+func TestProcessDueReminders(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Unix(1700000000, 0)
+	srv.storage.lockAll()
+	srv.storage.shard("12345").reminders["12345"] = []*Reminder{
+		{ID: "due", GameID: 1, RemindAt: now.Add(-time.Minute).Unix()},
+		{ID: "later", GameID: 2, RemindAt: now.Add(time.Hour).Unix()},
+	}
+	srv.storage.shard("999").reminders["999"] = []*Reminder{{ID: "failing", GameID: 3, RemindAt: now.Unix()}}
+	srv.storage.unlockAll()
+
+	var sent []string
+	send := func(userID string, reminder Reminder) error {
+		if userID == "999" {
+			return fmt.Errorf("no device token for user")
+		}
+		sent = append(sent, reminder.ID)
+		return nil
+	}
+
+	if delivered := srv.processDueReminders(now, send); delivered != 1 || len(sent) != 1 || sent[0] != "due" {
+		t.Errorf("Expected only the due reminder to be delivered, got %v", sent)
+	}
+
+	srv.storage.rlockAll()
+	if len(srv.storage.shard("12345").reminders["12345"]) != 1 || srv.storage.shard("12345").reminders["12345"][0].ID != "later" {
+		t.Error("Delivered reminder should be removed and future reminder kept")
+	}
+	if len(srv.storage.shard("999").reminders["999"]) != 1 {
+		t.Error("Failed reminder should be kept for retry")
+	}
+	srv.storage.runlockAll()
+
+	for i := 1; i < maxReminderAttempts; i++ {
+		srv.processDueReminders(now, send)
+	}
+
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+	if _, exists := srv.storage.shard("999").reminders["999"]; exists {
+		t.Error("Reminder should be dropped after the maximum attempts")
+	}
+}
+
+// Test: Next occurrence of a local time, including DST transitions
+func TestNextOccurrence(t *testing.T) {
+	t.Parallel()
+	newYork, err := loadTimezone("America/New_York")
+	if err != nil {
+		t.Fatalf("Failed to load timezone: %v", err)
+	}
+	nineAM := DailyTime{Hour: 9}
+
+	tests := []struct {
+		name     string
+		after    time.Time
+		at       DailyTime
+		weekdays []time.Weekday
+		expected time.Time
+	}{
+		{
+			name:     "Later today",
+			after:    time.Date(2025, 6, 10, 8, 0, 0, 0, newYork),
+			at:       nineAM,
+			expected: time.Date(2025, 6, 10, 9, 0, 0, 0, newYork),
+		},
+		{
+			name:     "Already passed today",
+			after:    time.Date(2025, 6, 10, 9, 0, 0, 0, newYork),
+			at:       nineAM,
+			expected: time.Date(2025, 6, 11, 9, 0, 0, 0, newYork),
+		},
+		{
+			name:     "Across spring forward keeps wall clock",
+			after:    time.Date(2025, 3, 8, 10, 0, 0, 0, newYork),
+			at:       nineAM,
+			expected: time.Date(2025, 3, 9, 9, 0, 0, 0, newYork),
+		},
+		{
+			name:     "Across fall back keeps wall clock",
+			after:    time.Date(2025, 11, 1, 10, 0, 0, 0, newYork),
+			at:       nineAM,
+			expected: time.Date(2025, 11, 2, 9, 0, 0, 0, newYork),
+		},
+		{
+			name:     "Nonexistent time on spring forward day",
+			after:    time.Date(2025, 3, 9, 0, 0, 0, 0, newYork),
+			at:       DailyTime{Hour: 2, Minute: 30},
+			expected: time.Date(2025, 3, 9, 3, 30, 0, 0, newYork),
+		},
+		{
+			name:     "Weekday filter",
+			after:    time.Date(2025, 6, 10, 8, 0, 0, 0, newYork), // Tuesday
+			at:       nineAM,
+			weekdays: []time.Weekday{time.Saturday},
+			expected: time.Date(2025, 6, 14, 9, 0, 0, 0, newYork),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := nextOccurrence(tt.after, newYork, tt.at, tt.weekdays...)
+			if !next.Equal(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, next.In(newYork))
+			}
+		})
+	}
+
+	// Spring forward day is only 23 hours long
+	before := time.Date(2025, 3, 8, 9, 0, 0, 0, newYork)
+	if gap := nextOccurrence(before, newYork, nineAM).Sub(before); gap != 23*time.Hour {
+		t.Errorf("Expected 23h between 9am occurrences across spring forward, got %v", gap)
+	}
+}
+
+// Test: Daily time windows, including windows that wrap past midnight
+func TestTimeWindow(t *testing.T) {
+	t.Parallel()
+	tokyo, _ := loadTimezone("Asia/Tokyo")
+
+	overnight, err := parseTimeWindow("22:00-07:00")
+	if err != nil {
+		t.Fatalf("Failed to parse window: %v", err)
+	}
+	daytime, _ := parseTimeWindow("09:00-17:30")
+
+	tests := []struct {
+		window   TimeWindow
+		hour     int
+		minute   int
+		expected bool
+	}{
+		{overnight, 23, 0, true},
+		{overnight, 3, 0, true},
+		{overnight, 7, 0, false},
+		{overnight, 21, 59, false},
+		{overnight, 22, 0, true},
+		{daytime, 12, 0, true},
+		{daytime, 17, 30, false},
+		{daytime, 8, 59, false},
+	}
+
+	for _, tt := range tests {
+		at := time.Date(2025, 6, 10, tt.hour, tt.minute, 0, 0, tokyo)
+		if contains := tt.window.Contains(at, tokyo); contains != tt.expected {
+			t.Errorf("%s contains %02d:%02d: expected %v, got %v", tt.window, tt.hour, tt.minute, tt.expected, contains)
+		}
+	}
+
+	// The same instant is evaluated in the given timezone
+	utcNoon := time.Date(2025, 6, 10, 14, 0, 0, 0, time.UTC) // 23:00 in Tokyo
+	if !overnight.Contains(utcNoon, tokyo) {
+		t.Error("Window should be evaluated in the user's timezone")
+	}
+
+	end := overnight.NextEnd(time.Date(2025, 6, 10, 23, 0, 0, 0, tokyo), tokyo)
+	if !end.Equal(time.Date(2025, 6, 11, 7, 0, 0, 0, tokyo)) {
+		t.Errorf("Unexpected window end: %v", end)
+	}
+
+	for _, invalid := range []string{"", "22:00", "25:00-07:00", "22:00_07:00"} {
+		if _, err := parseTimeWindow(invalid); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+}
+
+// Test: Local day boundaries and timezone validation
+func TestUserTimezone(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	if _, err := loadTimezone("Not/AZone"); err == nil {
+		t.Error("Expected unknown timezone to be rejected")
+	}
+	if srv.userLocation("12345") != time.UTC {
+		t.Error("Users without a timezone should default to UTC")
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{Timezone: "Pacific/Auckland", DailyNotificationCap: 1}
+	srv.storage.unlockAll()
+
+	// 11:00 UTC is already the next day in Auckland
+	now := time.Date(2025, 6, 10, 13, 0, 0, 0, time.UTC)
+	if day := localDayKey(now, srv.userLocation("12345")); day != "2025-06-11" {
+		t.Errorf("Expected Auckland day 2025-06-11, got %s", day)
+	}
+
+	// The daily cap resets at local midnight, not UTC midnight
+	srv.recordNotificationSent("12345", budgetSend, now)
+	if srv.checkNotificationBudget("12345", now) != budgetOverflow {
+		t.Error("Cap should be reached within the same local day")
+	}
+	localMidnight := time.Date(2025, 6, 12, 0, 0, 0, 0, srv.userLocation("12345"))
+	if srv.checkNotificationBudget("12345", localMidnight) != budgetSend {
+		t.Error("Cap should reset at local midnight")
+	}
+}
+
+// TestSLOBurnRate tests push latency SLO tracking and the metrics endpoint
+func TestSLOBurnRate(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// 98 fast successes, one slow success and one failure: 2% bad against a 1% budget
+	for i := 0; i < 98; i++ {
+		srv.pushSLO.record(now.Add(-5*time.Second), now, true)
+	}
+	srv.pushSLO.record(now.Add(-2*time.Minute), now, true)
+	srv.pushSLO.record(now.Add(-time.Second), now, false)
+
+	if rate := srv.pushSLO.burnRate(now, 5); rate < 1.99 || rate > 2.01 {
+		t.Errorf("Expected burn rate 2, got %v", rate)
+	}
+
+	// Outcomes age out of shorter windows
+	if rate := srv.pushSLO.burnRate(now.Add(10*time.Minute), 5); rate != 0 {
+		t.Errorf("Expected empty 5m window to report 0, got %v", rate)
+	}
+	if rate := srv.pushSLO.burnRate(now.Add(10*time.Minute), 60); rate < 1.99 || rate > 2.01 {
+		t.Errorf("Expected 1h window to still hold outcomes, got %v", rate)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	srv.getMetrics(rr, req)
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		`ogs_notifications_push_total{result="success"} 99`,
+		`ogs_notifications_push_total{result="failure"} 1`,
+		`ogs_notifications_push_latency_seconds_bucket{le="60"} 98`,
+		`ogs_notifications_slo_burn_rate{window="1h"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/slo/alert-rules", nil)
+	rr = httptest.NewRecorder()
+	getAlertRules(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "alert: OGSNotificationsFastBurn") {
+		t.Error("Expected alert rules to include the fast burn alert")
+	}
+}
+
+// TestCanary tests that the canary toggles turns and pushes through the pipeline
+func TestCanary(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var sent int
+	deliver := func(userID string, games []Game, waiting int) {
+		sent++
+		srv.commitNotification(userID, true)
+	}
+
+	now := time.Now()
+
+	// First move hands the turn to the opponent: no push
+	if srv.runCanary("canary-token", now, deliver) {
+		t.Error("Expected no push on the opponent's turn")
+	}
+	if !srv.runCanary("canary-token", now.Add(time.Minute), deliver) {
+		t.Error("Expected a push on the canary's turn")
+	}
+	if sent != 1 || srv.canary.lastSuccess.IsZero() {
+		t.Errorf("Expected one delivered canary push, sent=%d", sent)
+	}
+
+	// A failed push is recorded and retried on the canary's next turn
+	fail := func(userID string, games []Game, waiting int) {
+		srv.releaseNotification(userID, "test failure")
+	}
+	srv.runCanary("canary-token", now.Add(2*time.Minute), fail)
+	srv.runCanary("canary-token", now.Add(3*time.Minute), fail)
+	if srv.canary.lastError == "" {
+		t.Error("Expected canary failure to be recorded")
+	}
+	if !srv.canary.lastSuccess.Equal(now.Add(time.Minute)) {
+		t.Error("Expected last success to be unchanged by a failure")
+	}
+
+	if !isCanaryUser(strconv.Itoa(canaryUserID)) || isCanaryUser("12345") {
+		t.Error("isCanaryUser mismatch")
+	}
+}
+
+// TestClockSkewEstimate tests skew detection from OGS last_move timestamps
+func TestClockSkewEstimate(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	gameAt := func(lastMove time.Time) Game {
+		game := Game{ID: 1}
+		game.JSON.Clock.LastMove = lastMove.UnixMilli()
+		return game
+	}
+
+	// Moves in the past are no evidence of skew
+	srv.clockSkew.observe([]Game{gameAt(now.Add(-time.Minute)), gameAt(now.Add(-time.Hour))}, now)
+	if skew := srv.clockSkew.estimate(); skew != 0 {
+		t.Errorf("Expected no skew, got %v", skew)
+	}
+
+	// A move 20s in the future means the server is at least 20s behind
+	srv.clockSkew.observe([]Game{gameAt(now.Add(20 * time.Second)), gameAt(now.Add(-time.Hour))}, now.Add(time.Second))
+	if skew := srv.clockSkew.estimate(); skew < 18*time.Second || skew > 20*time.Second {
+		t.Errorf("Expected ~19s skew, got %v", skew)
+	}
+	if got := srv.ogsNow(now); !got.After(now.Add(18 * time.Second)) {
+		t.Errorf("Expected ogsNow to apply the skew, got %v", got.Sub(now))
+	}
+
+	// Samples age out of the window
+	srv.clockSkew.observe([]Game{gameAt(now.Add(2 * time.Hour))}, now.Add(2*time.Hour))
+	if skew := srv.clockSkew.estimate(); skew != 0 {
+		t.Errorf("Expected old samples to expire, got %v", skew)
+	}
+}
+
+// TestGzipMiddleware tests response compression and content negotiation
+func TestGzipMiddleware(t *testing.T) {
+	t.Parallel()
+	body := strings.Repeat(`{"game_id":12345,"status":"your_turn"}`, 100)
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+
+	req := httptest.NewRequest("GET", "/diagnostics/12345", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", rr.Header().Get("Content-Encoding"))
+	}
+	if rr.Body.Len() >= len(body) {
+		t.Errorf("Expected compressed body smaller than %d bytes, got %d", len(body), rr.Body.Len())
+	}
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzip body: %v", err)
+	}
+	decoded, _ := io.ReadAll(reader)
+	if string(decoded) != body {
+		t.Error("Decompressed body doesn't match")
+	}
+
+	// Clients that don't accept gzip, or refuse it, get the plain body
+	for _, acceptEncoding := range []string{"", "identity", "gzip;q=0"} {
+		req = httptest.NewRequest("GET", "/diagnostics/12345", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != body {
+			t.Errorf("Expected uncompressed response for Accept-Encoding %q", acceptEncoding)
+		}
+		if rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Error("Expected Vary: Accept-Encoding")
+		}
+	}
+
+	// Bodyless responses aren't encoded
+	noContent := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req = httptest.NewRequest("DELETE", "/reminders/12345/abc", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	noContent.ServeHTTP(rr, req)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.Len() != 0 {
+		t.Error("Expected 204 response to be left alone")
+	}
+}
+
+// TestDiagnosticsResponseShaping tests limit/offset paging and field selection
+func TestDiagnosticsResponseShaping(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/diagnostics/12345?limit=2&offset=1&fields=total_active_games,monitored_games.game_id", nil)
+	opts, err := parseListOptions(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	diagnostics := UserDiagnostics{UserID: "12345", TotalActiveGames: 4}
+	for i := 1; i <= 4; i++ {
+		diagnostics.MonitoredGames = append(diagnostics.MonitoredGames, GameDiagnostic{GameID: i, GameName: "game"})
+	}
+
+	start, end, next := opts.page(len(diagnostics.MonitoredGames))
+	if start != 1 || end != 3 || next != 3 {
+		t.Errorf("Expected page [1,3) next 3, got [%d,%d) next %d", start, end, next)
+	}
+	diagnostics.MonitoredGames = diagnostics.MonitoredGames[start:end]
+	diagnostics.NextOffset = next
+
+	selected, err := selectFields(diagnostics, opts.Fields)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(selected)
+	expected := `{"monitored_games":[{"game_id":2},{"game_id":3}],"total_active_games":4}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+
+	// Last page has no next offset
+	if _, end, next := (ListOptions{Limit: 10, Offset: 2}).page(4); end != 4 || next != 0 {
+		t.Errorf("Expected final page to end at 4 with no next, got end %d next %d", end, next)
+	}
+
+	// Omitted-but-valid fields are accepted, unknown fields are rejected
+	if _, err := selectFields(diagnostics, []string{"recently_finished_games"}); err != nil {
+		t.Errorf("Expected omitempty field to be selectable: %v", err)
+	}
+	if _, err := selectFields(diagnostics, []string{"device_token"}); err == nil {
+		t.Error("Expected unknown field to be rejected")
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=10000", "offset=-1"} {
+		req := httptest.NewRequest("GET", "/diagnostics/12345?"+query, nil)
+		if _, err := parseListOptions(req); err == nil {
+			t.Errorf("Expected %s to be rejected", query)
+		}
+	}
+}
+
+// TestValidateDeviceToken tests token validation against a fake APNs server
+func TestValidateDeviceToken(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var lastPushType, lastPriority string
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPushType = r.Header.Get("apns-push-type")
+		lastPriority = r.Header.Get("apns-priority")
+		if strings.HasSuffix(r.URL.Path, "/"+testDeviceToken) {
+			w.Header().Set("apns-id", "test-id")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+
+	validate := func(token string) TokenValidationResult {
+		body, _ := json.Marshal(TokenValidationRequest{DeviceToken: token})
+		rr := httptest.NewRecorder()
+		srv.validateDeviceToken(rr, httptest.NewRequest("POST", "/register/validate", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		var result TokenValidationResult
+		json.NewDecoder(rr.Body).Decode(&result)
+		return result
+	}
+
+	if result := validate(testDeviceToken); !result.Valid {
+		t.Errorf("Expected token to be valid, got %+v", result)
+	}
+	if lastPushType != "background" || lastPriority != "5" {
+		t.Errorf("Expected silent background push, got type=%q priority=%q", lastPushType, lastPriority)
+	}
+
+	result := validate("bad-token")
+	if result.Valid || result.Reason != apns2.ReasonBadDeviceToken || result.Hint == "" {
+		t.Errorf("Expected BadDeviceToken with hint, got %+v", result)
+	}
+
+	// Missing token and missing APNs client
+	rr := httptest.NewRecorder()
+	srv.validateDeviceToken(rr, httptest.NewRequest("POST", "/register/validate", strings.NewReader(`{}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for missing token, got %d", rr.Code)
+	}
+
+	srv.apns = nil
+	rr = httptest.NewRecorder()
+	srv.validateDeviceToken(rr, httptest.NewRequest("POST", "/register/validate", strings.NewReader(`{"device_token":"abc"}`)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without APNs client, got %d", rr.Code)
+	}
+}
+
+// TestOnboardingFunnel tests funnel milestones and stats
+func TestOnboardingFunnel(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	twoDaysAgo := now.Add(-48 * time.Hour)
+
+	// Fully onboarded: pushed after 10 minutes, acked a minute later
+	srv.recordFunnelStep("1", funnelRegistered, twoDaysAgo)
+	srv.recordFunnelStep("1", funnelPushed, twoDaysAgo.Add(10*time.Minute))
+	srv.recordFunnelStep("1", funnelAcked, twoDaysAgo.Add(11*time.Minute))
+
+	// Pushed but never opened a notification
+	srv.recordFunnelStep("2", funnelRegistered, twoDaysAgo)
+	srv.recordFunnelStep("2", funnelPushed, twoDaysAgo.Add(30*time.Minute))
+
+	// Never pushed, and a fresh registration that hasn't stalled yet
+	srv.recordFunnelStep("3", funnelRegistered, twoDaysAgo)
+	srv.recordFunnelStep("4", funnelRegistered, now)
+
+	// Repeat steps keep the first timestamp; unknown users aren't tracked
+	srv.recordFunnelStep("1", funnelRegistered, now)
+	srv.recordFunnelStep("1", funnelPushed, now)
+	srv.recordFunnelStep("5", funnelAcked, now)
+
+	if got := srv.storage.shard("1").onboarding["1"].RegisteredAt; got != twoDaysAgo.Unix() {
+		t.Errorf("Expected first registration time to be kept, got %d", got)
+	}
+	if _, exists := srv.storage.shard("5").onboarding["5"]; exists {
+		t.Error("Expected ack from unregistered user to be ignored")
+	}
+
+	stats := srv.buildFunnelStats(now)
+	expected := FunnelStats{
+		Registered:               4,
+		Pushed:                   2,
+		Acked:                    1,
+		StalledBeforePush:        1,
+		StalledBeforeAck:         1,
+		MedianSecondsToFirstPush: 30 * 60,
+		MedianSecondsToFirstAck:  60,
+	}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	// The ack endpoint records the step
+	router := mux.NewRouter()
+	router.HandleFunc("/ack/{userID}", srv.acknowledgeNotification).Methods("POST")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/ack/2", nil))
+	if rr.Code != http.StatusNoContent || srv.storage.shard("2").onboarding["2"].FirstAckAt == 0 {
+		t.Errorf("Expected ack to be recorded, status %d", rr.Code)
+	}
+}
+
+// TestOGSHealthDegradation tests shedding optional features when OGS struggles
+func TestStartupComponents(t *testing.T) {
+	srv := newTestServer(t)
+
+	health := func() (string, map[string]ComponentStatus) {
+		rr := httptest.NewRecorder()
+		srv.healthCheck(rr, httptest.NewRequest("GET", "/health", nil))
+		var result struct {
+			Status     string                     `json:"status"`
+			Components map[string]ComponentStatus `json:"components"`
+		}
+		json.NewDecoder(rr.Body).Decode(&result)
+		return result.Status, result.Components
+	}
+
+	// Without credentials, a required APNs stops startup
+	defer os.Setenv("GOOGLE_CLOUD_PROJECT", os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	if err := srv.startPushProviders(startupConfig{apnsRequired: true}); err == nil {
+		t.Fatal("Expected startup to fail without APNs")
+	}
+	if status, _ := health(); status != componentOK {
+		t.Errorf("Expected a healthy server before any component degrades, got %s", status)
+	}
+
+	// An optional one leaves the server running, degraded
+	if err := srv.startPushProviders(startupConfig{apnsRequired: false}); err != nil {
+		t.Fatalf("Expected startup to continue without an optional APNs, got %v", err)
+	}
+	if status, components := health(); status != componentDegraded || components["apns"].Status != componentDegraded {
+		t.Errorf("Expected APNs to be reported degraded, got %s %+v", status, components)
+	}
+}
+
+func TestOGSHealthDegradation(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+
+	// Too few samples to judge, even if they all fail
+	for i := 0; i < ogsHealthMinSamples-1; i++ {
+		srv.ogsHealth.record(100*time.Millisecond, true, now)
+	}
+	if !srv.optionalFeatureEnabled("game_results") {
+		t.Error("Expected features enabled with too few samples")
+	}
+
+	srv.ogsHealth.record(100*time.Millisecond, true, now)
+	if srv.optionalFeatureEnabled("game_results") {
+		t.Error("Expected game results disabled while OGS is failing")
+	}
+	if !srv.optionalFeatureEnabled("turn_notifications") {
+		t.Error("Expected non-optional features to stay enabled")
+	}
+
+	rr := httptest.NewRecorder()
+	srv.getStatus(rr, httptest.NewRequest("GET", "/status", nil))
+	var status ServerStatus
+	json.NewDecoder(rr.Body).Decode(&status)
+	if !status.Degraded || len(status.DisabledFeatures) == 0 || status.OGS.ErrorRate != 1 {
+		t.Errorf("Expected degraded status, got %+v", status)
+	}
+
+	// Once the failures age out and requests are healthy, features come back
+	later := now.Add(ogsHealthWindow + time.Minute)
+	for i := 0; i < ogsHealthMinSamples; i++ {
+		srv.ogsHealth.record(100*time.Millisecond, false, later)
+	}
+	if !srv.optionalFeatureEnabled("game_results") {
+		t.Error("Expected features re-enabled after recovery")
+	}
+
+	// Slow but successful responses also degrade
+	for i := 0; i < ogsHealthMinSamples*2; i++ {
+		srv.ogsHealth.record(10*time.Second, false, later)
+	}
+	if srv.optionalFeatureEnabled("game_results") {
+		t.Error("Expected game results disabled while OGS is slow")
+	}
+}
+
+// TestOGSCircuitBreaker tests that OGS requests stop after failures in a row
+// and resume once a probe succeeds
+func TestOGSCircuitBreaker(t *testing.T) {
+	srv := newTestServer(t)
+
+	t.Setenv("OGS_BREAKER_FAILURES", "3")
+
+	var requests atomic.Int32
+	status := http.StatusInternalServerError
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	defer ogs.Close()
+
+	for i := 0; i < 3; i++ {
+		if resp, err := srv.ogsGet(ogs.URL); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if _, err := srv.ogsGet(ogs.URL); !errors.Is(err, errOGSUnavailable) || requests.Load() != 3 {
+		t.Fatalf("Expected the circuit to open after 3 failures, got %v after %d requests", err, requests.Load())
+	}
+	if srv.ogsBreaker.trips.Load() != 1 || srv.ogsBreaker.openUntilTime(time.Now()).IsZero() {
+		t.Error("Expected one trip and an open circuit")
+	}
+
+	// Once the period is up, one probe goes through; a failure keeps it open
+	later := time.Now().Add(ogsBreakerOpenTime() + time.Second)
+	if !srv.ogsBreaker.allow(later) || srv.ogsBreaker.allow(later) {
+		t.Fatal("Expected exactly one probe after the open period")
+	}
+	srv.ogsBreaker.record(true, later)
+	if srv.ogsBreaker.openUntilTime(later).IsZero() {
+		t.Error("Expected a failed probe to keep the circuit open")
+	}
+
+	// A successful probe closes it
+	later = later.Add(ogsBreakerOpenTime() + time.Second)
+	if !srv.ogsBreaker.allow(later) {
+		t.Fatal("Expected a second probe")
+	}
+	srv.ogsBreaker.record(false, later)
+	status = http.StatusOK
+	if resp, err := srv.ogsGet(ogs.URL); err != nil {
+		t.Errorf("Expected requests to flow after a successful probe, got %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if srv.ogsBreaker.trips.Load() != 1 {
+		t.Errorf("Expected a failed probe not to count as a new trip, got %d", srv.ogsBreaker.trips.Load())
+	}
+}
+
+// TestOGSConcurrencyLimit tests that outbound OGS requests share a concurrency ceiling
+func TestOGSConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.ogsSlots = make(chan struct{}, 2)
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := srv.ogsGet(server.URL)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("Expected at most 2 concurrent OGS requests, saw %d", maxActive)
+	}
+	if len(srv.ogsSlots) != 0 {
+		t.Errorf("Expected all slots released, %d still held", len(srv.ogsSlots))
+	}
+}
+
+// TestOverdueCheckWarnings tests last-successful-check tracking and overdue warnings
+func TestOverdueCheckWarnings(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	srv.storage.shard("100").deviceTokens["100"] = testDeviceToken
+	srv.storage.shard("200").deviceTokens["200"] = testDeviceToken
+	srv.storage.shard("300").deviceTokens["300"] = testDeviceToken
+
+	// 100 is healthy, 200's checks stopped succeeding, 300 never succeeded since registering
+	srv.recordSuccessfulCheck("100", now)
+	srv.recordSuccessfulCheck("200", now.Add(-10*checkInterval()))
+	srv.recordFunnelStep("300", funnelRegistered, now.Add(-10*checkInterval()))
+
+	var warned []string
+	send := func(userID, title, body, action string, custom map[string]interface{}) error {
+		warned = append(warned, userID)
+		return nil
+	}
+
+	if count := srv.warnOverdueChecks(now, send); count != 2 {
+		t.Errorf("Expected 2 overdue users, got %d (%v)", count, warned)
+	}
+
+	// Warnings go out once per outage
+	if count := srv.warnOverdueChecks(now.Add(time.Minute), send); count != 0 {
+		t.Errorf("Expected no repeat warnings, got %d", count)
+	}
+
+	// A successful check clears the warning state
+	srv.recordSuccessfulCheck("200", now)
+	if srv.storage.shard("200").checkHealth["200"].WarnedAt != 0 {
+		t.Error("Expected success to clear the warning")
+	}
+	if checkOverdue(srv.storage.shard("200").checkHealth["200"].LastSuccess, now) {
+		t.Error("Expected user to no longer be overdue")
+	}
+
+	// Diagnostics report the real last successful check
+	diagnostics := srv.buildUserDiagnostics(300, nil)
+	if diagnostics.LastServerCheckTime == 0 || !diagnostics.CheckOverdue {
+		t.Errorf("Expected diagnostics to show an overdue check, got %+v", diagnostics)
+	}
+}
+
+// TestTurnUrgency tests age buckets and approaching-timeout flags
+func TestTurnUrgency(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	userID := 100
+
+	game := func(id, currentPlayer int, waiting, timeLeft time.Duration) Game {
+		g := Game{ID: id}
+		g.JSON.Clock.CurrentPlayer = currentPlayer
+		g.JSON.Clock.LastMove = now.Add(-waiting).UnixMilli()
+		g.JSON.Clock.Expiration = now.Add(timeLeft).UnixMilli()
+		return g
+	}
+
+	games := []Game{
+		game(1, userID, 2*time.Hour, 5*24*time.Hour),
+		game(2, userID, 2*24*time.Hour, 12*time.Hour),
+		game(3, userID, 5*24*time.Hour, 10*24*time.Hour),
+		game(4, 200, time.Hour, time.Hour), // opponent's clock is running
+	}
+	status := &TurnStatus{YourTurnOld: []int{1, 2, 3}, NotYourTurn: []int{4}}
+
+	addTurnUrgency(status, userID, games, now)
+
+	buckets := status.YourTurnOldByAge
+	if fmt.Sprint(buckets.UnderOneDay, buckets.OneToThreeDays, buckets.OverThreeDays) != "[1] [2] [3]" {
+		t.Errorf("Unexpected buckets: %+v", buckets)
+	}
+	if fmt.Sprint(status.TimeoutSoon) != "[2]" {
+		t.Errorf("Expected only game 2 to be approaching timeout, got %v", status.TimeoutSoon)
+	}
+}
+
+// TestRouterGroups tests that routes inherit their group's middleware
+func TestRouterGroups(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.limiters = newClientLimiters(3)
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	router := srv.newRouter()
+
+	serve := func(method, path, remoteAddr string, header map[string]string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// User routes reject invalid IDs before reaching the handler
+	if code := serve("POST", "/ack/not-a-user", "10.0.0.1:1234", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid user ID, got %d", code)
+	}
+
+	// Admin routes require the token
+	if code := serve("GET", "/admin/funnel", "10.0.0.2:1234", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin token, got %d", code)
+	}
+	if code := serve("GET", "/admin/funnel", "10.0.0.2:1234", map[string]string{"Authorization": "Bearer secret"}); code != http.StatusOK {
+		t.Errorf("Expected 200 with admin token, got %d", code)
+	}
+
+	// Method mismatches and unknown paths
+	if code := serve("DELETE", "/health", "10.0.0.3:1234", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", code)
+	}
+	if code := serve("GET", "/nope", "10.0.0.3:1234", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", code)
+	}
+
+	// Public routes are rate limited per client; internal routes aren't
+	for i := 0; i < 3; i++ {
+		if code := serve("GET", "/health", "10.0.0.4:1234", nil); code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i, code)
+		}
+	}
+	if code := serve("GET", "/health", "10.0.0.4:1234", nil); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after the burst, got %d", code)
+	}
+	if code := serve("GET", "/health", "10.0.0.5:1234", nil); code != http.StatusOK {
+		t.Errorf("Expected other clients to be unaffected, got %d", code)
+	}
+	if code := serve("GET", "/metrics", "10.0.0.4:1234", nil); code != http.StatusOK {
+		t.Errorf("Expected metrics to skip rate limiting, got %d", code)
+	}
+}
+
+// TestRecoveryMiddleware tests that handler panics become 500s
+func TestRecoveryMiddleware(t *testing.T) {
+	t.Parallel()
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", rr.Code)
+	}
+}
+
+// TestUserscriptTurnSummary tests the userscript polling contract
+func TestUserscriptTurnSummary(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	router := srv.newRouter()
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "10.1.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Only the holder of the registered device token gets a token
+	rr := serve(httptest.NewRequest("POST", "/userscript/token", strings.NewReader(`{"user_id":"12345","device_token":"wrong"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong device token, got %d", rr.Code)
+	}
+	rr = serve(httptest.NewRequest("POST", "/userscript/token", strings.NewReader(`{"user_id":"12345","device_token":"`+testDeviceToken+`"}`)))
+	var issued map[string]string
+	json.NewDecoder(rr.Body).Decode(&issued)
+	token := issued["token"]
+	if rr.Code != http.StatusOK || token == "" {
+		t.Fatalf("Expected token to be issued, got %d", rr.Code)
+	}
+	if srv.storage.shard("12345").userscriptTokens["12345"] == token {
+		t.Error("Expected only the token hash to be stored")
+	}
+
+	older, newer := Game{ID: 1, Name: "Older"}, Game{ID: 2, Name: "Newer"}
+	older.JSON.Clock.LastMove = 1000
+	newer.JSON.Clock.LastMove = 2000
+	srv.recordTurnSummary("12345", &TurnStatus{YourTurnNew: []int{2}, YourTurnOld: []int{1}, NotYourTurn: []int{3}}, []Game{older, newer}, time.Now())
+
+	// Wrong token, then the token in the query string
+	if rr := serve(httptest.NewRequest("GET", "/userscript/12345/turns?token=nope", nil)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for bad token, got %d", rr.Code)
+	}
+	rr = serve(httptest.NewRequest("GET", "/userscript/12345/turns?token="+token, nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Expected CORS-enabled 200, got %d", rr.Code)
+	}
+	var summary TurnSummary
+	json.NewDecoder(rr.Body).Decode(&summary)
+	if summary.YourTurn != 2 || summary.YourTurnNew != 1 || summary.NewestGame == nil || summary.NewestGame.GameID != 2 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+
+	// Unchanged state polls as 304
+	req := httptest.NewRequest("GET", "/userscript/12345/turns?token="+token, nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	if rr := serve(req); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching ETag, got %d", rr.Code)
+	}
+
+	// CORS preflight for header-based tokens
+	if rr := serve(httptest.NewRequest("OPTIONS", "/userscript/12345/turns", nil)); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 preflight, got %d", rr.Code)
+	}
+}
+
+// TestNtfyChannel tests subscribing a user to an ntfy topic and delivering to it
+func TestNtfyChannel(t *testing.T) {
+	srv := newTestServer(t)
+
+	for topic, valid := range map[string]bool{
+		"ogs-alerts_42":                  true,
+		"https://ntfy.example.com/ogs":   true,
+		"bad topic":                      false,
+		"http://ntfy.example.com/ogs":    false,
+		"ftp://ntfy.example.com/ogs":     false,
+		"https://ntfy.example.com/a?x=1": false,
+	} {
+		if _, err := ntfyTopicURL(topic); (err == nil) != valid {
+			t.Errorf("ntfyTopicURL(%q): expected valid=%v, got %v", topic, valid, err)
+		}
+	}
+
+	var published []*http.Request
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		published = append(published, r)
+	}))
+	defer ntfy.Close()
+
+	// Topic URLs users give can't reach the server's own network
+	t.Setenv("NTFY_SERVER", ntfy.URL)
+	if err := publishNtfy(ntfy.URL+"/ogs", "Test", "Test", ""); err != nil {
+		t.Fatalf("Expected the configured ntfy server to be reachable, got %v", err)
+	}
+	t.Setenv("NTFY_SERVER", "https://ntfy.example.com")
+	if _, err := ntfyTopicURL(ntfy.URL + "/ogs"); err == nil {
+		t.Error("Expected an http topic URL on another server to be refused")
+	}
+	if err := publishNtfy(ntfy.URL+"/ogs", "Test", "Test", ""); err == nil {
+		t.Error("Expected publishing to a loopback address to be refused")
+	}
+	t.Setenv("NTFY_SERVER", ntfy.URL)
+	published = nil
+
+	router := srv.newRouter()
+	req := httptest.NewRequest("PUT", "/ntfy/12345", strings.NewReader(`{"topic":"`+ntfy.URL+`/ogs"}`))
+	req.RemoteAddr = "10.2.0.1:1234"
+	req.Header.Set(ogsAccessTokenHeader, fakeOGSAccount(t, "12345"))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || srv.storage.shard("12345").ntfyTopics["12345"] != ntfy.URL+"/ogs" {
+		t.Fatalf("Expected topic to be saved, got %d", rr.Code)
+	}
+	if len(published) != 1 {
+		t.Fatalf("Expected a test notification, got %d", len(published))
+	}
+
+	// ntfy-only users are checked and notified without a device token
+	if !srv.storage.notifiedUsers()["12345"] {
+		t.Error("Expected ntfy-only user to be checked")
+	}
+	if err := srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result"); err != nil {
+		t.Fatalf("Expected ntfy delivery without APNs, got %v", err)
+	}
+	last := published[len(published)-1]
+	if last.Header.Get("Title") != "Game finished" || last.Header.Get("Click") != "https://online-go.com/game/987" {
+		t.Errorf("Unexpected ntfy headers: %v", last.Header)
+	}
+}
+
+func TestWebPushChannel(t *testing.T) {
+	srv := newTestServer(t)
+
+	vapidKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	sender, err := newWebPushSender(base64.RawURLEncoding.EncodeToString(vapidKey.Bytes()), "mailto:ops@example.com")
+	if err != nil {
+		t.Fatalf("Expected the VAPID key to load, got %v", err)
+	}
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := []byte("sixteen byte key")
+
+	// The push service checks the VAPID signature, and the browser decrypts
+	var received []WebPushMessage
+	gone := false
+	pushService := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token, key string
+		fmt.Sscanf(strings.ReplaceAll(r.Header.Get("Authorization"), ",", ""), "vapid t=%s k=%s", &token, &key)
+		parts := strings.Split(token, ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(parts) != 3 || len(signature) != 64 || key != base64.RawURLEncoding.EncodeToString(sender.publicKey) ||
+			!ecdsa.Verify(&sender.key.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if gone {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		salt, serverKey, ciphertext := body[:16], body[21:86], body[86:]
+		serverPublic, _ := ecdh.P256().NewPublicKey(serverKey)
+		shared, _ := browserKey.ECDH(serverPublic)
+		ikm := hkdfSHA256(authSecret, shared, append(append([]byte("WebPush: info\x00"), browserKey.PublicKey().Bytes()...), serverKey...), 32)
+		block, _ := aes.NewCipher(hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+		gcm, _ := cipher.NewGCM(block)
+		plaintext, err := gcm.Open(nil, hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), ciphertext, nil)
+		if err != nil || r.Header.Get("Content-Encoding") != "aes128gcm" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var message WebPushMessage
+		json.Unmarshal(bytes.TrimSuffix(plaintext, []byte{2}), &message)
+		received = append(received, message)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+
+	// Endpoints come from browsers, so pushes can't reach the server's own network
+	var loopback WebPushSubscription
+	loopback.Endpoint = pushService.URL + "/push/abc"
+	loopback.Keys.P256dh = base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes())
+	loopback.Keys.Auth = base64.RawURLEncoding.EncodeToString(authSecret)
+	if err := sender.send(&loopback, WebPushMessage{Title: "Test"}); err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("Expected a push to a loopback endpoint to be refused, got %v", err)
+	}
+
+	sender.client = pushService.Client()
+	srv.webPush = sender
+
+	subscription := fmt.Sprintf(`{"endpoint": "%s/push/abc", "keys": {"p256dh": "%s", "auth": "%s"}}`, pushService.URL,
+		base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(authSecret))
+	router := srv.newRouter()
+	preflight := httptest.NewRequest("OPTIONS", "/webpush/12345", nil)
+	preflight.RemoteAddr = "10.2.0.2:1234"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, preflight)
+	if rr.Code != http.StatusNoContent || !strings.Contains(rr.Header().Get("Access-Control-Allow-Headers"), ogsAccessTokenHeader) {
+		t.Errorf("Expected the preflight to allow the token header, got %d %q", rr.Code, rr.Header().Get("Access-Control-Allow-Headers"))
+	}
+
+	req := httptest.NewRequest("PUT", "/webpush/12345", strings.NewReader(subscription))
+	req.RemoteAddr = "10.2.0.2:1234"
+	req.Header.Set(ogsAccessTokenHeader, fakeOGSAccount(t, "12345"))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "*" || len(received) != 1 {
+		t.Fatalf("Expected the subscription saved after a test push, got %d and %d pushes", rr.Code, len(received))
+	}
+
+	// Browser-only users are checked and notified without a device token
+	if !srv.storage.notifiedUsers()["12345"] {
+		t.Error("Expected a browser-only user to be checked")
+	}
+	if err := srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result"); err != nil {
+		t.Fatalf("Expected web push delivery without APNs, got %v", err)
+	}
+	if last := received[len(received)-1]; last.Title != "Game finished" || last.URL != "https://online-go.com/game/987" || last.GameID != 987 {
+		t.Errorf("Unexpected web push message: %+v", last)
+	}
+
+	// A subscription the push service has dropped is removed
+	gone = true
+	if err := srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result"); err == nil {
+		t.Error("Expected delivery to an expired subscription to fail")
+	}
+	if srv.storage.shard("12345").webPushSubscriptions["12345"] != nil {
+		t.Error("Expected the expired subscription to be removed")
+	}
+}
+
+// TestNotificationPreview tests rendering notifications without sending them
+func TestNotificationPreview(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	router := srv.newRouter()
+	preview := func(body string) (int, NotificationPreview) {
+		req := httptest.NewRequest("POST", "/preview-notification", strings.NewReader(body))
+		req.RemoteAddr = "10.3.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var result NotificationPreview
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr.Code, result
+	}
+
+	code, result := preview(`{"new_turns":[{"game_id":42,"name":"Friendly match"}]}`)
+	if code != http.StatusOK || result.Decision != "send" {
+		t.Fatalf("Expected a send preview, got %d %q", code, result.Decision)
+	}
+	var apns struct {
+		APS struct {
+			Alert struct {
+				Title string `json:"title"`
+				Body  string `json:"body"`
+			} `json:"alert"`
+			Badge int `json:"badge"`
+		} `json:"aps"`
+		AppURL string `json:"app_url"`
+	}
+	json.Unmarshal(result.APNs, &apns)
+	if apns.APS.Alert.Body != "It's your turn in: Friendly match" || apns.APS.Badge != 1 || apns.AppURL != "ogs://game/42" {
+		t.Errorf("Unexpected APNs payload: %s", result.APNs)
+	}
+	if result.Ntfy == nil || result.Ntfy.Headers["Click"] != "https://online-go.com/game/42" {
+		t.Errorf("Unexpected ntfy preview: %+v", result.Ntfy)
+	}
+
+	// Known opponents and move numbers replace the game name
+	_, result = preview(`{"new_turns":[{"game_id":42,"name":"Friendly match","opponent":"PlayerX","move_number":57}]}`)
+	if result.Ntfy == nil || result.Ntfy.Body != "Your turn vs. PlayerX (move 57)" {
+		t.Errorf("Expected the opponent and move number, got %+v", result.Ntfy)
+	}
+	if !strings.Contains(string(result.APNs), `"opponent_name":"PlayerX"`) || !strings.Contains(string(result.APNs), `"move_number":57`) {
+		t.Errorf("Expected the opponent and move number in the APNs payload, got %s", result.APNs)
+	}
+
+	// Preferences drive grouping and the daily cap
+	_, result = preview(`{"new_turns":[{"game_id":1},{"game_id":2}],"waiting_games":30,"preferences":{"high_volume_mode":"on"}}`)
+	if !result.HighVolume || result.Ntfy.Body != "2 new turn(s), 30 games waiting for your move" {
+		t.Errorf("Expected grouped notification, got %+v", result.Ntfy)
+	}
+	_, result = preview(`{"new_turns":[{"game_id":1}],"sent_today":5,"preferences":{"daily_notification_cap":5}}`)
+	if result.Decision != "overflow" || result.Ntfy.Body != "1 more game awaits you" {
+		t.Errorf("Expected overflow notification, got %q", result.Decision)
+	}
+	_, result = preview(`{"new_turns":[{"game_id":1}],"sent_today":5,"overflow_sent":true,"preferences":{"daily_notification_cap":5}}`)
+	if result.Decision != "suppressed" || result.APNs != nil {
+		t.Errorf("Expected suppressed preview without payloads, got %q", result.Decision)
+	}
+
+	if code, _ := preview(`{"new_turns":[]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without games, got %d", code)
+	}
+	if len(srv.storage.snapshot().DailyCounts) != 0 {
+		t.Error("Preview should not touch storage")
+	}
+}
+
+// TestAPNsFaultInjection tests that configured faults replace APNs responses
+func TestAPNsFaultInjection(t *testing.T) {
+	if _, injected, _ := injectAPNsFault(0); injected {
+		t.Error("Expected no faults without APNS_FAULT_RATE")
+	}
+
+	t.Setenv("APNS_FAULT_RATE", "0.5")
+	t.Setenv("APNS_FAULT_REASONS", "Unregistered, SendError, NotAReason")
+
+	if _, injected, _ := injectAPNsFault(0.5); injected {
+		t.Error("Expected rolls at or above the rate to reach APNs")
+	}
+	res, injected, err := injectAPNsFault(0.1)
+	if !injected || err != nil || res.Sent() || res.StatusCode != http.StatusGone || res.Reason != apns2.ReasonUnregistered {
+		t.Errorf("Expected an injected Unregistered response, got %+v, %v", res, err)
+	}
+	if _, injected, err := injectAPNsFault(0.4); !injected || err == nil {
+		t.Error("Expected an injected send error")
+	}
+
+	// Never in production
+	t.Setenv("ENVIRONMENT", "production")
+	if _, injected, _ := injectAPNsFault(0); injected {
+		t.Error("Expected fault injection to be refused in production")
+	}
+}
+
+// TestAPNsTopic tests the configured topic and its check against the bundle ID
+func TestAPNsTopic(t *testing.T) {
+	t.Setenv("APNS_TOPIC", "")
+	t.Setenv("APNS_BUNDLE_ID", "")
+	if topic := apnsTopic(); topic != defaultAPNsTopic {
+		t.Errorf("Expected the default topic, got %q", topic)
+	}
+	t.Setenv("APNS_BUNDLE_ID", "org.example.go")
+	if topic := apnsTopic(); topic != "org.example.go" {
+		t.Errorf("Expected the bundle ID as topic, got %q", topic)
+	}
+	t.Setenv("APNS_TOPIC", "org.example.go.voip")
+	if topic := apnsTopic(); topic != "org.example.go.voip" {
+		t.Errorf("Expected the configured topic, got %q", topic)
+	}
+	if alert := (turnAlert{Title: "Your turn"}).apnsNotification(testDeviceToken); alert.Topic != "org.example.go.voip" {
+		t.Errorf("Expected pushes to use the configured topic, got %q", alert.Topic)
+	}
+
+	for _, topic := range []string{"org.example.go", "org.example.go.complication", "org.example.go\n"} {
+		if err := validateAPNsTopic(topic, "org.example.go"); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", topic, err)
+		}
+	}
+	for _, topic := range []string{defaultAPNsTopic, "org.example.gopher", "org.example.go.widget"} {
+		if err := validateAPNsTopic(topic, "org.example.go"); err == nil {
+			t.Errorf("Expected %q to be rejected", topic)
+		}
+	}
+}
+
+// TestAPNsEnvironmentPerDevice tests that devices are pushed to the APNs environment they registered with
+func TestAPNsEnvironmentPerDevice(t *testing.T) {
+	srv := newTestServer(t)
+	fakeOGSAccount(t, "")
+
+	pushes := map[string]int{}
+	fakeAPNs := func(environment string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pushes[environment]++
+			w.Header().Set("apns-id", "test-id")
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	sandbox, production := fakeAPNs(apnsSandbox), fakeAPNs(apnsProduction)
+	defer sandbox.Close()
+	defer production.Close()
+
+	originalHosts := apnsHosts
+	defer func() { apnsHosts = originalHosts }()
+	apnsHosts = map[string]string{apnsSandbox: sandbox.URL, apnsProduction: production.URL}
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: production.URL, HTTPClient: http.DefaultClient})
+
+	register := func(userID, environment string) int {
+		body, _ := json.Marshal(DeviceRegistration{UserID: userID, DeviceToken: testDeviceToken, APNsEnvironment: environment, OGSAccessToken: "token-" + userID})
+		w := httptest.NewRecorder()
+		srv.registerDevice(w, httptest.NewRequest("POST", "/register", bytes.NewReader(body)))
+		return w.Code
+	}
+	if code := register("1", "beta"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown environment to be refused, got %d", code)
+	}
+	if register("1", apnsSandbox) != http.StatusOK || register("2", "") != http.StatusOK {
+		t.Fatal("Expected both devices to register")
+	}
+
+	for _, userID := range []string{"1", "2"} {
+		if err := srv.sendGamePushNotification(userID, 987, "Game finished", "You won", "game_result"); err != nil {
+			t.Fatalf("Expected the push to user %s to be sent, got %v", userID, err)
+		}
+	}
+	if pushes[apnsSandbox] != 1 || pushes[apnsProduction] != 1 {
+		t.Errorf("Expected one push to each environment, got %v", pushes)
+	}
+
+	// Registering again without an environment goes back to the server's
+	register("1", "")
+	if _, set := srv.storage.shard("1").deviceEnvironments["1"]; set {
+		t.Error("Expected the device's environment to be cleared")
+	}
+}
+
+// TestAPNsDeliveryOptions tests push type, priority and expiration per event
+func TestAPNsDeliveryOptions(t *testing.T) {
+	now := time.Now()
+	game := Game{ID: 1, Name: "Friendly game"}
+	game.JSON.Clock.Expiration = now.Add(2 * time.Hour).UnixMilli()
+
+	notification := buildTurnAlert(1, []Game{game}, 0, budgetSend, "").apnsNotification(testDeviceToken)
+	if notification.PushType != apns2.PushTypeAlert || notification.Priority != apns2.PriorityHigh {
+		t.Errorf("Expected an alert at priority 10, got %s at %d", notification.PushType, notification.Priority)
+	}
+	if notification.Expiration.Unix() != now.Add(2*time.Hour).Unix() {
+		t.Errorf("Expected the push to expire with the clock, got %v", notification.Expiration)
+	}
+	if untimed := buildTurnAlert(1, []Game{{ID: 2}}, 0, budgetSend, "").apnsNotification(testDeviceToken); untimed.Expiration.Sub(now) < 23*time.Hour {
+		t.Errorf("Expected the default expiration without a clock, got %v", untimed.Expiration)
+	}
+
+	t.Setenv("APNS_LOW_PRIORITY_EVENTS", "chat, clock_resumed")
+	chat := &apns2.Notification{}
+	setAPNsDelivery(chat, eventChat, time.Time{}, now)
+	if chat.Priority != apns2.PriorityLow || chat.PushType != apns2.PushTypeAlert {
+		t.Errorf("Expected chat as a priority 5 alert, got %s at %d", chat.PushType, chat.Priority)
+	}
+
+	t.Setenv("APNS_BACKGROUND_EVENTS", "turn")
+	t.Setenv("APNS_EXPIRATION_HOURS", "0")
+	notification = buildTurnAlert(1, []Game{game}, 0, budgetSend, "").apnsNotification(testDeviceToken)
+	body, _ := json.Marshal(notification.Payload)
+	if notification.PushType != apns2.PushTypeBackground || notification.Priority != apns2.PriorityLow {
+		t.Errorf("Expected a priority 5 background push, got %s at %d", notification.PushType, notification.Priority)
+	}
+	if !strings.Contains(string(body), `"content-available":1`) || strings.Contains(string(body), `"alert"`) || strings.Contains(string(body), `"badge"`) {
+		t.Errorf("Expected a silent payload, got %s", body)
+	}
+	if notification.Expiration.Unix() != 0 {
+		t.Errorf("Expected APNs not to store the push, got %v", notification.Expiration)
+	}
+}
+
+// TestBoardImage tests rendering a game's board from its SGF for rich notifications
+func TestBoardImage(t *testing.T) {
+	srv := newTestServer(t)
+
+	board, err := boardFromSGF("(;GM[1]SZ[9]AB[cc][gg]C[a \\] comment];B[ba];W[aa];B[ab](;W[ee])(;W[ff]))")
+	if err != nil {
+		t.Fatalf("Expected the SGF to parse, got %v", err)
+	}
+	if board.width != 9 || board.stones[0][0] != 0 || board.stones[2][2] != stoneBlack || board.stones[4][4] != stoneWhite || board.stones[5][5] != 0 {
+		t.Errorf("Expected the main line played with the capture, got %v", board.stones)
+	}
+	if board.lastX != 4 || board.lastY != 4 {
+		t.Errorf("Expected the last move at ee, got %d,%d", board.lastX, board.lastY)
+	}
+
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/games/4321/sgf" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("(;GM[1]SZ[9];B[ba])"))
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsGameSGFURL = url }(ogsGameSGFURL)
+	ogsGameSGFURL = ogs.URL + "/api/v1/games/%d/sgf"
+
+	router := srv.newRouter()
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.5.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("/board/4321.png")
+	img, err := png.Decode(rr.Body)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" || err != nil {
+		t.Fatalf("Expected a PNG, got %d: %v", rr.Code, err)
+	}
+	if img.Bounds().Dx() != 240 {
+		t.Errorf("Expected a 9x9 board 240px wide, got %d", img.Bounds().Dx())
+	}
+	if r, g, b, _ := img.At(48+6, 24).RGBA(); r > 0x4000 || g > 0x4000 || b > 0x4000 {
+		t.Error("Expected a black stone at B2's point")
+	}
+	if rr := get("/board/999.png"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown game, got %d", rr.Code)
+	}
+
+	// Pushes link to the image once PUBLIC_URL is set
+	game := Game{ID: 4321}
+	body, _ := json.Marshal(buildTurnAlert(1, []Game{game}, 0, budgetSend, "").apnsNotification(testDeviceToken).Payload)
+	if strings.Contains(string(body), "image_url") {
+		t.Error("Expected no image without PUBLIC_URL")
+	}
+	t.Setenv("PUBLIC_URL", "https://push.example.com/")
+	body, _ = json.Marshal(buildTurnAlert(1, []Game{game}, 0, budgetSend, "").apnsNotification(testDeviceToken).Payload)
+	if !strings.Contains(string(body), `"mutable-content":1`) || !strings.Contains(string(body), `"image_url":"https://push.example.com/board/4321.png?move=0"`) {
+		t.Errorf("Expected a rich notification, got %s", body)
+	}
+}
+
+// TestDeadDeviceTokenRemoval tests that tokens APNs won't accept are removed
+func TestDeadDeviceTokenRemoval(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/uninstalled"):
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		case strings.HasSuffix(r.URL.Path, "/malformed"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		default:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"reason":"TooManyRequests"}`))
+		}
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+
+	srv.storage.shard("1").deviceTokens["1"] = "uninstalled"
+	srv.storage.shard("2").deviceTokens["2"] = "malformed"
+	srv.storage.shard("3").deviceTokens["3"] = "throttled"
+	for _, userID := range []string{"1", "2", "3"} {
+		if err := srv.sendGamePushNotification(userID, 987, "Game finished", "You won", "game_result"); err == nil {
+			t.Errorf("Expected the push to user %s to fail", userID)
+		}
+	}
+
+	users := srv.storage.notifiedUsers()
+	if users["1"] || users["2"] {
+		t.Errorf("Expected unregistered and invalid tokens to be removed, got %v", srv.storage.snapshot().DeviceTokens)
+	}
+	if !users["3"] {
+		t.Error("Expected a throttled token to be kept")
+	}
+
+	// A token registered again while the push was in flight is kept
+	srv.storage.shard("1").deviceTokens["1"] = "reinstalled"
+	if srv.removeDeadDeviceToken("1", "uninstalled", &apns2.Response{StatusCode: http.StatusGone, Reason: apns2.ReasonUnregistered}) {
+		t.Error("Expected a replaced token not to be removed")
+	}
+	if srv.storage.shard("1").deviceTokens["1"] != "reinstalled" {
+		t.Error("Expected the new token to be kept")
+	}
+}
+
+// TestPushRetryQueue tests that pushes failing on APNs's side are retried with backoff
+func TestPushRetryQueue(t *testing.T) {
+	srv := newTestServer(t)
+
+	apnsDown := true
+	var lastPayload string
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apnsDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"reason":"ServiceUnavailable"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		lastPayload = string(body)
+		w.Header().Set("apns-id", "test-id")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+
+	err := srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result")
+	if !errors.Is(err, errPushQueued) || len(srv.storage.shard("12345").pushRetries["12345"]) != 1 {
+		t.Fatalf("Expected the push to be queued, got %v", err)
+	}
+
+	// Retried once due, backing off after each failure
+	now := time.Now()
+	if srv.processDuePushRetries(now, srv.retryUserPush); srv.storage.shard("12345").pushRetries["12345"][0].Attempts != 1 {
+		t.Error("Expected no retry before the first delay")
+	}
+	srv.processDuePushRetries(now.Add(31*time.Second), srv.retryUserPush)
+	retry := srv.storage.shard("12345").pushRetries["12345"][0]
+	if retry.Attempts != 2 || retry.NextAttemptAt != now.Add(91*time.Second).Unix() {
+		t.Errorf("Expected a second attempt and a 60s backoff, got %+v", retry)
+	}
+
+	apnsDown = false
+	if delivered := srv.processDuePushRetries(now.Add(2*time.Minute), srv.retryUserPush); delivered != 1 {
+		t.Fatalf("Expected the retry to be delivered, got %d", delivered)
+	}
+	if len(srv.storage.snapshot().PushRetries) != 0 || !strings.Contains(lastPayload, `"game_id":987`) {
+		t.Errorf("Expected the delivered push removed with its payload intact, got %s", lastPayload)
+	}
+
+	// Dropped after the last attempt
+	t.Setenv("PUSH_RETRY_MAX_ATTEMPTS", "2")
+	apnsDown = true
+	srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result")
+	srv.processDuePushRetries(time.Now().Add(time.Minute), srv.retryUserPush)
+	if len(srv.storage.snapshot().PushRetries) != 0 {
+		t.Error("Expected the push to be dropped after its last attempt")
+	}
+}
+
+// TestNotificationKillSwitch tests that turning notifications off stops every channel
+func TestNotificationKillSwitch(t *testing.T) {
+	srv := newTestServer(t)
+
+	var published int
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		published++
+	}))
+	defer ntfy.Close()
+	t.Setenv("NTFY_SERVER", ntfy.URL)
+	srv.storage.shard("12345").ntfyTopics["12345"] = ntfy.URL + "/ogs"
+
+	router := srv.newRouter()
+	accessToken := fakeOGSAccount(t, "12345")
+	set := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/notifications/12345", strings.NewReader(body))
+		req.RemoteAddr = "10.4.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, accessToken)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := set(`{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without notifications_enabled, got %d", rr.Code)
+	}
+	rr := set(`{"notifications_enabled": false}`)
+	var state NotificationSwitch
+	json.NewDecoder(rr.Body).Decode(&state)
+	if rr.Code != http.StatusOK || state.NotificationsEnabled || state.DisabledAt == 0 {
+		t.Fatalf("Expected notifications to be off, got %d %+v", rr.Code, state)
+	}
+
+	if err := srv.sendGamePushNotification("12345", 1, "Reminder", "body", "reminder"); err == nil {
+		t.Error("Expected single pushes to be refused")
+	}
+
+	// New turns are marked seen without sending
+	game := Game{ID: 7, Name: "Test"}
+	game.JSON.Clock.LastMove = 5000
+	reserved := srv.reserveNotification("12345", []Game{game})
+	srv.sendConsolidatedPushNotification("12345", reserved, 0)
+	if published != 0 {
+		t.Errorf("Expected nothing published, got %d", published)
+	}
+	if srv.storage.shard("12345").pendingNotifications["12345"] != nil || storedMove(srv, "12345", 7) != 5000 {
+		t.Error("Expected the turn to be committed as seen")
+	}
+
+	// Live Activities aren't updated either
+	var activityPushes int
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activityPushes++
+		w.Header().Set("apns-id", "test-id")
+	}))
+	defer apns.Close()
+	defer func(pool *apnsPool) { srv.apns = pool }(srv.apns)
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+	srv.storage.shard("12345").liveActivityTokens["12345"] = map[int]string{7: "activity-token"}
+	srv.updateLiveActivities("12345", 12345, []Game{game}, time.Now())
+	if srv.pushLiveActivity("12345", 7, "activity-token", "", liveActivityEnd(time.Now()), apns2.PriorityHigh) || activityPushes != 0 {
+		t.Errorf("Expected no Live Activity pushes, got %d", activityPushes)
+	}
+
+	set(`{"notifications_enabled": true}`)
+	if err := srv.sendGamePushNotification("12345", 1, "Reminder", "body", "reminder"); err != nil || published != 1 {
+		t.Errorf("Expected delivery once re-enabled, got %v", err)
+	}
+	srv.updateLiveActivities("12345", 12345, []Game{game}, time.Now())
+	if activityPushes != 1 {
+		t.Errorf("Expected the Live Activity to catch up once re-enabled, got %d pushes", activityPushes)
+	}
+}
+
+// TestSettingsDocument tests loading and saving all settings with version checks
+func TestSettingsDocument(t *testing.T) {
+	srv := newTestServer(t)
+
+	router := srv.newRouter()
+	accessToken := fakeOGSAccount(t, "12345")
+	serve := func(method, body string) (int, UserSettings) {
+		req := httptest.NewRequest(method, "/settings/12345", strings.NewReader(body))
+		req.RemoteAddr = "10.5.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, accessToken)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var settings UserSettings
+		json.NewDecoder(rr.Body).Decode(&settings)
+		return rr.Code, settings
+	}
+
+	code, settings := serve("GET", "")
+	if code != http.StatusOK || settings.Version != 0 || !settings.NotificationsEnabled || settings.DeviceRegistered {
+		t.Fatalf("Unexpected initial settings: %d %+v", code, settings)
+	}
+
+	code, settings = serve("PUT", `{"version":0,"notifications_enabled":false,"device_token":"`+testDeviceToken+`","preferences":{"daily_notification_cap":10}}`)
+	if code != http.StatusOK || settings.Version != 1 || settings.NotificationsEnabled || !settings.DeviceRegistered || settings.Preferences.DailyNotificationCap != 10 {
+		t.Fatalf("Unexpected saved settings: %d %+v", code, settings)
+	}
+	if settings.DeviceToken != "" {
+		t.Error("Device token should not be echoed back")
+	}
+
+	// Changes through individual endpoints bump the version too
+	req := httptest.NewRequest("PUT", "/preferences/12345", strings.NewReader(`{"daily_notification_cap":3}`))
+	req.RemoteAddr = "10.5.0.1:1234"
+	req.Header.Set(deviceTokenHeader, testDeviceToken)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	code, settings = serve("PUT", `{"version":1,"notifications_enabled":true}`)
+	if code != http.StatusConflict || settings.Version != 2 || settings.Preferences.DailyNotificationCap != 3 {
+		t.Errorf("Expected 409 with current settings for a stale version, got %d %+v", code, settings)
+	}
+	if srv.storage.shard("12345").settingsFor("12345").NotificationsEnabled {
+		t.Error("Stale save should not change settings")
+	}
+
+	if code, _ := serve("PUT", `{"version":2,"preferences":{"high_volume_mode":"sometimes"}}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid preferences, got %d", code)
+	}
+
+	// The other channels and the snooze are shown but only set on their own
+	// endpoints; the webhook secret never appears
+	srv.storage.shard("12345").userWebhooks["12345"] = &UserWebhook{URL: "https://example.com/hook", Secret: "s3cret"}
+	srv.storage.shard("12345").telegramChats["12345"] = 42
+	srv.storage.shard("12345").snoozes["12345"] = &Snooze{Games: map[int]int64{7: time.Now().Add(time.Hour).Unix(), 8: 1}}
+	code, settings = serve("PUT", `{"version":2,"notifications_enabled":true,"webhook_url":"https://evil.example","slack_connected":true,"snooze":{"until":9999999999}}`)
+	if code != http.StatusOK || settings.WebhookURL != "https://example.com/hook" || !settings.TelegramLinked || settings.SlackConnected || settings.WebPushSubscribed {
+		t.Errorf("Expected the read-only channels to be reported and kept, got %d %+v", code, settings)
+	}
+	if settings.Snooze == nil || settings.Snooze.Until != 0 || len(settings.Snooze.Games) != 1 {
+		t.Errorf("Expected the live game snooze only, got %+v", settings.Snooze)
+	}
+	req = httptest.NewRequest("GET", "/settings/12345", nil)
+	req.RemoteAddr = "10.5.0.1:1234"
+	req.Header.Set(ogsAccessTokenHeader, accessToken)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), "s3cret") {
+		t.Error("The webhook secret must not be in the settings document")
+	}
+
+	// Snoozing bumps the version
+	req = httptest.NewRequest("POST", "/snooze/12345", nil)
+	req.RemoteAddr = "10.5.0.1:1234"
+	req.Header.Set(deviceTokenHeader, testDeviceToken)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if _, settings = serve("GET", ""); settings.Version != 4 || settings.Snooze == nil || settings.Snooze.Until == 0 {
+		t.Errorf("Expected a snooze to bump the version, got %+v", settings)
+	}
+}
+
+// gamePhaseFixtures are trimmed OGS active_games entries in which user 12345
+// is current_player
+var gamePhaseFixtures = map[string]struct {
+	payload string
+	started bool
+}{
+	"playing":            {`{"id": 1, "json": {"phase": "play", "clock": {"current_player": 12345, "last_move": 1000}, "moves": [[3,3,0],[15,15,0]]}}`, true},
+	"scoring":            {`{"id": 2, "json": {"phase": "stone removal", "clock": {"current_player": 12345, "last_move": 1000}}}`, true},
+	"no phase":           {`{"id": 3, "json": {"clock": {"current_player": 12345, "last_move": 1000}}}`, true},
+	"awaiting start":     {`{"id": 4, "json": {"phase": "waiting", "clock": {"current_player": 12345, "last_move": 1000}, "moves": []}}`, false},
+	"placing handicap":   {`{"id": 5, "json": {"phase": "play", "handicap": 4, "free_handicap_placement": true, "clock": {"current_player": 12345, "last_move": 1000}, "moves": [[3,3,0],[15,15,0]]}}`, false},
+	"handicap placed":    {`{"id": 6, "json": {"phase": "play", "handicap": 2, "free_handicap_placement": true, "clock": {"current_player": 12345, "last_move": 1000}, "moves": [[3,3,0],[15,15,0]]}}`, true},
+	"fixed handicap":     {`{"id": 7, "json": {"phase": "play", "handicap": 4, "clock": {"current_player": 12345, "last_move": 1000}, "moves": []}}`, true},
+	"handicap, no moves": {`{"id": 8, "json": {"phase": "play", "handicap": 4, "free_handicap_placement": true, "clock": {"current_player": 12345, "last_move": 1000}}}`, true},
+}
+
+// TestGamePhaseGating tests that games still being set up aren't pushed
+func TestGamePhaseGating(t *testing.T) {
+	srv := newTestServer(t)
+
+	var games []Game
+	for name, fixture := range gamePhaseFixtures {
+		var game Game
+		if err := json.Unmarshal([]byte(fixture.payload), &game); err != nil {
+			t.Fatalf("%s: invalid fixture: %v", name, err)
+		}
+		if game.Started() != fixture.started {
+			t.Errorf("%s: expected started=%v", name, fixture.started)
+		}
+		games = append(games, game)
+	}
+
+	status, newTurnGames := srv.classifyTurns(12345, games)
+	if len(status.NotStarted) != 2 || len(newTurnGames) != 6 {
+		t.Errorf("Expected 2 games not started and 6 new turns, got %v and %d", status.NotStarted, len(newTurnGames))
+	}
+	for _, game := range newTurnGames {
+		if game.ID == 4 || game.ID == 5 {
+			t.Errorf("Game %d hasn't started and shouldn't be notified", game.ID)
+		}
+	}
+}
+
+func TestRengoTurnDetection(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	// Black is 101 and 102, white 201 and 202; OGS names the team captain
+	payload := `{"id": 9, "black": {"id": 101}, "white": {"id": 201, "username": "Captain"}, "json": {
+		"rengo": true,
+		"rengo_teams": {"black": [{"id": 101}, {"id": 102}], "white": [{"id": 201}, {"id": 202}]},
+		"clock": {"current_player": 101, "black_player_id": 101, "white_player_id": 201, "last_move": 1000},
+		"moves": [[3,3,1000], [15,15,1000]]}}`
+	var game Game
+	if err := json.Unmarshal([]byte(payload), &game); err != nil {
+		t.Fatalf("Invalid fixture: %v", err)
+	}
+
+	// Black's second move is 102's
+	if game.PlayerToMove() != 102 || game.IsTurnOf(101) {
+		t.Errorf("Expected 102 to move, got %d", game.PlayerToMove())
+	}
+	status, newTurnGames := srv.classifyTurns(102, []Game{game})
+	if len(newTurnGames) != 1 || len(status.YourTurnNew) != 1 {
+		t.Errorf("Expected a new turn for 102, got %+v", status)
+	}
+	if status, _ := srv.classifyTurns(101, []Game{game}); len(status.NotYourTurn) != 1 {
+		t.Errorf("Expected no turn for 101, got %+v", status)
+	}
+	if game.Opponent(102).Username != "Captain" || game.OpponentID(202) != 101 {
+		t.Errorf("Expected team members to play the other team, got %+v and %d", game.Opponent(102), game.OpponentID(202))
+	}
+
+	// White moves next in turn, and first after fixed handicap stones
+	game.JSON.Moves = append(game.JSON.Moves, json.RawMessage("[4,4,1000]"))
+	game.JSON.Clock.CurrentPlayer = 201
+	if game.PlayerToMove() != 202 {
+		t.Errorf("Expected 202 to move, got %d", game.PlayerToMove())
+	}
+	game.JSON.Handicap = 2
+	if game.PlayerToMove() != 201 {
+		t.Errorf("Expected 201 to move with white's third move, got %d", game.PlayerToMove())
+	}
+
+	// Games that aren't rengo go by current_player alone
+	game.JSON.Rengo = false
+	if !game.IsTurnOf(201) || game.IsTurnOf(202) {
+		t.Error("Expected current_player to decide the turn outside rengo")
+	}
+}
+
+// TestAsyncMetrics tests that queue depths and dropped events are exported
+func TestAsyncMetrics(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{PresenceHints: true}
+	srv.storage.shard("12345").pendingNotifications["12345"] = &PendingNotification{}
+	srv.storage.unlockAll()
+
+	// A stream that never reads fills its buffer, then drops events
+	ch := srv.presence.subscribe("12345")
+	defer srv.presence.unsubscribe("12345", ch)
+	dropped := presenceEventsDropped.Load()
+	for i := 0; i < cap(ch)+3; i++ {
+		srv.publishPresenceEvent("12345", PresenceEvent{Type: "opponent_online", OpponentID: 999})
+	}
+	if got := presenceEventsDropped.Load() - dropped; got != 3 {
+		t.Errorf("Expected 3 dropped presence events, got %d", got)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	srv.getMetrics(rr, req)
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"ogs_notifications_goroutines ",
+		`ogs_notifications_pending_notifications{state="queued"} 1`,
+		`ogs_notifications_pending_notifications{state="sending"} 0`,
+		"ogs_notifications_presence_streams 1",
+		`ogs_notifications_dropped_total{source="presence_event"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/slo/alert-rules", nil)
+	rr = httptest.NewRecorder()
+	getAlertRules(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "alert: OGSNotificationsGoroutineLeak") {
+		t.Error("Expected alert rules to include the goroutine leak alert")
+	}
+}
+
+// TestRenotifySelection tests which users and turns an incident re-notify covers
+func TestRenotifySelection(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	from, to := int64(1000), int64(2000)
+
+	srv.storage.lockAll()
+	srv.storage.shard("1").pendingNotifications["1"] = &PendingNotification{ReservedAt: 1500, LastError: "ExpiredProviderToken", Games: map[int]MoveState{10: {LastMove: 900000}}}
+	srv.storage.shard("2").pendingNotifications["2"] = &PendingNotification{ReservedAt: 1500} // reserved, never failed
+	srv.storage.shard("3").pushFailingSince["3"] = 1200
+	srv.storage.shard("4").pushFailingSince["4"] = 500 // failing since before the incident
+	pending := srv.storage.shard("1").pendingNotifications["1"].clone()
+	srv.storage.unlockAll()
+	candidates := srv.storage.renotifyCandidates(from, to)
+
+	if !reflect.DeepEqual(candidates, []string{"1", "3"}) {
+		t.Errorf("Expected users 1 and 3, got %v", candidates)
+	}
+
+	games := []Game{
+		{ID: 10, JSON: GameState{Clock: Clock{CurrentPlayer: 1, LastMove: 900000}}},  // before the window, but its push failed
+		{ID: 11, JSON: GameState{Clock: Clock{CurrentPlayer: 1, LastMove: 1100000}}}, // moved during the incident
+		{ID: 12, JSON: GameState{Clock: Clock{CurrentPlayer: 1, LastMove: 500000}}},  // old turn, already notified
+		{ID: 13, JSON: GameState{Clock: Clock{CurrentPlayer: 2, LastMove: 1100000}}}, // opponent's turn now
+	}
+	var ids []int
+	for _, game := range turnsAwaitingSince(1, games, from, pending) {
+		ids = append(ids, game.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{10, 11}) {
+		t.Errorf("Expected games 10 and 11, got %v", ids)
+	}
+
+	for _, body := range []string{`{"to": 2000}`, `{"from": 3000, "to": 2000}`, `{"from": 1000, "user_ids": ["abc"]}`} {
+		rr := httptest.NewRecorder()
+		srv.renotifyUsers(rr, httptest.NewRequest("POST", "/admin/renotify", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rr.Code)
+		}
+	}
+}
+
+// TestGameLabelRules tests labeling games and notifying by label rules
+func TestGameLabelRules(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/labels/{userID}/{gameID}", srv.setGameLabels).Methods("POST")
+
+	labelFor := func(userID string, gameID int, body string) int {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", fmt.Sprintf("/labels/%s/%d", userID, gameID), strings.NewReader(body)))
+		return rr.Code
+	}
+	label := func(gameID int, body string) int { return labelFor("12345", gameID, body) }
+
+	if code := labelFor("abc", 1, `{"labels": ["league"]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid user ID, got %d", code)
+	}
+	for _, body := range []string{
+		`{"labels": ["<script>"]}`,
+		`{"labels": [""]}`,
+	} {
+		if code := label(1, body); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, code)
+		}
+	}
+
+	if code := label(1, `{"labels": ["League", "league"]}`); code != http.StatusOK {
+		t.Fatalf("Expected labels to be set, got %d", code)
+	}
+	label(2, `{"labels": ["teaching"]}`)
+	label(3, `{"labels": ["teaching", "league"]}`)
+	if labels := srv.gameLabelsFor("12345", 1); !reflect.DeepEqual(labels, []string{"league"}) {
+		t.Errorf("Expected labels to be normalized, got %v", labels)
+	}
+
+	prefs := UserPreferences{LabelRules: map[string]string{"league": "urgent", "teaching": "digest"}}
+	if prefs.validate() != "" {
+		t.Fatalf("Expected label rules to be valid: %s", prefs.validate())
+	}
+	if (UserPreferences{LabelRules: map[string]string{"league": "loud"}}).validate() == "" {
+		t.Error("Expected an unknown priority to be rejected")
+	}
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &prefs
+	srv.storage.shard("12345").lastNotificationTime["12345"] = time.Now().Unix()
+	srv.storage.unlockAll()
+
+	games := []Game{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	ids := func(games []Game) []int {
+		var ids []int
+		for _, game := range games {
+			ids = append(ids, game.ID)
+		}
+		return ids
+	}
+
+	// The most urgent rule wins for game 3; digest game 2 waits for the batch window
+	if got := ids(srv.turnsToNotify("12345", games, false, time.Now())); !reflect.DeepEqual(got, []int{1, 3, 4}) {
+		t.Errorf("Expected games 1, 3 and 4, got %v", got)
+	}
+	// High-volume players only get urgent games before the window ends
+	if got := ids(srv.turnsToNotify("12345", games, true, time.Now())); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("Expected urgent games only, got %v", got)
+	}
+	if got := ids(srv.turnsToNotify("12345", games, true, time.Now().Add(2*time.Hour))); len(got) != 4 {
+		t.Errorf("Expected every game once the window passed, got %v", got)
+	}
+
+	alert := buildTurnAlert(12345, games[:1], 0, budgetSend, "")
+	alert.Urgent = srv.hasUrgentGame("12345", games[:1])
+	encoded, _ := json.Marshal(alert.apnsNotification(testDeviceToken).Payload)
+	if !strings.Contains(string(encoded), `"interruption-level":"time-sensitive"`) {
+		t.Errorf("Expected an urgent game to be time-sensitive, got %s", encoded)
+	}
+
+	// A muted game is never pushed
+	if code := label(4, `{"labels": [], "muted": true}`); code != http.StatusOK {
+		t.Fatalf("Expected the game to be muted, got %d", code)
+	}
+	if got := ids(srv.turnsToNotify("12345", games, false, time.Now())); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("Expected the muted game to be skipped, got %v", got)
+	}
+
+	// Labels go with the game when it leaves the active list
+	srv.storage.lockAll()
+	srv.storage.shard("12345").gameRecord("12345", 1).LastMove = 1000
+	srv.storage.unlockAll()
+	srv.detectRemovedGames("12345", games[1:])
+	if len(srv.gameLabelsFor("12345", 1)) != 0 {
+		t.Error("Expected labels of a finished game to be removed")
+	}
+}
+
+// TestOpponentRules tests per-opponent rules and their CRUD endpoints
+func TestOpponentRules(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/opponent-rules/{userID}", srv.getOpponentRules).Methods("GET")
+	r.HandleFunc("/opponent-rules/{userID}/{opponentID}", srv.setOpponentRule).Methods("PUT")
+	r.HandleFunc("/opponent-rules/{userID}/{opponentID}", srv.deleteOpponentRule).Methods("DELETE")
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := request("PUT", "/opponent-rules/12345/4321", `{"priority": "loud"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown priority, got %d", rr.Code)
+	}
+	if rr := request("PUT", "/opponent-rules/12345/abc", `{"priority": "urgent"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid opponent ID, got %d", rr.Code)
+	}
+	request("PUT", "/opponent-rules/12345/4321", `{"priority": "urgent"}`)
+	request("PUT", "/opponent-rules/12345/999", `{"priority": "mute"}`)
+
+	var rules []OpponentRule
+	json.NewDecoder(request("GET", "/opponent-rules/12345", "").Body).Decode(&rules)
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %+v", rules)
+	}
+
+	game := func(id, opponent int) Game {
+		return Game{ID: id, JSON: GameState{Clock: Clock{CurrentPlayer: 12345, BlackPlayerID: 12345, WhitePlayerID: opponent}}}
+	}
+	games := []Game{game(1, 4321), game(2, 999), game(3, 777)}
+	if games[0].OpponentID(12345) != 4321 || games[0].OpponentID(4321) != 12345 || games[0].OpponentID(1) != 0 {
+		t.Error("Expected the opponent to be the other player on the clock")
+	}
+
+	urgent, normal, digest := srv.splitByPriority("12345", games)
+	if len(urgent) != 1 || urgent[0].ID != 1 || len(normal) != 1 || normal[0].ID != 3 || len(digest) != 0 {
+		t.Errorf("Expected game 1 urgent, game 2 muted and game 3 normal, got %v %v %v", urgent, normal, digest)
+	}
+
+	if rr := request("DELETE", "/opponent-rules/12345/999", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rr.Code)
+	}
+	if _, exists := srv.preferencesFor("12345").OpponentRules[999]; exists {
+		t.Error("Expected the rule to be removed")
+	}
+}
+
+// TestBotGameQuieting tests that games against bots default to digest
+func TestBotGameQuieting(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var games []Game
+	payload := `[
+		{"id": 1, "black": {"id": 12345, "ui_class": ""}, "white": {"id": 500, "ui_class": "supporter bot"},
+		 "json": {"clock": {"current_player": 12345, "black_player_id": 12345, "white_player_id": 500}}},
+		{"id": 2, "black": {"id": 600, "ui_class": "supporter"}, "white": {"id": 12345},
+		 "json": {"clock": {"current_player": 12345, "black_player_id": 600, "white_player_id": 12345}}}
+	]`
+	if err := json.Unmarshal([]byte(payload), &games); err != nil {
+		t.Fatalf("Failed to parse games: %v", err)
+	}
+	if !games[0].OpponentIsBot(12345) || games[1].OpponentIsBot(12345) || games[0].OpponentIsBot(500) {
+		t.Error("Expected only game 1 to be against a bot")
+	}
+
+	_, normal, digest := srv.splitByPriority("12345", games)
+	if len(digest) != 1 || digest[0].ID != 1 || len(normal) != 1 {
+		t.Errorf("Expected the bot game to default to digest, got normal %v digest %v", normal, digest)
+	}
+
+	// A rule for the bot itself overrides the default, as does bot_games
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{BotGames: "mute", OpponentRules: map[int]string{500: "normal"}}
+	srv.storage.unlockAll()
+	if _, normal, _ = srv.splitByPriority("12345", games); len(normal) != 2 {
+		t.Errorf("Expected the opponent rule to win over bot_games, got %v", normal)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{BotGames: "mute"}
+	srv.storage.unlockAll()
+	if urgent, normal, digest := srv.splitByPriority("12345", games); len(urgent)+len(normal)+len(digest) != 1 {
+		t.Errorf("Expected the bot game to be muted, got %v %v %v", urgent, normal, digest)
+	}
+
+	if (UserPreferences{BotGames: "quiet"}).validate() == "" {
+		t.Error("Expected an unknown bot_games priority to be rejected")
+	}
+}
+
+func TestLiveGameHandling(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	classify := []struct {
+		name string
+		tc   TimeControl
+		live bool
+	}{
+		{"speed label", TimeControl{Speed: "blitz"}, true},
+		{"correspondence label", TimeControl{Speed: "correspondence", System: "fischer", InitialTime: 60}, false},
+		{"fast fischer", TimeControl{System: "fischer", InitialTime: 600, TimeIncrement: 10}, true},
+		{"day-long fischer", TimeControl{System: "fischer", InitialTime: 259200, TimeIncrement: 86400}, false},
+		{"byoyomi", TimeControl{System: "byoyomi", MainTime: 1200, PeriodTime: 30}, true},
+		{"canadian", TimeControl{System: "canadian", MainTime: 600, PeriodTime: 300, StonesPerPeriod: 25}, true},
+		{"simple", TimeControl{System: "simple", PerMove: 86400}, false},
+		{"no clock", TimeControl{System: "none"}, false},
+	}
+	for _, c := range classify {
+		game := Game{}
+		game.JSON.TimeControl = c.tc
+		if game.IsLive() != c.live {
+			t.Errorf("%s: expected live=%v", c.name, c.live)
+		}
+	}
+
+	live := Game{ID: 1}
+	live.JSON.TimeControl = TimeControl{Speed: "live"}
+	slow := Game{ID: 2}
+	slow.JSON.TimeControl = TimeControl{Speed: "correspondence"}
+	games := []Game{live, slow}
+	now := time.Now()
+
+	// In high-volume mode with a fresh push, only the live game goes out
+	srv.storage.lockAll()
+	srv.storage.shard("12345").lastNotificationTime["12345"] = now.Unix()
+	srv.storage.unlockAll()
+	if toSend := srv.turnsToNotify("12345", games, true, now); len(toSend) != 1 || toSend[0].ID != 1 {
+		t.Errorf("Expected the live game to skip the batch window, got %v", toSend)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{LiveGames: "suppress"}
+	srv.storage.unlockAll()
+	if toSend := srv.turnsToNotify("12345", games, false, now); len(toSend) != 1 || toSend[0].ID != 2 {
+		t.Errorf("Expected the live game to be suppressed, got %v", toSend)
+	}
+
+	if (UserPreferences{LiveGames: "later"}).validate() == "" {
+		t.Error("Expected an unknown live_games mode to be rejected")
+	}
+}
+
+func TestRegionPartitioning(t *testing.T) {
+	single := regionPartition{region: "us-east"}
+	if !single.owns("12345") {
+		t.Error("Expected a single-region instance to own every user")
+	}
+
+	regions := []string{"eu-west", "us-east", "ap-south"}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		userID := strconv.Itoa(1000 + i)
+		owners := 0
+		for _, region := range regions {
+			partition := regionPartition{region: region, regions: []string{"ap-south", "eu-west", "us-east"}}
+			if partition.owns(userID) {
+				owners++
+				counts[region]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("Expected user %s to be owned by exactly one region, got %d", userID, owners)
+		}
+	}
+	for _, region := range regions {
+		if counts[region] < 50 {
+			t.Errorf("Expected users spread across regions, got %v", counts)
+		}
+	}
+
+	t.Setenv("REGIONS", "us-east, eu-west")
+	t.Setenv("REGION", "ap-south")
+	if _, err := regionConfig(); err == nil {
+		t.Error("Expected a region missing from REGIONS to be rejected")
+	}
+
+	// Reminders for users of another region are left for it
+	srv := newTestServer(t)
+	srv.partition = regionPartition{region: "us-east", regions: []string{"eu-west", "us-east"}}
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		userID := strconv.Itoa(2000 + i)
+		if srv.partition.owns(userID) {
+			local = userID
+		} else {
+			remote = userID
+		}
+	}
+	now := time.Now()
+	srv.storage.shard(local).reminders[local] = []*Reminder{{ID: "a", RemindAt: now.Unix() - 1}}
+	srv.storage.shard(remote).reminders[remote] = []*Reminder{{ID: "b", RemindAt: now.Unix() - 1}}
+	var sent []string
+	srv.processDueReminders(now, func(userID string, reminder Reminder) error {
+		sent = append(sent, userID)
+		return nil
+	})
+	if len(sent) != 1 || sent[0] != local {
+		t.Errorf("Expected only the local user's reminder to be sent, got %v", sent)
+	}
+
+	pool := newAPNSPool(&apns2.Client{}, &apns2.Client{})
+	if first, second := pool.client(), pool.client(); first == second || pool.client() != first {
+		t.Error("Expected sends to rotate through the APNs connections")
+	}
+}
+
+func TestNotificationRouting(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	os.WriteFile(path, []byte(`
+default:
+  channels: [apns]
+events:
+  turn:
+    channels: [ntfy, apns]
+    fallback: true
+    throttle_minutes: 30
+`), 0600)
+	config, err := loadRoutingConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load routing config: %v", err)
+	}
+	srv.routing = config
+
+	os.WriteFile(path, []byte("events:\n  turn:\n    channels: [sms]\n"), 0600)
+	if _, err := loadRoutingConfig(path); err == nil {
+		t.Error("Expected an unknown channel to be rejected")
+	}
+	os.WriteFile(path, []byte("events:\n  trun:\n    channels: [apns]\n"), 0600)
+	if _, err := loadRoutingConfig(path); err == nil {
+		t.Error("Expected an unknown event type to be rejected")
+	}
+
+	// The user's rule wins over the operator's, which wins over the default
+	if route := srv.routeFor("12345", "reminder"); len(route.Channels) != 1 || route.Channels[0] != channelAPNs {
+		t.Errorf("Expected the operator default route, got %+v", route)
+	}
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{Routing: map[string]RouteRule{"turn": {Channels: []string{"apns"}}}}
+	if route := srv.routeFor("12345", eventTurn); route.Fallback || len(route.Channels) != 1 {
+		t.Errorf("Expected the user's route, got %+v", route)
+	}
+	if route := srv.routeFor("999", eventTurn); !route.Fallback || route.Channels[0] != channelNtfy {
+		t.Errorf("Expected the operator's turn route, got %+v", route)
+	}
+
+	// Fallback stops at the first channel that delivers
+	var tried []string
+	send := func(channel string) error {
+		tried = append(tried, channel)
+		if channel == channelNtfy {
+			return fmt.Errorf("ntfy down")
+		}
+		return nil
+	}
+	both := map[string]bool{channelAPNs: true, channelNtfy: true}
+	if delivered, _ := deliverOnRoute(RouteRule{Channels: []string{"ntfy", "apns"}, Fallback: true}, both, send); !delivered || len(tried) != 2 {
+		t.Errorf("Expected fallback to APNs after ntfy failed, tried %v", tried)
+	}
+	tried = nil
+	deliverOnRoute(RouteRule{Channels: []string{"apns", "ntfy"}, Fallback: true}, both, send)
+	if len(tried) != 1 {
+		t.Errorf("Expected fallback to stop after APNs delivered, tried %v", tried)
+	}
+
+	// A throttled turn route holds normal turns until it has passed
+	now := time.Now()
+	game := Game{ID: 1}
+	rule := srv.routeFor("999", eventTurn)
+	srv.recordRouteDelivery("999", eventTurn, rule, now)
+	if toSend := srv.turnsToNotify("999", []Game{game}, false, now.Add(10*time.Minute)); len(toSend) != 0 {
+		t.Errorf("Expected the turn to be held by the throttle, got %v", toSend)
+	}
+	if toSend := srv.turnsToNotify("999", []Game{game}, false, now.Add(31*time.Minute)); len(toSend) != 1 {
+		t.Errorf("Expected the turn to be sent once the throttle passed, got %v", toSend)
+	}
+}
+
+func TestOGSRealtimeEvents(t *testing.T) {
+	srv := newTestServer(t)
+
+	for message, want := range map[string]int{
+		`["game/42/move",{"game_id":42,"move":[3,3,1200]}]`: 42,
+		`["game/42/clock",{"current_player":1}]`:            42,
+		`["game/42/chat",{}]`:                               0,
+		`["net/pong",{"client":1}]`:                         0,
+		`not json`:                                          0,
+	} {
+		if gameID, _ := realtimeGameEvent(message); gameID != want {
+			t.Errorf("realtimeGameEvent(%s) = %d, want %d", message, gameID, want)
+		}
+	}
+
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	srv.storage.shard("12345").games["12345"] = gameRecords(map[int]int64{42: 1})
+	srv.storage.shard("999").games["999"] = gameRecords(map[int]int64{7: 1}) // not registered
+
+	subscribed := make(chan string, 10)
+	ogs := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		var message string
+		if websocket.Message.Receive(conn, &message) != nil {
+			return
+		}
+		subscribed <- message
+		websocket.Message.Send(conn, `["game/7/move",{"game_id":7}]`)
+		websocket.Message.Send(conn, `["game/42/move",{"game_id":42}]`)
+		websocket.Message.Send(conn, `["game/42/clock",{"game_id":42}]`)
+		for websocket.Message.Receive(conn, &message) == nil {
+		}
+	}))
+	defer ogs.Close()
+
+	checked := make(chan string, 10)
+	rt := newOGSRealtime(srv, "ws"+strings.TrimPrefix(ogs.URL, "http"))
+	rt.check = func(gameID int, userIDs []string) { checked <- fmt.Sprint(gameID, userIDs) }
+	go rt.connectAndServe()
+
+	if message := <-subscribed; message != `["game/connect",{"chat":true,"game_id":42}]` {
+		t.Errorf("Expected a subscription to game 42 only, got %s", message)
+	}
+
+	// The move and clock events check game 42 once, for the registered player
+	select {
+	case got := <-checked:
+		if got != "42 [12345]" {
+			t.Errorf("Expected game 42 to be checked for user 12345, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a check after the move event")
+	}
+	select {
+	case got := <-checked:
+		t.Errorf("Expected one check, got another: %s", got)
+	case <-time.After(realtimeDebounce + time.Second):
+	}
+
+	// The check asks OGS for that one game, not the player's whole list
+	var requests atomic.Int32
+	games := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/42" {
+			t.Errorf("Expected only game 42 to be fetched, got %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"id": 42, "players": {"black": {"id": 12345}, "white": {"id": 999}}, "gamedata": {"phase": "play", "moves": [[3,3,100]], "clock": {"current_player": 12345, "last_move": 1700000000000}}}`))
+	}))
+	defer games.Close()
+	defer func(url string) { ogsGameURL = url }(ogsGameURL)
+	ogsGameURL = games.URL + "/%d"
+	srv.checkRealtimeGame(42, rt.playersOf(42))
+	if requests.Load() != 1 {
+		t.Errorf("Expected one OGS request, got %d", requests.Load())
+	}
+	// The send runs in the background and may already have committed the move
+	shard := srv.storage.shard("12345")
+	shard.mu.RLock()
+	_, pending := shard.pendingNotifications["12345"]
+	committed := shard.game("12345", 42).LastMove == 1700000000000
+	shard.mu.RUnlock()
+	if !pending && !committed {
+		t.Error("Expected the new turn in game 42 to be picked up for notification")
+	}
+
+	// While connected, polls are only a fallback
+	now := time.Now()
+	if !rt.pollDue(now) || rt.pollDue(now.Add(time.Minute)) {
+		t.Error("Expected one poll per real-time poll interval while connected")
+	}
+	if !rt.pollDue(now.Add(realtimePollInterval())) {
+		t.Error("Expected a poll once the real-time poll interval passed")
+	}
+}
+
+func TestCycleLog(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	srv.recordCycle(CycleSummary{StartedAt: now.Add(-8 * 24 * time.Hour).Unix(), UsersChecked: 5}, now.Add(-8*24*time.Hour))
+	srv.recordCycle(CycleSummary{StartedAt: now.Add(-time.Hour).Unix(), UsersChecked: 3}, now)
+
+	// A cycle that skips a gone account is recorded too
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	srv.storage.shard("12345").accountsGone["12345"] = &AccountGone{GoneAt: now.Unix()}
+	srv.checkAllUsers()
+
+	cycles := func(query string) []CycleSummary {
+		w := httptest.NewRecorder()
+		srv.getCycles(w, httptest.NewRequest("GET", "/admin/cycles"+query, nil))
+		var result []CycleSummary
+		json.NewDecoder(w.Body).Decode(&result)
+		return result
+	}
+	result := cycles("")
+	if len(result) != 2 || result[0].UsersSkipped != 1 || result[1].UsersChecked != 3 {
+		t.Errorf("Expected the two recent cycles, newest first, got %+v", result)
+	}
+	if result := cycles("?limit=1"); len(result) != 1 {
+		t.Errorf("Expected one cycle with limit=1, got %+v", result)
+	}
+	if _, kept := srv.storage.cycleLog.Load(cycleLogKey(now.Add(-8*24*time.Hour), "")); kept {
+		t.Error("Expected days past the retention to be dropped")
+	}
+}
+
+func TestChatNotifications(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+	srv.storage.shard("678").deviceTokens["678"] = testDeviceToken
+	srv.storage.shard("12345").games["12345"] = gameRecords(map[int]int64{42: 1})
+	srv.storage.shard("678").games["678"] = gameRecords(map[int]int64{42: 1})
+
+	pushed := make(chan string, 10)
+	rt := newOGSRealtime(srv, "")
+	rt.chat = func(userID string, gameID int, chat gameChat) { pushed <- userID + ": " + chat.text() }
+	rt.chatSince = map[int]int64{42: 1000}
+	rt.players = rt.trackedGames()
+
+	line := func(channel string, date int64, playerID int) string {
+		return fmt.Sprintf(`["game/42/chat",{"channel":%q,"line":{"body":"good luck","date":%d,"player_id":%d,"username":"PlayerX"}}]`, channel, date, playerID)
+	}
+	rt.handleMessage(line("main", 900, 678)) // history replayed on connect
+	rt.handleMessage(line("moderator", 1100, 678))
+	rt.handleMessage(line("main", 1100, 678))
+	select {
+	case got := <-pushed:
+		if got != "12345: good luck" {
+			t.Errorf("Expected the opponent's message to be pushed to user 12345, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a chat push")
+	}
+
+	// Users can mute chat
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{ChatMuted: true}
+	rt.handleMessage(line("malkovich", 1200, 678))
+	select {
+	case got := <-pushed:
+		t.Errorf("Expected no push for a muted user, got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAccountGone(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "12345"
+	srv.storage.shard(userID).deviceTokens[userID] = testDeviceToken
+	srv.storage.shard(userID).games[userID] = gameRecords(map[int]int64{1: 100})
+
+	var sent []string
+	send := func(userID, title, body, action string, custom map[string]interface{}) error {
+		sent = append(sent, action)
+		return nil
+	}
+
+	now := time.Now()
+	for i := 0; i < accountGoneAfterMisses-1; i++ {
+		srv.recordAccountMiss(userID, now, send)
+	}
+	if srv.accountGone(userID) || len(sent) != 0 {
+		t.Fatalf("Expected the account to survive %d misses, sent %v", accountGoneAfterMisses-1, sent)
+	}
+
+	// A successful check starts the count again
+	srv.recordSuccessfulCheck(userID, now)
+	for i := 0; i < accountGoneAfterMisses-1; i++ {
+		srv.recordAccountMiss(userID, now, send)
+	}
+	if srv.accountGone(userID) {
+		t.Fatal("Expected a successful check to reset the misses")
+	}
+
+	srv.recordAccountMiss(userID, now, send)
+	srv.recordAccountMiss(userID, now, send)
+	if !srv.accountGone(userID) {
+		t.Fatal("Expected the account to be gone")
+	}
+	if len(sent) != 1 || sent[0] != "account_gone" {
+		t.Errorf("Expected the device to be told once, sent %v", sent)
+	}
+	if warned := srv.warnOverdueChecks(now.Add(time.Hour), send); warned != 0 {
+		t.Errorf("Expected no overdue warning for a gone account, got %d", warned)
+	}
+
+	// Data is kept through the grace period, then deleted
+	if removed := srv.pruneGoneAccounts(now.Add(accountGoneGrace() - time.Hour)); removed != 0 {
+		t.Errorf("Expected nothing deleted within the grace period, got %d", removed)
+	}
+	if removed := srv.pruneGoneAccounts(now.Add(accountGoneGrace())); removed != 1 {
+		t.Errorf("Expected the gone account to be deleted, got %d", removed)
+	}
+	if _, exists := srv.storage.shard(userID).deviceTokens[userID]; exists {
+		t.Error("Expected the device token to be deleted")
+	}
+	if _, exists := srv.storage.shard(userID).accountsGone[userID]; exists {
+		t.Error("Expected the gone marker to be deleted")
+	}
+}
+
+func TestCheckGame(t *testing.T) {
+	srv := newTestServer(t)
+
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		players := `"players": {"black": {"id": 12345}, "white": {"id": 999}}`
+		switch r.URL.Path {
+		case "/1":
+			fmt.Fprintf(w, `{"id": 1, %s, "gamedata": {"phase": "play", "moves": [[3,3,100]], "clock": {"current_player": 12345, "last_move": 1700000000000}}}`, players)
+		case "/2":
+			fmt.Fprintf(w, `{"id": 2, %s, "gamedata": {"phase": "play", "moves": [[3,3,100]], "clock": {"current_player": 999, "last_move": 1700000000000}}}`, players)
+		case "/3":
+			fmt.Fprintf(w, `{"id": 3, %s, "ended": "2024-01-01T00:00:00Z", "gamedata": {"phase": "finished"}}`, players)
+		case "/4":
+			w.Write([]byte(`{"id": 4, "players": {"black": {"id": 1}, "white": {"id": 2}}, "gamedata": {"phase": "play"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsGameURL = url }(ogsGameURL)
+	ogsGameURL = ogs.URL + "/%d"
+
+	router := srv.newRouter()
+	check := func(body string) (int, GameCheck) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/check-game", strings.NewReader(body)))
+		var result GameCheck
+		json.NewDecoder(w.Body).Decode(&result)
+		return w.Code, result
+	}
+
+	if code, result := check(`{"user_id": "12345", "game_id": 1}`); code != http.StatusOK || !result.YourTurn || !result.NewTurn {
+		t.Errorf("Expected a new turn in game 1, got %d %+v", code, result)
+	}
+	// The push goes out in the background, so the turn is either still
+	// reserved or already committed
+	shard := srv.storage.shard("12345")
+	shard.mu.RLock()
+	_, pending := shard.pendingNotifications["12345"]
+	committed := shard.game("12345", 1) != nil && shard.game("12345", 1).LastMove == 1700000000000
+	shard.mu.RUnlock()
+	if !pending && !committed {
+		t.Error("Expected the new turn to be reserved for notification")
+	}
+	if code, result := check(`{"user_id": "12345", "game_id": 2}`); code != http.StatusOK || result.YourTurn {
+		t.Errorf("Expected the opponent's turn in game 2, got %d %+v", code, result)
+	}
+	if code, result := check(`{"user_id": "12345", "game_id": 3}`); code != http.StatusOK || !result.Finished || result.YourTurn {
+		t.Errorf("Expected game 3 to be finished, got %d %+v", code, result)
+	}
+	if code, _ := check(`{"user_id": "12345", "game_id": 4}`); code != http.StatusNotFound {
+		t.Errorf("Expected another players' game to be not found, got %d", code)
+	}
+	if code, _ := check(`{"user_id": "12345", "game_id": 5}`); code != http.StatusNotFound {
+		t.Errorf("Expected a game OGS doesn't have to be not found, got %d", code)
+	}
+	if code, _ := check(`{"user_id": "abc", "game_id": 1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid user ID to be rejected, got %d", code)
+	}
+}
+
+func TestIdleBackoff(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	userID := "idle-user"
+	defer srv.resetIdleBackoff(userID)
+	now := time.Now()
+
+	// A few empty checks in a row are still checked every cycle
+	for i := 0; i < idleAfterEmptyChecks-1; i++ {
+		srv.recordActiveGameCount(userID, 0, now)
+	}
+	if srv.userIdle(userID, now) {
+		t.Error("Expected a user to be checked until enough checks find no games")
+	}
+
+	// Then the wait doubles, up to the maximum
+	srv.recordActiveGameCount(userID, 0, now)
+	if !srv.userIdle(userID, now.Add(checkInterval())) || srv.userIdle(userID, now.Add(2*checkInterval())) {
+		t.Error("Expected an idle user to be checked every other interval")
+	}
+	for i := 0; i < 20; i++ {
+		srv.recordActiveGameCount(userID, 0, now)
+	}
+	if !srv.userIdle(userID, now.Add(idleBackoffMax()-time.Second)) || srv.userIdle(userID, now.Add(idleBackoffMax())) {
+		t.Error("Expected the wait to stop at the maximum")
+	}
+
+	// A game, or a heartbeat from the app, resets it
+	srv.recordActiveGameCount(userID, 1, now)
+	if srv.userIdle(userID, now) {
+		t.Error("Expected a user with a game to be checked every cycle")
+	}
+	for i := 0; i < idleAfterEmptyChecks; i++ {
+		srv.recordActiveGameCount(userID, 0, now)
+	}
+	w := httptest.NewRecorder()
+	srv.heartbeat(w, mux.SetURLVars(httptest.NewRequest("POST", "/heartbeat/"+userID, nil), map[string]string{"userID": userID}))
+	if w.Code != http.StatusNoContent || srv.userIdle(userID, now) {
+		t.Errorf("Expected a heartbeat to reset the backoff, got %d", w.Code)
+	}
+}
+
+func TestOGSRateLimitBackoff(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	if wait, ok := retryAfter("120", now); !ok || wait != 2*time.Minute {
+		t.Errorf("Expected Retry-After in seconds to parse, got %v %v", wait, ok)
+	}
+	if wait, ok := retryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now); !ok || wait < 59*time.Second || wait > time.Minute {
+		t.Errorf("Expected Retry-After as a date to parse, got %v %v", wait, ok)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("Expected an invalid Retry-After to be ignored")
+	}
+
+	// A 429 pauses every OGS request until Retry-After has passed
+	requests := 0
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ogs.Close()
+
+	resp, err := srv.ogsGet(ogs.URL)
+	if err != nil {
+		t.Fatalf("Expected the throttled response, got %v", err)
+	}
+	resp.Body.Close()
+	if until := srv.ogsPausedUntil(time.Now()); until.IsZero() || time.Until(until) > 30*time.Second {
+		t.Errorf("Expected OGS requests paused for 30s, got until %v", until)
+	}
+	if _, err := srv.ogsGet(ogs.URL); !errors.Is(err, errOGSThrottled) || requests != 1 {
+		t.Errorf("Expected the paused request not to be sent, got %v after %d requests", err, requests)
+	}
+
+	// Users are backed off exponentially after throttled or failed checks
+	userID := "backoff-user"
+	defer srv.recordUserCheckOutcome(userID, nil, now)
+	for failures, want := range []time.Duration{checkInterval(), 2 * checkInterval(), 4 * checkInterval()} {
+		srv.recordUserCheckOutcome(userID, errOGSServerError, now)
+		if !srv.userBackedOff(userID, now.Add(want-time.Second)) || srv.userBackedOff(userID, now.Add(want)) {
+			t.Errorf("Expected a backoff of %v after %d failures", want, failures+1)
+		}
+	}
+	srv.recordUserCheckOutcome(userID, nil, now)
+	if srv.userBackedOff(userID, now) {
+		t.Error("Expected a successful check to clear the backoff")
+	}
+}
+
+func TestConditionalPlayerRequests(t *testing.T) {
+	srv := newTestServer(t)
+
+	var conditional []string
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"active_games": [{"id": 7, "json": {"clock": {"current_player": 4242}}}]}`))
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsPlayerURL = url }(ogsPlayerURL)
+	ogsPlayerURL = ogs.URL + "/players/%d/full"
+
+	first, err := srv.getActiveGames(4242)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("Expected one game, got %v %v", first, err)
+	}
+	notModified := ogsNotModified.Load()
+	second, err := srv.getActiveGames(4242)
+	if err != nil || len(second) != 1 || second[0].ID != 7 {
+		t.Fatalf("Expected the cached game after a 304, got %v %v", second, err)
+	}
+	if conditional[0] != "" || conditional[1] != `"v1"` {
+		t.Errorf("Expected the second request to send the ETag, got %q", conditional)
+	}
+	if ogsNotModified.Load() != notModified+1 {
+		t.Error("Expected the 304 to be counted")
+	}
+}
+
+func TestPaginatedActiveGames(t *testing.T) {
+	srv := newTestServer(t)
+
+	var ogs *httptest.Server
+	ogs = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/full"):
+			w.Write([]byte(`{"active_games": [{"id": 1}, {"id": 2}]}`))
+		case strings.HasPrefix(r.URL.Path, "/players/"):
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(`{"next": null, "results": [{"id": 3}, {"id": 4}]}`))
+				return
+			}
+			fmt.Fprintf(w, `{"next": "%s/players/4242/games/?page=2", "results": [{"id": 1}, {"id": 2}]}`, ogs.URL)
+		case r.URL.Path == "/games/3":
+			w.Write([]byte(`{"id": 3, "gamedata": {"phase": "play"}}`))
+		case r.URL.Path == "/games/4":
+			w.Write([]byte(`{"id": 4, "ended": "2026-10-01T00:00:00Z", "gamedata": {"phase": "finished"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ogs.Close()
+	defer func(player, games, game string) {
+		ogsPlayerURL, ogsPlayerGamesURL, ogsGameURL = player, games, game
+	}(ogsPlayerURL, ogsPlayerGamesURL, ogsGameURL)
+	ogsPlayerURL = ogs.URL + "/players/%d/full"
+	ogsPlayerGamesURL = ogs.URL + "/players/%d/games/"
+	ogsGameURL = ogs.URL + "/games/%d"
+	srv.clearGameStates()
+
+	os.Setenv("ACTIVE_GAMES_PAGING_THRESHOLD", "3")
+	defer os.Unsetenv("ACTIVE_GAMES_PAGING_THRESHOLD")
+	if games, err := srv.getActiveGames(4242); err != nil || len(games) != 2 {
+		t.Fatalf("Expected the profile's games below the threshold, got %v %v", games, err)
+	}
+
+	os.Setenv("ACTIVE_GAMES_PAGING_THRESHOLD", "2")
+	games, err := srv.getActiveGames(4242)
+	if err != nil || len(games) != 3 || games[2].ID != 3 {
+		t.Errorf("Expected game 3 from the second page and not the finished game 4, got %v %v", games, err)
+	}
+}
+
+func TestGameStateCache(t *testing.T) {
+	srv := newTestServer(t)
+
+	gameRequests := 0
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gameRequests++
+		switch r.URL.Path {
+		case "/games/7":
+			w.Write([]byte(`{"id": 7, "ended": "2026-10-01T00:00:00Z", "outcome": "3.5 points", "winner": 4242, "gamedata": {"phase": "finished"}}`))
+		case "/games/8":
+			w.Write([]byte(`{"id": 8, "gamedata": {"phase": "play", "clock": {"current_player": 5151}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsGameURL = url }(ogsGameURL)
+	ogsGameURL = ogs.URL + "/games/%d"
+
+	// Both players of a finished game look up its result; OGS is asked once
+	for _, userID := range []string{"4242", "5151"} {
+		srv.storage.shard(userID).games[userID] = map[int]*GameRecord{7: {LastMove: 1}}
+		finished := srv.detectRemovedGames(userID, nil)
+		if len(finished) != 1 || finished[0].Result == "unknown" {
+			t.Fatalf("Expected the result of game 7 for user %s, got %+v", userID, finished)
+		}
+	}
+	if gameRequests != 1 {
+		t.Errorf("Expected one OGS request for both players' results, got %d", gameRequests)
+	}
+
+	// A game seen in one player's list isn't fetched again for the other
+	listed := Game{ID: 8}
+	listed.JSON.Clock.CurrentPlayer = 5151
+	srv.rememberListedGames([]Game{listed}, time.Now())
+	if game, ended, err := srv.getGame(8); err != nil || ended || game.JSON.Clock.CurrentPlayer != 5151 || gameRequests != 1 {
+		t.Errorf("Expected game 8 from the cache, got %+v %v %v after %d requests", game, ended, err, gameRequests)
+	}
+
+	// Each cycle starts afresh, as does a cache that's turned off
+	srv.clearGameStates()
+	srv.getGame(8)
+	srv.getGame(8)
+	if gameRequests != 2 {
+		t.Errorf("Expected game 8 fetched once after the cache was cleared, got %d requests", gameRequests)
+	}
+	t.Setenv("GAME_STATE_CACHE_SECONDS", "0")
+	srv.getGame(8)
+	if gameRequests != 3 {
+		t.Errorf("Expected game 8 fetched again with the cache off, got %d requests", gameRequests)
+	}
+}
+
+func TestOverviewActiveGames(t *testing.T) {
+	srv := newTestServer(t)
+
+	overview := `{"active_games": [{"id": 1, "json": {"clock": {"current_player": 4242}}}]}`
+	var fullRequests int
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/overview":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(overview))
+		case "/players/4242/full":
+			fullRequests++
+			w.Write([]byte(`{"active_games": [{"id": 1, "json": {"clock": {"current_player": 4242}}}, {"id": 2}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ogs.Close()
+	defer func(player, overview string) { ogsPlayerURL, ogsOverviewURL = player, overview }(ogsPlayerURL, ogsOverviewURL)
+	ogsPlayerURL = ogs.URL + "/players/%d/full"
+	ogsOverviewURL = ogs.URL + "/overview"
+
+	fetch := func() int {
+		srv.playerGames.Delete(4242)
+		games, err := srv.fetchActiveGames(4242)
+		if err != nil {
+			t.Fatalf("Expected games, got %v", err)
+		}
+		return len(games)
+	}
+
+	// Without a token, only the full profile can be read
+	if n := fetch(); n != 2 || fullRequests != 1 {
+		t.Errorf("Expected the full profile without a token, got %d games after %d requests", n, fullRequests)
+	}
+
+	srv.storage.shard("4242").challengeTokens["4242"] = "token"
+	checks := ogsOverviewChecks.Load()
+	if n := fetch(); n != 1 || fullRequests != 1 || ogsOverviewChecks.Load() != checks+1 {
+		t.Errorf("Expected the overview with a token, got %d games after %d full requests", n, fullRequests)
+	}
+
+	// Diagnostics read the games the same way the check does
+	r := mux.NewRouter()
+	r.HandleFunc("/diagnostics/{userID}", srv.getUserDiagnostics).Methods("GET")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/diagnostics/4242", nil))
+	var diagnostics UserDiagnostics
+	json.NewDecoder(rr.Body).Decode(&diagnostics)
+	if diagnostics.TotalActiveGames != 1 || fullRequests != 1 {
+		t.Errorf("Expected diagnostics from the overview, got %d games after %d full requests", diagnostics.TotalActiveGames, fullRequests)
+	}
+
+	// A game without its clock, a rejected token or turning it off falls back
+	overview = `{"active_games": [{"id": 1}]}`
+	if n := fetch(); n != 2 || fullRequests != 2 {
+		t.Errorf("Expected the full profile for an incomplete overview, got %d games", n)
+	}
+	srv.storage.shard("4242").challengeTokens["4242"] = "revoked"
+	if n := fetch(); n != 2 || fullRequests != 3 {
+		t.Errorf("Expected the full profile when the overview fails, got %d games", n)
+	}
+	srv.storage.shard("4242").challengeTokens["4242"] = "token"
+	t.Setenv("OGS_OVERVIEW", "false")
+	if n := fetch(); n != 2 || fullRequests != 4 {
+		t.Errorf("Expected the full profile with OGS_OVERVIEW=false, got %d games", n)
+	}
+}
+
+func TestDemoOGS(t *testing.T) {
+	srv := newTestServer(t)
+
+	start := time.Now().Truncate(time.Minute)
+	now := start
+	demo := &demoOGS{start: start, moveInterval: time.Minute, now: func() time.Time { return now }}
+	ogs := httptest.NewServer(demo.handler())
+	defer ogs.Close()
+	defer useOGSBaseURL(ogsWebURL)
+	useOGSBaseURL(ogs.URL)
+
+	if ogsGameLink(5) != ogs.URL+"/game/5" || ogsMeURL != ogs.URL+"/api/v1/me" {
+		t.Fatalf("Expected OGS URLs on the demo server, got %s and %s", ogsGameLink(5), ogsMeURL)
+	}
+
+	games, err := srv.getActiveGames(4242)
+	if err != nil || len(games) != demoGamesPerPlayer {
+		t.Fatalf("Expected %d demo games, got %v %v", demoGamesPerPlayer, games, err)
+	}
+	first := games[0]
+	if !first.Started() || first.JSON.Clock.CurrentPlayer != 4242 || first.Opponent(4242).Username != "Demo Bot 1" {
+		t.Errorf("Expected the first game to start with the player to move, got %+v", first)
+	}
+
+	// The bot answers a move later, and the game ends after demoGameMoves
+	now = start.Add(time.Minute)
+	if games, _ := srv.getActiveGames(4242); games[0].JSON.Clock.CurrentPlayer == 4242 || games[0].MoveNumber() != 1 {
+		t.Errorf("Expected the bot to move after a minute, got %+v", games[0].JSON.Clock)
+	}
+	now = start.Add(demoGameMoves * time.Minute)
+	games, _ = srv.getActiveGames(4242)
+	if games[0].ID == first.ID {
+		t.Fatal("Expected a new game after the first ended")
+	}
+	details, err := srv.getGameDetails(first.ID)
+	if err != nil || details.Outcome != "Resignation" || gameResultFor("4242", details) != "won" {
+		t.Errorf("Expected the first game won by resignation, got %+v %v", details, err)
+	}
+	if _, finished, err := srv.getGame(games[0].ID); err != nil || finished {
+		t.Errorf("Expected the new game in play, got %v %v", finished, err)
+	}
+
+	// Demo tokens belong to the player they name
+	if playerID, err := srv.ogsPlayerForToken("demo-4242"); err != nil || playerID != 4242 {
+		t.Errorf("Expected the demo token to belong to 4242, got %d %v", playerID, err)
+	}
+	if _, err := srv.ogsPlayerForToken("real-token"); err != errAccountLinkInvalid {
+		t.Errorf("Expected other tokens to be rejected, got %v", err)
+	}
+}
+
+func TestEntitlementTiers(t *testing.T) {
+	srv := newTestServer(t)
+
+	features := func(userID string) UserFeatures {
+		w := httptest.NewRecorder()
+		srv.getFeatures(w, mux.SetURLVars(httptest.NewRequest("GET", "/features/"+userID, nil), map[string]string{"userID": userID}))
+		var result UserFeatures
+		json.NewDecoder(w.Body).Decode(&result)
+		return result
+	}
+	if result := features("12345"); result.Tier != tierFree || !result.Features[featureDigests] || !result.Features[featureEventStream] {
+		t.Errorf("Expected every feature to be free by default, got %+v", result)
+	}
+
+	os.Setenv("PREMIUM_FEATURES", "digests, event_stream, holograms")
+	defer os.Unsetenv("PREMIUM_FEATURES")
+	if result := features("12345"); result.Features[featureDigests] || result.Features[featureEventStream] {
+		t.Errorf("Expected premium features to be off for a free user, got %+v", result)
+	}
+
+	// Free users' own digest rules act as normal; bot games keep the default
+	games := []Game{
+		{ID: 1, Black: GamePlayer{ID: 12345}, White: GamePlayer{ID: 500, UIClass: "bot"}},
+		{ID: 2, Black: GamePlayer{ID: 12345}, White: GamePlayer{ID: 600}},
+	}
+	games[1].JSON.Clock.BlackPlayerID, games[1].JSON.Clock.WhitePlayerID = 12345, 600
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{OpponentRules: map[int]string{600: "digest"}}
+	if _, normal, digest := srv.splitByPriority("12345", games); len(digest) != 1 || digest[0].ID != 1 || len(normal) != 1 {
+		t.Errorf("Expected only the bot game to be a digest for a free user, got normal %v digest %v", normal, digest)
+	}
+
+	// An admin grant unlocks them, and takes precedence over the subscription
+	request := func(method, body string) int {
+		w := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(method, "/admin/entitlements/12345", strings.NewReader(body)), map[string]string{"userID": "12345"})
+		if method == "PUT" {
+			srv.setEntitlementOverride(w, req)
+		} else {
+			srv.deleteEntitlementOverride(w, req)
+		}
+		return w.Code
+	}
+	if code := request("PUT", `{"tier": "gold"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown tier to be rejected, got %d", code)
+	}
+	if code := request("PUT", `{"tier": "premium"}`); code != http.StatusNoContent {
+		t.Fatalf("Expected the override to be set, got %d", code)
+	}
+	if result := features("12345"); result.Tier != tierPremium || result.Source != "admin" || !result.Features[featureDigests] {
+		t.Errorf("Expected the admin grant to unlock premium features, got %+v", result)
+	}
+	if _, _, digest := srv.splitByPriority("12345", games); len(digest) != 2 {
+		t.Errorf("Expected premium users' digest rules to apply, got %v", digest)
+	}
+
+	srv.storage.shard("12345").entitlements["12345"] = &Entitlement{Tier: tierPremium, Source: "app_store"}
+	request("PUT", `{"tier": "free"}`)
+	if srv.hasPremium("12345", time.Now()) {
+		t.Error("Expected a free override to take premium away")
+	}
+	if code := request("DELETE", ""); code != http.StatusNoContent || features("12345").Source != "app_store" {
+		t.Errorf("Expected the subscription to apply once the override is removed, got %d", code)
+	}
+}
+
+func TestChallengeNotifications(t *testing.T) {
+	srv := newTestServer(t)
+
+	status := http.StatusOK
+	challenges := `{"results":[
+		{"id":7,"challenger":{"id":678,"username":"PlayerX"},"challenged":{"id":12345},"game":{"width":19,"height":19,"time_control_parameters":"{\"speed\":\"correspondence\"}"}},
+		{"id":8,"challenger":{"id":12345,"username":"testuser"},"challenged":{"id":678},"game":{"width":9,"height":9}}
+	]}`
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Expected the user's access token, got %q", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(challenges))
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsChallengesURL = url }(ogsChallengesURL)
+	ogsChallengesURL = ogs.URL
+
+	var sent []string
+	send := func(userID, title, body, action string, custom map[string]interface{}) error {
+		sent = append(sent, body+" "+custom["accept_url"].(string))
+		return nil
+	}
+
+	srv.storage.shard("12345").challengeTokens["12345"] = "secret"
+	if n := srv.checkChallenges("12345", send); n != 1 {
+		t.Fatalf("Expected only the incoming challenge to be pushed, sent %v", sent)
+	}
+	if want := "New challenge from PlayerX (19x19, correspondence) ogs://challenge/7/accept"; sent[0] != want {
+		t.Errorf("Expected %q, got %q", want, sent[0])
+	}
+	if n := srv.checkChallenges("12345", send); n != 0 {
+		t.Errorf("Expected a challenge to be pushed once, sent %v", sent)
+	}
+
+	// A token OGS rejects turns the notifications off
+	status = http.StatusUnauthorized
+	srv.checkChallenges("12345", send)
+	if _, enabled := srv.storage.shard("12345").challengeTokens["12345"]; enabled {
+		t.Error("Expected a rejected token to be dropped")
+	}
+}
+
+func TestResync(t *testing.T) {
+	srv := newTestServer(t)
+
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"active_games": [
+			{"id": 1, "json": {"moves": [[3,3],[4,4]], "clock": {"current_player": 4242, "last_move": 2000}}},
+			{"id": 2, "json": {"moves": [[3,3]], "clock": {"current_player": 99, "last_move": 1000}}}
+		]}`))
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsPlayerURL = url }(ogsPlayerURL)
+	ogsPlayerURL = ogs.URL + "/players/%d/full"
+
+	// The stored state is ahead of OGS, and a push is pending
+	srv.storage.shard("4242").games["4242"] = gameRecords(map[int]int64{1: 5000, 3: 100})
+	setMoveNumbers(srv, "4242", map[int]int{1: 9})
+	srv.storage.shard("4242").pendingNotifications["4242"] = &PendingNotification{Games: map[int]MoveState{3: {LastMove: 100}}}
+
+	w := httptest.NewRecorder()
+	srv.resyncUser(w, mux.SetURLVars(httptest.NewRequest("POST", "/resync/4242", nil), map[string]string{"userID": "4242"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var status TurnStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if len(status.YourTurnNew) != 0 || len(status.YourTurnOld) != 1 || status.YourTurnOld[0] != 1 {
+		t.Errorf("Expected game 1 as an old turn, got %+v", status)
+	}
+	if storedMoveNumber(srv, "4242", 1) != 2 || storedMoveNumber(srv, "4242", 2) != 1 {
+		t.Errorf("Expected the current move numbers to be stored, got %d and %d", storedMoveNumber(srv, "4242", 1), storedMoveNumber(srv, "4242", 2))
+	}
+	if _, stale := srv.storage.shard("4242").games["4242"][3]; stale {
+		t.Error("Expected the finished game's stored move to be dropped")
+	}
+	if srv.storage.shard("4242").pendingNotifications["4242"] != nil {
+		t.Error("Expected the pending notification to be dropped")
+	}
+	if !srv.isNewTurnAt("4242", 1, 3, 3000) {
+		t.Error("Expected the next move to be a new turn")
+	}
+}
+
+func TestLowClockWarnings(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	now := time.Now()
+	game := Game{ID: 77, Name: "Slow game"}
+	game.JSON.TimeControl = TimeControl{System: "fischer", Speed: "correspondence"}
+	game.JSON.Clock.CurrentPlayer = 12345
+	game.JSON.Clock.Expiration = now.Add(20 * time.Hour).UnixMilli()
+
+	if srv.checkLowClock("12345", 12345, game, now) {
+		t.Error("Expected no warning with time to spare")
+	}
+
+	// Each level is warned about once, escalating
+	game.JSON.Clock.Expiration = now.Add(11 * time.Hour).UnixMilli()
+	if !srv.checkLowClock("12345", 12345, game, now) || srv.checkLowClock("12345", 12345, game, now) {
+		t.Error("Expected one warning at 12 hours")
+	}
+	game.JSON.Clock.Expiration = now.Add(30 * time.Minute).UnixMilli()
+	if !srv.checkLowClock("12345", 12345, game, now) {
+		t.Error("Expected another warning at the last level")
+	}
+
+	// Once the user moves, the warnings start over
+	game.JSON.Clock.CurrentPlayer = 678
+	srv.checkLowClock("12345", 12345, game, now)
+	game.JSON.Clock.CurrentPlayer = 12345
+	game.JSON.Clock.Expiration = now.Add(11 * time.Hour).UnixMilli()
+	if !srv.checkLowClock("12345", 12345, game, now) {
+		t.Error("Expected a warning after the user's next turn started")
+	}
+
+	// Without an expiration the deadline is projected from the clock
+	game.JSON.Clock.Expiration = 0
+	game.JSON.TimeControl.System = "byoyomi"
+	game.JSON.Clock.LastMove = now.Add(-time.Hour).UnixMilli()
+	game.JSON.Clock.BlackPlayerID = 12345
+	game.JSON.Clock.BlackTime = json.RawMessage(`{"thinking_time": 0, "periods": 2, "period_time": 3600}`)
+	if deadline, ok := clockDeadline(game); !ok || !deadline.Equal(time.UnixMilli(game.JSON.Clock.LastMove).Add(2*time.Hour)) {
+		t.Errorf("Expected the deadline two periods after the last move, got %v", deadline)
+	}
+}
+
+// TestLiveActivityUpdates tests Live Activity token registration and the
+// updates pushed as a game changes
+func TestLiveActivityUpdates(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	type push struct {
+		header http.Header
+		body   map[string]interface{}
+	}
+	var pushes []push
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		pushes = append(pushes, push{r.Header, body})
+		w.Header().Set("apns-id", "test-id")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+
+	srv.storage.shard("12345").setDevice("12345", testDeviceToken, "")
+	r := srv.newRouter()
+	serve := func(method, deviceToken, body string) int {
+		req := httptest.NewRequest(method, "/live-activities/12345/77", strings.NewReader(body))
+		req.RemoteAddr = "10.15.0.1:1234"
+		req.Header.Set(deviceTokenHeader, deviceToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for body, expected := range map[string]int{`{"push_token": ""}`: http.StatusBadRequest, `{"push_token": "activity-token"}`: http.StatusNoContent} {
+		if code := serve("PUT", testDeviceToken, body); code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, body, code)
+		}
+	}
+
+	now := time.Now()
+	game := Game{ID: 77, Name: "Slow game"}
+	game.JSON.Clock.CurrentPlayer = 12345
+	game.JSON.Clock.BlackPlayerID = 12345
+	game.JSON.Clock.WhitePlayerID = 678
+	game.JSON.Clock.Expiration = now.Add(time.Hour).UnixMilli()
+
+	srv.updateLiveActivities("12345", 12345, []Game{game}, now)
+	srv.updateLiveActivities("12345", 12345, []Game{game}, now)
+	if len(pushes) != 1 {
+		t.Fatalf("Expected one update for an unchanged game, got %d", len(pushes))
+	}
+	header, aps := pushes[0].header, pushes[0].body["aps"].(map[string]interface{})
+	if header.Get("apns-push-type") != "liveactivity" || header.Get("apns-topic") != apnsTopic()+".push-type.liveactivity" || header.Get("apns-priority") != "10" {
+		t.Errorf("Expected a priority 10 Live Activity push, got %v", header)
+	}
+	state := aps["content-state"].(map[string]interface{})
+	if aps["event"] != "update" || state["your_turn"] != true || state["clock_deadline"] != float64(now.Add(time.Hour).Unix()) {
+		t.Errorf("Expected the user's turn and clock in the update, got %v", aps)
+	}
+
+	// The opponent's turn is pushed at low priority
+	game.JSON.Clock.CurrentPlayer = 678
+	game.JSON.Moves = make([]json.RawMessage, 1)
+	srv.updateLiveActivities("12345", 12345, []Game{game}, now)
+	if len(pushes) != 2 || pushes[1].header.Get("apns-priority") != "5" {
+		t.Fatalf("Expected a priority 5 update after the move, got %d pushes", len(pushes))
+	}
+
+	// Once the game is over the activity is ended and forgotten
+	srv.updateLiveActivities("12345", 12345, nil, now)
+	if len(pushes) != 3 || pushes[2].body["aps"].(map[string]interface{})["event"] != "end" {
+		t.Fatalf("Expected an end event, got %d pushes", len(pushes))
+	}
+	if code := serve("DELETE", testDeviceToken, ""); code != http.StatusNotFound {
+		t.Errorf("Expected the ended activity to be removed, got %d", code)
+	}
+}
+
+// TestBadgeUpdates tests that the badge is lowered with a silent push as the
+// user plays their moves
+func TestBadgeUpdates(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	var badges []string
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		badges = append(badges, string(body))
+		w.Header().Set("apns-id", "test-id")
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+	srv.storage.shard("12345").deviceTokens["12345"] = testDeviceToken
+
+	srv.recordAwaitingMoves("12345", 3)
+	if badge := srv.turnBadge("12345", 1); badge != 3 {
+		t.Errorf("Expected the turn push to count every waiting game, got %d", badge)
+	}
+	srv.setBadgeShown("12345", 3)
+	srv.updateBadge("12345")
+	if len(badges) != 0 {
+		t.Fatalf("Expected no update while the badge is right, got %v", badges)
+	}
+
+	// A turn push in flight carries the badge itself
+	srv.recordAwaitingMoves("12345", 0)
+	srv.storage.shard("12345").pendingNotifications["12345"] = &PendingNotification{inFlight: true}
+	srv.updateBadge("12345")
+	if len(badges) != 0 {
+		t.Fatalf("Expected no update with a turn push in flight, got %v", badges)
+	}
+
+	delete(srv.storage.shard("12345").pendingNotifications, "12345")
+	srv.updateBadge("12345")
+	srv.updateBadge("12345")
+	if len(badges) != 1 || badges[0] != `{"aps":{"badge":0}}` {
+		t.Fatalf("Expected one silent push clearing the badge, got %v", badges)
+	}
+	if _, exists := srv.storage.shard("12345").badgeCounts["12345"]; exists {
+		t.Error("Expected a cleared badge to be forgotten")
+	}
+}
+
+// TestTurnTemplate tests rendering the user's own text for turn notifications
+func TestTurnTemplate(t *testing.T) {
+	t.Parallel()
+	for _, template := range []string{"{{player}} moved", "Your move in {{game", "line\nbreak", strings.Repeat("x", 201)} {
+		if (UserPreferences{TurnTemplate: template}).validate() == "" {
+			t.Errorf("Expected %q to be rejected", template)
+		}
+	}
+	template := "⚫ {{opponent}} played — your move in {{game}} ({{move}})"
+	if problem := (UserPreferences{TurnTemplate: template}).validate(); problem != "" {
+		t.Fatalf("Expected the template to be accepted, got %s", problem)
+	}
+
+	// Names from OGS are inserted as they are, not read as placeholders
+	game := Game{ID: 7, Name: "{{opponent}}'s game", Black: GamePlayer{ID: 1}, White: GamePlayer{ID: 2, Username: "PlayerX"}}
+	game.JSON.Moves = make([]json.RawMessage, 12)
+	alert := buildTurnAlert(1, []Game{game}, 0, budgetSend, template)
+	if alert.Body != "⚫ PlayerX played — your move in {{opponent}}'s game (12)" {
+		t.Errorf("Unexpected body %q", alert.Body)
+	}
+
+	// Grouped pushes keep their summary
+	if grouped := buildTurnAlert(1, []Game{game, {ID: 8}}, 0, budgetSend, template); grouped.Body != "It's your turn in 2 games" {
+		t.Errorf("Expected the template to apply to one game only, got %q", grouped.Body)
+	}
+}
+
+// TestTelegramChannel tests linking a Telegram chat and delivering to it
+func TestTelegramChannel(t *testing.T) {
+	srv := newTestServer(t)
+
+	var received []telegramMessage
+	blocked := false
+	botAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottest-token/sendMessage" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"ok":false,"description":"Not Found"}`))
+			return
+		}
+		var message telegramMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		if blocked || message.ChatID == 404 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"ok":false,"description":"Forbidden: bot was blocked by the user"}`))
+			return
+		}
+		received = append(received, message)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer botAPI.Close()
+
+	defer func(apiURL string) { telegramAPIURL = apiURL }(telegramAPIURL)
+	telegramAPIURL = botAPI.URL
+	srv.telegram = &telegramSender{token: "test-token", client: botAPI.Client()}
+
+	r := srv.newRouter()
+	accessToken := fakeOGSAccount(t, "12345")
+	link := func(body string) int {
+		req := httptest.NewRequest("PUT", "/telegram/12345", strings.NewReader(body))
+		req.RemoteAddr = "10.14.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, accessToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := link(`{"chat_id": 404}`); code != http.StatusBadGateway {
+		t.Errorf("Expected a chat the bot can't write to to be rejected, got %d", code)
+	}
+	if code := link(`{"chat_id": 777}`); code != http.StatusNoContent || len(received) != 1 {
+		t.Fatalf("Expected the chat to be linked after a test message, got %d", code)
+	}
+	if !srv.storage.notifiedUsers()["12345"] {
+		t.Error("Expected a user with only a Telegram chat to be checked")
+	}
+
+	if err := srv.sendGamePushNotification("12345", 987, "Game finished", "You won <b>", "game_result"); err != nil {
+		t.Fatalf("Expected the message to be sent, got %v", err)
+	}
+	message := received[1]
+	if message.Text != "<b>Game finished</b>\nYou won &lt;b&gt;" || message.ParseMode != "HTML" {
+		t.Errorf("Expected an escaped HTML message, got %q", message.Text)
+	}
+	if message.ReplyMarkup == nil || message.ReplyMarkup.InlineKeyboard[0][0].URL != ogsGameLink(987) {
+		t.Errorf("Expected an Open game button, got %+v", message.ReplyMarkup)
+	}
+
+	// The webhook answers with the chat ID, only when Telegram signs it
+	t.Setenv("TELEGRAM_WEBHOOK_SECRET", "webhook-secret")
+	update := func(secret string) int {
+		req := httptest.NewRequest("POST", "/telegram/webhook", strings.NewReader(`{"message": {"chat": {"id": 555}, "text": "/start"}}`))
+		req.RemoteAddr = "10.14.0.1:1234"
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := update("wrong"); code != http.StatusNotFound {
+		t.Errorf("Expected an unsigned update to be refused, got %d", code)
+	}
+	if code := update("webhook-secret"); code != http.StatusOK || !strings.Contains(received[len(received)-1].Text, "555") {
+		t.Errorf("Expected a reply with the chat ID, got %d", code)
+	}
+
+	// Once the user blocks the bot, the chat is unlinked
+	blocked = true
+	srv.sendGamePushNotification("12345", 987, "Game finished", "You won", "game_result")
+	if _, exists := srv.storage.shard("12345").telegramChats["12345"]; exists {
+		t.Error("Expected a blocked chat to be unlinked")
+	}
+}
+
+// TestDiscordChannel tests posting notifications to a user's and a club's
+// Discord webhooks
+func TestDiscordChannel(t *testing.T) {
+	srv := newTestServer(t)
+
+	type post struct {
+		Path   string
+		Embeds []struct {
+			Title  string            `json:"title"`
+			URL    string            `json:"url"`
+			Author map[string]string `json:"author"`
+		} `json:"embeds"`
+	}
+	var posts []post
+	discord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/deleted") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		received := post{Path: r.URL.Path}
+		json.NewDecoder(r.Body).Decode(&received)
+		posts = append(posts, received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer discord.Close()
+
+	defer func(prefixes []string) { discordWebhookPrefixes = prefixes }(discordWebhookPrefixes)
+	discordWebhookPrefixes = []string{discord.URL + "/api/webhooks/"}
+	userWebhook := discord.URL + "/api/webhooks/1/user"
+	clubWebhook := discord.URL + "/api/webhooks/2/club"
+
+	router := srv.newRouter()
+	accessToken := fakeOGSAccount(t, "12345")
+	putWebhook := func(body string) int {
+		req := httptest.NewRequest("PUT", "/discord/12345", strings.NewReader(body))
+		req.RemoteAddr = "10.13.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, accessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/discord-clubs/{clubID}", srv.setDiscordClub).Methods("PUT")
+	put := func(path, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := putWebhook(`{"webhook_url": "https://example.com/api/webhooks/1/user"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a webhook on another host to be rejected, got %d", code)
+	}
+	if code := putWebhook(fmt.Sprintf(`{"webhook_url": %q}`, userWebhook)); code != http.StatusNoContent {
+		t.Fatalf("Expected the webhook to be set, got %d", code)
+	}
+	if code := put("/admin/discord-clubs/go-club", fmt.Sprintf(`{"webhook_url": %q, "members": {"12345": "Alice", "678": "Bob"}}`, clubWebhook)); code != http.StatusNoContent {
+		t.Fatalf("Expected the club to be set, got %d", code)
+	}
+	if !srv.storage.notifiedUsers()["678"] {
+		t.Error("Expected club members to be checked")
+	}
+	posts = nil
+
+	// Results go to the user's webhook and the club, marked with the member
+	if err := srv.sendGamePushNotification("12345", 987, "Opponent resigned", "You won", "game_result"); err != nil {
+		t.Fatalf("Expected the result to be posted, got %v", err)
+	}
+	if len(posts) != 2 || posts[1].Path != "/api/webhooks/2/club" || posts[1].Embeds[0].Author["name"] != "Alice" || posts[1].Embeds[0].URL != ogsGameLink(987) {
+		t.Fatalf("Expected posts to the user's and the club's webhooks, got %+v", posts)
+	}
+
+	// Other events don't go to the club
+	posts = nil
+	srv.sendGamePushNotification("12345", 987, "Clock resumed", "The game goes on", "clock_resumed")
+	if len(posts) != 1 || posts[0].Path != "/api/webhooks/1/user" {
+		t.Errorf("Expected only the user's webhook, got %+v", posts)
+	}
+
+	// A webhook deleted in Discord is forgotten
+	srv.storage.shard("678").discordWebhooks["678"] = discord.URL + "/api/webhooks/3/deleted"
+	srv.sendGamePushNotification("678", 987, "Opponent resigned", "You lost", "game_result")
+	if _, exists := srv.storage.shard("678").discordWebhooks["678"]; exists {
+		t.Error("Expected the deleted webhook to be removed")
+	}
+	if _, exists := srv.storage.discordClubs.Load("go-club"); !exists {
+		t.Error("Expected the club to be kept")
+	}
+}
+
+// TestUserWebhook tests delivering signed events to a user's webhook
+func TestUserWebhook(t *testing.T) {
+	srv := newTestServer(t)
+
+	var secret string
+	var events []WebhookEvent
+	gone := false
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		if secret != "" && r.Header.Get("X-OGS-Signature") != signWebhook(secret, body, time.Unix(event.SentAt, 0)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if gone {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	if err := publicAddressOnly("tcp", receiver.Listener.Addr().String(), nil); err == nil {
+		t.Error("Expected webhooks to be kept off loopback addresses")
+	}
+	webhookClient = receiver.Client()
+
+	router := srv.newRouter()
+	accessToken := fakeOGSAccount(t, "12345")
+	put := func(webhookURL string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/webhook/12345", strings.NewReader(fmt.Sprintf(`{"url": %q}`, webhookURL)))
+		req.RemoteAddr = "10.11.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, accessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := put("http://example.com/hook"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a plain http webhook to be rejected, got %d", w.Code)
+	}
+	w := put(receiver.URL + "/hook")
+	var webhook UserWebhook
+	json.NewDecoder(w.Body).Decode(&webhook)
+	if w.Code != http.StatusOK || len(webhook.Secret) != 64 || len(events) != 1 || events[0].Event != "ping" {
+		t.Fatalf("Expected the webhook to be set after a ping, got %d", w.Code)
+	}
+	secret = webhook.Secret
+
+	if err := srv.sendGamePushNotification("12345", 987, "Opponent resigned", "You won", "game_result"); err != nil {
+		t.Fatalf("Expected the event to be delivered, got %v", err)
+	}
+	if event := events[1]; event.Event != "game_result" || event.UserID != "12345" || event.GameID != 987 || event.URL != ogsGameLink(987) {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// A webhook answering 410 is removed
+	gone = true
+	srv.sendGamePushNotification("12345", 987, "Opponent resigned", "You won", "game_result")
+	if _, exists := srv.storage.shard("12345").userWebhooks["12345"]; exists {
+		t.Error("Expected the webhook to be removed")
+	}
+}
+
+// TestSlackChannel tests posting notifications through a Slack webhook and a
+// bot token
+func TestSlackChannel(t *testing.T) {
+	srv := newTestServer(t)
+
+	type post struct {
+		Path          string
+		Authorization string
+		Channel       string `json:"channel"`
+		Text          string `json:"text"`
+		Blocks        []struct {
+			Type     string `json:"type"`
+			Elements []struct {
+				URL string `json:"url"`
+			} `json:"elements"`
+		} `json:"blocks"`
+	}
+	var posts []post
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := post{Path: r.URL.Path, Authorization: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&received)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/removed"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "no_service")
+		case r.URL.Path == "/api/chat.postMessage" && received.Channel == "C0ARCHIVED":
+			fmt.Fprint(w, `{"ok": false, "error": "is_archived"}`)
+		case r.URL.Path == "/api/chat.postMessage":
+			posts = append(posts, received)
+			fmt.Fprint(w, `{"ok": true}`)
+		default:
+			posts = append(posts, received)
+			fmt.Fprint(w, "ok")
+		}
+	}))
+	defer slack.Close()
+
+	defer func(prefix, api string) { slackWebhookPrefix, slackAPIURL = prefix, api }(slackWebhookPrefix, slackAPIURL)
+	slackWebhookPrefix = slack.URL + "/services/"
+	slackAPIURL = slack.URL + "/api"
+
+	router := srv.newRouter()
+	fakeOGSAccount(t, "12345")
+	put := func(userID, body string) int {
+		req := httptest.NewRequest("PUT", "/slack/"+userID, strings.NewReader(body))
+		req.RemoteAddr = "10.12.0.1:1234"
+		req.Header.Set(ogsAccessTokenHeader, "token-"+userID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put("12345", `{"webhook_url": "https://example.com/services/T1/B1/x"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a webhook on another host to be rejected, got %d", code)
+	}
+	if code := put("12345", `{"bot_token": "xoxb-1", "channel": "general"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a channel name instead of an ID to be rejected, got %d", code)
+	}
+	if code := put("12345", fmt.Sprintf(`{"webhook_url": %q}`, slack.URL+"/services/T1/B1/x")); code != http.StatusNoContent {
+		t.Fatalf("Expected the webhook to be set, got %d", code)
+	}
+	if code := put("678", `{"bot_token": "xoxb-1", "channel": "U0123456"}`); code != http.StatusNoContent {
+		t.Fatalf("Expected the bot destination to be set, got %d", code)
+	}
+	if !srv.storage.notifiedUsers()["678"] {
+		t.Error("Expected users with a Slack destination to be checked")
+	}
+	posts = nil
+
+	// Webhooks post the message with a button to the game
+	if err := srv.sendGamePushNotification("12345", 987, "Opponent resigned", "You won", "game_result"); err != nil {
+		t.Fatalf("Expected the result to be posted, got %v", err)
+	}
+	if len(posts) != 1 || posts[0].Path != "/services/T1/B1/x" || posts[0].Text != "Opponent resigned: You won" || posts[0].Blocks[1].Elements[0].URL != ogsGameLink(987) {
+		t.Fatalf("Expected a post to the webhook, got %+v", posts)
+	}
+
+	// Bots post to the channel with their token
+	posts = nil
+	srv.sendGamePushNotification("678", 987, "Opponent resigned", "You lost", "game_result")
+	if len(posts) != 1 || posts[0].Channel != "U0123456" || posts[0].Authorization != "Bearer xoxb-1" {
+		t.Fatalf("Expected a post from the bot, got %+v", posts)
+	}
+
+	// Removed webhooks and archived channels are forgotten
+	srv.storage.shard("12345").slackDestinations["12345"] = &SlackDestination{WebhookURL: slack.URL + "/services/T1/B1/removed"}
+	srv.storage.shard("678").slackDestinations["678"] = &SlackDestination{BotToken: "xoxb-1", Channel: "C0ARCHIVED"}
+	srv.sendGamePushNotification("12345", 987, "Opponent resigned", "You won", "game_result")
+	srv.sendGamePushNotification("678", 987, "Opponent resigned", "You lost", "game_result")
+	if len(srv.storage.snapshot().SlackDestinations) != 0 {
+		t.Errorf("Expected the gone destinations to be removed, got %+v", srv.storage.snapshot().SlackDestinations)
+	}
+}
+
+// TestFinalClockWarningEscalation tests that the final low-clock warning is
+// scheduled as a reminder and sent as time-sensitive
+func TestFinalClockWarningEscalation(t *testing.T) {
+	srv := newTestServer(t)
+
+	type push struct {
+		header http.Header
+		body   map[string]interface{}
+	}
+	var pushes []push
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		pushes = append(pushes, push{r.Header, body})
+		w.Header().Set("apns-id", "test-id")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apns.Close()
+
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+	srv.storage.shard("12345").deviceTokens["12345"] = "device-token"
+	t.Setenv("APNS_LOW_PRIORITY_EVENTS", "low_clock")
+
+	now := time.Now()
+	game := Game{ID: 77, Name: "Slow game"}
+	game.JSON.TimeControl = TimeControl{System: "fischer", Speed: "correspondence"}
+	game.JSON.Clock.CurrentPlayer = 12345
+	game.JSON.Clock.Expiration = now.Add(20 * time.Hour).UnixMilli()
+
+	// The final warning is scheduled for when an hour is left, and dropped
+	// once the user moves
+	srv.checkLowClock("12345", 12345, game, now)
+	reminders := srv.storage.shard("12345").reminders["12345"]
+	if len(reminders) != 1 || reminders[0].Deadline == 0 || reminders[0].RemindAt < now.Add(19*time.Hour-time.Minute).Unix() || reminders[0].RemindAt > now.Add(19*time.Hour+time.Minute).Unix() {
+		t.Fatalf("Expected the final warning scheduled 19 hours out, got %+v", reminders)
+	}
+	game.JSON.Clock.CurrentPlayer = 678
+	srv.checkLowClock("12345", 12345, game, now)
+	if len(srv.storage.shard("12345").reminders["12345"]) != 0 {
+		t.Fatal("Expected the final warning to be dropped once the user moved")
+	}
+
+	// When it comes due it's sent as time-sensitive at high priority
+	game.JSON.Clock.CurrentPlayer = 12345
+	srv.checkLowClock("12345", 12345, game, now)
+	reminder := srv.storage.shard("12345").reminders["12345"][0]
+	reminder.RemindAt = now.Unix()
+	reminder.Deadline = now.Add(50 * time.Minute).Unix()
+	if delivered := srv.processDueReminders(time.Now(), srv.sendReminderNotification); delivered != 1 {
+		t.Fatalf("Expected the final warning to be sent, got %d", delivered)
+	}
+	if len(pushes) != 1 {
+		t.Fatalf("Expected one push, got %d", len(pushes))
+	}
+	aps, _ := pushes[0].body["aps"].(map[string]interface{})
+	alert, _ := aps["alert"].(map[string]interface{})
+	if aps["interruption-level"] != "time-sensitive" || pushes[0].header.Get("apns-priority") != "10" || alert["title"] != "Almost out of time!" {
+		t.Errorf("Expected a time-sensitive final warning, got %v %v", pushes[0].header, pushes[0].body)
+	}
+
+	// A check reaching the last level afterwards doesn't warn again
+	game.JSON.Clock.Expiration = now.Add(30 * time.Minute).UnixMilli()
+	if srv.checkLowClock("12345", 12345, game, now) {
+		t.Error("Expected no second final warning")
+	}
+}
+
+// TestSnooze tests snoozing a user's notifications, or one game's, and
+// delivering held turns once the snooze ends
+func TestSnooze(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.shard("12345").setDevice("12345", testDeviceToken, "")
+	r := srv.newRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "10.16.0.1:1234"
+		req.Header.Set(deviceTokenHeader, testDeviceToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("POST", "/snooze/12345", `{"minutes": 0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a snooze of 0 minutes to be rejected, got %d", w.Code)
+	}
+
+	// The notification action snoozes one game for an hour without a body
+	now := time.Now()
+	w := request("POST", "/snooze/12345/77", "")
+	var snooze Snooze
+	json.NewDecoder(w.Body).Decode(&snooze)
+	if w.Code != http.StatusOK || snooze.Games[77] < now.Add(59*time.Minute).Unix() || snooze.Until != 0 {
+		t.Fatalf("Expected game 77 snoozed for an hour, got %d %+v", w.Code, snooze)
+	}
+
+	games := []Game{{ID: 77, Name: "Snoozed"}, {ID: 88, Name: "Awake"}}
+	if toSend := srv.turnsToNotify("12345", games, false, now); len(toSend) != 1 || toSend[0].ID != 88 {
+		t.Errorf("Expected only the game not snoozed, got %+v", toSend)
+	}
+	if err := srv.sendGamePushNotification("12345", 77, "Clock resumed", "The game goes on", "clock_resumed"); !errors.Is(err, errPushSnoozed) {
+		t.Errorf("Expected pushes about the snoozed game to be skipped, got %v", err)
+	}
+
+	// Retries of pushes queued before the snooze are held the same way,
+	// unless they're urgent
+	retry := PushRetry{Title: "Clock resumed", Action: "clock_resumed", Custom: map[string]interface{}{"game_id": float64(77)}}
+	if err := srv.retryUserPush("12345", retry); !errors.Is(err, errPushSnoozed) {
+		t.Errorf("Expected the retry about the snoozed game to be skipped, got %v", err)
+	}
+	retry.Custom["urgent"] = true
+	if err := srv.retryUserPush("12345", retry); errors.Is(err, errPushSnoozed) {
+		t.Error("Expected an urgent retry not to be snoozed")
+	}
+
+	// Held turns go out once the snooze is over
+	if toSend := srv.turnsToNotify("12345", games, false, now.Add(61*time.Minute)); len(toSend) != 2 {
+		t.Errorf("Expected both games after the snooze, got %+v", toSend)
+	}
+
+	// Snoozing everything holds every game until it's cancelled
+	request("POST", "/snooze/12345", `{"minutes": 30}`)
+	if toSend := srv.turnsToNotify("12345", games, false, now); len(toSend) != 0 {
+		t.Errorf("Expected every game held, got %+v", toSend)
+	}
+	if w := request("DELETE", "/snooze/12345/77", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the game's snooze to be cancelled, got %d", w.Code)
+	}
+	if w := request("DELETE", "/snooze/12345/88", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected cancelling a game not snoozed to fail, got %d", w.Code)
+	}
+	if !srv.storage.shard("12345").snoozed("12345", 88, now) {
+		t.Error("Expected the snooze of every game to be kept")
+	}
+
+	// Expired snoozes are dropped
+	if expired := srv.expireSnoozes(now.Add(31 * time.Minute)); expired != 1 || len(srv.storage.snapshot().Snoozes) != 0 {
+		t.Errorf("Expected the expired snooze to be dropped, got %d", expired)
+	}
+}
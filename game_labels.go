@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxLabelsPerGame = 10
+	maxLabelLength   = 32
+)
+
+// GameLabelsRequest sets the labels a user has given one of their games, and
+// optionally mutes or unmutes it
+type GameLabelsRequest struct {
+	Labels []string `json:"labels"`
+	Muted  *bool    `json:"muted,omitempty"`
+}
+
+// normalizeLabels lowercases and de-duplicates labels, or reports what's wrong
+// with them. Labels are letters, digits, spaces, '-' and '_'.
+func normalizeLabels(labels []string) ([]string, string) {
+	if len(labels) > maxLabelsPerGame {
+		return nil, "at most 10 labels per game"
+	}
+
+	normalized := make([]string, 0, len(labels))
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label == "" || len(label) > maxLabelLength {
+			return nil, "labels must be 1 to 32 characters"
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == ' ' || r == '-' || r == '_') {
+				return nil, "labels may only contain letters, digits, spaces, '-' and '_'"
+			}
+		}
+		if !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	return normalized, ""
+}
+
+// gameLabelsFor returns a copy of the labels on a user's game
+func (srv *Server) gameLabelsFor(userID string, gameID int) []string {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if record := shard.game(userID, gameID); record != nil {
+		return append([]string(nil), record.Labels...)
+	}
+	return nil
+}
+
+// setGameLabels handles POST /labels/{userID}/{gameID}. The labels replace
+// any already on the game; an empty list removes them. muted, when given,
+// mutes or unmutes the game.
+func (srv *Server) setGameLabels(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	gameID, err := strconv.Atoi(vars["gameID"])
+	if err != nil || gameID <= 0 {
+		http.Error(w, "Invalid game ID", http.StatusBadRequest)
+		return
+	}
+
+	var req GameLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	labels, problem := normalizeLabels(req.Labels)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	record := shard.gameRecord(userID, gameID)
+	record.Labels = nil
+	if len(labels) > 0 {
+		record.Labels = labels
+	}
+	if req.Muted != nil {
+		record.Muted = *req.Muted
+	}
+	muted := record.Muted
+	shard.deleteGameIfEmpty(userID, gameID)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	log.Printf("Set %d label(s) on game %d for user %s", len(labels), gameID, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"game_id": gameID, "labels": labels, "muted": muted})
+}
+
+// getGameLabels handles GET /labels/{userID}: every labeled game, by game ID
+func (srv *Server) getGameLabels(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	labels := make(map[int][]string)
+	for gameID, record := range shard.games[userID] {
+		if len(record.Labels) > 0 {
+			labels[gameID] = append([]string(nil), record.Labels...)
+		}
+	}
+	shard.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
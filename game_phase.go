@@ -0,0 +1,20 @@
+package main
+
+// Started reports whether play has begun. OGS can list a game, with the user
+// as current_player, while it's still being set up: outside the play and
+// scoring phases, or while black places free handicap stones. Those games
+// aren't anyone's turn yet. Payloads without a phase or move list are treated
+// as started, so missing fields never hide a turn.
+func (g Game) Started() bool {
+	switch g.JSON.Phase {
+	case "", "play", "stone removal":
+	default:
+		return false
+	}
+
+	if g.JSON.FreeHandicapPlacement && g.JSON.Handicap > 1 &&
+		g.JSON.Moves != nil && len(g.JSON.Moves) < g.JSON.Handicap {
+		return false
+	}
+	return true
+}
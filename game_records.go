@@ -0,0 +1,92 @@
+package main
+
+// GameRecord is everything stored about one of a user's games: the position
+// last notified or seen, notification history, and the user's own settings
+// for the game. Records for games that leave the user's active list are
+// dropped when the user is next checked.
+type GameRecord struct {
+	LastMove       int64    `json:"last_move"`
+	MoveNumber     int      `json:"move_number,omitempty"` // 0 when unknown
+	LastNotifiedAt int64    `json:"last_notified_at,omitempty"`
+	NotifyCount    int      `json:"notify_count,omitempty"`
+	Muted          bool     `json:"muted,omitempty"` // never pushed, whatever the user's rules say
+	Labels         []string `json:"labels,omitempty"`
+}
+
+// tracked reports whether the record holds a position. A record can exist
+// only for the user's settings, before the game has been seen.
+func (r *GameRecord) tracked() bool {
+	return r.LastMove > 0 || r.MoveNumber > 0
+}
+
+// hasMetadata reports whether the record holds anything besides the position
+func (r *GameRecord) hasMetadata() bool {
+	return r.LastNotifiedAt != 0 || r.NotifyCount != 0 || r.Muted || len(r.Labels) > 0
+}
+
+// game returns the record of a user's game, or nil. Callers must hold mu.
+func (s *storageShard) game(userID string, gameID int) *GameRecord {
+	return s.games[userID][gameID]
+}
+
+// gameRecord returns the record of a user's game, creating it if needed.
+// Callers must hold mu for writing.
+func (s *storageShard) gameRecord(userID string, gameID int) *GameRecord {
+	if s.games[userID] == nil {
+		s.games[userID] = make(map[int]*GameRecord)
+	}
+	record := s.games[userID][gameID]
+	if record == nil {
+		record = &GameRecord{}
+		s.games[userID][gameID] = record
+	}
+	return record
+}
+
+// deleteGameIfEmpty drops a record left with no position and no metadata.
+// Callers must hold mu for writing.
+func (s *storageShard) deleteGameIfEmpty(userID string, gameID int) {
+	if record := s.games[userID][gameID]; record != nil && !record.tracked() && !record.hasMetadata() {
+		delete(s.games[userID], gameID)
+	}
+}
+
+// upgradeLegacyGames folds the per-game maps that state was kept in before
+// GameRecord into Games, so state written by older versions loads unchanged
+func (data *storageFile) upgradeLegacyGames() {
+	if data.Moves == nil && data.MoveNumbers == nil && data.GameLabels == nil {
+		return
+	}
+	if data.Games == nil {
+		data.Games = make(map[string]map[int]*GameRecord)
+	}
+	record := func(userID string, gameID int) *GameRecord {
+		if data.Games[userID] == nil {
+			data.Games[userID] = make(map[int]*GameRecord)
+		}
+		if data.Games[userID][gameID] == nil {
+			data.Games[userID][gameID] = &GameRecord{}
+		}
+		return data.Games[userID][gameID]
+	}
+
+	for userID, moves := range data.Moves {
+		if data.Games[userID] == nil {
+			data.Games[userID] = make(map[int]*GameRecord)
+		}
+		for gameID, lastMove := range moves {
+			record(userID, gameID).LastMove = lastMove
+		}
+	}
+	for userID, numbers := range data.MoveNumbers {
+		for gameID, moveNumber := range numbers {
+			record(userID, gameID).MoveNumber = moveNumber
+		}
+	}
+	for userID, labels := range data.GameLabels {
+		for gameID, gameLabels := range labels {
+			record(userID, gameID).Labels = gameLabels
+		}
+	}
+	data.Moves, data.MoveNumbers, data.GameLabels = nil, nil, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFinishedGamesPerUser caps the per-user history of removed games
+const maxFinishedGamesPerUser = 20
+
+// FinishedGame records a game that dropped out of a user's active games
+type FinishedGame struct {
+	GameID    int    `json:"game_id"`
+	Outcome   string `json:"outcome,omitempty"` // OGS outcome, e.g. "Resignation", "Timeout", "7.5 points"
+	Result    string `json:"result"`            // "won", "lost", "annulled" or "unknown"
+	RemovedAt int64  `json:"removed_at"`
+}
+
+// GameDetails is the subset of /api/v1/games/{id} used to explain why a game ended
+type GameDetails struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Outcome  string `json:"outcome"`
+	Winner   int    `json:"winner"`
+	Annulled bool   `json:"annulled"`
+	Ended    string `json:"ended"`
+	Players  struct {
+		Black GamePlayer `json:"black"`
+		White GamePlayer `json:"white"`
+	} `json:"players"`
+}
+
+// detectRemovedGames compares the stored games for a user against the current
+// active games. Games that are no longer active are removed from storage, their
+// outcome is recorded when OGS can tell us, and the user is notified of games
+// their opponent resigned or lost on time, or optionally of every result.
+func (srv *Server) detectRemovedGames(userID string, activeGames []Game) []FinishedGame {
+	active := make(map[int]bool, len(activeGames))
+	for _, game := range activeGames {
+		active[game.ID] = true
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	var removedIDs []int
+	for gameID, record := range shard.games[userID] {
+		if !active[gameID] && record.tracked() {
+			removedIDs = append(removedIDs, gameID)
+		}
+	}
+	for _, gameID := range removedIDs {
+		delete(shard.games[userID], gameID)
+		delete(shard.pausedGames[userID], gameID)
+		delete(shard.periodWarnings[userID], gameID)
+		delete(shard.clockWarnings[userID], gameID)
+		if pending := shard.pendingNotifications[userID]; pending != nil && !pending.inFlight {
+			delete(pending.Games, gameID)
+			if len(pending.Games) == 0 {
+				delete(shard.pendingNotifications, userID)
+			}
+		}
+	}
+	shard.mu.Unlock()
+
+	if len(removedIDs) == 0 {
+		return nil
+	}
+
+	log.Printf("User %s: %d game(s) no longer active, cleaning up", userID, len(removedIDs))
+
+	finished := make([]FinishedGame, 0, len(removedIDs))
+	forfeits := make(map[int]*GameDetails)
+	for _, gameID := range removedIDs {
+		entry := FinishedGame{GameID: gameID, Result: "unknown", RemovedAt: time.Now().Unix()}
+
+		// Outcomes are a nice-to-have; skip the lookup while OGS is struggling
+		if !srv.optionalFeatureEnabled("game_results") {
+			finished = append(finished, entry)
+			continue
+		}
+
+		details, err := srv.getGameDetails(gameID)
+		if err != nil {
+			log.Printf("Could not determine outcome of game %d: %v", gameID, err)
+		} else {
+			entry.Outcome = details.Outcome
+			entry.Result = gameResultFor(userID, details)
+			if _, _, ok := opponentForfeitNotification(userID, details); ok {
+				forfeits[gameID] = details
+			}
+		}
+
+		finished = append(finished, entry)
+	}
+
+	srv.recordFinishedGames(userID, finished)
+
+	notifyForfeits := os.Getenv("NOTIFY_OPPONENT_FORFEITS") != "false"
+	notifyResults := os.Getenv("NOTIFY_GAME_RESULTS") == "true"
+	for _, entry := range finished {
+		if details := forfeits[entry.GameID]; details != nil && notifyForfeits {
+			go srv.sendOpponentForfeitNotification(userID, details)
+		} else if notifyResults && entry.Result != "unknown" {
+			go srv.sendGameResultNotification(userID, entry)
+		}
+	}
+
+	return finished
+}
+
+// gameResultFor maps OGS game details to a result from the user's point of view
+func gameResultFor(userID string, details *GameDetails) string {
+	if details.Annulled {
+		return "annulled"
+	}
+	if details.Winner == 0 {
+		return "unknown"
+	}
+	if strconv.Itoa(details.Winner) == userID {
+		return "won"
+	}
+	return "lost"
+}
+
+func (srv *Server) recordFinishedGames(userID string, finished []FinishedGame) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	history := append(shard.finishedGames[userID], finished...)
+	if len(history) > maxFinishedGamesPerUser {
+		history = history[len(history)-maxFinishedGamesPerUser:]
+	}
+	shard.finishedGames[userID] = history
+	shard.mu.Unlock()
+}
+
+// ogsGameURL is the OGS API URL of a game, formatted with its ID
+var ogsGameURL = "https://online-go.com/api/v1/games/%d"
+
+// getGameDetails fetches how a game ended, reusing the result if the other
+// player's check already fetched it
+func (srv *Server) getGameDetails(gameID int) (*GameDetails, error) {
+	state, err := srv.fetchGameState(gameID, true)
+	if err != nil {
+		return nil, err
+	}
+	details := *state.details
+	return &details, nil
+}
+
+func (srv *Server) sendGameResultNotification(userID string, entry FinishedGame) {
+	var body string
+	switch entry.Result {
+	case "won":
+		body = "You won"
+	case "lost":
+		body = "You lost"
+	case "annulled":
+		body = "Game annulled"
+	}
+	if entry.Outcome != "" && entry.Result != "annulled" {
+		body = fmt.Sprintf("%s by %s", body, entry.Outcome)
+	}
+	body = fmt.Sprintf("%s (game %d)", body, entry.GameID)
+
+	if err := srv.sendGamePushNotification(userID, entry.GameID, "Game finished", body, "game_result"); err != nil {
+		log.Printf("Game result notification not sent to user %s: %v", userID, err)
+	}
+}
+
+// opponentForfeitNotification describes a game the user won because their
+// opponent resigned or ran out of time. ok is false for any other ending.
+func opponentForfeitNotification(userID string, details *GameDetails) (title, body string, ok bool) {
+	if gameResultFor(userID, details) != "won" {
+		return "", "", false
+	}
+	switch strings.ToLower(details.Outcome) {
+	case "resignation":
+		title = "Opponent resigned"
+	case "timeout":
+		title = "Opponent ran out of time"
+	default:
+		return "", "", false
+	}
+
+	opponent := details.Players.Black
+	if strconv.Itoa(opponent.ID) == userID {
+		opponent = details.Players.White
+	}
+	game := details.Name
+	if game == "" {
+		game = fmt.Sprintf("game %d", details.ID)
+	}
+	body = "You won " + game
+	if opponent.Username != "" {
+		body += " against " + opponent.Username
+	}
+	return title, body, true
+}
+
+func (srv *Server) sendOpponentForfeitNotification(userID string, details *GameDetails) {
+	title, body, _ := opponentForfeitNotification(userID, details)
+	if err := srv.sendGamePushNotification(userID, details.ID, title, body, "game_result"); err != nil {
+		log.Printf("Opponent forfeit notification not sent to user %s: %v", userID, err)
+	}
+}
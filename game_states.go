@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// When two registered users play each other, the same game comes up in both
+// of their checks: in both profiles, in both paged games lists, and, once it
+// ends, in both lookups of its result. Game states are kept here by game ID
+// for a short while, so a game found in one user's check isn't fetched again
+// for the other. The cache is cleared at the start of every check cycle, so
+// each cycle sees each game's state once, as fetched during that cycle.
+
+type cachedGameState struct {
+	game      Game
+	ended     bool
+	details   *GameDetails // nil when the state came from a player's games list
+	fetchedAt time.Time
+}
+
+// gameStateCacheHits counts game fetches served from Server.gameStates
+var gameStateCacheHits atomic.Int64
+
+// gameStateTTL reads GAME_STATE_CACHE_SECONDS, how long a game's state is
+// reused (default: half the check interval; 0 turns the cache off)
+func gameStateTTL() time.Duration {
+	if value := os.Getenv("GAME_STATE_CACHE_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return checkInterval() / 2
+}
+
+// cachedGame returns the game's state if it was fetched recently
+func (srv *Server) cachedGame(gameID int, now time.Time) (cachedGameState, bool) {
+	state, exists := srv.gameStates.Load(gameID)
+	if !exists || now.Sub(state.fetchedAt) >= gameStateTTL() {
+		return cachedGameState{}, false
+	}
+	return state, true
+}
+
+// rememberListedGames keeps the active games from a player's games list
+func (srv *Server) rememberListedGames(games []Game, now time.Time) {
+	if gameStateTTL() == 0 {
+		return
+	}
+	for _, game := range games {
+		srv.gameStates.Store(game.ID, cachedGameState{game: game, fetchedAt: now})
+	}
+}
+
+// clearGameStates forgets every cached game state
+func (srv *Server) clearGameStates() {
+	srv.gameStates.mu.Lock()
+	defer srv.gameStates.mu.Unlock()
+	clear(srv.gameStates.m)
+}
+
+// fetchGameState returns a game from the OGS games API, or from the cache
+// when it was fetched recently. Results are only served from a games API
+// response, since a games list doesn't say how a game ended.
+func (srv *Server) fetchGameState(gameID int, needDetails bool) (cachedGameState, error) {
+	if state, cached := srv.cachedGame(gameID, time.Now()); cached && (state.details != nil || !needDetails) {
+		gameStateCacheHits.Add(1)
+		return state, nil
+	}
+
+	resp, err := srv.ogsGet(fmt.Sprintf(ogsGameURL, gameID))
+	if err != nil {
+		log.Printf("OGS game request failed for game %d: %v", gameID, err)
+		return cachedGameState{}, fmt.Errorf("failed to fetch game")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return cachedGameState{}, errGameNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("OGS game request returned status %d for game %d", resp.StatusCode, gameID)
+		return cachedGameState{}, fmt.Errorf("API request failed")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cachedGameState{}, fmt.Errorf("failed to process response")
+	}
+
+	var fetched ogsGame
+	var details GameDetails
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		log.Printf("Failed to parse OGS game response for game %d: %v", gameID, err)
+		return cachedGameState{}, fmt.Errorf("failed to process response")
+	}
+	if err := json.Unmarshal(body, &details); err != nil {
+		log.Printf("Failed to parse OGS game response for game %d: %v", gameID, err)
+		return cachedGameState{}, fmt.Errorf("failed to process response")
+	}
+
+	state := cachedGameState{
+		game: Game{
+			ID:    fetched.ID,
+			Name:  fetched.Name,
+			Black: fetched.Players.Black,
+			White: fetched.Players.White,
+			JSON:  fetched.Gamedata,
+		},
+		ended:     fetched.Ended != "" || fetched.Gamedata.Phase == "finished",
+		details:   &details,
+		fetchedAt: time.Now(),
+	}
+	if gameStateTTL() > 0 {
+		srv.gameStates.Store(gameID, state)
+	}
+	return state, nil
+}
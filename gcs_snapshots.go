@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// snapshotTimeFormat names snapshot objects so they sort oldest first
+const snapshotTimeFormat = "20060102T150405Z"
+
+// gcsSnapshots uploads gzipped copies of storage to a Cloud Storage bucket.
+// On Cloud Run the local moves.json disappears with the instance; restoring
+// the newest snapshot on a cold start brings back registrations and move
+// history, losing at most one snapshot interval of changes.
+type gcsSnapshots struct {
+	client *gcs.Client
+	bucket string
+	prefix string
+	keep   int
+	server *Server
+}
+
+// newGCSSnapshots reads GCS_SNAPSHOT_BUCKET, GCS_SNAPSHOT_PREFIX (default
+// "snapshots/") and GCS_SNAPSHOT_KEEP (default 48). Returns nil when no
+// bucket is configured.
+func newGCSSnapshots(server *Server) (*gcsSnapshots, error) {
+	bucket := os.Getenv("GCS_SNAPSHOT_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	prefix := os.Getenv("GCS_SNAPSHOT_PREFIX")
+	if prefix == "" {
+		prefix = "snapshots/"
+	}
+
+	keep := 48
+	if keepStr := os.Getenv("GCS_SNAPSHOT_KEEP"); keepStr != "" {
+		if parsed, err := strconv.Atoi(keepStr); err == nil && parsed > 0 {
+			keep = parsed
+		}
+	}
+
+	client, err := gcs.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloud storage client: %v", err)
+	}
+
+	return &gcsSnapshots{client: client, bucket: bucket, prefix: prefix, keep: keep, server: server}, nil
+}
+
+// gcsSnapshotInterval reads GCS_SNAPSHOT_INTERVAL_MINUTES, defaulting to 15
+func gcsSnapshotInterval() time.Duration {
+	if intervalStr := os.Getenv("GCS_SNAPSHOT_INTERVAL_MINUTES"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			return time.Duration(interval) * time.Minute
+		}
+	}
+	return 15 * time.Minute
+}
+
+// encodeSnapshot gzips the JSON form of data
+func encodeSnapshot(data *storageFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gw).Encode(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSnapshot reads a snapshot written by encodeSnapshot
+func decodeSnapshot(r io.Reader) (*storageFile, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	data := &storageFile{}
+	if err := json.NewDecoder(gr).Decode(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// expiredSnapshots returns the names beyond the newest keep
+func expiredSnapshots(names []string, keep int) []string {
+	sort.Strings(names)
+	if len(names) <= keep {
+		return nil
+	}
+	return names[:len(names)-keep]
+}
+
+// list returns the snapshot object names, oldest first
+func (g *gcsSnapshots) list(ctx context.Context) ([]string, error) {
+	var names []string
+	it := g.client.Bucket(g.bucket).Objects(ctx, &gcs.Query{Prefix: g.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, ".json.gz") {
+			names = append(names, attrs.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// upload writes the current storage as a new snapshot and deletes the
+// oldest beyond the number kept
+func (g *gcsSnapshots) upload(now time.Time) error {
+	g.server.storage.rlockAll()
+	data := g.server.storage.snapshot().copy()
+	g.server.storage.runlockAll()
+	encoded, err := encodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	name := g.prefix + now.UTC().Format(snapshotTimeFormat) + ".json.gz"
+	w := g.client.Bucket(g.bucket).Object(name).NewWriter(ctx)
+	w.ContentType = "application/json"
+	w.ContentEncoding = "gzip"
+	if _, err := w.Write(encoded); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	log.Printf("Uploaded storage snapshot gs://%s/%s (%d bytes)", g.bucket, name, len(encoded))
+
+	names, err := g.list(ctx)
+	if err != nil {
+		return fmt.Errorf("listing snapshots: %v", err)
+	}
+	for _, old := range expiredSnapshots(names, g.keep) {
+		if err := g.client.Bucket(g.bucket).Object(old).Delete(ctx); err != nil {
+			log.Printf("Error deleting old snapshot gs://%s/%s: %v", g.bucket, old, err)
+		}
+	}
+	return nil
+}
+
+// restoreIfEmpty loads the newest snapshot when storage came up empty, as on
+// a cold start with an ephemeral filesystem. Storage that already has users is
+// left alone, so a snapshot never replaces newer state.
+func (g *gcsSnapshots) restoreIfEmpty() error {
+	g.server.storage.rlockAll()
+	current := g.server.storage.snapshot()
+	empty := len(current.DeviceTokens) == 0 && len(current.NtfyTopics) == 0 && len(current.WebPushSubscriptions) == 0 && len(current.TelegramChats) == 0 && len(current.DiscordWebhooks) == 0 && len(current.DiscordClubs) == 0 && len(current.UserWebhooks) == 0 && len(current.SlackDestinations) == 0 && len(current.Games) == 0
+	g.server.storage.runlockAll()
+	if !empty {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	names, err := g.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		log.Printf("No storage snapshots in gs://%s/%s to restore", g.bucket, g.prefix)
+		return nil
+	}
+	latest := names[len(names)-1]
+
+	// Read the stored bytes as-is; decodeSnapshot does the decompression
+	r, err := g.client.Bucket(g.bucket).Object(latest).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := decodeSnapshot(r)
+	if err != nil {
+		return fmt.Errorf("reading snapshot %s: %v", latest, err)
+	}
+
+	g.server.storage.lockAll()
+	g.server.storage.reset()
+	g.server.storage.apply(data)
+	g.server.storage.unlockAll()
+	users := len(data.DeviceTokens)
+
+	log.Printf("Restored storage from snapshot gs://%s/%s: %d users with device tokens", g.bucket, latest, users)
+	if err := g.server.writeStorage(); err != nil {
+		g.server.retryStorageWrite()
+	}
+	return nil
+}
+
+// start uploads a snapshot every interval
+func (g *gcsSnapshots) start(interval time.Duration) {
+	log.Printf("Uploading storage snapshots to gs://%s/%s every %v", g.bucket, g.prefix, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := g.upload(time.Now()); err != nil {
+			log.Printf("Error uploading storage snapshot: %v", err)
+		}
+	}
+}
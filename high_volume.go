@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHighVolumeThreshold = 20
+	defaultBatchWindow         = 60 * time.Minute
+)
+
+// highVolumeThreshold is the number of active games above which "auto" mode
+// switches a user to grouped notifications (HIGH_VOLUME_GAME_THRESHOLD)
+func highVolumeThreshold() int {
+	if thresholdStr := os.Getenv("HIGH_VOLUME_GAME_THRESHOLD"); thresholdStr != "" {
+		if threshold, err := strconv.Atoi(thresholdStr); err == nil && threshold > 0 {
+			return threshold
+		}
+	}
+	return defaultHighVolumeThreshold
+}
+
+// highVolumeModeActive reports whether the user's pushes should be grouped
+func (srv *Server) highVolumeModeActive(userID string, activeGames int) bool {
+	return highVolumeModeFor(srv.preferencesFor(userID), activeGames)
+}
+
+// highVolumeModeFor applies a user's high_volume_mode preference
+func highVolumeModeFor(prefs UserPreferences, activeGames int) bool {
+	switch prefs.HighVolumeMode {
+	case "on":
+		return true
+	case "off":
+		return false
+	default:
+		return activeGames > highVolumeThreshold()
+	}
+}
+
+// batchWindowElapsed reports whether enough time has passed since the user's
+// last push to send the next grouped notification
+func (srv *Server) batchWindowElapsed(userID string, now time.Time) bool {
+	window := defaultBatchWindow
+	if minutes := srv.preferencesFor(userID).BatchWindowMinutes; minutes > 0 {
+		window = time.Duration(minutes) * time.Minute
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	lastNotified := shard.lastNotificationTime[userID]
+	shard.mu.RUnlock()
+
+	return now.Sub(time.Unix(lastNotified, 0)) >= window
+}
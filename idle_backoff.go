@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Many registered users have no active games at all, yet were fetched every
+// cycle. After idleAfterEmptyChecks checks in a row find no games, a user is
+// checked half as often, then a quarter, up to IDLE_BACKOFF_MAX_MINUTES
+// between checks. /check, registering and a heartbeat from the app reset it
+// at once, so a user who starts a game is back to the normal interval as soon
+// as they open the app. The state is kept in memory.
+
+// idleAfterEmptyChecks is how many checks in a row must find no games before
+// a user's checks are spaced out
+const idleAfterEmptyChecks = 3
+
+type idleState struct {
+	emptyChecks int
+	lastCheck   time.Time
+}
+
+// idleChecksSkipped counts scheduled checks skipped for idle users
+var idleChecksSkipped atomic.Int64
+
+// idleBackoffMax reads IDLE_BACKOFF_MAX_MINUTES, the longest wait between
+// checks of a user with no games (default 30). 0 checks them every cycle.
+func idleBackoffMax() time.Duration {
+	if minutesStr := os.Getenv("IDLE_BACKOFF_MAX_MINUTES"); minutesStr != "" {
+		if minutes, err := strconv.Atoi(minutesStr); err == nil && minutes >= 0 {
+			return time.Duration(minutes) * time.Minute
+		}
+	}
+	return 30 * time.Minute
+}
+
+// userIdle reports whether the user's next scheduled check should wait
+// because their recent checks found no games
+func (srv *Server) userIdle(userID string, now time.Time) bool {
+	maxWait := idleBackoffMax()
+	if maxWait == 0 {
+		return false
+	}
+
+	state, _ := srv.idleUsers.Load(userID)
+	if state.emptyChecks < idleAfterEmptyChecks {
+		return false
+	}
+
+	wait := checkInterval()
+	for i := idleAfterEmptyChecks; i <= state.emptyChecks && wait < maxWait; i++ {
+		wait *= 2
+	}
+	return now.Before(state.lastCheck.Add(min(wait, maxWait)))
+}
+
+// recordActiveGameCount counts checks in a row that found no games. Any game
+// clears the count.
+func (srv *Server) recordActiveGameCount(userID string, games int, now time.Time) {
+	if games > 0 {
+		srv.idleUsers.Delete(userID)
+		return
+	}
+	srv.idleUsers.Update(userID, func(state idleState, _ bool) (idleState, bool) {
+		state.emptyChecks++
+		state.lastCheck = now
+		return state, true
+	})
+}
+
+// resetIdleBackoff puts the user back on the normal check interval
+func (srv *Server) resetIdleBackoff(userID string) {
+	srv.idleUsers.Delete(userID)
+}
+
+// heartbeat handles POST /heartbeat/{userID}, which the app sends when it
+// opens so an idle user is checked at the normal interval again
+func (srv *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
+	srv.resetIdleBackoff(mux.Vars(r)["userID"])
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// End-to-end tests: a server with real routes and scheduler, talking to mock
+// OGS and APNs servers, run for a few accelerated check cycles
+
+// integrationDeviceToken is the second user's device; the first uses testDeviceToken
+const integrationDeviceToken = "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"
+
+// sentPush is a push as received by the mock APNs server
+type sentPush struct {
+	Device string
+	Action string
+	GameID int
+	Title  string
+	Body   string
+	Badge  int
+}
+
+// mockAPNs records every push it accepts
+type mockAPNs struct {
+	*httptest.Server
+	mu     sync.Mutex
+	pushes []sentPush
+}
+
+func newMockAPNs() *mockAPNs {
+	m := &mockAPNs{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification struct {
+			APS struct {
+				Alert struct {
+					Title string `json:"title"`
+					Body  string `json:"body"`
+				} `json:"alert"`
+				Badge int `json:"badge"`
+			} `json:"aps"`
+			Action string `json:"action"`
+			GameID int    `json:"game_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.pushes = append(m.pushes, sentPush{
+			Device: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:],
+			Action: notification.Action,
+			GameID: notification.GameID,
+			Title:  notification.APS.Alert.Title,
+			Body:   notification.APS.Alert.Body,
+			Badge:  notification.APS.Badge,
+		})
+		m.mu.Unlock()
+		w.Header().Set("apns-id", "test-id")
+	}))
+	return m
+}
+
+func (m *mockAPNs) sent() []sentPush {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]sentPush(nil), m.pushes...)
+}
+
+// mockOGS serves each player's active games from a script: the nth request
+// for a player gets their nth list, and the last list after that
+type mockOGS struct {
+	*httptest.Server
+	mu       sync.Mutex
+	script   map[int][][]Game
+	requests map[int]int
+	games    map[int]GameDetails
+}
+
+func newMockOGS(script map[int][][]Game, games map[int]GameDetails) *mockOGS {
+	m := &mockOGS{script: script, requests: make(map[int]int), games: games}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var playerID, gameID int
+		fmt.Sscanf(r.URL.Path, "/players/%d/full", &playerID)
+		fmt.Sscanf(r.URL.Path, "/games/%d", &gameID)
+		switch {
+		case playerID != 0:
+			m.mu.Lock()
+			lists := m.script[playerID]
+			n := min(m.requests[playerID], len(lists)-1)
+			m.requests[playerID]++
+			m.mu.Unlock()
+			if n < 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(PlayerResponse{ActiveGames: lists[n]})
+		case gameID != 0:
+			details, ok := m.games[gameID]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(details)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return m
+}
+
+// requestsFor returns how many times the player's games have been fetched
+func (m *mockOGS) requestsFor(playerID int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[playerID]
+}
+
+// scriptedGame is a correspondence game between player and opponent with
+// moves played and toMove to play
+func scriptedGame(id, player int, opponent GamePlayer, moves, toMove int) Game {
+	game := Game{ID: id, Name: fmt.Sprintf("Game %d", id), Black: GamePlayer{ID: player}, White: opponent}
+	game.JSON.Phase = "play"
+	game.JSON.Clock.CurrentPlayer = toMove
+	game.JSON.Clock.BlackPlayerID, game.JSON.Clock.WhitePlayerID = player, opponent.ID
+	game.JSON.Clock.LastMove = time.Now().Add(-time.Duration(100-moves) * time.Minute).UnixMilli()
+	for i := 0; i < moves; i++ {
+		game.JSON.Moves = append(game.JSON.Moves, json.RawMessage(fmt.Sprintf("[%d,3,1000]", i%19)))
+	}
+	return game
+}
+
+// TestEndToEndCheckCycles registers two users through the API, runs the
+// scheduler against scripted OGS responses and checks exactly which pushes
+// reach APNs
+func TestEndToEndCheckCycles(t *testing.T) {
+	playerX := GamePlayer{ID: 999, Username: "PlayerX"}
+	playerY := GamePlayer{ID: 888, Username: "PlayerY"}
+	script := map[int][][]Game{
+		4242: {
+			// Cycle 1: a new turn in game 2 is pushed
+			{scriptedGame(1, 4242, playerX, 10, 999), scriptedGame(2, 4242, playerY, 5, 4242)},
+			// Cycle 2: nothing has changed
+			{scriptedGame(1, 4242, playerX, 10, 999), scriptedGame(2, 4242, playerY, 5, 4242)},
+			// Cycle 3: PlayerX moved in game 1
+			{scriptedGame(1, 4242, playerX, 11, 4242), scriptedGame(2, 4242, playerY, 5, 4242)},
+			// Cycle 4: PlayerY resigned game 2; game 1 is still waiting
+			{scriptedGame(1, 4242, playerX, 11, 4242)},
+		},
+		// The other user's opponent never moves
+		5151: {{scriptedGame(3, 5151, playerX, 20, 999)}},
+	}
+	resigned := GameDetails{ID: 2, Name: "Game 2", Outcome: "Resignation", Winner: 4242}
+	resigned.Players.Black, resigned.Players.White = GamePlayer{ID: 4242}, playerY
+
+	ogs := newMockOGS(script, map[int]GameDetails{2: resigned})
+	defer ogs.Close()
+	apns := newMockAPNs()
+	defer apns.Close()
+
+	defer func(player, game string, delay time.Duration) {
+		ogsPlayerURL, ogsGameURL, firstCheckDelay = player, game, delay
+	}(ogsPlayerURL, ogsGameURL, firstCheckDelay)
+	ogsPlayerURL = ogs.URL + "/players/%d/full"
+	ogsGameURL = ogs.URL + "/games/%d"
+	firstCheckDelay = 0
+
+	srv := newServer(&memoryBackend{}, nil)
+	srv.apns = newAPNSPool(&apns2.Client{Host: apns.URL, HTTPClient: apns.Client()})
+	router := srv.newRouter()
+	fakeOGSAccount(t, "")
+	for userID, device := range map[string]string{"4242": testDeviceToken, "5151": integrationDeviceToken} {
+		body, _ := json.Marshal(DeviceRegistration{UserID: userID, DeviceToken: device, OGSAccessToken: "token-" + userID})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/register", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected user %s to register, got %d: %s", userID, w.Code, w.Body.String())
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.runPeriodicChecks(100*time.Millisecond, stop)
+	}()
+
+	// Run every scripted cycle and one more, so the last cycle's pushes are out
+	deadline := time.Now().Add(10 * time.Second)
+	for ogs.requestsFor(4242) <= len(script[4242]) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(stop)
+	<-stopped
+	if ogs.requestsFor(4242) <= len(script[4242]) {
+		t.Fatalf("Expected at least %d check cycles, got %d", len(script[4242])+1, ogs.requestsFor(4242))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The badge counts every game awaiting a move, and is lowered by a silent
+	// push once the resigned game no longer does. The result is looked up in
+	// the background, so it's checked apart from the badge push.
+	expected := []sentPush{
+		{Device: testDeviceToken, Action: "open_game", GameID: 2, Title: "Your turn in Go!", Body: "Your turn vs. PlayerY (move 5)", Badge: 1},
+		{Device: testDeviceToken, Action: "open_game", GameID: 1, Title: "Your turn in Go!", Body: "Your turn vs. PlayerX (move 11)", Badge: 2},
+		{Device: testDeviceToken, Action: "game_result", GameID: 2, Title: "Opponent resigned", Body: "You won Game 2 against PlayerY"},
+	}
+	var sent, badges []sentPush
+	for _, push := range apns.sent() {
+		if push.Title == "" && push.Action == "" {
+			badges = append(badges, push)
+		} else {
+			sent = append(sent, push)
+		}
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Unexpected pushes:\n got  %+v\n want %+v", sent, expected)
+	}
+	if want := []sentPush{{Device: testDeviceToken, Badge: 1}}; !reflect.DeepEqual(badges, want) {
+		t.Errorf("Expected one badge update to 1, got %+v", badges)
+	}
+
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+	if srv.storage.shard("4242").game("4242", 2) != nil || len(srv.storage.shard("4242").finishedGames["4242"]) != 1 {
+		t.Errorf("Expected the resigned game moved to the finished games, got %+v", srv.storage.shard("4242").finishedGames["4242"])
+	}
+	if record := srv.storage.shard("4242").game("4242", 1); record == nil || record.MoveNumber != 11 || record.NotifyCount != 1 {
+		t.Errorf("Expected game 1 stored as notified at move 11, got %+v", record)
+	}
+	if pending := srv.storage.shard("4242").pendingNotifications["4242"]; pending != nil {
+		t.Errorf("Expected no pending notification left, got %+v", pending)
+	}
+}
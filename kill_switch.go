@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// NotificationSwitch is a user's master notification switch. When it's off,
+// nothing is sent on any channel, whatever the preferences say.
+type NotificationSwitch struct {
+	NotificationsEnabled bool `json:"notifications_enabled"`
+	// DisabledAt is when notifications were turned off (unix seconds)
+	DisabledAt int64 `json:"disabled_at,omitempty"`
+}
+
+// notificationsEnabled is the final gate every sender checks
+func (srv *Server) notificationsEnabled(userID string) bool {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	_, disabled := shard.notificationsDisabled[userID]
+	return !disabled
+}
+
+func (srv *Server) notificationSwitchFor(userID string) NotificationSwitch {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	disabledAt, disabled := shard.notificationsDisabled[userID]
+	return NotificationSwitch{NotificationsEnabled: !disabled, DisabledAt: disabledAt}
+}
+
+func (srv *Server) getNotificationsEnabled(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(srv.notificationSwitchFor(userID))
+}
+
+// setNotificationsEnabled turns all of a user's notifications on or off. It
+// takes effect for the next send, including pushes already being prepared.
+func (srv *Server) setNotificationsEnabled(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var request struct {
+		NotificationsEnabled *bool `json:"notifications_enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.NotificationsEnabled == nil {
+		http.Error(w, "notifications_enabled is required", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if *request.NotificationsEnabled {
+		delete(shard.notificationsDisabled, userID)
+	} else if _, disabled := shard.notificationsDisabled[userID]; !disabled {
+		shard.notificationsDisabled[userID] = time.Now().Unix()
+	}
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	log.Printf("Notifications for user %s set to enabled=%v", userID, *request.NotificationsEnabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(srv.notificationSwitchFor(userID))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// A Live Activity keeps one game on the user's lock screen: whose turn it is,
+// the move number and when the player to move runs out of time. The app
+// starts it and sends its push token here, and each check pushes an update
+// when the game has changed. The activity is ended when the game leaves the
+// user's active games.
+
+const maxLiveActivitiesPerUser = 20
+
+// liveActivityDismissal is how long an ended activity stays on the lock screen
+const liveActivityDismissal = 15 * time.Minute
+
+// LiveActivityRegistration carries a Live Activity's push token
+type LiveActivityRegistration struct {
+	PushToken string `json:"push_token"`
+}
+
+func (srv *Server) setLiveActivityToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["userID"]
+	gameID, err := strconv.Atoi(vars["gameID"])
+	if err != nil || gameID <= 0 {
+		http.Error(w, "Invalid game ID", http.StatusBadRequest)
+		return
+	}
+
+	var registration LiveActivityRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if registration.PushToken == "" || len(registration.PushToken) > 256 {
+		http.Error(w, "push_token is required", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	activities := shard.liveActivityTokens[userID]
+	if _, exists := activities[gameID]; !exists && len(activities) >= maxLiveActivitiesPerUser {
+		shard.mu.Unlock()
+		http.Error(w, "Too many Live Activities", http.StatusConflict)
+		return
+	}
+	if activities == nil {
+		activities = make(map[int]string)
+		shard.liveActivityTokens[userID] = activities
+	}
+	activities[gameID] = registration.PushToken
+	shard.mu.Unlock()
+
+	// The new activity gets the game's state on the next check
+	srv.liveActivities.Delete(fmt.Sprintf("%s/%d", userID, gameID))
+	srv.saveStorage()
+	log.Printf("Registered Live Activity for user %s, game %d", userID, gameID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) deleteLiveActivityToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["userID"]
+	gameID, err := strconv.Atoi(vars["gameID"])
+	if err != nil {
+		http.Error(w, "Invalid game ID", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	removed := srv.removeLiveActivity(shard, userID, gameID)
+	shard.mu.Unlock()
+
+	if !removed {
+		http.Error(w, "No Live Activity for this game", http.StatusNotFound)
+		return
+	}
+	srv.saveStorage()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeLiveActivity forgets a game's activity token. Callers must hold the
+// shard's mu.
+func (srv *Server) removeLiveActivity(shard *storageShard, userID string, gameID int) bool {
+	if _, exists := shard.liveActivityTokens[userID][gameID]; !exists {
+		return false
+	}
+	delete(shard.liveActivityTokens[userID], gameID)
+	if len(shard.liveActivityTokens[userID]) == 0 {
+		delete(shard.liveActivityTokens, userID)
+	}
+	srv.liveActivities.Delete(fmt.Sprintf("%s/%d", userID, gameID))
+	return true
+}
+
+// liveActivityState is the activity's content state, as the app's
+// ActivityAttributes.ContentState decodes it
+func liveActivityState(userID int, game Game) map[string]interface{} {
+	state := map[string]interface{}{
+		"game_id":     game.ID,
+		"game_name":   game.Name,
+		"your_turn":   game.IsTurnOf(userID),
+		"move_number": game.MoveNumber(),
+		"opponent":    game.Opponent(userID).Username,
+	}
+	if deadline, ok := clockDeadline(game); ok {
+		state["clock_deadline"] = deadline.Unix()
+	}
+	return state
+}
+
+// updateLiveActivities pushes each of the user's activities the current
+// state of its game, if it changed, and ends those whose game is over.
+// Nothing is pushed while the user has notifications off; activities catch
+// up once they're back on.
+func (srv *Server) updateLiveActivities(userIDStr string, userID int, games []Game, now time.Time) {
+	if !srv.notificationsEnabled(userIDStr) {
+		return
+	}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	activities := make(map[int]string, len(shard.liveActivityTokens[userIDStr]))
+	for gameID, token := range shard.liveActivityTokens[userIDStr] {
+		activities[gameID] = token
+	}
+	environment := shard.deviceEnvironments[userIDStr]
+	shard.mu.RUnlock()
+
+	if len(activities) == 0 || srv.apns == nil {
+		return
+	}
+
+	active := make(map[int]Game, len(games))
+	for _, game := range games {
+		active[game.ID] = game
+	}
+
+	for gameID, token := range activities {
+		key := fmt.Sprintf("%s/%d", userIDStr, gameID)
+		game, ongoing := active[gameID]
+		if !ongoing {
+			srv.pushLiveActivity(userIDStr, gameID, token, environment, liveActivityEnd(now), apns2.PriorityHigh)
+			shard.mu.Lock()
+			srv.removeLiveActivity(shard, userIDStr, gameID)
+			shard.mu.Unlock()
+			log.Printf("Ended Live Activity for user %s, game %d", userIDStr, gameID)
+			continue
+		}
+
+		state := liveActivityState(userID, game)
+		encoded, _ := json.Marshal(state)
+		if sent, exists := srv.liveActivities.Load(key); exists && sent == string(encoded) {
+			continue
+		}
+
+		// APNs budgets priority 10 updates, so only the user's turn uses it
+		priority := apns2.PriorityLow
+		if game.IsTurnOf(userID) {
+			priority = apns2.PriorityHigh
+		}
+		update := payload.NewPayload().SetEvent(payload.LiveActivityEventUpdate).
+			SetTimestamp(now.Unix()).
+			SetContentState(state)
+		if deadline, ok := state["clock_deadline"].(int64); ok && deadline > now.Unix() {
+			update.SetStaleDate(deadline)
+		}
+		if srv.pushLiveActivity(userIDStr, gameID, token, environment, update, priority) {
+			srv.liveActivities.Store(key, string(encoded))
+		}
+	}
+}
+
+// liveActivityEnd is the push that ends an activity
+func liveActivityEnd(now time.Time) *payload.Payload {
+	return payload.NewPayload().SetEvent(payload.LiveActivityEventEnd).
+		SetTimestamp(now.Unix()).
+		SetContentState(map[string]interface{}{"your_turn": false}).
+		SetDismissalDate(now.Add(liveActivityDismissal).Unix())
+}
+
+// pushLiveActivity sends a Live Activity push, forgetting tokens APNs
+// reports as no longer valid. It reports whether APNs accepted the push.
+func (srv *Server) pushLiveActivity(userID string, gameID int, token, environment string, update *payload.Payload, priority int) bool {
+	if !srv.notificationsEnabled(userID) {
+		return false
+	}
+	notification := &apns2.Notification{
+		DeviceToken: token,
+		Topic:       apnsTopic() + ".push-type.liveactivity",
+		PushType:    apns2.PushTypeLiveActivity,
+		Priority:    priority,
+		Payload:     update,
+	}
+	res, err := srv.pushAPNs(notification, environment)
+	if err != nil {
+		log.Printf("Live Activity update for user %s, game %d failed: %v", userID, gameID, err)
+		return false
+	}
+	if !res.Sent() {
+		log.Printf("Live Activity update for user %s, game %d rejected: %s", userID, gameID, res.Reason)
+		if deadDeviceToken(res) {
+			shard := srv.storage.shard(userID)
+			shard.mu.Lock()
+			if shard.liveActivityTokens[userID][gameID] == token {
+				srv.removeLiveActivity(shard, userID, gameID)
+			}
+			shard.mu.Unlock()
+		}
+		return false
+	}
+	return true
+}
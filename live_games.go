@@ -0,0 +1,67 @@
+package main
+
+// movesPerPlayer is the game length assumed when spreading main time over
+// moves, the same estimate OGS uses to classify speed
+const movesPerPlayer = 90
+
+// liveMoveSeconds is the average time per move below which a game is live:
+// both players are expected to be at the board
+const liveMoveSeconds = 3600
+
+// Live game handling modes (the live_games preference)
+const (
+	liveGamesImmediate = "immediate" // push right away, skipping batch windows (default)
+	liveGamesSuppress  = "suppress"  // never push; the user is already watching the board
+)
+
+// averageMoveSeconds estimates the thinking time per move the time control
+// allows, or 0 when the game has no clock
+func (tc TimeControl) averageMoveSeconds() float64 {
+	switch tc.System {
+	case "fischer":
+		return tc.InitialTime/movesPerPlayer + tc.TimeIncrement
+	case "byoyomi":
+		return tc.MainTime/movesPerPlayer + tc.PeriodTime
+	case "canadian":
+		stones := max(float64(tc.StonesPerPeriod), 1)
+		return tc.MainTime/movesPerPlayer + tc.PeriodTime/stones
+	case "simple":
+		return tc.PerMove
+	case "absolute":
+		return tc.TotalTime / movesPerPlayer
+	}
+	return 0
+}
+
+// IsLive reports whether the game is played in real time. OGS's own speed
+// label is used when present; otherwise the time control decides.
+func (g Game) IsLive() bool {
+	switch g.JSON.TimeControl.Speed {
+	case "blitz", "rapid", "live":
+		return true
+	case "correspondence":
+		return false
+	}
+	seconds := g.JSON.TimeControl.averageMoveSeconds()
+	return seconds > 0 && seconds < liveMoveSeconds
+}
+
+// liveGamesMode returns how the user wants turns in live games handled
+func liveGamesMode(prefs UserPreferences) string {
+	if prefs.LiveGames == liveGamesSuppress {
+		return liveGamesSuppress
+	}
+	return liveGamesImmediate
+}
+
+// separateLiveGames splits games into live and slower ones
+func separateLiveGames(games []Game) (live, other []Game) {
+	for _, game := range games {
+		if game.IsLive() {
+			live = append(live, game)
+		} else {
+			other = append(other, game)
+		}
+	}
+	return live, other
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A correspondence game is lost on time as easily as a live one, just more
+// slowly. Each check projects when the user's clock runs out in games where
+// it's their turn, and warns as it passes each level in
+// LOW_CLOCK_WARNING_HOURS, the last one more urgently. The level last warned
+// about is stored per game and cleared once it's no longer the user's turn,
+// so the next time they run low they're warned again. The last warning is
+// escalated: see checkLowClock.
+
+// eventLowClock is the routing event and push action for low-clock warnings
+const eventLowClock = "low_clock"
+
+// lowClockWarningLevels reads LOW_CLOCK_WARNING_HOURS, a comma-separated list
+// of hours left at which to warn (default "12,3,1"), longest first. "0"
+// turns the warnings off.
+func lowClockWarningLevels() []time.Duration {
+	value := os.Getenv("LOW_CLOCK_WARNING_HOURS")
+	if value == "" {
+		value = "12,3,1"
+	}
+
+	var levels []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		hours, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || hours <= 0 {
+			continue
+		}
+		levels = append(levels, time.Duration(hours*float64(time.Hour)))
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] > levels[j] })
+	return levels
+}
+
+// playerTime is a player's clock as of the last move. Which fields are set
+// depends on the time control system.
+type playerTime struct {
+	ThinkingTime float64 `json:"thinking_time"`
+	Periods      int     `json:"periods"`     // byo-yomi
+	PeriodTime   float64 `json:"period_time"` // byo-yomi
+	BlockTime    float64 `json:"block_time"`  // canadian
+}
+
+// clockDeadline returns when the player to move runs out of time. OGS gives
+// it as the clock's expiration; without one it's projected from the player's
+// clock and the time control.
+func clockDeadline(game Game) (time.Time, bool) {
+	clock := game.JSON.Clock
+	if clock.Expiration > 0 {
+		return time.UnixMilli(clock.Expiration), true
+	}
+	if clock.LastMove <= 0 {
+		return time.Time{}, false
+	}
+
+	var player playerTime
+	if err := json.Unmarshal(game.playerClock(clock.CurrentPlayer), &player); err != nil {
+		return time.Time{}, false
+	}
+
+	tc := game.JSON.TimeControl
+	left := player.ThinkingTime
+	switch tc.System {
+	case "byoyomi":
+		periodTime := player.PeriodTime
+		if periodTime <= 0 {
+			periodTime = tc.PeriodTime
+		}
+		left += float64(player.Periods) * periodTime
+	case "canadian":
+		left += player.BlockTime
+	case "fischer", "absolute", "simple":
+	default:
+		return time.Time{}, false
+	}
+	return time.UnixMilli(clock.LastMove).Add(time.Duration(left * float64(time.Second))), true
+}
+
+// formatTimeLeft renders the time left on a clock, e.g. "11 hours"
+func formatTimeLeft(left time.Duration) string {
+	switch {
+	case left >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(left.Hours()))
+	case left >= time.Hour:
+		return "1 hour"
+	default:
+		return fmt.Sprintf("%d minutes", max(1, int(left.Minutes())))
+	}
+}
+
+// checkLowClock warns the user when their clock in a correspondence game
+// passes a warning level, once per level until they move. now should be on
+// OGS's clock. Returns true if a warning was issued.
+//
+// The final warning is also kept as a reminder due when the clock reaches the
+// last level, so it goes out on time even if no check runs then. Whichever
+// comes first sends it, as a time-sensitive push.
+func (srv *Server) checkLowClock(userIDStr string, userID int, game Game, now time.Time) bool {
+	levels := lowClockWarningLevels()
+	if len(levels) == 0 || game.JSON.TimeControl.Speed != "correspondence" {
+		return false
+	}
+	final := levels[len(levels)-1]
+
+	var left time.Duration
+	deadline, ok := clockDeadline(game)
+	if ok {
+		left = deadline.Sub(now)
+	}
+	onTurn := ok && left > 0 && game.IsTurnOf(userID) && game.Started() && !game.IsPaused()
+	var level time.Duration
+	if onTurn {
+		for _, candidate := range levels {
+			if left <= candidate {
+				level = candidate
+			}
+		}
+	}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.Lock()
+	if onTurn && level != final {
+		shard.scheduleFinalClockWarning(userIDStr, game, left, final)
+	} else {
+		shard.removeReminder(userIDStr, finalClockReminderID(game.ID))
+	}
+	warned, exists := shard.clockWarnings[userIDStr][game.ID]
+	if level == 0 {
+		// The user moved, or has time again
+		if exists {
+			delete(shard.clockWarnings[userIDStr], game.ID)
+		}
+		shard.mu.Unlock()
+		return false
+	}
+	if exists && time.Duration(warned)*time.Second <= level {
+		shard.mu.Unlock()
+		return false
+	}
+	shard.markClockWarned(userIDStr, game.ID, level)
+	shard.mu.Unlock()
+
+	log.Printf("User %s has %v left in game %d", userIDStr, left.Round(time.Minute), game.ID)
+
+	go func() {
+		if err := srv.sendClockWarning(userIDStr, game.ID, game.Name, left, level == final); err != nil {
+			log.Printf("Low clock warning not sent to user %s: %v", userIDStr, err)
+		}
+	}()
+	return true
+}
+
+// markClockWarned records the level last warned about. Callers must hold mu.
+func (s *storageShard) markClockWarned(userID string, gameID int, level time.Duration) {
+	if s.clockWarnings[userID] == nil {
+		s.clockWarnings[userID] = make(map[int]int64)
+	}
+	s.clockWarnings[userID][gameID] = int64(level / time.Second)
+}
+
+// finalClockReminderID is the ID of the reminder carrying a game's final
+// low-clock warning
+func finalClockReminderID(gameID int) string {
+	return fmt.Sprintf("clock-%d", gameID)
+}
+
+// scheduleFinalClockWarning keeps the game's final warning reminder due when
+// left reaches the final level, moving it if the deadline moves by more than
+// the reminder interval. Reminders run on the server's clock, so the times
+// are taken from time left rather than OGS's deadline. Callers must hold mu.
+func (s *storageShard) scheduleFinalClockWarning(userID string, game Game, left, final time.Duration) {
+	now := time.Now()
+	remindAt := now.Add(left - final).Unix()
+	deadline := now.Add(left).Unix()
+
+	id := finalClockReminderID(game.ID)
+	for _, reminder := range s.reminders[userID] {
+		if reminder.ID == id {
+			if diff := reminder.RemindAt - remindAt; diff < -int64(reminderCheckInterval/time.Second) || diff > int64(reminderCheckInterval/time.Second) {
+				reminder.RemindAt, reminder.Deadline, reminder.Attempts = remindAt, deadline, 0
+			}
+			return
+		}
+	}
+	s.reminders[userID] = append(s.reminders[userID], &Reminder{
+		ID:        id,
+		GameID:    game.ID,
+		RemindAt:  remindAt,
+		Note:      game.Name,
+		Deadline:  deadline,
+		CreatedAt: now.Unix(),
+	})
+}
+
+// sendFinalClockWarning sends a final warning reminder, unless a check has
+// already warned at the last level
+func (srv *Server) sendFinalClockWarning(userID string, reminder Reminder) error {
+	levels := lowClockWarningLevels()
+	left := time.Until(time.Unix(reminder.Deadline, 0))
+	if len(levels) == 0 || left <= 0 {
+		return nil
+	}
+	final := levels[len(levels)-1]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	warned, exists := shard.clockWarnings[userID][reminder.GameID]
+	if exists && time.Duration(warned)*time.Second <= final {
+		shard.mu.Unlock()
+		return nil
+	}
+	shard.markClockWarned(userID, reminder.GameID, final)
+	shard.mu.Unlock()
+
+	log.Printf("User %s has %v left in game %d, sending the final warning", userID, left.Round(time.Minute), reminder.GameID)
+	return srv.sendClockWarning(userID, reminder.GameID, reminder.Note, left, true)
+}
+
+// sendClockWarning sends a low-clock warning. The final one is marked urgent:
+// it's sent as time-sensitive, past Focus on iOS, at high priority and past
+// routing throttles.
+func (srv *Server) sendClockWarning(userID string, gameID int, name string, left time.Duration, final bool) error {
+	title := "Low on time"
+	custom := map[string]interface{}{
+		"web_url": ogsGameLink(gameID),
+		"app_url": fmt.Sprintf("ogs://game/%d", gameID),
+		"game_id": gameID,
+	}
+	if final {
+		title = "Almost out of time!"
+		custom["urgent"] = true
+	}
+	body := fmt.Sprintf("%s left to move in %s", formatTimeLeft(left), name)
+	return srv.sendUserPushNotification(userID, title, body, eventLowClock, custom)
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,28 +21,65 @@ import (
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/payload"
 	"github.com/sideshow/apns2/token"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
+type Game struct {
+	ID    int        `json:"id"`
+	Name  string     `json:"name"`
+	Black GamePlayer `json:"black"`
+	White GamePlayer `json:"white"`
+	JSON  GameState  `json:"json"`
 }
 
-type Game struct {
-	ID   int       `json:"id"`
-	Name string    `json:"name"`
-	JSON GameState `json:"json"`
+// GamePlayer is a player as listed on a game
+type GamePlayer struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	UIClass  string `json:"ui_class"` // space-separated, e.g. "supporter" or "bot"
 }
 
 type GameState struct {
-	Clock Clock `json:"clock"`
+	Clock                 Clock                      `json:"clock"`
+	Moves                 []json.RawMessage          `json:"moves"`
+	PauseControl          map[string]json.RawMessage `json:"pause_control"`
+	TimeControl           TimeControl                `json:"time_control"`
+	Phase                 string                     `json:"phase"`
+	Handicap              int                        `json:"handicap"`
+	FreeHandicapPlacement bool                       `json:"free_handicap_placement"`
+	Rengo                 bool                       `json:"rengo"`
+	RengoTeams            RengoTeams                 `json:"rengo_teams"`
 }
 
 type Clock struct {
-	CurrentPlayer int   `json:"current_player"`
-	LastMove      int64 `json:"last_move"`
+	CurrentPlayer int             `json:"current_player"`
+	LastMove      int64           `json:"last_move"`
+	PausedSince   int64           `json:"paused_since"`
+	Expiration    int64           `json:"expiration"`
+	BlackPlayerID int             `json:"black_player_id"`
+	WhitePlayerID int             `json:"white_player_id"`
+	BlackTime     json.RawMessage `json:"black_time"`
+	WhiteTime     json.RawMessage `json:"white_time"`
+}
+
+type TimeControl struct {
+	System          string  `json:"system"`
+	Speed           string  `json:"speed"`
+	Periods         int     `json:"periods"`
+	PeriodTime      float64 `json:"period_time"`
+	MainTime        float64 `json:"main_time"`
+	InitialTime     float64 `json:"initial_time"`
+	TimeIncrement   float64 `json:"time_increment"`
+	PerMove         float64 `json:"per_move"`
+	TotalTime       float64 `json:"total_time"`
+	StonesPerPeriod int     `json:"stones_per_period"`
+}
+
+// MoveNumber returns the number of moves played in the game, or 0 when the
+// payload didn't include the move list.
+func (g Game) MoveNumber() int {
+	return len(g.JSON.Moves)
 }
 
 type PlayerResponse struct {
@@ -47,47 +87,243 @@ type PlayerResponse struct {
 }
 
 type TurnStatus struct {
-	NotYourTurn  []int `json:"not_your_turn"`
-	YourTurnNew  []int `json:"your_turn_new"`
-	YourTurnOld  []int `json:"your_turn_old"`
+	NotYourTurn []int `json:"not_your_turn"`
+	YourTurnNew []int `json:"your_turn_new"`
+	YourTurnOld []int `json:"your_turn_old"`
+	// NotStarted games are still being set up, so nobody is notified yet
+	NotStarted []int `json:"not_started,omitempty"`
+
+	// Urgency for clients, so they don't have to re-derive it from clocks
+	YourTurnOldByAge *TurnAgeBuckets `json:"your_turn_old_by_age,omitempty"`
+	TimeoutSoon      []int           `json:"timeout_soon,omitempty"`
 }
 
+// storageShard holds the state of the users whose IDs hash to it, under its
+// own lock. Every map is keyed by user ID.
+type storageShard struct {
+	mu sync.RWMutex
+
+	games                 map[string]map[int]*GameRecord  // userID -> gameID -> stored position and settings
+	deviceTokens          map[string]string               // userID -> deviceToken
+	deviceEnvironments    map[string]string               // userID -> APNs environment, when the device gave one
+	lastNotificationTime  map[string]int64                // userID -> unix timestamp
+	pendingNotifications  map[string]*PendingNotification // userID -> reserved, unsent notification
+	finishedGames         map[string][]FinishedGame       // userID -> recently finished games
+	pausedGames           map[string]map[int]GamePause    // userID -> gameID -> active pause
+	periodWarnings        map[string]map[int]int64        // userID -> gameID -> final period warning time
+	preferences           map[string]*UserPreferences     // userID -> notification preferences
+	dailyCounts           map[string]*DailyCount          // userID -> pushes sent today
+	reminders             map[string][]*Reminder          // userID -> scheduled reminders
+	onboarding            map[string]*OnboardingFunnel    // userID -> onboarding milestones
+	checkHealth           map[string]*CheckHealth         // userID -> last successful check
+	userscriptTokens      map[string]string               // userID -> sha256 of userscript access token
+	ntfyTopics            map[string]string               // userID -> ntfy topic URL
+	webPushSubscriptions  map[string]*WebPushSubscription // userID -> browser push subscription
+	notificationsDisabled map[string]int64                // userID -> when the user turned notifications off
+	settingsVersions      map[string]int                  // userID -> settings document version
+	pushFailingSince      map[string]int64                // userID -> first failed push since the last delivered one
+	pushRetries           map[string][]*PushRetry         // userID -> pushes waiting to be retried
+	userTenants           map[string]string               // userID -> tenantID, for users registered with a tenant API key
+	accountsGone          map[string]*AccountGone         // userID -> OGS account not found
+	linkedAccounts        map[string]int64                // userID -> when ownership was verified with an OGS token
+	entitlements          map[string]*Entitlement         // userID -> paid tier, from App Store notifications
+	appAccountTokens      map[string]string               // userID -> UUID the app attaches to App Store purchases
+	entitlementOverrides  map[string]*Entitlement         // userID -> tier granted by an admin, ahead of the App Store
+	challengeTokens       map[string]string               // userID -> OGS access token used to read the user's challenges
+	seenChallenges        map[string][]int                // userID -> incoming challenge IDs already notified
+	clockWarnings         map[string]map[int]int64        // userID -> gameID -> level of the last low-clock warning, in seconds
+	liveActivityTokens    map[string]map[int]string       // userID -> gameID -> Live Activity push token
+	badgeCounts           map[string]*BadgeCount          // userID -> games awaiting a move and the badge shown
+	telegramChats         map[string]int64                // userID -> Telegram chat ID
+	discordWebhooks       map[string]string               // userID -> Discord webhook URL
+	userWebhooks          map[string]*UserWebhook         // userID -> webhook receiving signed events
+	slackDestinations     map[string]*SlackDestination    // userID -> Slack webhook, or bot token and channel
+	snoozes               map[string]*Snooze              // userID -> when the user's snoozes end
+}
 
+// MoveStorage is the server's persisted state. Users' state is sharded by user
+// ID, so requests and checks for different users don't wait on each other;
+// the rest is shared, each map with its own lock. Locks are taken in a fixed
+// order: claims, then shards in index order, then the shared maps. Nothing
+// locks a shard from inside a shared map's Range or Update.
 type MoveStorage struct {
-	mu                   sync.RWMutex
-	moves                map[string]map[int]int64 // userID -> gameID -> lastMove
-	deviceTokens         map[string]string        // userID -> deviceToken
-	lastNotificationTime map[string]int64         // userID -> unix timestamp
+	shards [storageShards]*storageShard
+
+	tenants      *syncMap[string, *Tenant]        // tenantID -> hosted tenant, quotas and usage
+	cycleLog     *syncMap[string, []CycleSummary] // day (and region) -> that day's check cycles, kept for cycleLogRetention
+	discordClubs *syncMap[string, *DiscordClub]   // clubID -> club's Discord webhook and members
+
+	claims sync.Mutex // held while a user is claimed for a tenant, so tenants' user quotas hold
+}
+
+func newStorageShard() *storageShard {
+	return &storageShard{
+		games:                 make(map[string]map[int]*GameRecord),
+		deviceTokens:          make(map[string]string),
+		deviceEnvironments:    make(map[string]string),
+		lastNotificationTime:  make(map[string]int64),
+		pendingNotifications:  make(map[string]*PendingNotification),
+		finishedGames:         make(map[string][]FinishedGame),
+		pausedGames:           make(map[string]map[int]GamePause),
+		periodWarnings:        make(map[string]map[int]int64),
+		preferences:           make(map[string]*UserPreferences),
+		dailyCounts:           make(map[string]*DailyCount),
+		reminders:             make(map[string][]*Reminder),
+		onboarding:            make(map[string]*OnboardingFunnel),
+		checkHealth:           make(map[string]*CheckHealth),
+		userscriptTokens:      make(map[string]string),
+		ntfyTopics:            make(map[string]string),
+		webPushSubscriptions:  make(map[string]*WebPushSubscription),
+		notificationsDisabled: make(map[string]int64),
+		settingsVersions:      make(map[string]int),
+		pushFailingSince:      make(map[string]int64),
+		pushRetries:           make(map[string][]*PushRetry),
+		userTenants:           make(map[string]string),
+		accountsGone:          make(map[string]*AccountGone),
+		linkedAccounts:        make(map[string]int64),
+		entitlements:          make(map[string]*Entitlement),
+		appAccountTokens:      make(map[string]string),
+		entitlementOverrides:  make(map[string]*Entitlement),
+		challengeTokens:       make(map[string]string),
+		seenChallenges:        make(map[string][]int),
+		clockWarnings:         make(map[string]map[int]int64),
+		liveActivityTokens:    make(map[string]map[int]string),
+		badgeCounts:           make(map[string]*BadgeCount),
+		telegramChats:         make(map[string]int64),
+		discordWebhooks:       make(map[string]string),
+		userWebhooks:          make(map[string]*UserWebhook),
+		slackDestinations:     make(map[string]*SlackDestination),
+		snoozes:               make(map[string]*Snooze),
+	}
+}
+
+func newMoveStorage() *MoveStorage {
+	s := &MoveStorage{
+		tenants:      newSyncMap[string, *Tenant](),
+		cycleLog:     newSyncMap[string, []CycleSummary](),
+		discordClubs: newSyncMap[string, *DiscordClub](),
+	}
+	for i := range s.shards {
+		s.shards[i] = newStorageShard()
+	}
+	return s
+}
+
+// reset replaces all maps with empty ones. Callers must hold every lock; see
+// lockAll.
+func (s *MoveStorage) reset() {
+	s.apply(newMoveStorage().snapshot())
+}
+
+// storageFile is the on-disk layout of moves.json
+type storageFile struct {
+	Games                 map[string]map[int]*GameRecord  `json:"games"`
+	DeviceTokens          map[string]string               `json:"device_tokens"`
+	DeviceEnvironments    map[string]string               `json:"device_environments,omitempty"`
+	LastNotificationTime  map[string]int64                `json:"last_notification_time"`
+	PendingNotifications  map[string]*PendingNotification `json:"pending_notifications,omitempty"`
+	FinishedGames         map[string][]FinishedGame       `json:"finished_games,omitempty"`
+	PausedGames           map[string]map[int]GamePause    `json:"paused_games,omitempty"`
+	PeriodWarnings        map[string]map[int]int64        `json:"period_warnings,omitempty"`
+	Preferences           map[string]*UserPreferences     `json:"preferences,omitempty"`
+	DailyCounts           map[string]*DailyCount          `json:"daily_counts,omitempty"`
+	Reminders             map[string][]*Reminder          `json:"reminders,omitempty"`
+	Onboarding            map[string]*OnboardingFunnel    `json:"onboarding,omitempty"`
+	CheckHealth           map[string]*CheckHealth         `json:"check_health,omitempty"`
+	UserscriptTokens      map[string]string               `json:"userscript_tokens,omitempty"`
+	NtfyTopics            map[string]string               `json:"ntfy_topics,omitempty"`
+	WebPushSubscriptions  map[string]*WebPushSubscription `json:"web_push_subscriptions,omitempty"`
+	NotificationsDisabled map[string]int64                `json:"notifications_disabled,omitempty"`
+	SettingsVersions      map[string]int                  `json:"settings_versions,omitempty"`
+	PushFailingSince      map[string]int64                `json:"push_failing_since,omitempty"`
+	PushRetries           map[string][]*PushRetry         `json:"push_retries,omitempty"`
+	Tenants               map[string]*Tenant              `json:"tenants,omitempty"`
+	UserTenants           map[string]string               `json:"user_tenants,omitempty"`
+	AccountsGone          map[string]*AccountGone         `json:"accounts_gone,omitempty"`
+	LinkedAccounts        map[string]int64                `json:"linked_accounts,omitempty"`
+	Entitlements          map[string]*Entitlement         `json:"entitlements,omitempty"`
+	AppAccountTokens      map[string]string               `json:"app_account_tokens,omitempty"`
+	EntitlementOverrides  map[string]*Entitlement         `json:"entitlement_overrides,omitempty"`
+	CycleLog              map[string][]CycleSummary       `json:"cycle_log,omitempty"`
+	ChallengeTokens       map[string]string               `json:"challenge_tokens,omitempty"`
+	SeenChallenges        map[string][]int                `json:"seen_challenges,omitempty"`
+	ClockWarnings         map[string]map[int]int64        `json:"clock_warnings,omitempty"`
+	LiveActivityTokens    map[string]map[int]string       `json:"live_activity_tokens,omitempty"`
+	BadgeCounts           map[string]*BadgeCount          `json:"badge_counts,omitempty"`
+	TelegramChats         map[string]int64                `json:"telegram_chats,omitempty"`
+	DiscordWebhooks       map[string]string               `json:"discord_webhooks,omitempty"`
+	DiscordClubs          map[string]*DiscordClub         `json:"discord_clubs,omitempty"`
+	UserWebhooks          map[string]*UserWebhook         `json:"user_webhooks,omitempty"`
+	SlackDestinations     map[string]*SlackDestination    `json:"slack_destinations,omitempty"`
+	Snoozes               map[string]*Snooze              `json:"snoozes,omitempty"`
+
+	// Per-game maps from before GameRecord, only read from older state
+	Moves       map[string]map[int]int64    `json:"moves,omitempty"`
+	MoveNumbers map[string]map[int]int      `json:"move_numbers,omitempty"`
+	GameLabels  map[string]map[int][]string `json:"game_labels,omitempty"`
+}
+
+// PendingNotification is a push that has been reserved for a user but not yet
+// confirmed as delivered. Stored moves are only advanced when the push is
+// committed, so a failed send leaves the turns eligible for re-notification.
+type PendingNotification struct {
+	Games      map[int]MoveState `json:"games"` // gameID -> move being notified
+	ReservedAt int64             `json:"reserved_at"`
+	Attempts   int               `json:"attempts"`
+	LastError  string            `json:"last_error,omitempty"`
+	inFlight   bool              // a send is currently in progress (not persisted)
 }
 
-var storage = &MoveStorage{
-	moves:                make(map[string]map[int]int64),
-	deviceTokens:         make(map[string]string),
-	lastNotificationTime: make(map[string]int64),
+// clone returns a copy that's safe to use outside the storage lock
+func (p *PendingNotification) clone() *PendingNotification {
+	copied := *p
+	copied.Games = make(map[int]MoveState, len(p.Games))
+	for gameID, move := range p.Games {
+		copied.Games[gameID] = move
+	}
+	return &copied
+}
+
+// MoveState identifies a position in a game by move count and timestamp
+type MoveState struct {
+	LastMove   int64 `json:"last_move"`
+	MoveNumber int   `json:"move_number,omitempty"`
 }
 
 type DeviceRegistration struct {
-	UserID      string `json:"user_id"`
-	DeviceToken string `json:"device_token"`
+	UserID          string `json:"user_id"`
+	Username        string `json:"username,omitempty"` // looked up on OGS when user_id is missing
+	DeviceToken     string `json:"device_token"`
+	APNsEnvironment string `json:"apns_environment,omitempty"` // sandbox or production; default: the server's
+	OGSAccessToken  string `json:"ogs_access_token,omitempty"` // proves the registrant controls the OGS account
 }
 
 type GameDiagnostic struct {
-	GameID              int    `json:"game_id"`
-	LastMoveTimestamp   int64  `json:"last_move_timestamp"`
-	CurrentPlayer       int    `json:"current_player"`
-	IsYourTurn          bool   `json:"is_your_turn"`
-	GameName            string `json:"game_name,omitempty"`
+	GameID            int    `json:"game_id"`
+	LastMoveTimestamp int64  `json:"last_move_timestamp"`
+	CurrentPlayer     int    `json:"current_player"`
+	IsYourTurn        bool   `json:"is_your_turn"`
+	GameName          string `json:"game_name,omitempty"`
+	Paused            bool   `json:"paused,omitempty"`
+	PauseReason       string `json:"pause_reason,omitempty"`
+	NotifyCount       int    `json:"notify_count,omitempty"`
+	LastNotifiedAt    int64  `json:"last_notified_at,omitempty"`
+	Muted             bool   `json:"muted,omitempty"`
 }
 
 type UserDiagnostics struct {
-	UserID                   string           `json:"user_id"`
-	DeviceTokenRegistered    bool             `json:"device_token_registered"`
-	DeviceTokenPreview       string           `json:"device_token_preview,omitempty"`
-	LastNotificationTime     int64            `json:"last_notification_time"`
-	MonitoredGames           []GameDiagnostic `json:"monitored_games"`
-	TotalActiveGames         int              `json:"total_active_games"`
-	ServerCheckInterval      string           `json:"server_check_interval"`
-	LastServerCheckTime      int64            `json:"last_server_check_time"`
+	UserID                string           `json:"user_id"`
+	DeviceTokenRegistered bool             `json:"device_token_registered"`
+	DeviceTokenPreview    string           `json:"device_token_preview,omitempty"`
+	LastNotificationTime  int64            `json:"last_notification_time"`
+	MonitoredGames        []GameDiagnostic `json:"monitored_games"`
+	TotalActiveGames      int              `json:"total_active_games"`
+	ServerCheckInterval   string           `json:"server_check_interval"`
+	LastServerCheckTime   int64            `json:"last_server_check_time"`
+	CheckOverdue          bool             `json:"check_overdue"`
+	NotificationsEnabled  bool             `json:"notifications_enabled"`
+	RecentlyFinished      []FinishedGame   `json:"recently_finished_games,omitempty"`
+	NextOffset            int              `json:"next_offset,omitempty"`
 }
 
 type DeviceTokenUsers struct {
@@ -95,35 +331,36 @@ type DeviceTokenUsers struct {
 	UserIDs     []string `json:"user_ids"`
 }
 
-
-var apnsClient *apns2.Client
-
 func main() {
-	loadStorage()
-	initAPNS()
-
-	// Start periodic checking in background
-	go startPeriodicChecking()
+	dataDirFlag := flag.String("data-dir", "", "directory for persisted state (overrides DATA_DIR)")
+	flag.Parse()
+	configureLogging()
 
-	r := mux.NewRouter()
-
-	r.HandleFunc("/check/{userID}", checkUserTurn).Methods("GET")
-	r.HandleFunc("/register", registerDevice).Methods("POST")
-	r.HandleFunc("/users-by-token/{deviceToken}", getUsersByDeviceToken).Methods("GET")
-	r.HandleFunc("/health", healthCheck).Methods("GET")
-	r.HandleFunc("/diagnostics/{userID}", getUserDiagnostics).Methods("GET")
-
-	log.Println("Server starting on :8080")
-	log.Println("Automatic turn checking enabled")
-	log.Fatal(http.ListenAndServe(":8080", r))
-}
+	cfg, err := loadStartupConfig(*dataDirFlag)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	srv, err := openStorage(cfg)
+	if err != nil {
+		log.Fatalf("Storage error: %v", err)
+	}
+	if err := srv.startPushProviders(cfg); err != nil {
+		log.Fatalf("Push provider error: %v", err)
+	}
+	listener, err := listen(cfg)
+	if err != nil {
+		log.Fatalf("Startup error: %v", err)
+	}
+	srv.startScheduler(cfg)
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	log.Printf("Server starting on %s", cfg.addr)
+	// Cleartext HTTP/2 (h2c) for clients and proxies that speak it; HTTP/1.1
+	// clients are unaffected
+	handler := h2c.NewHandler(gzipMiddleware(srv.newRouter()), &http2.Server{})
+	log.Fatal(http.Serve(listener, handler))
 }
 
-func checkUserTurn(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) checkUserTurn(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userIDStr := vars["userID"]
 
@@ -133,10 +370,15 @@ func checkUserTurn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status, err := getUserTurnStatus(userID)
+	srv.resetIdleBackoff(userIDStr)
+	status, err := srv.getUserTurnStatus(userID)
+	if errors.Is(err, errAccountGone) {
+		http.Error(w, "OGS account not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("Error getting user turn status for user %d: %v", userID, err)
-		http.Error(w, "Failed to fetch turn status", http.StatusInternalServerError)
+		http.Error(w, "Failed to fetch turn status", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -144,16 +386,82 @@ func checkUserTurn(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
-func getUserTurnStatus(userID int) (*TurnStatus, error) {
+func (srv *Server) getUserTurnStatus(userID int) (*TurnStatus, error) {
 	log.Printf("Fetching turn status for user %d", userID)
 
-	games, err := getActiveGames(userID)
+	games, err := srv.fetchActiveGames(userID)
+	srv.recordUserCheckOutcome(strconv.Itoa(userID), err, time.Now())
 	if err != nil {
 		log.Printf("Failed to get active games for user %d: %v", userID, err)
+		srv.recordCheckResult(strconv.Itoa(userID), nil, err)
+		if errors.Is(err, errAccountGone) {
+			srv.recordAccountMiss(strconv.Itoa(userID), time.Now(), srv.sendUserPushNotification)
+		}
 		return nil, err
 	}
 
 	log.Printf("User %d has %d active games", userID, len(games))
+	srv.recordActiveGameCount(strconv.Itoa(userID), len(games), time.Now())
+	srv.clockSkew.observe(games, time.Now())
+
+	userIDStr := strconv.Itoa(userID)
+	srv.detectRemovedGames(userIDStr, games)
+
+	for _, game := range games {
+		srv.rollbackUndoneMoves(userIDStr, game)
+		srv.trackClockPause(userIDStr, game)
+		srv.checkFinalByoyomiPeriod(userIDStr, userID, game, srv.ogsNow(time.Now()))
+		srv.checkLowClock(userIDStr, userID, game, srv.ogsNow(time.Now()))
+	}
+	srv.updateLiveActivities(userIDStr, userID, games, srv.ogsNow(time.Now()))
+
+	status, newTurnGames := srv.classifyTurns(userID, games)
+	addTurnUrgency(status, userID, games, srv.ogsNow(time.Now()))
+	srv.recordCheckResult(userIDStr, status, nil)
+	srv.recordTurnSummary(userIDStr, status, games, time.Now())
+	srv.recordAwaitingMoves(userIDStr, len(status.YourTurnNew)+len(status.YourTurnOld))
+
+	// High-volume players get one grouped push per batch window, as do
+	// games the user's rules mark as digest-only
+	waiting := 0
+	highVolume := srv.highVolumeModeActive(userIDStr, len(games))
+	if highVolume {
+		waiting = len(status.YourTurnNew) + len(status.YourTurnOld)
+	}
+	srv.notifyNewTurns(userID, games, status, newTurnGames, highVolume, waiting)
+	srv.updateBadge(userIDStr)
+
+	srv.saveStorage()
+	return status, nil
+}
+
+// notifyNewTurns applies the user's rules and batching to the new turns found
+// in games, then reserves and sends a single consolidated push for those left.
+// Stored moves are only advanced once the push is committed.
+func (srv *Server) notifyNewTurns(userID int, games []Game, status *TurnStatus, newTurnGames []Game, highVolume bool, waiting int) {
+	userIDStr := strconv.Itoa(userID)
+	newTurnGames = srv.turnsToNotify(userIDStr, newTurnGames, highVolume, time.Now())
+
+	var reserved []Game
+	if len(newTurnGames) > 0 {
+		reserved = srv.reserveNotification(userIDStr, newTurnGames)
+	}
+
+	if decisionTraceEnabled() {
+		srv.decisions.add(srv.buildDecisionTrace(userID, games, status, reserved))
+	}
+
+	if len(reserved) > 0 {
+		turnPushesQueued.Add(1)
+		go srv.sendConsolidatedPushNotification(userIDStr, reserved, waiting)
+	}
+}
+
+// classifyTurns sorts games into not-your-turn, new and old turns against the
+// stored state. It has no side effects, so it can also be used to preview what
+// a check would do.
+func (srv *Server) classifyTurns(userID int, games []Game) (*TurnStatus, []Game) {
+	userIDStr := strconv.Itoa(userID)
 
 	status := &TurnStatus{
 		NotYourTurn: []int{},
@@ -161,21 +469,21 @@ func getUserTurnStatus(userID int) (*TurnStatus, error) {
 		YourTurnOld: []int{},
 	}
 
-	userIDStr := strconv.Itoa(userID)
-
 	var newTurnGames []Game
 
 	for _, game := range games {
+		if !game.Started() {
+			status.NotStarted = append(status.NotStarted, game.ID)
+			continue
+		}
 
-		if game.JSON.Clock.CurrentPlayer == userID {
+		if game.IsTurnOf(userID) {
 			// Check if this is a new turn vs old turn
-			isNew := isNewTurn(userIDStr, game.ID, game.JSON.Clock.LastMove)
+			isNew := srv.isNewTurnAt(userIDStr, game.ID, game.MoveNumber(), game.JSON.Clock.LastMove)
 
 			if isNew {
 				status.YourTurnNew = append(status.YourTurnNew, game.ID)
 				newTurnGames = append(newTurnGames, game)
-				// Update stored move for new turns
-				updateStoredMove(userIDStr, game.ID, game.JSON.Clock.LastMove)
 			} else {
 				status.YourTurnOld = append(status.YourTurnOld, game.ID)
 			}
@@ -184,21 +492,127 @@ func getUserTurnStatus(userID int) (*TurnStatus, error) {
 		}
 	}
 
-	// Send single consolidated push notification if there are new turns
-	if len(newTurnGames) > 0 {
-		go sendConsolidatedPushNotification(userIDStr, newTurnGames)
+	return status, newTurnGames
+}
+
+// reserveNotification records a pending notification for the given games and
+// returns the games to send. If a send for this user is already in flight,
+// nothing is returned so overlapping checks don't produce duplicate pushes.
+func (srv *Server) reserveNotification(userID string, games []Game) []Game {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	pending := shard.pendingNotifications[userID]
+	if pending != nil && pending.inFlight {
+		log.Printf("Notification already in flight for user %s, skipping reservation", userID)
+		return nil
 	}
 
-	saveStorage()
-	return status, nil
+	if pending == nil {
+		pending = &PendingNotification{ReservedAt: time.Now().Unix()}
+		shard.pendingNotifications[userID] = pending
+	}
+
+	pending.Games = make(map[int]MoveState, len(games))
+	for _, game := range games {
+		pending.Games[game.ID] = MoveState{LastMove: game.JSON.Clock.LastMove, MoveNumber: game.MoveNumber()}
+	}
+	pending.Attempts++
+	pending.inFlight = true
+
+	return games
+}
+
+// commitNotification marks a reserved notification as delivered: the notified
+// moves become the stored moves and the pending record is removed.
+func (srv *Server) commitNotification(userID string, notified bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	pending := shard.pendingNotifications[userID]
+	if pending == nil {
+		shard.mu.Unlock()
+		return
+	}
+
+	now := time.Now().Unix()
+	srv.logStorageChange(walEntry{Op: walCommit, UserID: userID, At: now, Games: pending.Games, Notified: notified})
+	shard.applyCommit(userID, pending.Games, notified, now)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+}
+
+// applyCommit stores the notified moves and removes the pending record.
+// Callers must hold mu.
+func (s *storageShard) applyCommit(userID string, games map[int]MoveState, notified bool, at int64) {
+	if s.games[userID] == nil {
+		s.games[userID] = make(map[int]*GameRecord)
+	}
+	for gameID, move := range games {
+		record := s.gameRecord(userID, gameID)
+		if move.LastMove > record.LastMove {
+			record.LastMove = move.LastMove
+		}
+		if move.MoveNumber > 0 {
+			record.MoveNumber = move.MoveNumber
+		}
+		if notified {
+			record.LastNotifiedAt = at
+			record.NotifyCount++
+		}
+	}
+	if notified {
+		s.lastNotificationTime[userID] = at
+		delete(s.pushFailingSince, userID)
+	}
+	delete(s.pendingNotifications, userID)
+}
+
+// pendingDetectedAt returns when the turns in the user's pending notification
+// were first detected, which is where delivery latency is measured from
+func (srv *Server) pendingDetectedAt(userID string) time.Time {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if pending := shard.pendingNotifications[userID]; pending != nil && pending.ReservedAt > 0 {
+		return time.Unix(pending.ReservedAt, 0)
+	}
+	return time.Now()
+}
+
+// releaseNotification records a failed send. The pending record is kept so
+// the turns are picked up again on the next check.
+func (srv *Server) releaseNotification(userID string, reason string) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if pending := shard.pendingNotifications[userID]; pending != nil {
+		pending.inFlight = false
+		pending.LastError = reason
+	}
+	if _, failing := shard.pushFailingSince[userID]; !failing {
+		shard.pushFailingSince[userID] = time.Now().Unix()
+	}
+	shard.mu.Unlock()
+
+	srv.saveStorage()
 }
 
-func getActiveGames(userID int) ([]Game, error) {
-	url := fmt.Sprintf("https://online-go.com/api/v1/players/%d/full", userID)
+func (srv *Server) getActiveGames(userID int) ([]Game, error) {
+	url := fmt.Sprintf(ogsPlayerURL, userID)
 	log.Printf("Making OGS API request: %s", url)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	srv.addConditionalHeaders(req, userID)
+
+	resp, err := srv.ogsDo(req)
+	if errors.Is(err, errOGSThrottled) {
+		return nil, err
+	}
 	if err != nil {
 		log.Printf("OGS API request failed for user %d: %v", userID, err)
 		return nil, fmt.Errorf("failed to fetch games")
@@ -207,9 +621,20 @@ func getActiveGames(userID int) ([]Game, error) {
 
 	log.Printf("OGS API response status: %d", resp.StatusCode)
 
+	if resp.StatusCode == http.StatusNotModified {
+		if games, cached := srv.cachedActiveGames(userID); cached {
+			ogsNotModified.Add(1)
+			srv.rememberListedGames(games, time.Now())
+			return srv.completeActiveGames(userID, games), nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		log.Printf("OGS API has no player %d (status %d)", userID, resp.StatusCode)
+		return nil, errAccountGone
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("OGS API returned non-200 status: %d for user %d", resp.StatusCode, userID)
-		return nil, fmt.Errorf("API request failed")
+		return nil, ogsStatusError(resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -224,106 +649,357 @@ func getActiveGames(userID int) ([]Game, error) {
 		return nil, fmt.Errorf("failed to process response")
 	}
 
-	return response.ActiveGames, nil
+	srv.cacheActiveGames(userID, resp, response.ActiveGames)
+	srv.rememberListedGames(response.ActiveGames, time.Now())
+	return srv.completeActiveGames(userID, response.ActiveGames), nil
 }
 
-func isNewTurn(userID string, gameID int, currentMove int64) bool {
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+func (srv *Server) isNewTurn(userID string, gameID int, currentMove int64) bool {
+	return srv.isNewTurnAt(userID, gameID, 0, currentMove)
+}
 
-	userMoves, exists := storage.moves[userID]
-	if !exists {
-		return true // First time seeing this user
-	}
+// isNewTurnAt compares a game position against the stored one. The move count
+// is the primary key since last_move timestamps can repeat or regress; the
+// timestamp is only used when either side has no move count.
+func (srv *Server) isNewTurnAt(userID string, gameID int, moveNumber int, currentMove int64) bool {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	lastMove, exists := userMoves[gameID]
-	if !exists {
+	record := shard.game(userID, gameID)
+	if record == nil || !record.tracked() {
 		return true // First time seeing this game for this user
 	}
 
-	return currentMove > lastMove // New move since last check
+	if moveNumber > 0 && record.MoveNumber > 0 {
+		return moveNumber > record.MoveNumber
+	}
+
+	return currentMove > record.LastMove // New move since last check
 }
 
-func updateStoredMove(userID string, gameID int, lastMove int64) {
-	storage.mu.Lock()
-	defer storage.mu.Unlock()
+// rollbackUndoneMoves detects an accepted undo (the game has fewer moves than
+// we last stored) and rewinds the stored state to the current position, so the
+// re-played move is treated as new instead of as already notified.
+func (srv *Server) rollbackUndoneMoves(userID string, game Game) bool {
+	moveNumber := game.MoveNumber()
+	if moveNumber == 0 {
+		return false
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	record := shard.game(userID, game.ID)
+	if record == nil || moveNumber >= record.MoveNumber {
+		return false
+	}
+	storedNumber := record.MoveNumber
+
+	log.Printf("Undo detected for user %s in game %d: move %d -> %d, rolling back stored state",
+		userID, game.ID, storedNumber, moveNumber)
+
+	record.MoveNumber = moveNumber
+	record.LastMove = game.JSON.Clock.LastMove
 
-	if storage.moves[userID] == nil {
-		storage.moves[userID] = make(map[int]int64)
+	// A pending notification for the undone move is no longer accurate
+	if pending := shard.pendingNotifications[userID]; pending != nil && !pending.inFlight {
+		if move, exists := pending.Games[game.ID]; exists && move.MoveNumber > moveNumber {
+			delete(pending.Games, game.ID)
+			if len(pending.Games) == 0 {
+				delete(shard.pendingNotifications, userID)
+			}
+		}
 	}
-	storage.moves[userID][gameID] = lastMove
+
+	return true
+}
+
+func (srv *Server) updateStoredMove(userID string, gameID int, lastMove int64) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.gameRecord(userID, gameID).LastMove = lastMove
 }
 
-func loadStorage() {
-	storage.mu.Lock()
-	defer storage.mu.Unlock()
+// loadStorage replaces the in-memory state with the backend's. If the backend
+// can't be read, storage is left empty and the error returned.
+func (srv *Server) loadStorage() error {
+	srv.storage.lockAll()
+	defer srv.storage.unlockAll()
 
-	log.Println("Loading storage from moves.json...")
+	log.Printf("Loading storage from %s...", srv.backend.Name())
 
-	data, err := os.ReadFile("moves.json")
+	storageData, err := srv.backend.Load()
 	if err != nil {
-		log.Println("No existing moves.json file, starting fresh")
-		storage.moves = make(map[string]map[int]int64)
-		storage.deviceTokens = make(map[string]string)
-		storage.lastNotificationTime = make(map[string]int64)
-		return
+		log.Printf("Error loading storage: %v", err)
+		srv.storage.reset()
+		return err
 	}
 
-	// Try to load new format first (with device tokens and notification times)
-	var storageData struct {
-		Moves                map[string]map[int]int64 `json:"moves"`
-		DeviceTokens         map[string]string        `json:"device_tokens"`
-		LastNotificationTime map[string]int64         `json:"last_notification_time"`
-	}
+	srv.storage.reset()
+	srv.storage.apply(storageData)
 
-	if err := json.Unmarshal(data, &storageData); err == nil && storageData.Moves != nil {
-		storage.moves = storageData.Moves
-		if storageData.DeviceTokens != nil {
-			storage.deviceTokens = storageData.DeviceTokens
-		}
-		if storageData.LastNotificationTime != nil {
-			storage.lastNotificationTime = storageData.LastNotificationTime
-		}
-		log.Printf("Loaded storage: %d users with device tokens, %d users with move history, %d users with notification times",
-			len(storage.deviceTokens), len(storage.moves), len(storage.lastNotificationTime))
-		return
-	}
+	log.Printf("Loaded storage: %d users with device tokens, %d users with move history, %d users with notification times, %d pending notifications",
+		len(storageData.DeviceTokens), len(storageData.Games), len(storageData.LastNotificationTime), len(storageData.PendingNotifications))
+	return nil
+}
 
-	// Fallback to old format (just moves)
-	if err := json.Unmarshal(data, &storage.moves); err != nil {
-		log.Printf("Error loading moves.json: %v", err)
-		storage.moves = make(map[string]map[int]int64)
-		storage.deviceTokens = make(map[string]string)
-		storage.lastNotificationTime = make(map[string]int64)
+// apply replaces stored maps with those present in data, each shard taking
+// its own users. Callers must hold every lock; see lockAll.
+func (s *MoveStorage) apply(data *storageFile) {
+	data.upgradeLegacyGames()
+	if data.Tenants != nil {
+		s.tenants.Replace(data.Tenants)
+	}
+	if data.CycleLog != nil {
+		s.cycleLog.Replace(data.CycleLog)
+	}
+	if data.DiscordClubs != nil {
+		s.discordClubs.Replace(data.DiscordClubs)
+	}
+	for i, shard := range s.shards {
+		shard.apply(data, func(userID string) bool { return shardIndex(userID) == i })
 	}
 }
 
-func saveStorage() {
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+// apply replaces the shard's maps with the users it owns from those present
+// in data. Callers must hold mu.
+func (s *storageShard) apply(data *storageFile, owns func(userID string) bool) {
+	if data.Games != nil {
+		s.games = ownedBy(data.Games, owns)
+	}
+	if data.DeviceTokens != nil {
+		s.deviceTokens = ownedBy(data.DeviceTokens, owns)
+	}
+	if data.DeviceEnvironments != nil {
+		s.deviceEnvironments = ownedBy(data.DeviceEnvironments, owns)
+	}
+	if data.LastNotificationTime != nil {
+		s.lastNotificationTime = ownedBy(data.LastNotificationTime, owns)
+	}
+	if data.PendingNotifications != nil {
+		s.pendingNotifications = ownedBy(data.PendingNotifications, owns)
+	}
+	if data.FinishedGames != nil {
+		s.finishedGames = ownedBy(data.FinishedGames, owns)
+	}
+	if data.PausedGames != nil {
+		s.pausedGames = ownedBy(data.PausedGames, owns)
+	}
+	if data.PeriodWarnings != nil {
+		s.periodWarnings = ownedBy(data.PeriodWarnings, owns)
+	}
+	if data.Preferences != nil {
+		s.preferences = ownedBy(data.Preferences, owns)
+	}
+	if data.DailyCounts != nil {
+		s.dailyCounts = ownedBy(data.DailyCounts, owns)
+	}
+	if data.Reminders != nil {
+		s.reminders = ownedBy(data.Reminders, owns)
+	}
+	if data.Onboarding != nil {
+		s.onboarding = ownedBy(data.Onboarding, owns)
+	}
+	if data.CheckHealth != nil {
+		s.checkHealth = ownedBy(data.CheckHealth, owns)
+	}
+	if data.UserscriptTokens != nil {
+		s.userscriptTokens = ownedBy(data.UserscriptTokens, owns)
+	}
+	if data.NtfyTopics != nil {
+		s.ntfyTopics = ownedBy(data.NtfyTopics, owns)
+	}
+	if data.WebPushSubscriptions != nil {
+		s.webPushSubscriptions = ownedBy(data.WebPushSubscriptions, owns)
+	}
+	if data.NotificationsDisabled != nil {
+		s.notificationsDisabled = ownedBy(data.NotificationsDisabled, owns)
+	}
+	if data.SettingsVersions != nil {
+		s.settingsVersions = ownedBy(data.SettingsVersions, owns)
+	}
+	if data.PushFailingSince != nil {
+		s.pushFailingSince = ownedBy(data.PushFailingSince, owns)
+	}
+	if data.PushRetries != nil {
+		s.pushRetries = ownedBy(data.PushRetries, owns)
+	}
+	if data.UserTenants != nil {
+		s.userTenants = ownedBy(data.UserTenants, owns)
+	}
+	if data.AccountsGone != nil {
+		s.accountsGone = ownedBy(data.AccountsGone, owns)
+	}
+	if data.LinkedAccounts != nil {
+		s.linkedAccounts = ownedBy(data.LinkedAccounts, owns)
+	}
+	if data.Entitlements != nil {
+		s.entitlements = ownedBy(data.Entitlements, owns)
+	}
+	if data.AppAccountTokens != nil {
+		s.appAccountTokens = ownedBy(data.AppAccountTokens, owns)
+	}
+	if data.EntitlementOverrides != nil {
+		s.entitlementOverrides = ownedBy(data.EntitlementOverrides, owns)
+	}
+	if data.ChallengeTokens != nil {
+		s.challengeTokens = ownedBy(data.ChallengeTokens, owns)
+	}
+	if data.SeenChallenges != nil {
+		s.seenChallenges = ownedBy(data.SeenChallenges, owns)
+	}
+	if data.ClockWarnings != nil {
+		s.clockWarnings = ownedBy(data.ClockWarnings, owns)
+	}
+	if data.LiveActivityTokens != nil {
+		s.liveActivityTokens = ownedBy(data.LiveActivityTokens, owns)
+	}
+	if data.BadgeCounts != nil {
+		s.badgeCounts = ownedBy(data.BadgeCounts, owns)
+	}
+	if data.TelegramChats != nil {
+		s.telegramChats = ownedBy(data.TelegramChats, owns)
+	}
+	if data.DiscordWebhooks != nil {
+		s.discordWebhooks = ownedBy(data.DiscordWebhooks, owns)
+	}
+	if data.UserWebhooks != nil {
+		s.userWebhooks = ownedBy(data.UserWebhooks, owns)
+	}
+	if data.SlackDestinations != nil {
+		s.slackDestinations = ownedBy(data.SlackDestinations, owns)
+	}
+	if data.Snoozes != nil {
+		s.snoozes = ownedBy(data.Snoozes, owns)
+	}
+}
 
-	storageData := struct {
-		Moves                map[string]map[int]int64 `json:"moves"`
-		DeviceTokens         map[string]string        `json:"device_tokens"`
-		LastNotificationTime map[string]int64         `json:"last_notification_time"`
-	}{
-		Moves:                storage.moves,
-		DeviceTokens:         storage.deviceTokens,
-		LastNotificationTime: storage.lastNotificationTime,
+// snapshot returns the persisted view of storage, gathered from the shards.
+// The values are shared, so callers must hold every lock while using it; see
+// rlockAll.
+func (s *MoveStorage) snapshot() *storageFile {
+	data := &storageFile{
+		Tenants:      s.tenants.Clone(),
+		CycleLog:     s.cycleLog.Clone(),
+		DiscordClubs: s.discordClubs.Clone(),
+	}
+	for _, shard := range s.shards {
+		data.merge(shard.snapshot())
 	}
+	return data
+}
 
-	data, err := json.MarshalIndent(storageData, "", "  ")
-	if err != nil {
-		log.Printf("Error marshaling storage: %v", err)
-		return
+// snapshot returns the shard's persisted view, sharing its maps. Callers must
+// hold mu.
+func (s *storageShard) snapshot() *storageFile {
+	return &storageFile{
+		Games:                 s.games,
+		DeviceTokens:          s.deviceTokens,
+		DeviceEnvironments:    s.deviceEnvironments,
+		LastNotificationTime:  s.lastNotificationTime,
+		PendingNotifications:  s.pendingNotifications,
+		FinishedGames:         s.finishedGames,
+		PausedGames:           s.pausedGames,
+		PeriodWarnings:        s.periodWarnings,
+		Preferences:           s.preferences,
+		DailyCounts:           s.dailyCounts,
+		Reminders:             s.reminders,
+		Onboarding:            s.onboarding,
+		CheckHealth:           s.checkHealth,
+		UserscriptTokens:      s.userscriptTokens,
+		NtfyTopics:            s.ntfyTopics,
+		WebPushSubscriptions:  s.webPushSubscriptions,
+		NotificationsDisabled: s.notificationsDisabled,
+		SettingsVersions:      s.settingsVersions,
+		PushFailingSince:      s.pushFailingSince,
+		PushRetries:           s.pushRetries,
+		UserTenants:           s.userTenants,
+		AccountsGone:          s.accountsGone,
+		LinkedAccounts:        s.linkedAccounts,
+		Entitlements:          s.entitlements,
+		AppAccountTokens:      s.appAccountTokens,
+		EntitlementOverrides:  s.entitlementOverrides,
+		ChallengeTokens:       s.challengeTokens,
+		SeenChallenges:        s.seenChallenges,
+		ClockWarnings:         s.clockWarnings,
+		LiveActivityTokens:    s.liveActivityTokens,
+		BadgeCounts:           s.badgeCounts,
+		TelegramChats:         s.telegramChats,
+		DiscordWebhooks:       s.discordWebhooks,
+		UserWebhooks:          s.userWebhooks,
+		SlackDestinations:     s.slackDestinations,
+		Snoozes:               s.snoozes,
 	}
+}
 
-	if err := os.WriteFile("moves.json", data, 0600); err != nil {
-		log.Printf("Error saving moves.json: %v", err)
-	} else {
-		log.Printf("Storage saved: %d users with device tokens, %d users with move history, %d notification times",
-			len(storage.deviceTokens), len(storage.moves), len(storage.lastNotificationTime))
+// merge adds the users in part, one shard's snapshot, to data
+func (data *storageFile) merge(part *storageFile) {
+	data.Games = mergeInto(data.Games, part.Games)
+	data.DeviceTokens = mergeInto(data.DeviceTokens, part.DeviceTokens)
+	data.DeviceEnvironments = mergeInto(data.DeviceEnvironments, part.DeviceEnvironments)
+	data.LastNotificationTime = mergeInto(data.LastNotificationTime, part.LastNotificationTime)
+	data.PendingNotifications = mergeInto(data.PendingNotifications, part.PendingNotifications)
+	data.FinishedGames = mergeInto(data.FinishedGames, part.FinishedGames)
+	data.PausedGames = mergeInto(data.PausedGames, part.PausedGames)
+	data.PeriodWarnings = mergeInto(data.PeriodWarnings, part.PeriodWarnings)
+	data.Preferences = mergeInto(data.Preferences, part.Preferences)
+	data.DailyCounts = mergeInto(data.DailyCounts, part.DailyCounts)
+	data.Reminders = mergeInto(data.Reminders, part.Reminders)
+	data.Onboarding = mergeInto(data.Onboarding, part.Onboarding)
+	data.CheckHealth = mergeInto(data.CheckHealth, part.CheckHealth)
+	data.UserscriptTokens = mergeInto(data.UserscriptTokens, part.UserscriptTokens)
+	data.NtfyTopics = mergeInto(data.NtfyTopics, part.NtfyTopics)
+	data.WebPushSubscriptions = mergeInto(data.WebPushSubscriptions, part.WebPushSubscriptions)
+	data.NotificationsDisabled = mergeInto(data.NotificationsDisabled, part.NotificationsDisabled)
+	data.SettingsVersions = mergeInto(data.SettingsVersions, part.SettingsVersions)
+	data.PushFailingSince = mergeInto(data.PushFailingSince, part.PushFailingSince)
+	data.PushRetries = mergeInto(data.PushRetries, part.PushRetries)
+	data.UserTenants = mergeInto(data.UserTenants, part.UserTenants)
+	data.AccountsGone = mergeInto(data.AccountsGone, part.AccountsGone)
+	data.LinkedAccounts = mergeInto(data.LinkedAccounts, part.LinkedAccounts)
+	data.Entitlements = mergeInto(data.Entitlements, part.Entitlements)
+	data.AppAccountTokens = mergeInto(data.AppAccountTokens, part.AppAccountTokens)
+	data.EntitlementOverrides = mergeInto(data.EntitlementOverrides, part.EntitlementOverrides)
+	data.ChallengeTokens = mergeInto(data.ChallengeTokens, part.ChallengeTokens)
+	data.SeenChallenges = mergeInto(data.SeenChallenges, part.SeenChallenges)
+	data.ClockWarnings = mergeInto(data.ClockWarnings, part.ClockWarnings)
+	data.LiveActivityTokens = mergeInto(data.LiveActivityTokens, part.LiveActivityTokens)
+	data.BadgeCounts = mergeInto(data.BadgeCounts, part.BadgeCounts)
+	data.TelegramChats = mergeInto(data.TelegramChats, part.TelegramChats)
+	data.DiscordWebhooks = mergeInto(data.DiscordWebhooks, part.DiscordWebhooks)
+	data.UserWebhooks = mergeInto(data.UserWebhooks, part.UserWebhooks)
+	data.SlackDestinations = mergeInto(data.SlackDestinations, part.SlackDestinations)
+	data.Snoozes = mergeInto(data.Snoozes, part.Snoozes)
+}
+
+// writeStorage writes a snapshot of storage to the backend. Most callers
+// should use saveStorage, which defers the write to the background writer
+// and retries it if it fails. Storage is only locked while the snapshot is
+// copied, so a slow backend doesn't hold up checks and requests that change
+// storage.
+func (srv *Server) writeStorage() error {
+	srv.saves.Lock()
+	defer srv.saves.Unlock()
+
+	srv.storage.rlockAll()
+	data := srv.storage.snapshot().copy()
+	walOffset := srv.storageWALOffset()
+	srv.storage.runlockAll()
+	devices, moves, notified := len(data.DeviceTokens), len(data.Games), len(data.LastNotificationTime)
+
+	if err := srv.backend.Save(data); err != nil {
+		log.Printf("Error saving storage to %s: %v", srv.backend.Name(), err)
+		return err
 	}
+	srv.truncateStorageWAL(walOffset)
+	srv.lastSaveAt.Store(time.Now().Unix())
+	log.Printf("Storage saved: %d users with device tokens, %d users with move history, %d notification times",
+		devices, moves, notified)
+	return nil
 }
 
 func getSecret(secretName string) (string, error) {
@@ -353,9 +1029,7 @@ func getSecret(secretName string) (string, error) {
 }
 
 func getAPNSConfig() (keyData []byte, keyID, teamID, bundleID string, isDevelopment bool, err error) {
-	//environment := os.Getenv("ENVIRONMENT")
-
-	if true { //environment == "production" {
+	if productionDeployment() {
 		log.Println("Loading APNs configuration from Secret Manager...")
 
 		// Get configuration from Secret Manager
@@ -384,8 +1058,8 @@ func getAPNSConfig() (keyData []byte, keyID, teamID, bundleID string, isDevelopm
 			return nil, "", "", "", false, fmt.Errorf("failed to load APNs configuration")
 		}
 
-		isDevelopment = false // Production always uses production APNs
-		log.Println("APNs configuration loaded from Secret Manager")
+		isDevelopment = apnsDevelopment()
+		log.Printf("APNs configuration loaded from Secret Manager (development=%t)", isDevelopment)
 	} else {
 		log.Println("Loading APNs configuration from environment variables...")
 
@@ -408,7 +1082,7 @@ func getAPNSConfig() (keyData []byte, keyID, teamID, bundleID string, isDevelopm
 		keyID = os.Getenv("APNS_KEY_ID")
 		teamID = os.Getenv("APNS_TEAM_ID")
 		bundleID = os.Getenv("APNS_BUNDLE_ID")
-		isDevelopment = os.Getenv("APNS_DEVELOPMENT") == "true"
+		isDevelopment = apnsDevelopment()
 
 		log.Printf("APNs configuration loaded from environment variables (development=%t)", isDevelopment)
 	}
@@ -420,21 +1094,69 @@ func getAPNSConfig() (keyData []byte, keyID, teamID, bundleID string, isDevelopm
 	return keyData, keyID, teamID, bundleID, isDevelopment, nil
 }
 
-func initAPNS() {
+// defaultAPNsTopic is the OGS app's topic, used when nothing is configured
+const defaultAPNsTopic = "online-go-server-push-notification"
+
+// apnsTopicSuffixes are the suffixes APNs adds to the bundle ID for pushes
+// that aren't alerts
+var apnsTopicSuffixes = []string{".voip", ".complication", ".pushkit.fileprovider"}
+
+// apnsTopic returns the topic pushes are sent to: APNS_TOPIC, which startup
+// sets from the APNs configuration, else the bundle ID
+func apnsTopic() string {
+	if topic := os.Getenv("APNS_TOPIC"); topic != "" {
+		return topic
+	}
+	if bundleID := os.Getenv("APNS_BUNDLE_ID"); bundleID != "" {
+		return bundleID
+	}
+	return defaultAPNsTopic
+}
+
+// validateAPNsTopic checks the topic belongs to the app: APNs only accepts
+// the bundle ID, or the bundle ID with a push type suffix
+func validateAPNsTopic(topic, bundleID string) error {
+	topic, bundleID = strings.TrimSpace(topic), strings.TrimSpace(bundleID)
+	if topic == bundleID {
+		return nil
+	}
+	for _, suffix := range apnsTopicSuffixes {
+		if topic == bundleID+suffix {
+			return nil
+		}
+	}
+	return fmt.Errorf("APNs topic %q doesn't match bundle ID %q", topic, bundleID)
+}
+
+// configureAPNs returns a pool of APNS_CONNECTIONS clients for the
+// configured credentials
+func configureAPNs() (*apnsPool, error) {
 	keyData, keyID, teamID, bundleID, isDevelopment, err := getAPNSConfig()
 
 	if err != nil {
-		log.Printf("APNs configuration error: %v. Push notifications will be disabled.", err)
-		return
+		return nil, err
 	}
 
 	// Store bundle ID in environment for later use
 	os.Setenv("APNS_BUNDLE_ID", bundleID)
 
+	topic := os.Getenv("APNS_TOPIC")
+	if topic == "" {
+		if secret, err := getSecret("apns-topic"); err == nil {
+			topic = strings.TrimSpace(secret)
+		}
+	}
+	if topic == "" {
+		topic = bundleID
+	}
+	if err := validateAPNsTopic(topic, bundleID); err != nil {
+		return nil, err
+	}
+	os.Setenv("APNS_TOPIC", topic)
+
 	authKey, err := token.AuthKeyFromBytes(keyData)
 	if err != nil {
-		log.Printf("Error loading APNs auth key: %v. Push notifications will be disabled.", err)
-		return
+		return nil, fmt.Errorf("loading auth key: %v", err)
 	}
 
 	tokenProvider := &token.Token{
@@ -443,16 +1165,24 @@ func initAPNS() {
 		TeamID:  teamID,
 	}
 
+	// Each client has its own HTTP/2 connection
+	clients := make([]*apns2.Client, apnsConnections())
+	for i := range clients {
+		clients[i] = apns2.NewTokenClient(tokenProvider).Production()
+		if isDevelopment {
+			clients[i].Development()
+		}
+	}
+
 	if isDevelopment {
-		apnsClient = apns2.NewTokenClient(tokenProvider).Development()
-		log.Println("APNs client initialized for development")
+		log.Printf("APNs client initialized for development (%d connections)", len(clients))
 	} else {
-		apnsClient = apns2.NewTokenClient(tokenProvider).Development()
-		log.Println("APNs client initialized for production")
+		log.Printf("APNs client initialized for production (%d connections)", len(clients))
 	}
+	return newAPNSPool(clients...), nil
 }
 
-func registerDevice(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) registerDevice(w http.ResponseWriter, r *http.Request) {
 
 	var registration DeviceRegistration
 	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
@@ -461,29 +1191,92 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The app may only know the player's username
+	lookedUp := registration.UserID == "" && registration.Username != "" && registration.DeviceToken != ""
+	if lookedUp {
+		playerID, err := srv.ogsPlayerIDForUsername(registration.Username)
+		if errors.Is(err, errPlayerNotFound) {
+			http.Error(w, "OGS user not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Registration failed: looking up OGS username %q: %v", registration.Username, err)
+			http.Error(w, "Failed to look up OGS user", http.StatusServiceUnavailable)
+			return
+		}
+		registration.UserID = strconv.Itoa(playerID)
+	}
+
 	if registration.UserID == "" || registration.DeviceToken == "" {
 		log.Printf("Registration failed: Missing required fields (user_id=%s, token_length=%d)",
 			registration.UserID, len(registration.DeviceToken))
-		http.Error(w, "user_id and device_token are required", http.StatusBadRequest)
+		http.Error(w, "user_id (or username) and device_token are required", http.StatusBadRequest)
+		return
+	}
+	if !validAPNsEnvironment(registration.APNsEnvironment) {
+		http.Error(w, "apns_environment must be sandbox or production", http.StatusBadRequest)
 		return
 	}
 
 	log.Printf("Registering device for user %s (token length: %d)",
 		registration.UserID, len(registration.DeviceToken))
 
-	storage.mu.Lock()
-	storage.deviceTokens[registration.UserID] = registration.DeviceToken
-	storage.mu.Unlock()
+	// Ownership is proven by an OGS access token for the account, by a
+	// tenant's API key for its users, or by the device already registered
+	tenantID := tenantFromRequest(r)
+	linked := registration.OGSAccessToken != ""
+	if linked {
+		if err := srv.verifyAccountLink(registration.UserID, registration.OGSAccessToken); err != nil {
+			log.Printf("Registration failed: OGS account link for user %s: %v", registration.UserID, err)
+			writeAccountLinkError(w, err)
+			return
+		}
+	}
 
-	saveStorage()
+	// claims is held until the device is set, so claims can't race each other
+	srv.storage.claims.Lock()
+	if err := srv.storage.claimUserForTenant(registration.UserID, tenantID); err != nil {
+		srv.storage.claims.Unlock()
+		log.Printf("Registration failed: %v", err)
+		http.Error(w, "User can't be registered with this API key", http.StatusForbidden)
+		return
+	}
+	shard := srv.storage.shard(registration.UserID)
+	shard.mu.Lock()
+	if !linked && tenantID == "" {
+		if err := shard.checkUnlinkedRegistration(registration.UserID, registration.DeviceToken, r.Header.Get(deviceTokenHeader)); err != nil {
+			shard.mu.Unlock()
+			srv.storage.claims.Unlock()
+			log.Printf("Registration failed: OGS account link for user %s: %v", registration.UserID, err)
+			writeAccountLinkError(w, err)
+			return
+		}
+	}
+	srv.logStorageChange(walEntry{Op: walRegister, UserID: registration.UserID, DeviceToken: registration.DeviceToken, APNsEnvironment: registration.APNsEnvironment})
+	shard.setDevice(registration.UserID, registration.DeviceToken, registration.APNsEnvironment)
+	delete(shard.accountsGone, registration.UserID) // registering again retries a gone account
+	if linked {
+		shard.recordAccountLink(registration.UserID, time.Now())
+	}
+	shard.bumpSettingsVersion(registration.UserID)
+	shard.mu.Unlock()
+	srv.storage.claims.Unlock()
+
+	srv.recordFunnelStep(registration.UserID, funnelRegistered, time.Now())
+	srv.resetIdleBackoff(registration.UserID)
+
+	srv.saveStorage()
 	log.Printf("Successfully registered device for user %s", registration.UserID)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
+	response := map[string]string{"status": "registered"}
+	if lookedUp {
+		response["user_id"] = registration.UserID
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
-
-func getUserDiagnostics(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) getUserDiagnostics(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userIDStr := vars["userID"]
 
@@ -496,29 +1289,74 @@ func getUserDiagnostics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user is registered
-	storage.mu.RLock()
-	_, hasDeviceToken := storage.deviceTokens[userIDStr]
-	lastNotificationTime := storage.lastNotificationTime[userIDStr]
-	storage.mu.RUnlock()
+	opts, err := parseListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Get current games from OGS API
-	games, err := getActiveGames(userID)
+	// Get current games the way the scheduled check does
+	games, err := srv.fetchActiveGames(userID)
 	if err != nil {
 		log.Printf("Failed to get active games for user %s in diagnostics: %v", userIDStr, err)
 		http.Error(w, "Failed to fetch user games", http.StatusServiceUnavailable)
 		return
 	}
 
+	diagnostics := srv.buildUserDiagnostics(userID, games)
+
+	// Page the game list; total_active_games still counts every game
+	start, end, next := opts.page(len(diagnostics.MonitoredGames))
+	diagnostics.MonitoredGames = diagnostics.MonitoredGames[start:end]
+	diagnostics.NextOffset = next
+
+	response, err := selectFields(diagnostics, opts.Fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Diagnostics generated for user %s: %d games, device_registered=%t, last_notification=%d",
+		userIDStr, len(games), diagnostics.DeviceTokenRegistered, diagnostics.LastNotificationTime)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// buildUserDiagnostics assembles the diagnostics document for a user from
+// stored state and their current active games
+func (srv *Server) buildUserDiagnostics(userID int, games []Game) UserDiagnostics {
+	userIDStr := strconv.Itoa(userID)
+
+	// Check if user is registered
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	_, hasDeviceToken := shard.deviceTokens[userIDStr]
+	lastNotificationTime := shard.lastNotificationTime[userIDStr]
+	_, notificationsOff := shard.notificationsDisabled[userIDStr]
+	recentlyFinished := append([]FinishedGame(nil), shard.finishedGames[userIDStr]...)
+	var lastCheck int64
+	if health := shard.checkHealth[userIDStr]; health != nil {
+		lastCheck = health.LastSuccess
+	}
+	records := make(map[int]GameRecord, len(shard.games[userIDStr]))
+	for gameID, record := range shard.games[userIDStr] {
+		records[gameID] = *record
+	}
+	shard.mu.RUnlock()
+
 	// Build diagnostics response
 	diagnostics := UserDiagnostics{
 		UserID:                userIDStr,
 		DeviceTokenRegistered: hasDeviceToken,
 		LastNotificationTime:  lastNotificationTime,
 		TotalActiveGames:      len(games),
-		ServerCheckInterval:   "30s", // Could make this dynamic
-		LastServerCheckTime:   time.Now().Unix(),
+		ServerCheckInterval:   checkInterval().String(),
+		LastServerCheckTime:   lastCheck,
+		CheckOverdue:          checkOverdue(lastCheck, time.Now()),
+		NotificationsEnabled:  !notificationsOff,
 		MonitoredGames:        make([]GameDiagnostic, 0),
+		RecentlyFinished:      recentlyFinished,
 	}
 
 	// Add device token preview if available
@@ -531,21 +1369,22 @@ func getUserDiagnostics(w http.ResponseWriter, r *http.Request) {
 		gameDiag := GameDiagnostic{
 			GameID:            game.ID,
 			LastMoveTimestamp: game.JSON.Clock.LastMove,
-			CurrentPlayer:     game.JSON.Clock.CurrentPlayer,
-			IsYourTurn:        game.JSON.Clock.CurrentPlayer == userID,
+			CurrentPlayer:     game.PlayerToMove(),
+			IsYourTurn:        game.IsTurnOf(userID),
 			GameName:          game.Name,
+			Paused:            game.IsPaused(),
+			PauseReason:       game.PauseReason(),
+			NotifyCount:       records[game.ID].NotifyCount,
+			LastNotifiedAt:    records[game.ID].LastNotifiedAt,
+			Muted:             records[game.ID].Muted,
 		}
 		diagnostics.MonitoredGames = append(diagnostics.MonitoredGames, gameDiag)
 	}
 
-	log.Printf("Diagnostics generated for user %s: %d games, device_registered=%t, last_notification=%d",
-		userIDStr, len(games), hasDeviceToken, lastNotificationTime)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(diagnostics)
+	return diagnostics
 }
 
-func getUsersByDeviceToken(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) getUsersByDeviceToken(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	deviceToken := vars["deviceToken"]
 
@@ -557,14 +1396,16 @@ func getUsersByDeviceToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Search through all device tokens to find matching user IDs
-	storage.mu.RLock()
 	var matchingUserIDs []string
-	for userID, token := range storage.deviceTokens {
-		if token == deviceToken {
-			matchingUserIDs = append(matchingUserIDs, userID)
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for userID, token := range shard.deviceTokens {
+			if token == deviceToken {
+				matchingUserIDs = append(matchingUserIDs, userID)
+			}
 		}
+		shard.mu.RUnlock()
 	}
-	storage.mu.RUnlock()
 
 	response := DeviceTokenUsers{
 		DeviceToken: deviceToken,
@@ -577,30 +1418,150 @@ func getUsersByDeviceToken(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func sendConsolidatedPushNotification(userID string, newTurnGames []Game) {
+// sendConsolidatedPushNotification sends one push for all new turns. waiting
+// is the total number of games awaiting a move when notifications are grouped
+// for high-volume players, or 0 for a regular push.
+func (srv *Server) sendConsolidatedPushNotification(userID string, newTurnGames []Game, waiting int) {
+	pushesInFlight.Add(1)
+	defer pushesInFlight.Add(-1)
+
 	log.Printf("Preparing push notification for user %s with %d new turn games", userID, len(newTurnGames))
 
-	if apnsClient == nil {
-		log.Printf("APNs client not initialized, skipping push notification for user %s", userID)
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	deviceToken, hasDevice := shard.deviceTokens[userID]
+	environment := shard.deviceEnvironments[userID]
+	_, disabled := shard.notificationsDisabled[userID]
+	shard.mu.RUnlock()
+	channels := srv.userChannelsFor(userID, eventTurn)
+
+	// Turns seen while notifications are off are committed, so turning them
+	// back on doesn't replay a backlog
+	if disabled {
+		log.Printf("Notifications are off for user %s, skipping %d game(s)", userID, len(newTurnGames))
+		srv.commitNotification(userID, false)
 		return
 	}
 
-	storage.mu.RLock()
-	deviceToken, exists := storage.deviceTokens[userID]
-	storage.mu.RUnlock()
-
-	if !exists {
-		log.Printf("No device token found for user %s", userID)
+	// With nowhere on the route to deliver, there's nothing to retry: commit
+	// the moves as seen
+	route := srv.routeFor(userID, eventTurn)
+	hasAPNs := hasDevice && srv.apns != nil
+	available := channels.available(hasAPNs)
+	routable := false
+	for _, channel := range route.Channels {
+		routable = routable || available[channel]
+	}
+	if !routable {
+		if srv.apns == nil {
+			log.Printf("APNs client not initialized, skipping push notification for user %s", userID)
+		} else {
+			log.Printf("No device token found for user %s", userID)
+		}
+		srv.commitNotification(userID, false)
 		return
 	}
 
 	if len(newTurnGames) == 0 {
 		log.Printf("No new turn games for user %s, skipping notification", userID)
+		srv.commitNotification(userID, false)
+		return
+	}
+
+	detectedAt := srv.pendingDetectedAt(userID)
+
+	// Urgent games are sent even once the daily cap is reached
+	urgent := srv.hasUrgentGame(userID, newTurnGames)
+	budget := srv.checkNotificationBudget(userID, time.Now())
+	if budget == budgetSuppress && urgent {
+		budget = budgetSend
+	}
+	if budget == budgetSuppress {
+		log.Printf("Daily notification cap reached for user %s, suppressing %d game(s)", userID, len(newTurnGames))
+		srv.commitNotification(userID, false)
+		return
+	}
+	if srv.tenantQuotaReached(userID, time.Now()) {
+		log.Printf("Tenant notification quota reached for user %s, suppressing %d game(s)", userID, len(newTurnGames))
+		srv.commitNotification(userID, false)
 		return
 	}
 
-	log.Printf("Found device token for user %s", userID)
+	playerID, _ := strconv.Atoi(userID)
+	alert := buildTurnAlert(playerID, newTurnGames, waiting, budget, srv.preferencesFor(userID).TurnTemplate)
+	alert.Urgent = urgent
+	alert.Badge = srv.turnBadge(userID, len(newTurnGames))
+
+	// Delivered if any channel on the route accepts it; otherwise the last
+	// failure is recorded and the moves are retried
+	message := channelMessage{Event: eventTurn, Action: "open_game", Title: alert.Title, Body: alert.Body, URL: alert.WebURL, GameID: alert.Game.ID}
+	for _, game := range newTurnGames {
+		message.GameIDs = append(message.GameIDs, game.ID)
+	}
+	var failure string
+	sent, _ := deliverOnRoute(route, available, func(channel string) error {
+		if channel != channelAPNs {
+			if err := channels.send(userID, channel, message); err != nil {
+				failure = channelSenders[channel].failure
+				return err
+			}
+			return nil
+		}
+
+		res, err := srv.pushAPNs(alert.apnsNotification(deviceToken), environment)
+		if err != nil {
+			log.Printf("Error sending push notification to user %s: %v", userID, err)
+			failure = "send error"
+			return err
+		}
+		if !res.Sent() {
+			log.Printf("Push notification failed for user %s: %v", userID, res.Reason)
+			srv.removeDeadDeviceToken(userID, deviceToken, res)
+			failure = res.Reason
+			return fmt.Errorf("APNs rejected the push: %s", res.Reason)
+		}
+		log.Printf("Push notification sent successfully to user %s for %d game(s). Web URL: %s, App URL: %s", userID, len(newTurnGames), alert.WebURL, alert.AppURL)
+		if !apnsBackgroundEvent(eventTurn) {
+			srv.setBadgeShown(userID, alert.Badge)
+		}
+		return nil
+	})
+
+	if sent {
+		srv.recordRouteDelivery(userID, eventTurn, route, time.Now())
+		// Commit the notified moves and update last notification time
+		srv.recordPushOutcome(detectedAt, true)
+		srv.recordFunnelStep(userID, funnelPushed, time.Now())
+		srv.recordNotificationSent(userID, budget, time.Now())
+		srv.meterTenantNotification(userID, time.Now())
+		srv.commitNotification(userID, true)
+	} else {
+		srv.recordPushOutcome(detectedAt, false)
+		srv.releaseNotification(userID, failure)
+	}
+}
+
+// turnAlert is the content of a consolidated turn notification, shared by
+// every delivery channel
+type turnAlert struct {
+	Title  string
+	Body   string
+	Badge  int  // games awaiting the user's move
+	Game   Game // the game the notification links to
+	WebURL string
+	AppURL string
+	Urgent bool // a game the user's rules mark urgent; delivered as time-sensitive
+	// Deadline is when the last of the games' clocks runs out, if known
+	Deadline time.Time
+
+	Opponent   string // the user's opponent in Game, if known
+	MoveNumber int    // moves played in Game, or 0 if unknown
+}
 
+// buildTurnAlert renders the notification for the user's new turns. waiting is
+// the total number of games awaiting a move for grouped notifications, or 0.
+// template is the user's turn template, used for a single new turn.
+func buildTurnAlert(userID int, newTurnGames []Game, waiting int, budget budgetDecision, template string) turnAlert {
 	// Get environment name (defaults to "none" if not set)
 	environment := os.Getenv("ENVIRONMENT")
 	if environment == "" {
@@ -609,12 +1570,29 @@ func sendConsolidatedPushNotification(userID string, newTurnGames []Game) {
 
 	// Create notification title and body based on number of games
 	var title, body string
-	if len(newTurnGames) == 1 {
+	if budget == budgetOverflow {
 		title = "Your turn in Go!"
+		body = fmt.Sprintf("%d more games await you", len(newTurnGames))
+		if len(newTurnGames) == 1 {
+			body = "1 more game awaits you"
+		}
 		if environment != "none" {
-			body = fmt.Sprintf("[%s] It's your turn in: %s", environment, newTurnGames[0].Name)
-		} else {
-			body = fmt.Sprintf("It's your turn in: %s", newTurnGames[0].Name)
+			body = fmt.Sprintf("[%s] %s", environment, body)
+		}
+	} else if waiting > 0 {
+		title = "Your turn in Go!"
+		body = fmt.Sprintf("%d new turn(s), %d games waiting for your move", len(newTurnGames), waiting)
+		if environment != "none" {
+			body = fmt.Sprintf("[%s] %s", environment, body)
+		}
+	} else if len(newTurnGames) == 1 {
+		title = "Your turn in Go!"
+		body = singleTurnBody(userID, newTurnGames[0])
+		if template != "" {
+			body = renderTurnTemplate(template, userID, newTurnGames[0])
+		}
+		if environment != "none" {
+			body = fmt.Sprintf("[%s] %s", environment, body)
 		}
 	} else {
 		title = "Your turn in Go!"
@@ -627,92 +1605,325 @@ func sendConsolidatedPushNotification(userID string, newTurnGames []Game) {
 
 	// Use the first game for the deep link
 	firstGame := newTurnGames[0]
-	webURL := fmt.Sprintf("https://online-go.com/game/%d", firstGame.ID)
-	appURL := fmt.Sprintf("ogs://game/%d", firstGame.ID)  // Custom URL scheme for the app
+	return turnAlert{
+		Title:      title,
+		Body:       body,
+		Badge:      max(waiting, len(newTurnGames)),
+		Game:       firstGame,
+		WebURL:     ogsGameLink(firstGame.ID),
+		AppURL:     fmt.Sprintf("ogs://game/%d", firstGame.ID), // Custom URL scheme for the app
+		Opponent:   firstGame.Opponent(userID).Username,
+		MoveNumber: firstGame.MoveNumber(),
+		Deadline:   turnDeadline(newTurnGames),
+	}
+}
 
+// singleTurnBody describes a new turn in one game: "Your turn vs. PlayerX
+// (move 57)", falling back to the game's name when the opponent isn't known
+func singleTurnBody(userID int, game Game) string {
+	opponent := game.Opponent(userID).Username
+	if opponent == "" {
+		return fmt.Sprintf("It's your turn in: %s", game.Name)
+	}
+	if moves := game.MoveNumber(); moves > 0 {
+		return fmt.Sprintf("Your turn vs. %s (move %d)", opponent, moves)
+	}
+	return fmt.Sprintf("Your turn vs. %s", opponent)
+}
+
+// apnsNotification builds the APNs push for a device
+func (a turnAlert) apnsNotification(deviceToken string) *apns2.Notification {
 	// Create notification payload with both web and app URLs
 	notification := &apns2.Notification{}
 	notification.DeviceToken = deviceToken
-	notification.Topic = "online-go-server-push-notification"
+	notification.Topic = apnsTopic()
 
 	// Add URLs and action data for iOS app to handle
-	payload := payload.NewPayload().Alert(title).
-		AlertBody(body).
-		Badge(len(newTurnGames)).
-		Sound("default").
-		Custom("web_url", webURL).        // For opening in Safari as fallback
-		Custom("app_url", appURL).        // For opening in app
-		Custom("game_id", firstGame.ID).
+	alertPayload := newAPNsPayload(eventTurn, a.Title, a.Body).
+		Custom("web_url", a.WebURL). // For opening in Safari as fallback
+		Custom("app_url", a.AppURL). // For opening in app
+		Custom("game_id", a.Game.ID).
 		Custom("action", "open_game").
-		Custom("game_name", firstGame.Name)
+		Custom("game_name", a.Game.Name)
+	if a.Opponent != "" {
+		alertPayload.Custom("opponent_name", a.Opponent)
+	}
+	if a.MoveNumber > 0 {
+		alertPayload.Custom("move_number", a.MoveNumber)
+	}
+	if !apnsBackgroundEvent(eventTurn) {
+		alertPayload.Badge(a.Badge)
+		attachBoardImage(alertPayload, a.Game.ID, a.MoveNumber)
+	}
+	if a.Urgent {
+		alertPayload.InterruptionLevel(payload.InterruptionLevelTimeSensitive)
+	}
+	alertPayload.Category(apnsCategories[eventTurn])
 
-	notification.Payload = payload
-	notification.CollapseID = "game_turn"  // Group similar notifications
+	notification.Payload = alertPayload
+	notification.CollapseID = "game_turn" // Group similar notifications
+	setAPNsDelivery(notification, eventTurn, a.Deadline, time.Now())
+	return notification
+}
 
-	// Send the notification
-	res, err := apnsClient.Push(notification)
-	if err != nil {
-		log.Printf("Error sending push notification to user %s: %v", userID, err)
-		return
+// sendGamePushNotification sends a single alert about one game to the user's
+// device. It's used for game events outside the consolidated turn flow.
+func (srv *Server) sendGamePushNotification(userID string, gameID int, title, body, action string) error {
+	return srv.sendUserPushNotification(userID, title, body, action, map[string]interface{}{
+		"web_url": ogsGameLink(gameID),
+		"app_url": fmt.Sprintf("ogs://game/%d", gameID),
+		"game_id": gameID,
+	})
+}
+
+// sendUserPushNotification sends a single push to a user, with any extra
+// payload fields
+func (srv *Server) sendUserPushNotification(userID string, title, body, action string, custom map[string]interface{}) error {
+	if !srv.notificationsEnabled(userID) {
+		log.Printf("Notifications are off for user %s, not sending %s", userID, action)
+		return fmt.Errorf("notifications disabled by user")
+	}
+	if srv.tenantQuotaReached(userID, time.Now()) {
+		log.Printf("Tenant notification quota reached for user %s, not sending %s", userID, action)
+		return fmt.Errorf("tenant notification quota reached")
 	}
 
-	if res.Sent() {
-		log.Printf("Push notification sent successfully to user %s for %d game(s). Web URL: %s, App URL: %s", userID, len(newTurnGames), webURL, appURL)
+	if environment := os.Getenv("ENVIRONMENT"); environment != "" && environment != "none" {
+		body = fmt.Sprintf("[%s] %s", environment, body)
+	}
 
-		// Update last notification time
-		storage.mu.Lock()
-		storage.lastNotificationTime[userID] = time.Now().Unix()
-		storage.mu.Unlock()
+	if srv.snoozedPush(userID, custom, time.Now()) {
+		log.Printf("Notifications are snoozed for user %s, not sending %s", userID, action)
+		return errPushSnoozed
+	}
+	// Urgent pushes, like the final low-clock warning, aren't throttled
+	urgent, _ := custom["urgent"].(bool)
+	route := srv.routeFor(userID, action)
+	if !urgent && !srv.routeAllows(userID, action, route, time.Now()) {
+		log.Printf("Throttling %s notification for user %s", action, userID)
+		return fmt.Errorf("%s notifications throttled", action)
+	}
 
-		saveStorage()
-	} else {
-		log.Printf("Push notification failed for user %s: %v", userID, res.Reason)
+	err := srv.deliverUserPush(userID, title, body, action, custom)
+	if isTransientPush(err) && srv.queuePushRetry(userID, PushRetry{Title: title, Body: body, Action: action, Custom: custom}, err, time.Now()) {
+		return fmt.Errorf("%w: %v", errPushQueued, err)
 	}
+	return err
 }
 
+// customGameID returns the game a push is about, or 0. Queued pushes come
+// back from storage with numbers as float64.
+func customGameID(custom map[string]interface{}) int {
+	gameID, _ := custom["game_id"].(int)
+	if stored, ok := custom["game_id"].(float64); ok {
+		gameID = int(stored)
+	}
+	return gameID
+}
 
-func startPeriodicChecking() {
-	// Get check interval from environment, default to 30 seconds
-	checkInterval := 30 * time.Second
+// deliverUserPush sends a push on the user's route for the action
+func (srv *Server) deliverUserPush(userID string, title, body, action string, custom map[string]interface{}) error {
+	route := srv.routeFor(userID, action)
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	_, hasDevice := shard.deviceTokens[userID]
+	shard.mu.RUnlock()
+	channels := srv.userChannelsFor(userID, action)
+
+	webURL, _ := custom["web_url"].(string)
+	message := channelMessage{Event: action, Action: action, Title: title, Body: body, URL: webURL, GameID: customGameID(custom)}
+	delivered, err := deliverOnRoute(route, channels.available(hasDevice), func(channel string) error {
+		if channel == channelAPNs {
+			return srv.sendAPNsAlert(userID, title, body, action, custom)
+		}
+		if err := channels.send(userID, channel, message); err != nil {
+			return err
+		}
+		srv.recordFunnelStep(userID, funnelPushed, time.Now())
+		return nil
+	})
+	if !delivered {
+		return err
+	}
+	srv.recordRouteDelivery(userID, action, route, time.Now())
+	srv.meterTenantNotification(userID, time.Now())
+	return nil
+}
+
+// sendAPNsAlert sends an alert to the user's iOS device
+func (srv *Server) sendAPNsAlert(userID string, title, body, action string, custom map[string]interface{}) error {
+	if srv.apns == nil {
+		return fmt.Errorf("APNs client not initialized")
+	}
 
-	// Support both seconds and minutes for flexibility
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	deviceToken, exists := shard.deviceTokens[userID]
+	environment := shard.deviceEnvironments[userID]
+	shard.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("no device token for user")
+	}
+
+	notificationPayload := newAPNsPayload(action, title, body).Custom("action", action)
+	for key, value := range custom {
+		notificationPayload.Custom(key, value)
+	}
+	if category := apnsCategories[action]; category != "" {
+		notificationPayload.Category(category)
+	}
+	if gameID, ok := custom["game_id"].(int); ok && !apnsBackgroundEvent(action) {
+		moves, _ := custom["move_number"].(int)
+		attachBoardImage(notificationPayload, gameID, moves)
+	}
+
+	notification := &apns2.Notification{
+		DeviceToken: deviceToken,
+		Topic:       apnsTopic(),
+		Payload:     notificationPayload,
+	}
+	setAPNsDelivery(notification, action, time.Time{}, time.Now())
+	if urgent, _ := custom["urgent"].(bool); urgent && !apnsBackgroundEvent(action) {
+		notificationPayload.InterruptionLevel(payload.InterruptionLevelTimeSensitive)
+		notification.Priority = apns2.PriorityHigh
+	}
+
+	res, err := srv.pushAPNs(notification, environment)
+	if err != nil {
+		log.Printf("Error sending %s notification to user %s: %v", action, userID, err)
+		return transientPushError{fmt.Errorf("failed to send notification")}
+	}
+	if !res.Sent() {
+		log.Printf("%s notification failed for user %s: %v", action, userID, res.Reason)
+		srv.removeDeadDeviceToken(userID, deviceToken, res)
+		if transientAPNsStatus(res.StatusCode) {
+			return transientPushError{fmt.Errorf("notification rejected: %s", res.Reason)}
+		}
+		return fmt.Errorf("notification rejected: %s", res.Reason)
+	}
+
+	log.Printf("%s notification sent to user %s", action, userID)
+	srv.recordFunnelStep(userID, funnelPushed, time.Now())
+	return nil
+}
+
+// checkInterval reads CHECK_INTERVAL_SECONDS, defaulting to 30 seconds
+func checkInterval() time.Duration {
 	if intervalStr := os.Getenv("CHECK_INTERVAL_SECONDS"); intervalStr != "" {
-		if interval, err := strconv.Atoi(intervalStr); err == nil {
-			checkInterval = time.Duration(interval) * time.Second
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			return time.Duration(interval) * time.Second
 		}
 	}
+	return 30 * time.Second
+}
 
-	log.Printf("Starting periodic turn checking every %v", checkInterval)
+// firstCheckDelay is how long after startup the first check runs
+var firstCheckDelay = 5 * time.Second
 
-	ticker := time.NewTicker(checkInterval)
-	defer ticker.Stop()
+func (srv *Server) startPeriodicChecking() {
+	srv.runPeriodicChecks(checkInterval(), nil)
+}
 
-	// Run initial check after 5 seconds
-	time.Sleep(5 * time.Second)
-	checkAllUsers()
+// runPeriodicChecks runs the first check after firstCheckDelay, then one every
+// interval until stop is closed
+func (srv *Server) runPeriodicChecks(interval time.Duration, stop <-chan struct{}) {
+	log.Printf("Starting periodic turn checking every %v", interval)
 
-	// Then run on schedule
-	for range ticker.C {
-		checkAllUsers()
+	select {
+	case <-time.After(firstCheckDelay):
+	case <-stop:
+		return
+	}
+	srv.runScheduledCheck(interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			srv.runScheduledCheck(interval)
+		case <-stop:
+			return
+		}
 	}
 }
 
-func checkAllUsers() {
-	storage.mu.RLock()
-	deviceTokens := make(map[string]string)
-	for userID, token := range storage.deviceTokens {
-		deviceTokens[userID] = token
+// runScheduledCheck checks all users unless another instance sharing the
+// storage backend holds the check lease. Each region has its own lease.
+func (srv *Server) runScheduledCheck(interval time.Duration) {
+	// Moves arrive as events while the real-time connection is up, so polls
+	// are only a fallback
+	if srv.realtime != nil && !srv.realtime.pollDue(time.Now()) {
+		return
 	}
-	storage.mu.RUnlock()
+	if coordinator, ok := srv.backend.(checkCoordinator); ok && !coordinator.claimCheck(srv.partition.leaseScope(), interval*3/2) {
+		log.Println("Skipping check: another instance holds the check lease")
+		return
+	}
+	srv.checkAllUsers()
+}
 
-	if len(deviceTokens) == 0 {
+func (srv *Server) checkAllUsers() {
+	srv.storage.rlockAll()
+	users := srv.storage.notifiedUsers()
+	srv.storage.runlockAll()
+
+	if len(users) == 0 {
 		log.Println("No registered users to check")
 		return
 	}
 
-	log.Printf("Checking turns for %d registered users", len(deviceTokens))
+	log.Printf("Checking turns for %d registered users", len(users))
+
+	// Games are fetched afresh each cycle, then shared between their players
+	srv.clearGameStates()
+
+	started := time.Now()
+	cycle := CycleSummary{StartedAt: started.Unix(), Region: srv.partition.region}
+	queuedBefore := turnPushesQueued.Load()
+	defer func() {
+		cycle.DurationMs = time.Since(started).Milliseconds()
+		cycle.Notifications = turnPushesQueued.Load() - queuedBefore
+		srv.recordCycle(cycle, time.Now())
+	}()
 
-	for userIDStr := range deviceTokens {
+	for userIDStr := range users {
+		// The canary's game lives on this server, not OGS
+		if isCanaryUser(userIDStr) {
+			continue
+		}
+		// Another region checks this user
+		if !srv.partition.owns(userIDStr) {
+			continue
+		}
+		// OGS no longer has this account
+		if srv.accountGone(userIDStr) {
+			cycle.UsersSkipped++
+			continue
+		}
+		// OGS has asked us to slow down, for everyone or for this user
+		if until := srv.ogsPausedUntil(time.Now()); !until.IsZero() {
+			log.Printf("OGS requests paused until %s; ending this check cycle early", until.UTC().Format(time.RFC3339))
+			cycle.EndedEarly = true
+			break
+		}
+		// OGS is down; a probe is sent once the circuit's time is up
+		if until := srv.ogsBreaker.openUntilTime(time.Now()); !until.IsZero() {
+			log.Printf("OGS circuit open until %s; ending this check cycle early", until.UTC().Format(time.RFC3339))
+			cycle.EndedEarly = true
+			break
+		}
+		if srv.userBackedOff(userIDStr, time.Now()) {
+			cycle.UsersSkipped++
+			continue
+		}
+		// Recent checks found no games
+		if srv.userIdle(userIDStr, time.Now()) {
+			idleChecksSkipped.Add(1)
+			cycle.UsersSkipped++
+			continue
+		}
 
 		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
@@ -721,9 +1932,11 @@ func checkAllUsers() {
 		}
 
 		// Use the existing getUserTurnStatus function which handles notifications
-		status, err := getUserTurnStatus(userID)
+		cycle.UsersChecked++
+		status, err := srv.getUserTurnStatus(userID)
 		if err != nil {
 			log.Printf("Error checking user %s: %v", userIDStr, err)
+			cycle.Errors++
 			continue
 		}
 
@@ -733,8 +1946,13 @@ func checkAllUsers() {
 		if len(status.YourTurnNew) > 0 {
 			log.Printf("User %s has %d new turns - notification should be sent", userIDStr, len(status.YourTurnNew))
 		}
+
+		if srv.optionalFeatureEnabled("challenges") {
+			srv.checkChallenges(userIDStr, srv.sendUserPushNotification)
+		}
 	}
 
+	srv.warnOverdueChecks(time.Now(), srv.sendUserPushNotification)
+
 	log.Println("Turn checking cycle complete")
 }
-
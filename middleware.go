@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// statusRecorder captures the response status for request logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming endpoints working through the middleware
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// routeName identifies the matched route for logs without leaking path
+// values like device tokens
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if name := route.GetName(); name != "" {
+			return name
+		}
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// loggingMiddleware logs each request's route, status and duration
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s -> %d in %v", r.Method, routeName(r), recorder.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// recoveryMiddleware turns a handler panic into a 500 instead of a dropped connection
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s: %v\n%s", r.Method, routeName(r), err, debug.Stack())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientLimiters holds a token bucket per client IP
+type clientLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*clientLimiter
+	perMin   int
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiters(perMin int) *clientLimiters {
+	return &clientLimiters{limiters: make(map[string]*clientLimiter), perMin: perMin}
+}
+
+// rateLimitPerMinute reads RATE_LIMIT_PER_MINUTE (default 60 requests per client)
+func rateLimitPerMinute() int {
+	if value := os.Getenv("RATE_LIMIT_PER_MINUTE"); value != "" {
+		if limit, err := strconv.Atoi(value); err == nil && limit > 0 {
+			return limit
+		}
+	}
+	return 60
+}
+
+func (c *clientLimiters) allow(client string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.limiters[client]
+	if entry == nil {
+		// Forget idle clients so the map doesn't grow without bound
+		for key, idle := range c.limiters {
+			if now.Sub(idle.lastSeen) > 10*time.Minute {
+				delete(c.limiters, key)
+			}
+		}
+		entry = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(float64(c.perMin)/60), c.perMin)}
+		c.limiters[client] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// rateLimitMiddleware limits requests per client IP
+func (srv *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !srv.limiters.allow(client, time.Now()) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userMiddleware guards routes scoped to one OGS user: the {userID} path
+// value must be a valid user ID before any handler sees it
+func userMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID, ok := mux.Vars(r)["userID"]; ok {
+			if id, err := strconv.Atoi(userID); err != nil || id <= 0 {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminMiddleware requires the admin token on every route it wraps
+func adminMiddleware(next http.Handler) http.Handler {
+	return requireAdmin(next.ServeHTTP)
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// DailyCount tracks pushes sent to a user on a given day in their timezone
+type DailyCount struct {
+	Day        string `json:"day"` // YYYY-MM-DD, local to the user
+	Sent       int    `json:"sent"`
+	Overflowed bool   `json:"overflowed"` // the "N more games" push has been sent
+}
+
+type budgetDecision int
+
+const (
+	budgetSend     budgetDecision = iota // under the cap, send normally
+	budgetOverflow                       // cap just reached, send one coalesced push
+	budgetSuppress                       // cap reached and coalesced push already sent
+)
+
+// checkNotificationBudget decides how a push to the user should be handled
+// under their daily cap
+func (srv *Server) checkNotificationBudget(userID string, now time.Time) budgetDecision {
+	limit := srv.preferencesFor(userID).DailyNotificationCap
+	if limit <= 0 {
+		return budgetSend
+	}
+	today := localDayKey(now, srv.userLocation(userID))
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return budgetFor(limit, shard.dailyCounts[userID], today)
+}
+
+// budgetFor decides how a push is handled given a cap and the user's count
+func budgetFor(limit int, count *DailyCount, today string) budgetDecision {
+	if limit <= 0 || count == nil || count.Day != today || count.Sent < limit {
+		return budgetSend
+	}
+	if !count.Overflowed {
+		return budgetOverflow
+	}
+	return budgetSuppress
+}
+
+// recordNotificationSent counts a delivered push against today's budget
+func (srv *Server) recordNotificationSent(userID string, decision budgetDecision, now time.Time) {
+	today := localDayKey(now, srv.userLocation(userID))
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	count := shard.dailyCounts[userID]
+	if count == nil || count.Day != today {
+		count = &DailyCount{Day: today}
+		shard.dailyCounts[userID] = count
+	}
+
+	if decision == budgetOverflow {
+		count.Overflowed = true
+		return
+	}
+	count.Sent++
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Notification priorities a rule can assign to a game, most urgent first
+const (
+	priorityUrgent = "urgent" // sent immediately, past batching and the daily cap, as time-sensitive
+	priorityNormal = "normal" // the default
+	priorityDigest = "digest" // held and sent with others once the batch window has passed
+	priorityMute   = "mute"   // never pushed
+)
+
+// priorityRank orders priorities so the most urgent matching rule wins
+var priorityRank = map[string]int{priorityUrgent: 3, priorityNormal: 2, priorityDigest: 1, priorityMute: 0}
+
+// validatePriority reports whether a rule's priority is one of the known ones
+func validatePriority(field, priority string) string {
+	if _, known := priorityRank[priority]; !known {
+		return fmt.Sprintf("%s must be urgent, normal, digest or mute", field)
+	}
+	return ""
+}
+
+// defaultBotPriority is how games against bots are handled unless the user
+// sets bot_games: bots reply instantly, so every move would otherwise be a push
+const defaultBotPriority = priorityDigest
+
+// botPriority returns the priority of games against bots for the user
+func botPriority(prefs UserPreferences) string {
+	if prefs.BotGames != "" {
+		return prefs.BotGames
+	}
+	return defaultBotPriority
+}
+
+// gamePriority evaluates the user's rules for a game. The rule for the
+// opponent and each label with a rule contribute a priority, and the most
+// urgent wins. Games matching no rule are normal, or get the user's bot
+// priority when the opponent is a bot.
+func gamePriority(prefs UserPreferences, labels []string, opponentID int, vsBot bool) string {
+	priority := ""
+	consider := func(candidate string) {
+		if priority == "" || priorityRank[candidate] > priorityRank[priority] {
+			priority = candidate
+		}
+	}
+
+	for _, label := range labels {
+		if rule, exists := prefs.LabelRules[label]; exists {
+			consider(rule)
+		}
+	}
+	if rule, exists := prefs.OpponentRules[opponentID]; exists && opponentID > 0 {
+		consider(rule)
+	}
+
+	switch {
+	case priority != "":
+		return priority
+	case vsBot:
+		return botPriority(prefs)
+	default:
+		return priorityNormal
+	}
+}
+
+// splitByPriority sorts new turns by the priority the user's rules give them.
+// Muted games are left out.
+func (srv *Server) splitByPriority(userID string, games []Game) (urgent, normal, digest []Game) {
+	prefs := srv.preferencesFor(userID)
+	if !srv.featureEnabled(userID, featureDigests, time.Now()) {
+		prefs = withoutDigestRules(prefs)
+	}
+	playerID, _ := strconv.Atoi(userID)
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	muted := 0
+	for _, game := range games {
+		var labels []string
+		record := shard.game(userID, game.ID)
+		if record != nil {
+			labels = record.Labels
+		}
+		priority := gamePriority(prefs, labels, game.OpponentID(playerID), game.OpponentIsBot(playerID))
+		if record != nil && record.Muted {
+			priority = priorityMute
+		}
+		switch priority {
+		case priorityUrgent:
+			urgent = append(urgent, game)
+		case priorityDigest:
+			digest = append(digest, game)
+		case priorityMute:
+			muted++
+		default:
+			normal = append(normal, game)
+		}
+	}
+	if muted > 0 {
+		log.Printf("Skipping %d muted game(s) for user %s", muted, userID)
+	}
+	return urgent, normal, digest
+}
+
+// hasUrgentGame reports whether any of the games is urgent for the user
+func (srv *Server) hasUrgentGame(userID string, games []Game) bool {
+	urgent, _, _ := srv.splitByPriority(userID, games)
+	return len(urgent) > 0
+}
+
+// turnsToNotify applies the user's rules and batching to new turns: urgent
+// games go out now, muted games never do, and digest games (and everything
+// else for high-volume players or while a routing throttle applies) wait for
+// the batch window. Live games skip the window, or aren't pushed at all if
+// the user chose to suppress them. Snoozed games wait for the snooze to end.
+// Held turns stay new, so they're included once the window has passed.
+func (srv *Server) turnsToNotify(userID string, newTurnGames []Game, highVolume bool, now time.Time) []Game {
+	newTurnGames, snoozed := srv.splitSnoozed(userID, newTurnGames, now)
+	if len(snoozed) > 0 {
+		log.Printf("Holding %d new turn(s) for user %s until their snooze ends", len(snoozed), userID)
+	}
+	urgent, normal, digest := srv.splitByPriority(userID, newTurnGames)
+
+	liveNormal, normal := separateLiveGames(normal)
+	liveDigest, digest := separateLiveGames(digest)
+	live := append(liveNormal, liveDigest...)
+	if liveGamesMode(srv.preferencesFor(userID)) == liveGamesSuppress {
+		liveUrgent, slowUrgent := separateLiveGames(urgent)
+		urgent = slowUrgent
+		if suppressed := len(live) + len(liveUrgent); suppressed > 0 {
+			log.Printf("Not pushing %d live game(s) for user %s, who is at the board", suppressed, userID)
+		}
+		live = nil
+	}
+
+	// A routing throttle on turn notifications holds everything not urgent
+	// or live until it has passed, like a batch window
+	throttled := !srv.routeAllows(userID, eventTurn, srv.routeFor(userID, eventTurn), now)
+
+	toSend := append(append(urgent, live...), normal...)
+	held := digest
+	if highVolume || throttled {
+		toSend = append(urgent, live...)
+		held = append(normal, digest...)
+	}
+
+	if len(held) > 0 {
+		if !throttled && srv.batchWindowElapsed(userID, now) {
+			toSend = append(toSend, held...)
+		} else {
+			log.Printf("Holding %d new turn(s) for user %s until the batch window ends", len(held), userID)
+		}
+	}
+	return toSend
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// maxPreviewGames bounds the hypothetical new turns in a preview request
+const maxPreviewGames = 500
+
+// maxPreviewMoves bounds the move number of a previewed game
+const maxPreviewMoves = 1000
+
+type PreviewGame struct {
+	GameID     int    `json:"game_id"`
+	Name       string `json:"name"`
+	Opponent   string `json:"opponent"`
+	MoveNumber int    `json:"move_number"`
+}
+
+// NotificationPreviewRequest describes a hypothetical check: the games with
+// new turns, the user's situation and their preferences
+type NotificationPreviewRequest struct {
+	NewTurns []PreviewGame `json:"new_turns"`
+	// ActiveGames and WaitingGames feed high-volume grouping; they default to
+	// the number of new turns
+	ActiveGames  int `json:"active_games"`
+	WaitingGames int `json:"waiting_games"`
+	// SentToday and OverflowSent are the user's daily cap state
+	SentToday    int             `json:"sent_today"`
+	OverflowSent bool            `json:"overflow_sent"`
+	Preferences  UserPreferences `json:"preferences"`
+}
+
+type NtfyPreview struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// NotificationPreview is what would be sent for a request. Decision is
+// "send", "overflow" (the final "N more games" push) or "suppressed", in
+// which case no payloads are rendered.
+type NotificationPreview struct {
+	Decision   string          `json:"decision"`
+	HighVolume bool            `json:"high_volume"`
+	APNs       json.RawMessage `json:"apns,omitempty"`
+	APNsTopic  string          `json:"apns_topic,omitempty"`
+	CollapseID string          `json:"apns_collapse_id,omitempty"`
+	PushType   string          `json:"apns_push_type,omitempty"`
+	Priority   int             `json:"apns_priority,omitempty"`
+	Expiration int64           `json:"apns_expiration,omitempty"` // unix time
+	Ntfy       *NtfyPreview    `json:"ntfy,omitempty"`
+}
+
+// buildNotificationPreview renders a request through the same decisions and
+// templates as a real check, without touching storage
+func buildNotificationPreview(req NotificationPreviewRequest) (*NotificationPreview, error) {
+	// The previewed user plays black; only the opponent's name is shown
+	const previewUserID = 1
+	games := make([]Game, len(req.NewTurns))
+	for i, game := range req.NewTurns {
+		games[i] = Game{
+			ID:    game.GameID,
+			Name:  game.Name,
+			Black: GamePlayer{ID: previewUserID},
+			White: GamePlayer{Username: game.Opponent},
+		}
+		if game.MoveNumber > 0 && game.MoveNumber <= maxPreviewMoves {
+			games[i].JSON.Moves = make([]json.RawMessage, game.MoveNumber)
+		}
+	}
+
+	activeGames := max(req.ActiveGames, len(games))
+	waiting := 0
+	preview := &NotificationPreview{HighVolume: highVolumeModeFor(req.Preferences, activeGames)}
+	if preview.HighVolume {
+		waiting = max(req.WaitingGames, len(games))
+	}
+
+	budget := budgetFor(req.Preferences.DailyNotificationCap,
+		&DailyCount{Day: "preview", Sent: req.SentToday, Overflowed: req.OverflowSent}, "preview")
+	switch budget {
+	case budgetSuppress:
+		preview.Decision = "suppressed"
+		return preview, nil
+	case budgetOverflow:
+		preview.Decision = "overflow"
+	default:
+		preview.Decision = "send"
+	}
+
+	alert := buildTurnAlert(previewUserID, games, waiting, budget, req.Preferences.TurnTemplate)
+	notification := alert.apnsNotification("")
+	apnsPayload, err := json.Marshal(notification.Payload)
+	if err != nil {
+		return nil, err
+	}
+	preview.APNs = apnsPayload
+	preview.APNsTopic = notification.Topic
+	preview.CollapseID = notification.CollapseID
+	preview.PushType = string(notification.PushType)
+	preview.Priority = notification.Priority
+	preview.Expiration = notification.Expiration.Unix()
+	preview.Ntfy = &NtfyPreview{Headers: ntfyHeaders(alert.Title, alert.WebURL), Body: alert.Body}
+
+	return preview, nil
+}
+
+// previewNotification renders the notifications a hypothetical set of new
+// turns would produce, without sending anything
+func previewNotification(w http.ResponseWriter, r *http.Request) {
+	var req NotificationPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.NewTurns) == 0 || len(req.NewTurns) > maxPreviewGames {
+		http.Error(w, "new_turns must list 1-500 games", http.StatusBadRequest)
+		return
+	}
+	for _, game := range req.NewTurns {
+		if game.GameID <= 0 {
+			http.Error(w, "game_id must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ActiveGames < 0 || req.WaitingGames < 0 || req.SentToday < 0 {
+		http.Error(w, "counts must not be negative", http.StatusBadRequest)
+		return
+	}
+	if problem := req.Preferences.validate(); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	preview, err := buildNotificationPreview(req)
+	if err != nil {
+		http.Error(w, "Failed to render notification", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
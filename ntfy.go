@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ntfyTopicName matches the topic names ntfy accepts
+var ntfyTopicName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ntfyClient publishes to NTFY_SERVER, which the operator chose, and
+// ntfyPublicClient to topic URLs users give
+var (
+	ntfyClient       = &http.Client{Timeout: 10 * time.Second}
+	ntfyPublicClient = newPublicClient()
+)
+
+// ntfyServer is where bare topic names are published (default https://ntfy.sh)
+func ntfyServer() string {
+	if server := os.Getenv("NTFY_SERVER"); server != "" {
+		return strings.TrimRight(server, "/")
+	}
+	return "https://ntfy.sh"
+}
+
+// onNtfyServer reports whether a topic URL is on NTFY_SERVER
+func onNtfyServer(topicURL string) bool {
+	return strings.HasPrefix(topicURL, ntfyServer()+"/")
+}
+
+// ntfyTopicURL resolves a topic name, or a full topic URL on a self-hosted
+// server, to the URL notifications are published to. Only NTFY_SERVER may be
+// plain http.
+func ntfyTopicURL(topic string) (string, error) {
+	if !strings.Contains(topic, "://") {
+		if !ntfyTopicName.MatchString(topic) {
+			return "", fmt.Errorf("topic must be 1-64 letters, digits, - or _, or a topic URL")
+		}
+		return ntfyServer() + "/" + topic, nil
+	}
+
+	parsed, err := url.Parse(topic)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return "", fmt.Errorf("topic URL must be https://host/topic")
+	}
+	if !ntfyTopicName.MatchString(strings.Trim(parsed.Path, "/")) || parsed.RawQuery != "" || parsed.User != nil {
+		return "", fmt.Errorf("topic URL must be https://host/topic")
+	}
+	topicURL := parsed.Scheme + "://" + parsed.Host + "/" + strings.Trim(parsed.Path, "/")
+	if parsed.Scheme != "https" && !onNtfyServer(topicURL) {
+		return "", fmt.Errorf("topic URL must be https://host/topic")
+	}
+	return topicURL, nil
+}
+
+// publishNtfy posts a notification to an ntfy topic. clickURL, if set, is
+// opened when the notification is tapped. Topics on other servers than
+// NTFY_SERVER are only published to at public addresses.
+func publishNtfy(topicURL, title, body, clickURL string) error {
+	req, err := http.NewRequest("POST", topicURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range ntfyHeaders(title, clickURL) {
+		req.Header.Set(name, value)
+	}
+
+	client := ntfyPublicClient
+	if onNtfyServer(topicURL) {
+		client = ntfyClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ntfy returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ntfyHeaders are the message options sent with each ntfy notification
+func ntfyHeaders(title, clickURL string) map[string]string {
+	headers := map[string]string{"Title": title, "Tags": "go"}
+	if clickURL != "" {
+		headers["Click"] = clickURL
+	}
+	return headers
+}
+
+// ntfyTopicFor returns the user's ntfy topic URL, if they've set one
+func (srv *Server) ntfyTopicFor(userID string) (string, bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	topicURL, exists := shard.ntfyTopics[userID]
+	return topicURL, exists
+}
+
+// notifiedUsers returns every user with somewhere to deliver notifications:
+// an iOS device, an ntfy topic, a browser, a Telegram chat, a Discord webhook
+// or club, a webhook of their own, a Slack channel, or any of them. Callers
+// must hold every lock for reading; see rlockAll.
+func (s *MoveStorage) notifiedUsers() map[string]bool {
+	users := make(map[string]bool)
+	for _, shard := range s.shards {
+		for userID := range shard.deviceTokens {
+			users[userID] = true
+		}
+		for userID := range shard.ntfyTopics {
+			users[userID] = true
+		}
+		for userID := range shard.webPushSubscriptions {
+			users[userID] = true
+		}
+		for userID := range shard.telegramChats {
+			users[userID] = true
+		}
+		for userID := range shard.discordWebhooks {
+			users[userID] = true
+		}
+		for userID := range shard.userWebhooks {
+			users[userID] = true
+		}
+		for userID := range shard.slackDestinations {
+			users[userID] = true
+		}
+	}
+	s.discordClubs.Range(func(_ string, club *DiscordClub) bool {
+		for userID := range club.Members {
+			users[userID] = true
+		}
+		return true
+	})
+	return users
+}
+
+type NtfySubscription struct {
+	Topic string `json:"topic"`
+}
+
+// setNtfyTopic subscribes a user's notifications to an ntfy topic. A test
+// notification is published first, so a mistyped or unreachable topic is
+// rejected rather than silently dropping turns.
+func (srv *Server) setNtfyTopic(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var subscription NtfySubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	topicURL, err := ntfyTopicURL(subscription.Topic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := publishNtfy(topicURL, "OGS notifications", "You'll get a notification here when it's your turn.", ""); err != nil {
+		log.Printf("ntfy test notification for user %s failed: %v", userID, err)
+		http.Error(w, "Could not publish to ntfy topic", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.ntfyTopics[userID] = topicURL
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Set ntfy topic for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NtfySubscription{Topic: topicURL})
+}
+
+func (srv *Server) deleteNtfyTopic(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.ntfyTopics[userID]
+	delete(shard.ntfyTopics, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No ntfy topic set", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Removed ntfy topic for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ogsMeURL returns the player an OGS access token belongs to
+var ogsMeURL = "https://online-go.com/api/v1/me"
+
+var (
+	errAccountLinkRequired = errors.New("an OGS access token is required")
+	errAccountLinkInvalid  = errors.New("the OGS access token was rejected")
+	errAccountLinkMismatch = errors.New("the OGS access token belongs to another player")
+	errDeviceTokenMismatch = errors.New("the device token isn't the user's")
+)
+
+// accountLinkRequired reads REQUIRE_OGS_ACCOUNT_LINK. Unless it's false, a
+// registration must prove it controls the OGS account, with an access token
+// or the device token already registered.
+func accountLinkRequired() bool {
+	return os.Getenv("REQUIRE_OGS_ACCOUNT_LINK") != "false"
+}
+
+// ogsPlayerForToken asks OGS which player an OAuth access token belongs to
+func (srv *Server) ogsPlayerForToken(accessToken string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, ogsMeURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := srv.ogsDo(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return 0, errAccountLinkInvalid
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("OGS returned status %d", resp.StatusCode)
+	}
+
+	var me struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		return 0, err
+	}
+	if me.ID == 0 {
+		return 0, errAccountLinkInvalid
+	}
+	return me.ID, nil
+}
+
+// verifyAccountLink checks that an OGS access token belongs to the user
+func (srv *Server) verifyAccountLink(userID, accessToken string) error {
+	if accessToken == "" {
+		return errAccountLinkRequired
+	}
+	playerID, err := srv.ogsPlayerForToken(accessToken)
+	if err != nil {
+		return err
+	}
+	if strconv.Itoa(playerID) != userID {
+		return errAccountLinkMismatch
+	}
+	return nil
+}
+
+// checkUnlinkedRegistration checks a registration without an OGS access token.
+// Registering the device already registered, or sending its token as proof,
+// is the user's own. Anything else is refused unless links aren't required
+// and the account has never been linked, and even then it can't replace
+// another device. Callers must hold mu.
+func (s *storageShard) checkUnlinkedRegistration(userID, deviceToken, proof string) error {
+	current := s.deviceTokens[userID]
+	if current != "" && current == deviceToken {
+		return nil
+	}
+	if proof != "" {
+		if current == "" || subtle.ConstantTimeCompare([]byte(current), []byte(proof)) != 1 {
+			return errDeviceTokenMismatch
+		}
+		return nil
+	}
+	if _, linked := s.linkedAccounts[userID]; linked || accountLinkRequired() {
+		return errAccountLinkRequired
+	}
+	if current != "" {
+		return errDeviceTokenMismatch
+	}
+	return nil
+}
+
+// writeAccountLinkError responds to a registration whose ownership couldn't
+// be verified
+func writeAccountLinkError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAccountLinkRequired), errors.Is(err, errAccountLinkInvalid), errors.Is(err, errDeviceTokenMismatch):
+		http.Error(w, "OGS account ownership not verified", http.StatusUnauthorized)
+	case errors.Is(err, errAccountLinkMismatch):
+		http.Error(w, "OGS account ownership not verified", http.StatusForbidden)
+	default:
+		http.Error(w, "Could not verify OGS account", http.StatusServiceUnavailable)
+	}
+}
+
+// recordAccountLink remembers that the user proved ownership. Callers must
+// hold mu for writing.
+func (s *storageShard) recordAccountLink(userID string, now time.Time) {
+	if _, linked := s.linkedAccounts[userID]; !linked {
+		log.Printf("Linked OGS account for user %s", userID)
+	}
+	s.linkedAccounts[userID] = now.Unix()
+}
+
+// Headers a request to a per-user route proves it comes from the user with
+const (
+	deviceTokenHeader    = "X-Device-Token"     // the device token the user registered
+	ogsAccessTokenHeader = "X-OGS-Access-Token" // an OGS access token for the account
+)
+
+// verifiedTokenTTL is how long an OGS access token that proved ownership is
+// trusted before OGS is asked about it again
+const verifiedTokenTTL = 10 * time.Minute
+
+// verifiedToken is a user's OGS access token that proved ownership
+type verifiedToken struct {
+	hash  string
+	until time.Time
+}
+
+// userAuthMiddleware guards routes scoped to one {userID}: the request must
+// prove it comes from the user with the same proof registration takes, the
+// user's registered device token or an OGS access token for the account. A
+// tenant's API key acts for the tenant's users, which tenantMiddleware has
+// already checked. CORS preflights carry no credentials and pass through.
+func (srv *Server) userAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, scoped := mux.Vars(r)["userID"]
+		if scoped && r.Method != http.MethodOptions && tenantFromRequest(r) == "" {
+			if err := srv.authenticateUser(userID, r, time.Now()); err != nil {
+				log.Printf("Rejected %s %s for user %s: %v", r.Method, routeName(r), userID, err)
+				writeAccountLinkError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateUser checks the request's proof that it comes from the user
+func (srv *Server) authenticateUser(userID string, r *http.Request, now time.Time) error {
+	if deviceToken := r.Header.Get(deviceTokenHeader); deviceToken != "" {
+		shard := srv.storage.shard(userID)
+		shard.mu.RLock()
+		registered := shard.deviceTokens[userID]
+		shard.mu.RUnlock()
+		if registered == "" || subtle.ConstantTimeCompare([]byte(registered), []byte(deviceToken)) != 1 {
+			return errDeviceTokenMismatch
+		}
+		return nil
+	}
+
+	accessToken := r.Header.Get(ogsAccessTokenHeader)
+	if accessToken == "" {
+		return errAccountLinkRequired
+	}
+	hash := hashUserscriptToken(accessToken)
+	if cached, ok := srv.verifiedTokens.Load(userID); ok && now.Before(cached.until) && subtle.ConstantTimeCompare([]byte(cached.hash), []byte(hash)) == 1 {
+		return nil
+	}
+	if err := srv.verifyAccountLink(userID, accessToken); err != nil {
+		return err
+	}
+	srv.verifiedTokens.Store(userID, verifiedToken{hash: hash, until: now.Add(verifiedTokenTTL)})
+	return nil
+}
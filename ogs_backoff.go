@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OGS rate limits by IP, so one server checking many users must slow down as
+// soon as OGS asks it to. A 429 (or a 503 with Retry-After) pauses every OGS
+// request until the time OGS gives. Users whose checks fail because OGS is
+// throttling or erroring are also backed off individually, doubling the wait
+// after each failure, so the next cycles don't hit OGS with the same requests.
+
+var (
+	errOGSThrottled   = errors.New("OGS is rate limiting requests")
+	errOGSServerError = errors.New("OGS server error")
+)
+
+const (
+	// ogsDefaultRetryAfter is the pause after a 429 without Retry-After
+	ogsDefaultRetryAfter = time.Minute
+	// ogsMaxRetryAfter caps the pause, whatever OGS asks for
+	ogsMaxRetryAfter = time.Hour
+	// ogsMaxUserBackoff caps how long a user's checks are backed off
+	ogsMaxUserBackoff = 30 * time.Minute
+)
+
+// ogsPauseState holds how long OGS has asked for requests to stop
+type ogsPauseState struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// ogsPausedUntil returns when OGS requests may resume, or the zero time if
+// they aren't paused
+func (srv *Server) ogsPausedUntil(now time.Time) time.Time {
+	srv.ogsPause.mu.Lock()
+	defer srv.ogsPause.mu.Unlock()
+	if now.Before(srv.ogsPause.until) {
+		return srv.ogsPause.until
+	}
+	return time.Time{}
+}
+
+// pauseOGSRequests stops OGS requests until at least the given time
+func (srv *Server) pauseOGSRequests(until time.Time) {
+	srv.ogsPause.mu.Lock()
+	defer srv.ogsPause.mu.Unlock()
+	if until.After(srv.ogsPause.until) {
+		srv.ogsPause.until = until
+		log.Printf("OGS asked us to slow down: pausing OGS requests until %s", until.UTC().Format(time.RFC3339))
+	}
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if at.Before(now) {
+			return 0, true
+		}
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// observeRateLimit pauses OGS requests when a response asks for it
+func (srv *Server) observeRateLimit(resp *http.Response, now time.Time) {
+	wait, given := retryAfter(resp.Header.Get("Retry-After"), now)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		if !given {
+			wait = ogsDefaultRetryAfter
+		}
+	case http.StatusServiceUnavailable:
+		if !given {
+			return
+		}
+	default:
+		return
+	}
+	srv.pauseOGSRequests(now.Add(min(wait, ogsMaxRetryAfter)))
+}
+
+// ogsStatusError maps a failed OGS response status to an error, telling
+// throttling and server errors apart from other failures
+func ogsStatusError(status int) error {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return errOGSThrottled
+	case status >= 500:
+		return errOGSServerError
+	default:
+		return errors.New("API request failed")
+	}
+}
+
+type userBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// userBackedOff reports whether the user's next check should wait
+func (srv *Server) userBackedOff(userID string, now time.Time) bool {
+	backoff, _ := srv.userBackoff.Load(userID)
+	return now.Before(backoff.until)
+}
+
+// recordUserCheckOutcome backs the user off after a check that failed
+// because of OGS throttling or errors, one check interval after the first
+// failure and twice as long after each one since. Any other outcome clears
+// the backoff.
+func (srv *Server) recordUserCheckOutcome(userID string, err error, now time.Time) {
+	if !errors.Is(err, errOGSThrottled) && !errors.Is(err, errOGSServerError) {
+		srv.userBackoff.Delete(userID)
+		return
+	}
+
+	srv.userBackoff.Update(userID, func(backoff userBackoff, _ bool) (userBackoff, bool) {
+		backoff.failures++
+		wait := checkInterval()
+		for i := 1; i < backoff.failures && wait < ogsMaxUserBackoff; i++ {
+			wait *= 2
+		}
+		backoff.until = now.Add(min(wait, ogsMaxUserBackoff))
+		return backoff, true
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When OGS is down, every check would otherwise wait out its timeout and
+// add to the load on a failing upstream. After OGS_BREAKER_FAILURES requests
+// in a row fail with a network error or a 5xx, the circuit opens: OGS
+// requests fail at once for OGS_BREAKER_OPEN_SECONDS, and check cycles end
+// early. Then one request is let through as a probe. If it succeeds the
+// circuit closes; if it fails it stays open for another period.
+
+var errOGSUnavailable = errors.New("OGS is unavailable, not sending requests")
+
+// ogsBreakerFailures reads OGS_BREAKER_FAILURES, the failures in a row that
+// open the circuit (default 5; 0 turns the breaker off)
+func ogsBreakerFailures() int {
+	if value := os.Getenv("OGS_BREAKER_FAILURES"); value != "" {
+		if failures, err := strconv.Atoi(value); err == nil && failures >= 0 {
+			return failures
+		}
+	}
+	return 5
+}
+
+// ogsBreakerOpenTime reads OGS_BREAKER_OPEN_SECONDS, how long the circuit
+// stays open before a probe (default 30)
+func ogsBreakerOpenTime() time.Duration {
+	if value := os.Getenv("OGS_BREAKER_OPEN_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 30 * time.Second
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int       // requests in a row that failed
+	openUntil time.Time // zero while the circuit is closed
+	trips     atomic.Int64
+}
+
+// allow reports whether a request may be sent. Once an open circuit's time
+// is up, one request is let through and the rest wait another period.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(ogsBreakerOpenTime())
+	return true
+}
+
+// record notes the outcome of a request that was sent
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if !b.openUntil.IsZero() {
+			log.Println("OGS is responding again, closing the circuit")
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+
+	b.failures++
+	threshold := ogsBreakerFailures()
+	if threshold == 0 || b.failures < threshold {
+		return
+	}
+	if b.openUntil.IsZero() {
+		b.trips.Add(1)
+		log.Printf("%d OGS requests in a row failed, opening the circuit for %v", b.failures, ogsBreakerOpenTime())
+	}
+	b.openUntil = now.Add(ogsBreakerOpenTime())
+}
+
+// openUntilTime returns when an open circuit lets a probe through, or the
+// zero time while it's closed or ready for one
+func (b *circuitBreaker) openUntilTime(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return b.openUntil
+	}
+	return time.Time{}
+}
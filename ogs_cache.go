@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ogsPlayerURL is the OGS API URL of a player's full profile, formatted with
+// their ID
+var ogsPlayerURL = "https://online-go.com/api/v1/players/%d/full"
+
+// Player profiles are fetched every check interval but rarely change between
+// two checks. The last parsed response is kept with its validators, so OGS
+// can answer an unchanged profile with 304 and the cached games are reused
+// without downloading or parsing it again. The cache is in memory only.
+
+type cachedPlayerGames struct {
+	etag         string
+	lastModified string
+	games        []Game
+}
+
+// ogsNotModified counts player requests OGS answered with 304
+var ogsNotModified atomic.Int64
+
+// addConditionalHeaders asks OGS to skip the player's profile if it hasn't
+// changed since the cached response
+func (srv *Server) addConditionalHeaders(req *http.Request, userID int) {
+	cached, exists := srv.playerGames.Load(userID)
+	if !exists {
+		return
+	}
+	if cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if cached.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.lastModified)
+	}
+}
+
+// cachedActiveGames returns the games from the player's cached profile
+func (srv *Server) cachedActiveGames(userID int) ([]Game, bool) {
+	cached, exists := srv.playerGames.Load(userID)
+	if !exists {
+		return nil, false
+	}
+	return append([]Game(nil), cached.games...), true
+}
+
+// cacheActiveGames keeps the player's games if the response can be validated
+// later
+func (srv *Server) cacheActiveGames(userID int, resp *http.Response, games []Game) {
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+
+	if etag == "" && lastModified == "" {
+		srv.playerGames.Delete(userID)
+		return
+	}
+	srv.playerGames.Store(userID, cachedPlayerGames{
+		etag:         etag,
+		lastModified: lastModified,
+		games:        append([]Game(nil), games...),
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ogsHTTPClient is shared by every OGS request, so connections are reused.
+// It keeps as many idle connections to OGS as requests may run at once.
+var ogsHTTPClient = newOGSHTTPClient()
+
+// ogsTimeout reads OGS_TIMEOUT_SECONDS, how long an OGS request may take in
+// total (default 10)
+func ogsTimeout() time.Duration {
+	if value := os.Getenv("OGS_TIMEOUT_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 10 * time.Second
+}
+
+func newOGSHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = ogsMaxConcurrent()
+	transport.DialContext = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 5 * time.Second
+	return &http.Client{Timeout: ogsTimeout(), Transport: transport}
+}
+
+// defaultOGSBaseURL is the OGS site used unless OGS_BASE_URL names another
+const defaultOGSBaseURL = "https://online-go.com"
+
+// ogsWebURL is the OGS site the server talks to, and links to in notifications
+var ogsWebURL = defaultOGSBaseURL
+
+// ogsBaseURL reads OGS_BASE_URL, e.g. a beta or self-hosted OGS instance
+func ogsBaseURL() string {
+	if base := os.Getenv("OGS_BASE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return defaultOGSBaseURL
+}
+
+// useOGSBaseURL points every OGS API URL and notification link at base
+func useOGSBaseURL(base string) {
+	for _, url := range []*string{&ogsPlayerURL, &ogsPlayerGamesURL, &ogsGameURL, &ogsMeURL, &ogsChallengesURL, &ogsOverviewURL, &ogsPlayerSearchURL, &ogsGameSGFURL} {
+		*url = base + strings.TrimPrefix(*url, ogsWebURL)
+	}
+	ogsWebURL = base
+}
+
+// ogsGameLink is the web page of a game
+func ogsGameLink(gameID int) string {
+	return fmt.Sprintf("%s/game/%d", ogsWebURL, gameID)
+}
+
+// ogsSlotWait is how long a request waits for a free slot before giving up
+const ogsSlotWait = 10 * time.Second
+
+// ogsMaxConcurrent reads OGS_MAX_CONCURRENT_REQUESTS (default 4)
+func ogsMaxConcurrent() int {
+	if value := os.Getenv("OGS_MAX_CONCURRENT_REQUESTS"); value != "" {
+		if limit, err := strconv.Atoi(value); err == nil && limit > 0 {
+			return limit
+		}
+	}
+	return 4
+}
+
+// ogsGet makes a GET request to the OGS API, recording its latency and
+// outcome for OGS health tracking. Rate limiting and server errors count as
+// failures; other statuses are left to the caller. A concurrency slot is held
+// until the response body is closed.
+func (srv *Server) ogsGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return srv.ogsDo(req)
+}
+
+// ogsDo sends a request to the OGS API, like ogsGet. While OGS has asked us
+// to back off, or the circuit breaker is open, requests fail without being
+// sent.
+func (srv *Server) ogsDo(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	if until := srv.ogsPausedUntil(time.Now()); !until.IsZero() {
+		return nil, errOGSThrottled
+	}
+	if !srv.ogsBreaker.allow(time.Now()) {
+		return nil, errOGSUnavailable
+	}
+
+	ogsRequestsWaiting.Add(1)
+	select {
+	case srv.ogsSlots <- struct{}{}:
+		ogsRequestsWaiting.Add(-1)
+	case <-time.After(ogsSlotWait):
+		ogsRequestsWaiting.Add(-1)
+		ogsRequestsDropped.Add(1)
+		log.Printf("No OGS request slot free after %v, dropping request to %s", ogsSlotWait, url)
+		return nil, fmt.Errorf("too many concurrent OGS requests")
+	}
+
+	release := sync.OnceFunc(func() { <-srv.ogsSlots })
+
+	start := time.Now()
+	resp, err := ogsHTTPClient.Do(req)
+
+	failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	srv.ogsHealth.record(time.Since(start), failed, time.Now())
+	srv.ogsBreaker.record(err != nil || resp.StatusCode >= 500, time.Now())
+
+	if err != nil {
+		release()
+		return nil, err
+	}
+	srv.observeRateLimit(resp, time.Now())
+
+	resp.Body = &slotReleasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// slotReleasingBody frees the request's concurrency slot when closed
+type slotReleasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *slotReleasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
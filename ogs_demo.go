@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// With OGS_DEMO=true the server talks to a built-in stand-in for OGS instead
+// of the real site, so the server and the app can be developed offline and
+// without OGS accounts. Every player ID has demo games against bots, whose
+// moves come every DEMO_MOVE_SECONDS. Games end after demoGameMoves moves,
+// by resignation, timeout or counting in turn, and a new one starts in their
+// place. Access tokens are "demo-" followed by the player ID. The stand-in
+// listens on a loopback port and the server's OGS URLs point at it, so every
+// request goes through the same code as with OGS.
+
+const (
+	demoGamesPerPlayer = 3
+	demoGameMoves      = 30
+	demoBotID          = 1_000_000_000 // bots are this plus the game's slot
+	demoTokenPrefix    = "demo-"
+)
+
+// demoModeEnabled reads OGS_DEMO
+func demoModeEnabled() bool {
+	return os.Getenv("OGS_DEMO") == "true"
+}
+
+// demoMoveInterval reads DEMO_MOVE_SECONDS, the time between moves in each
+// demo game (default 60)
+func demoMoveInterval() time.Duration {
+	if value := os.Getenv("DEMO_MOVE_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return time.Minute
+}
+
+// demoOGS works out every game from the time since it started, so it keeps
+// no state
+type demoOGS struct {
+	start        time.Time
+	moveInterval time.Duration
+	now          func() time.Time
+}
+
+// startDemoOGS serves demo games on a loopback port and returns its URL
+func startDemoOGS(moveInterval time.Duration) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	demo := &demoOGS{start: time.Now(), moveInterval: moveInterval, now: time.Now}
+	go http.Serve(listener, demo.handler())
+	return "http://" + listener.Addr().String(), nil
+}
+
+// demoPosition is where a player's game slot stands
+type demoPosition struct {
+	generation int       // games played in the slot before this one
+	moves      int       // moves played in the current game
+	lastMove   time.Time // when the last move was played, or the game started
+}
+
+// position works out a slot's game at now. Slots are staggered so their
+// moves don't all land at once.
+func (d *demoOGS) position(slot int, now time.Time) demoPosition {
+	offset := time.Duration(slot) * d.moveInterval / demoGamesPerPlayer
+	ticks := int(now.Sub(d.start)+offset)/int(d.moveInterval) + slot*7
+	return demoPosition{
+		generation: ticks / demoGameMoves,
+		moves:      ticks % demoGameMoves,
+		lastMove:   d.start.Add(time.Duration(ticks-slot*7)*d.moveInterval - offset),
+	}
+}
+
+// demoGameID encodes the player, slot and generation of a demo game
+func demoGameID(playerID, slot, generation int) int {
+	return (playerID*demoGamesPerPlayer+slot)*1000 + generation%1000
+}
+
+// game builds a demo game. The player has black, so it's their turn after
+// an even number of moves.
+func (d *demoOGS) game(playerID, slot int, position demoPosition) Game {
+	bot := GamePlayer{ID: demoBotID + slot, Username: fmt.Sprintf("Demo Bot %d", slot+1), UIClass: "bot"}
+	game := Game{
+		ID:    demoGameID(playerID, slot, position.generation),
+		Name:  fmt.Sprintf("Demo game %d.%d", slot+1, position.generation+1),
+		Black: GamePlayer{ID: playerID, Username: fmt.Sprintf("Player %d", playerID)},
+		White: bot,
+	}
+	game.JSON.Phase = "play"
+	game.JSON.TimeControl = TimeControl{System: "fischer", Speed: "correspondence", InitialTime: 3 * 86400, TimeIncrement: 86400}
+	game.JSON.Clock = Clock{
+		CurrentPlayer: playerID,
+		LastMove:      position.lastMove.UnixMilli(),
+		BlackPlayerID: playerID,
+		WhitePlayerID: bot.ID,
+		BlackTime:     json.RawMessage(`{"thinking_time": 259200}`),
+		WhiteTime:     json.RawMessage(`{"thinking_time": 259200}`),
+	}
+	if position.moves%2 == 1 {
+		game.JSON.Clock.CurrentPlayer = bot.ID
+	}
+	game.JSON.Moves = make([]json.RawMessage, position.moves)
+	for i := range game.JSON.Moves {
+		game.JSON.Moves[i] = json.RawMessage(fmt.Sprintf("[%d,%d,%d]", i%19, i/19, d.moveInterval.Milliseconds()))
+	}
+	return game
+}
+
+// activeGames returns a player's current demo games
+func (d *demoOGS) activeGames(playerID int) []Game {
+	now := d.now()
+	games := make([]Game, demoGamesPerPlayer)
+	for slot := range games {
+		games[slot] = d.game(playerID, slot, d.position(slot, now))
+	}
+	return games
+}
+
+// demoGameDetails is a game as the OGS games API returns it, with the
+// outcome once it's over
+type demoGameDetails struct {
+	ogsGame
+	Outcome string `json:"outcome,omitempty"`
+	Winner  int    `json:"winner,omitempty"`
+}
+
+// details describes a demo game, finished or not. ok is false for IDs that
+// aren't a demo game yet.
+func (d *demoOGS) details(gameID int) (demoGameDetails, bool) {
+	slotKey, generation := gameID/1000, gameID%1000
+	playerID, slot := slotKey/demoGamesPerPlayer, slotKey%demoGamesPerPlayer
+	current := d.position(slot, d.now())
+	if playerID <= 0 || generation > current.generation%1000 {
+		return demoGameDetails{}, false
+	}
+
+	position := current
+	if generation < current.generation%1000 {
+		position = demoPosition{generation: generation, moves: demoGameMoves}
+	}
+	game := d.game(playerID, slot, position)
+	fetched := demoGameDetails{ogsGame: ogsGame{ID: game.ID, Name: game.Name, Gamedata: game.JSON}}
+	fetched.Players.Black, fetched.Players.White = game.Black, game.White
+	if position.moves < demoGameMoves {
+		return fetched, true
+	}
+
+	// Finished games rotate through the ways a game can end
+	fetched.Gamedata.Phase = "finished"
+	fetched.Ended = d.start.Format(time.RFC3339)
+	switch generation % 3 {
+	case 0:
+		fetched.Outcome, fetched.Winner = "Resignation", playerID
+	case 1:
+		fetched.Outcome, fetched.Winner = "Timeout", game.White.ID
+	default:
+		fetched.Outcome, fetched.Winner = "3.5 points", playerID
+	}
+	return fetched, true
+}
+
+// demoTokenPlayer returns the player a demo access token belongs to
+func demoTokenPlayer(r *http.Request) (int, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, demoTokenPrefix) {
+		return 0, false
+	}
+	playerID, err := strconv.Atoi(strings.TrimPrefix(token, demoTokenPrefix))
+	return playerID, err == nil && playerID > 0
+}
+
+// handler serves the parts of the OGS API the server uses
+func (d *demoOGS) handler() http.Handler {
+	r := mux.NewRouter()
+	writeJSON := func(w http.ResponseWriter, value interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+	playerID := func(r *http.Request) int {
+		id, _ := strconv.Atoi(mux.Vars(r)["playerID"])
+		return id
+	}
+
+	r.HandleFunc("/api/v1/players/{playerID:[0-9]+}/full", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, PlayerResponse{ActiveGames: d.activeGames(playerID(r))})
+	})
+	r.HandleFunc("/api/v1/players/{playerID:[0-9]+}/games/", func(w http.ResponseWriter, r *http.Request) {
+		var page struct {
+			Next    *string `json:"next"`
+			Results []Game  `json:"results"`
+		}
+		page.Results = d.activeGames(playerID(r))
+		writeJSON(w, page)
+	})
+	r.HandleFunc("/api/v1/players", func(w http.ResponseWriter, r *http.Request) {
+		var players struct {
+			Results []GamePlayer `json:"results"`
+		}
+		var id int
+		if _, err := fmt.Sscanf(strings.ToLower(r.URL.Query().Get("username")), "player %d", &id); err == nil && id > 0 {
+			players.Results = append(players.Results, GamePlayer{ID: id, Username: fmt.Sprintf("Player %d", id)})
+		}
+		writeJSON(w, players)
+	})
+	r.HandleFunc("/api/v1/games/{gameID:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		gameID, _ := strconv.Atoi(mux.Vars(r)["gameID"])
+		details, ok := d.details(gameID)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, details)
+	})
+	r.HandleFunc("/api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := demoTokenPlayer(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"id": id, "username": fmt.Sprintf("Player %d", id)})
+	})
+	r.HandleFunc("/api/v1/me/challenges", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := demoTokenPlayer(r); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"results": []interface{}{}})
+	})
+	r.HandleFunc("/api/v1/ui/overview", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := demoTokenPlayer(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, PlayerResponse{ActiveGames: d.activeGames(id)})
+	})
+	return r
+}
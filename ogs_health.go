@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OGS requests are tracked over a sliding window. When OGS is slow or failing
+// the server sheds optional features that make extra OGS requests, so the
+// remaining budget goes to core turn notifications.
+
+const (
+	ogsHealthWindow     = 5 * time.Minute
+	ogsHealthMinSamples = 10
+)
+
+// optionalFeatures are disabled while degraded
+var optionalFeatures = []string{
+	"game_results", // fetching finished game outcomes
+	"challenges",   // reading incoming challenges
+}
+
+type ogsCall struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+type ogsHealthTracker struct {
+	mu            sync.Mutex
+	calls         []ogsCall
+	degraded      bool
+	degradedSince time.Time
+}
+
+type OGSHealthStats struct {
+	Requests     int     `json:"requests"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMS int64   `json:"avg_latency_ms"`
+}
+
+// ogsDegradeErrorRate reads OGS_DEGRADE_ERROR_RATE (default 0.2)
+func ogsDegradeErrorRate() float64 {
+	if value := os.Getenv("OGS_DEGRADE_ERROR_RATE"); value != "" {
+		if rate, err := strconv.ParseFloat(value, 64); err == nil && rate > 0 && rate <= 1 {
+			return rate
+		}
+	}
+	return 0.2
+}
+
+// ogsDegradeLatency reads OGS_DEGRADE_LATENCY_MS (default 3000)
+func ogsDegradeLatency() time.Duration {
+	if value := os.Getenv("OGS_DEGRADE_LATENCY_MS"); value != "" {
+		if ms, err := strconv.Atoi(value); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return 3 * time.Second
+}
+
+// record notes the outcome of one OGS request
+func (h *ogsHealthTracker) record(latency time.Duration, failed bool, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls = append(h.calls, ogsCall{at: now, latency: latency, failed: failed})
+	h.prune(now)
+	h.evaluate(now)
+}
+
+// prune drops calls outside the window. Callers must hold mu.
+func (h *ogsHealthTracker) prune(now time.Time) {
+	cutoff := now.Add(-ogsHealthWindow)
+	i := 0
+	for i < len(h.calls) && h.calls[i].at.Before(cutoff) {
+		i++
+	}
+	h.calls = h.calls[i:]
+}
+
+// stats summarizes the calls in the window. Callers must hold mu.
+func (h *ogsHealthTracker) stats() OGSHealthStats {
+	stats := OGSHealthStats{Requests: len(h.calls)}
+	if len(h.calls) == 0 {
+		return stats
+	}
+
+	failed := 0
+	var total time.Duration
+	for _, call := range h.calls {
+		if call.failed {
+			failed++
+		}
+		total += call.latency
+	}
+	stats.ErrorRate = float64(failed) / float64(len(h.calls))
+	stats.AvgLatencyMS = (total / time.Duration(len(h.calls))).Milliseconds()
+	return stats
+}
+
+// evaluate updates the degraded state, logging transitions. With too few
+// samples the current state is kept. Callers must hold mu.
+func (h *ogsHealthTracker) evaluate(now time.Time) {
+	if len(h.calls) < ogsHealthMinSamples {
+		return
+	}
+
+	stats := h.stats()
+	unhealthy := stats.ErrorRate > ogsDegradeErrorRate() ||
+		time.Duration(stats.AvgLatencyMS)*time.Millisecond > ogsDegradeLatency()
+
+	if unhealthy && !h.degraded {
+		h.degraded = true
+		h.degradedSince = now
+		log.Printf("OGS degraded (error rate %.2f, avg latency %dms): disabling optional features %v",
+			stats.ErrorRate, stats.AvgLatencyMS, optionalFeatures)
+	} else if !unhealthy && h.degraded {
+		h.degraded = false
+		log.Printf("OGS recovered after %v: re-enabling optional features", now.Sub(h.degradedSince).Round(time.Second))
+	}
+}
+
+func (h *ogsHealthTracker) isDegraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degraded
+}
+
+// optionalFeatureEnabled reports whether an optional feature should run now
+func (srv *Server) optionalFeatureEnabled(name string) bool {
+	for _, feature := range optionalFeatures {
+		if feature == name {
+			return !srv.ogsHealth.isDegraded()
+		}
+	}
+	return true
+}
+
+type ServerStatus struct {
+	Degraded         bool           `json:"degraded"`
+	DegradedSince    int64          `json:"degraded_since,omitempty"`
+	DisabledFeatures []string       `json:"disabled_features"`
+	OGS              OGSHealthStats `json:"ogs"`
+	OGSPausedUntil   int64          `json:"ogs_paused_until,omitempty"`       // set while OGS has asked us to back off
+	OGSCircuitOpen   int64          `json:"ogs_circuit_open_until,omitempty"` // set while OGS requests fail fast
+}
+
+// getStatus reports OGS health and which optional features are disabled
+func (srv *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	srv.ogsHealth.mu.Lock()
+	srv.ogsHealth.prune(time.Now())
+	status := ServerStatus{
+		Degraded:         srv.ogsHealth.degraded,
+		DisabledFeatures: []string{},
+		OGS:              srv.ogsHealth.stats(),
+	}
+	if srv.ogsHealth.degraded {
+		status.DegradedSince = srv.ogsHealth.degradedSince.Unix()
+		status.DisabledFeatures = optionalFeatures
+	}
+	srv.ogsHealth.mu.Unlock()
+	if until := srv.ogsPausedUntil(time.Now()); !until.IsZero() {
+		status.OGSPausedUntil = until.Unix()
+	}
+	if until := srv.ogsBreaker.openUntilTime(time.Now()); !until.IsZero() {
+		status.OGSCircuitOpen = until.Unix()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
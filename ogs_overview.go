@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A player's full profile carries their ratings, ladders, tournaments and
+// groups alongside the active games a check needs. OGS's ui/overview lists
+// just the active games, but only for the player an access token belongs to.
+// Users who have given one (for challenge notifications) are checked through
+// it, and everyone else, or anyone whose overview fails or lists a game
+// without its clock, through the full profile.
+
+// ogsOverviewURL lists the active games of the player an access token belongs to
+var ogsOverviewURL = "https://online-go.com/api/v1/ui/overview"
+
+// ogsOverviewChecks counts turn checks served from ui/overview
+var ogsOverviewChecks atomic.Int64
+
+// overviewEnabled reads OGS_OVERVIEW; checks use ui/overview unless it's "false"
+func overviewEnabled() bool {
+	return os.Getenv("OGS_OVERVIEW") != "false"
+}
+
+// getOverviewGames fetches the active games of the token's player
+func (srv *Server) getOverviewGames(accessToken string) ([]Game, error) {
+	req, err := http.NewRequest(http.MethodGet, ogsOverviewURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := srv.ogsDo(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ogsStatusError(resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process response")
+	}
+	var overview PlayerResponse
+	if err := json.Unmarshal(body, &overview); err != nil {
+		return nil, fmt.Errorf("failed to process response")
+	}
+	return overview.ActiveGames, nil
+}
+
+// overviewComplete reports whether every game has the clock a check needs
+func overviewComplete(games []Game) bool {
+	for _, game := range games {
+		if game.JSON.Clock.CurrentPlayer == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchActiveGames gets the user's active games for a turn check, from
+// ui/overview when it can and from their full profile otherwise
+func (srv *Server) fetchActiveGames(userID int) ([]Game, error) {
+	userIDStr := strconv.Itoa(userID)
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.RLock()
+	accessToken := shard.challengeTokens[userIDStr]
+	shard.mu.RUnlock()
+	if accessToken == "" || !overviewEnabled() {
+		return srv.getActiveGames(userID)
+	}
+
+	games, err := srv.getOverviewGames(accessToken)
+	switch {
+	case errors.Is(err, errOGSThrottled):
+		return nil, err
+	case err != nil:
+		log.Printf("OGS overview failed for user %d, fetching the full profile: %v", userID, err)
+	case !overviewComplete(games):
+		log.Printf("OGS overview for user %d is missing clocks, fetching the full profile", userID)
+	default:
+		ogsOverviewChecks.Add(1)
+		srv.rememberListedGames(games, time.Now())
+		return games, nil
+	}
+	return srv.getActiveGames(userID)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// ogsPlayerGamesURL is the OGS API URL listing a player's unfinished games a
+// page at a time, formatted with their ID
+var ogsPlayerGamesURL = "https://online-go.com/api/v1/players/%d/games/?ended__isnull=true&page_size=100"
+
+// The full profile doesn't promise to list every active game, and heavy
+// correspondence players can have more than it returns. For players with many
+// games the paged games list is walked too, and any game it has that the
+// profile left out is fetched on its own, so no game is silently missed.
+
+// maxActiveGamePages bounds how many pages of the games list are followed
+const maxActiveGamePages = 50
+
+// activeGamesPagingThreshold reads ACTIVE_GAMES_PAGING_THRESHOLD, the number
+// of games in a profile from which the paged list is checked too (default
+// 50). 0 always checks it.
+func activeGamesPagingThreshold() int {
+	if thresholdStr := os.Getenv("ACTIVE_GAMES_PAGING_THRESHOLD"); thresholdStr != "" {
+		if threshold, err := strconv.Atoi(thresholdStr); err == nil && threshold >= 0 {
+			return threshold
+		}
+	}
+	return 50
+}
+
+// listActiveGameIDs walks the player's paged games list and returns the IDs of
+// their unfinished games
+func (srv *Server) listActiveGameIDs(userID int) ([]int, error) {
+	pageURL := fmt.Sprintf(ogsPlayerGamesURL, userID)
+	first, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for page := 0; pageURL != ""; page++ {
+		if page == maxActiveGamePages {
+			log.Printf("Stopped listing games for user %d after %d pages", userID, page)
+			break
+		}
+
+		resp, err := srv.ogsGet(pageURL)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Next    string `json:"next"`
+			Results []struct {
+				ID int `json:"id"`
+			} `json:"results"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, ogsStatusError(resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to process response")
+		}
+
+		for _, game := range list.Results {
+			ids = append(ids, game.ID)
+		}
+
+		pageURL = ""
+		if list.Next != "" {
+			// Only follow links back to OGS
+			next, err := first.Parse(list.Next)
+			if err != nil || next.Host != first.Host {
+				log.Printf("Not following games list link %q for user %d", list.Next, userID)
+				break
+			}
+			pageURL = next.String()
+		}
+	}
+	return ids, nil
+}
+
+// completeActiveGames adds the games the player's profile left out. If the
+// games list can't be read the profile's games are used as they are.
+func (srv *Server) completeActiveGames(userID int, games []Game) []Game {
+	if len(games) < activeGamesPagingThreshold() {
+		return games
+	}
+
+	ids, err := srv.listActiveGameIDs(userID)
+	if err != nil {
+		log.Printf("Could not list active games for user %d, using their profile only: %v", userID, err)
+		return games
+	}
+
+	listed := make(map[int]bool, len(games))
+	for _, game := range games {
+		listed[game.ID] = true
+	}
+	added := 0
+	for _, gameID := range ids {
+		if listed[gameID] {
+			continue
+		}
+		listed[gameID] = true
+
+		game, ended, err := srv.getGame(gameID)
+		if err != nil {
+			log.Printf("Could not fetch game %d for user %d: %v", gameID, userID, err)
+			continue
+		}
+		if ended {
+			continue
+		}
+		games = append(games, game)
+		added++
+	}
+	if added > 0 {
+		log.Printf("Found %d active games for user %d missing from their profile", added, userID)
+	}
+	return games
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// realtimeDebounce collects the events one move produces (the move, then the
+// clock) into a single check of each player
+const realtimeDebounce = 2 * time.Second
+
+// realtimePingInterval is how often the connection is kept alive. OGS drops
+// clients that stop pinging.
+const realtimePingInterval = 20 * time.Second
+
+// realtimeSyncInterval is how often game subscriptions are brought in line
+// with the games storage tracks
+const realtimeSyncInterval = time.Minute
+
+// ogsRealtimeURL reads OGS_REALTIME_URL, the OGS real-time API endpoint, by
+// default on the OGS site. Real-time updates are off unless OGS_REALTIME is
+// true.
+func ogsRealtimeURL() string {
+	if os.Getenv("OGS_REALTIME") != "true" {
+		return ""
+	}
+	if url := os.Getenv("OGS_REALTIME_URL"); url != "" {
+		return url
+	}
+	// wss:// for an https:// site, ws:// for http://
+	return "ws" + strings.TrimPrefix(ogsWebURL, "http") + "/"
+}
+
+// realtimePollInterval reads OGS_REALTIME_POLL_SECONDS, how often users are
+// still polled while the real-time connection is up (default 300)
+func realtimePollInterval() time.Duration {
+	if intervalStr := os.Getenv("OGS_REALTIME_POLL_SECONDS"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			return time.Duration(interval) * time.Second
+		}
+	}
+	return 5 * time.Minute
+}
+
+// ogsRealtime keeps a connection to the OGS real-time API and subscribes to
+// the games of this region's users. A move in one of them triggers a check of
+// that game for its players straight away instead of at the next poll;
+// polling continues at a slower rate for games the connection doesn't cover
+// (new games, and any event missed while reconnecting).
+type ogsRealtime struct {
+	url   string
+	srv   *Server
+	check func(gameID int, userIDs []string)             // checks a game for its players; the server's check by default
+	chat  func(userID string, gameID int, chat gameChat) // pushes a chat line; the server's by default
+
+	connected atomic.Bool
+	lastPoll  atomic.Int64 // unix seconds of the last full poll while connected
+
+	mu         sync.Mutex
+	conn       *websocket.Conn
+	subscribed map[int]bool     // game IDs subscribed on the current connection
+	players    map[int][]string // game ID -> its tracked players, as of the last subscription sync
+	chatSince  map[int]int64    // when each game was subscribed; older chat is history
+	pending    map[int]bool     // games with a check already scheduled
+
+	// Presence: the players of each subscribed game, the opponents monitored
+	// on the current connection, and their last known online state
+	gamePlayers map[int][]int
+	monitored   map[int]bool
+	online      map[int]bool
+}
+
+func newOGSRealtime(srv *Server, url string) *ogsRealtime {
+	return &ogsRealtime{
+		url:         url,
+		srv:         srv,
+		pending:     make(map[int]bool),
+		gamePlayers: make(map[int][]int),
+		monitored:   make(map[int]bool),
+		online:      make(map[int]bool),
+		check:       srv.checkRealtimeGame,
+		chat:        srv.sendChatNotification,
+	}
+}
+
+// run connects and reconnects until the process exits, backing off up to a
+// minute between attempts
+func (rt *ogsRealtime) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := rt.connectAndServe()
+		rt.connected.Store(false)
+		log.Printf("OGS real-time connection closed: %v; polling every %v until it's back", err, checkInterval())
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// connectAndServe holds one connection, returning when it fails
+func (rt *ogsRealtime) connectAndServe() error {
+	conn, err := websocket.Dial(rt.url, "", ogsWebURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rt.mu.Lock()
+	rt.conn = conn
+	rt.subscribed = make(map[int]bool)
+	rt.chatSince = make(map[int]int64)
+	rt.gamePlayers = make(map[int][]int)
+	rt.monitored = make(map[int]bool)
+	rt.online = make(map[int]bool)
+	rt.mu.Unlock()
+	defer func() {
+		rt.mu.Lock()
+		rt.conn = nil
+		rt.mu.Unlock()
+	}()
+
+	if err := rt.syncSubscriptions(); err != nil {
+		return err
+	}
+	rt.connected.Store(true)
+	log.Printf("Connected to OGS real-time API at %s", rt.url)
+
+	done := make(chan struct{})
+	defer close(done)
+	go rt.keepAlive(done)
+
+	for {
+		var message string
+		if err := websocket.Message.Receive(conn, &message); err != nil {
+			return err
+		}
+		rt.handleMessage(message)
+	}
+}
+
+// keepAlive pings and resyncs subscriptions until done is closed
+func (rt *ogsRealtime) keepAlive(done <-chan struct{}) {
+	ping := time.NewTicker(realtimePingInterval)
+	defer ping.Stop()
+	resync := time.NewTicker(realtimeSyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			rt.send("net/ping", map[string]interface{}{"client": time.Now().UnixMilli(), "drift": 0, "latency": 0})
+		case <-resync.C:
+			if err := rt.syncSubscriptions(); err != nil {
+				log.Printf("Error syncing OGS real-time subscriptions: %v", err)
+			}
+		}
+	}
+}
+
+// send writes one message: a JSON array of the command and its data
+func (rt *ogsRealtime) send(command string, data interface{}) error {
+	message, err := json.Marshal([]interface{}{command, data})
+	if err != nil {
+		return err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	return websocket.Message.Send(rt.conn, string(message))
+}
+
+// trackedGames returns the games storage tracks for users this region owns,
+// with the users in each
+func (rt *ogsRealtime) trackedGames() map[int][]string {
+	srv := rt.srv
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+
+	notified := srv.storage.notifiedUsers()
+	games := make(map[int][]string)
+	for _, shard := range srv.storage.shards {
+		for userID, userGames := range shard.games {
+			if !notified[userID] || isCanaryUser(userID) || !srv.partition.owns(userID) {
+				continue
+			}
+			if gone := shard.accountsGone[userID]; gone != nil && gone.GoneAt != 0 {
+				continue
+			}
+			for gameID, record := range userGames {
+				if !record.tracked() {
+					continue
+				}
+				games[gameID] = append(games[gameID], userID)
+			}
+		}
+	}
+	for _, users := range games {
+		sort.Strings(users)
+	}
+	return games
+}
+
+// syncSubscriptions connects to tracked games not yet subscribed and
+// disconnects from games no longer tracked. It's the only walk of storage:
+// events look their game's players up in the index it leaves.
+func (rt *ogsRealtime) syncSubscriptions() error {
+	games := rt.trackedGames()
+
+	rt.mu.Lock()
+	rt.players = games
+	var connect, disconnect []int
+	for gameID := range games {
+		if !rt.subscribed[gameID] {
+			connect = append(connect, gameID)
+		}
+	}
+	for gameID := range rt.subscribed {
+		if _, tracked := games[gameID]; !tracked {
+			disconnect = append(disconnect, gameID)
+		}
+	}
+	rt.mu.Unlock()
+
+	for _, gameID := range connect {
+		rt.mu.Lock()
+		rt.chatSince[gameID] = time.Now().Unix()
+		rt.mu.Unlock()
+		if err := rt.send("game/connect", map[string]interface{}{"game_id": gameID, "chat": true}); err != nil {
+			return err
+		}
+		rt.mu.Lock()
+		rt.subscribed[gameID] = true
+		rt.mu.Unlock()
+	}
+	for _, gameID := range disconnect {
+		if err := rt.send("game/disconnect", map[string]interface{}{"game_id": gameID}); err != nil {
+			return err
+		}
+		rt.mu.Lock()
+		delete(rt.subscribed, gameID)
+		delete(rt.chatSince, gameID)
+		delete(rt.gamePlayers, gameID)
+		rt.mu.Unlock()
+	}
+	if len(connect)+len(disconnect) > 0 {
+		log.Printf("OGS real-time: subscribed to %d game(s), unsubscribed from %d", len(connect), len(disconnect))
+	}
+	// Picks up users who turned presence hints on since
+	return rt.monitorOpponents()
+}
+
+// parseRealtimeFrame splits a message into its event name and data
+func parseRealtimeFrame(message string) (string, json.RawMessage, bool) {
+	var frame []json.RawMessage
+	if err := json.Unmarshal([]byte(message), &frame); err != nil || len(frame) == 0 {
+		return "", nil, false
+	}
+	var event string
+	if err := json.Unmarshal(frame[0], &event); err != nil {
+		return "", nil, false
+	}
+	var data json.RawMessage
+	if len(frame) > 1 {
+		data = frame[1]
+	}
+	return event, data, true
+}
+
+// gameEventID parses the game ID out of a game/{id}/{kind} event name
+func gameEventID(event, kind string) (int, bool) {
+	parts := strings.Split(event, "/")
+	if len(parts) != 3 || parts[0] != "game" || parts[2] != kind {
+		return 0, false
+	}
+	gameID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	return gameID, true
+}
+
+// realtimeGameEvent parses the game ID out of an event that can change whose
+// turn it is: game/{id}/move, game/{id}/clock or game/{id}/phase
+func realtimeGameEvent(message string) (int, bool) {
+	event, _, ok := parseRealtimeFrame(message)
+	if !ok {
+		return 0, false
+	}
+	for _, kind := range []string{"move", "clock", "phase"} {
+		if gameID, ok := gameEventID(event, kind); ok {
+			return gameID, true
+		}
+	}
+	return 0, false
+}
+
+// playersOf returns the tracked players of a subscribed game
+func (rt *ogsRealtime) playersOf(gameID int) []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.players[gameID]
+}
+
+// handleMessage schedules a check of the game an event is about for its
+// players. A check already scheduled absorbs further events.
+func (rt *ogsRealtime) handleMessage(message string) {
+	if gameID, chat, ok := realtimeChatEvent(message); ok {
+		rt.handleChat(gameID, chat)
+		return
+	}
+	if gameID, players, ok := realtimeGamedataEvent(message); ok {
+		rt.handleGamedata(gameID, players)
+		return
+	}
+	if states, ok := realtimeUserState(message); ok {
+		rt.handleUserState(states)
+		return
+	}
+	gameID, ok := realtimeGameEvent(message)
+	if !ok {
+		return
+	}
+
+	rt.mu.Lock()
+	scheduled := rt.pending[gameID]
+	tracked := len(rt.players[gameID]) > 0
+	if tracked {
+		rt.pending[gameID] = true
+	}
+	rt.mu.Unlock()
+	if !tracked || scheduled {
+		return
+	}
+
+	time.AfterFunc(realtimeDebounce, func() {
+		rt.mu.Lock()
+		delete(rt.pending, gameID)
+		rt.mu.Unlock()
+		rt.check(gameID, rt.playersOf(gameID))
+	})
+}
+
+// checkRealtimeGame checks a game an event was about for each of its players,
+// with one request to OGS. A game that has ended gets a full check of its
+// players instead, which records the result.
+func (srv *Server) checkRealtimeGame(gameID int, userIDs []string) {
+	// The event means OGS has a newer state than any cached
+	srv.gameStates.Delete(gameID)
+	game, finished, err := srv.getGame(gameID)
+	if err != nil {
+		log.Printf("Error checking game %d after a real-time event: %v", gameID, err)
+		return
+	}
+
+	for _, userIDStr := range userIDs {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			continue
+		}
+		if finished {
+			if _, err := srv.getUserTurnStatus(userID); err != nil {
+				log.Printf("Error checking user %d after game %d ended: %v", userID, gameID, err)
+			}
+			continue
+		}
+		if _, playing := game.colorOf(userID); playing {
+			srv.checkSingleGame(userID, game)
+		}
+	}
+}
+
+// pollDue reports whether a scheduled poll should run. While connected,
+// polls are spaced by the real-time poll interval; otherwise every one runs.
+func (rt *ogsRealtime) pollDue(now time.Time) bool {
+	if !rt.connected.Load() {
+		return true
+	}
+	if now.Unix()-rt.lastPoll.Load() < int64(realtimePollInterval()/time.Second) {
+		return false
+	}
+	rt.lastPoll.Store(now.Unix())
+	return true
+}
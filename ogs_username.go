@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Most players know their OGS username but not their numeric player ID, so
+// /register also accepts a username and looks the player up.
+
+// ogsPlayerSearchURL lists the players with a username, formatted with the
+// escaped username
+var ogsPlayerSearchURL = "https://online-go.com/api/v1/players?username=%s"
+
+// errPlayerNotFound is returned when OGS has no player with the username
+var errPlayerNotFound = errors.New("no OGS player with that username")
+
+// ogsPlayerIDForUsername asks OGS for the ID of the player with the username.
+// Usernames are matched ignoring case, as OGS does at sign-in.
+func (srv *Server) ogsPlayerIDForUsername(username string) (int, error) {
+	resp, err := srv.ogsGet(fmt.Sprintf(ogsPlayerSearchURL, url.QueryEscape(username)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, ogsStatusError(resp.StatusCode)
+	}
+
+	var players struct {
+		Results []GamePlayer `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&players); err != nil {
+		return 0, fmt.Errorf("failed to process response")
+	}
+	for _, player := range players.Results {
+		if player.ID > 0 && strings.EqualFold(player.Username, username) {
+			return player.ID, nil
+		}
+	}
+	return 0, errPlayerNotFound
+}
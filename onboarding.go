@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// stalledAfter is how long a user can sit at one onboarding step before the
+// funnel counts them as stalled there
+const stalledAfter = 24 * time.Hour
+
+// OnboardingFunnel records when a user first reached each onboarding step, as
+// unix timestamps (0 = not yet)
+type OnboardingFunnel struct {
+	RegisteredAt int64 `json:"registered_at"`
+	FirstPushAt  int64 `json:"first_push_at,omitempty"`
+	FirstAckAt   int64 `json:"first_ack_at,omitempty"`
+}
+
+type funnelStep int
+
+const (
+	funnelRegistered funnelStep = iota
+	funnelPushed
+	funnelAcked
+)
+
+// recordFunnelStep stamps the first time a user reaches a step. Later steps
+// aren't recorded for users the server never saw register.
+func (srv *Server) recordFunnelStep(userID string, step funnelStep, now time.Time) {
+	if isCanaryUser(userID) {
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	funnel := shard.onboarding[userID]
+	if funnel == nil {
+		if step != funnelRegistered {
+			return
+		}
+		funnel = &OnboardingFunnel{}
+		shard.onboarding[userID] = funnel
+	}
+
+	switch step {
+	case funnelRegistered:
+		if funnel.RegisteredAt == 0 {
+			funnel.RegisteredAt = now.Unix()
+		}
+	case funnelPushed:
+		if funnel.FirstPushAt == 0 {
+			funnel.FirstPushAt = now.Unix()
+			log.Printf("User %s received their first push", userID)
+		}
+	case funnelAcked:
+		if funnel.FirstAckAt == 0 {
+			funnel.FirstAckAt = now.Unix()
+			log.Printf("User %s acknowledged their first push", userID)
+		}
+	}
+}
+
+// acknowledgeNotification is called by the app when the user opens a push
+func (srv *Server) acknowledgeNotification(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	srv.recordFunnelStep(userID, funnelAcked, time.Now())
+	srv.saveStorage()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type FunnelStats struct {
+	Registered int `json:"registered"`
+	Pushed     int `json:"pushed"`
+	Acked      int `json:"acked"`
+
+	// Users stuck for over a day: never pushed (often no games to notify, or a
+	// bad token) or pushed but never opened one (often permission denied)
+	StalledBeforePush int `json:"stalled_before_push"`
+	StalledBeforeAck  int `json:"stalled_before_ack"`
+
+	MedianSecondsToFirstPush int64 `json:"median_seconds_to_first_push"`
+	MedianSecondsToFirstAck  int64 `json:"median_seconds_to_first_ack"`
+}
+
+// buildFunnelStats summarizes onboarding across all users
+func (srv *Server) buildFunnelStats(now time.Time) FunnelStats {
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
+
+	var stats FunnelStats
+	var toPush, toAck []int64
+	stalledBefore := now.Add(-stalledAfter).Unix()
+
+	for _, shard := range srv.storage.shards {
+		for _, funnel := range shard.onboarding {
+			stats.Registered++
+			if funnel.FirstPushAt == 0 {
+				if funnel.RegisteredAt < stalledBefore {
+					stats.StalledBeforePush++
+				}
+				continue
+			}
+			stats.Pushed++
+			toPush = append(toPush, funnel.FirstPushAt-funnel.RegisteredAt)
+
+			if funnel.FirstAckAt == 0 {
+				if funnel.FirstPushAt < stalledBefore {
+					stats.StalledBeforeAck++
+				}
+				continue
+			}
+			stats.Acked++
+			toAck = append(toAck, funnel.FirstAckAt-funnel.FirstPushAt)
+		}
+	}
+
+	stats.MedianSecondsToFirstPush = median(toPush)
+	stats.MedianSecondsToFirstAck = median(toAck)
+	return stats
+}
+
+func median(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values[len(values)/2]
+}
+
+// getFunnelStats serves onboarding funnel stats to admins
+func (srv *Server) getFunnelStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(srv.buildFunnelStats(time.Now()))
+}
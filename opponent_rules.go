@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// OpponentID returns the ID of the user's opponent, from the player IDs on
+// the game clock, or 0 if the user isn't one of the players. In rengo games
+// it's the other team's first player.
+func (g Game) OpponentID(userID int) int {
+	black, ok := g.colorOf(userID)
+	switch {
+	case !ok:
+		return 0
+	case black:
+		return g.JSON.Clock.WhitePlayerID
+	default:
+		return g.JSON.Clock.BlackPlayerID
+	}
+}
+
+// IsBot reports whether OGS marks the player as a bot account
+func (p GamePlayer) IsBot() bool {
+	for _, class := range strings.Fields(p.UIClass) {
+		if class == "bot" {
+			return true
+		}
+	}
+	return false
+}
+
+// Opponent returns the user's opponent as listed on the game, or an empty
+// player if the user isn't one of the players
+func (g Game) Opponent(userID int) GamePlayer {
+	black, ok := g.colorOf(userID)
+	switch {
+	case !ok:
+		return GamePlayer{}
+	case black:
+		return g.White
+	default:
+		return g.Black
+	}
+}
+
+// OpponentIsBot reports whether the user is playing against a bot
+func (g Game) OpponentIsBot(userID int) bool {
+	return g.Opponent(userID).IsBot()
+}
+
+// OpponentRule sets the priority of every game against one opponent
+type OpponentRule struct {
+	OpponentID int    `json:"opponent_id"`
+	Priority   string `json:"priority"`
+}
+
+// getOpponentRules handles GET /opponent-rules/{userID}
+func (srv *Server) getOpponentRules(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	rules := make([]OpponentRule, 0)
+	for opponentID, priority := range srv.preferencesFor(userID).OpponentRules {
+		rules = append(rules, OpponentRule{OpponentID: opponentID, Priority: priority})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// setOpponentRule handles PUT /opponent-rules/{userID}/{opponentID} with
+// {"priority": "urgent"}
+func (srv *Server) setOpponentRule(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	opponentID, err := strconv.Atoi(mux.Vars(r)["opponentID"])
+	if err != nil || opponentID <= 0 {
+		http.Error(w, "Invalid opponent ID", http.StatusBadRequest)
+		return
+	}
+
+	var rule OpponentRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if problem := validatePriority("priority", rule.Priority); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+	rule.OpponentID = opponentID
+
+	srv.updateOpponentRules(userID, func(rules map[int]string) {
+		rules[opponentID] = rule.Priority
+	})
+	log.Printf("Set opponent rule for user %s: games vs %d are %s", userID, opponentID, rule.Priority)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// deleteOpponentRule handles DELETE /opponent-rules/{userID}/{opponentID}
+func (srv *Server) deleteOpponentRule(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	opponentID, err := strconv.Atoi(mux.Vars(r)["opponentID"])
+	if err != nil {
+		http.Error(w, "Invalid opponent ID", http.StatusBadRequest)
+		return
+	}
+
+	srv.updateOpponentRules(userID, func(rules map[int]string) {
+		delete(rules, opponentID)
+	})
+	log.Printf("Removed opponent rule for user %s vs %d", userID, opponentID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateOpponentRules applies change to a copy of the user's opponent rules
+// and stores it in their preferences. The map is copied because readers of
+// preferencesFor share it.
+func (srv *Server) updateOpponentRules(userID string, change func(rules map[int]string)) {
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	prefs := UserPreferences{}
+	if existing := shard.preferences[userID]; existing != nil {
+		prefs = *existing
+	}
+	rules := make(map[int]string, len(prefs.OpponentRules)+1)
+	for opponentID, priority := range prefs.OpponentRules {
+		rules[opponentID] = priority
+	}
+	change(rules)
+	prefs.OpponentRules = rules
+	if len(rules) == 0 {
+		prefs.OpponentRules = nil
+	}
+	shard.preferences[userID] = &prefs
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+}
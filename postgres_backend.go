@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresSchema is applied on startup; every statement is idempotent
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	user_id                TEXT PRIMARY KEY,
+	last_notification_time BIGINT,
+	has_moves              BOOLEAN NOT NULL DEFAULT FALSE,
+	has_move_numbers       BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE TABLE IF NOT EXISTS devices (
+	user_id      TEXT PRIMARY KEY,
+	device_token TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS devices_token_idx ON devices (device_token);
+CREATE TABLE IF NOT EXISTS game_moves (
+	user_id     TEXT NOT NULL,
+	game_id     BIGINT NOT NULL,
+	last_move   BIGINT,
+	move_number INTEGER,
+	PRIMARY KEY (user_id, game_id)
+);
+CREATE TABLE IF NOT EXISTS notification_history (
+	user_id TEXT NOT NULL,
+	sent_at BIGINT NOT NULL,
+	PRIMARY KEY (user_id, sent_at)
+);
+CREATE TABLE IF NOT EXISTS server_state (
+	key   TEXT PRIMARY KEY,
+	value JSONB NOT NULL
+);
+`
+
+// pgUser is a row of the users table. has_moves keeps users whose game
+// records exist but are empty, so state round-trips exactly. has_move_numbers
+// is only read, from databases written before GameRecord.
+type pgUser struct {
+	LastNotificationTime *int64
+	HasMoves             bool
+	HasMoveNumbers       bool
+}
+
+type pgGameKey struct {
+	UserID string
+	GameID int
+}
+
+type pgGame struct {
+	LastMove   *int64
+	MoveNumber *int
+}
+
+// pgRows is the relational form of a storage state. Users, devices and the
+// position in each game get their own tables; everything else, including the
+// rest of each game record, is kept as one JSON document.
+type pgRows struct {
+	Users   map[string]pgUser
+	Devices map[string]string
+	Games   map[pgGameKey]pgGame
+	Extra   string
+}
+
+func newPGRows() *pgRows {
+	return &pgRows{
+		Users:   make(map[string]pgUser),
+		Devices: make(map[string]string),
+		Games:   make(map[pgGameKey]pgGame),
+	}
+}
+
+// toPGRows splits a state into rows
+func toPGRows(data *storageFile) (*pgRows, error) {
+	rows := newPGRows()
+
+	for userID, notifiedAt := range data.LastNotificationTime {
+		notifiedAt := notifiedAt
+		user := rows.Users[userID]
+		user.LastNotificationTime = &notifiedAt
+		rows.Users[userID] = user
+	}
+	metadata := make(map[string]map[int]*GameRecord)
+	for userID, games := range data.Games {
+		user := rows.Users[userID]
+		user.HasMoves = true
+		rows.Users[userID] = user
+		for gameID, record := range games {
+			game := pgGame{LastMove: &record.LastMove}
+			if record.MoveNumber > 0 {
+				game.MoveNumber = &record.MoveNumber
+			}
+			rows.Games[pgGameKey{userID, gameID}] = game
+
+			if record.hasMetadata() {
+				meta := *record
+				meta.LastMove, meta.MoveNumber = 0, 0
+				if metadata[userID] == nil {
+					metadata[userID] = make(map[int]*GameRecord)
+				}
+				metadata[userID][gameID] = &meta
+			}
+		}
+	}
+	for userID, token := range data.DeviceTokens {
+		rows.Devices[userID] = token
+	}
+
+	extra := *data
+	extra.Games, extra.DeviceTokens, extra.LastNotificationTime = nil, nil, nil
+	if len(metadata) > 0 {
+		extra.Games = metadata
+	}
+	encoded, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+	rows.Extra = string(encoded)
+
+	return rows, nil
+}
+
+// fromPGRows rebuilds a state from rows
+func fromPGRows(rows *pgRows) (*storageFile, error) {
+	data := &storageFile{}
+	if rows.Extra != "" {
+		if err := json.Unmarshal([]byte(rows.Extra), data); err != nil {
+			return nil, fmt.Errorf("invalid server_state: %v", err)
+		}
+	}
+
+	metadata := data.Games
+	data.Games = make(map[string]map[int]*GameRecord)
+	data.DeviceTokens = make(map[string]string)
+	data.LastNotificationTime = make(map[string]int64)
+
+	for userID, user := range rows.Users {
+		if user.LastNotificationTime != nil {
+			data.LastNotificationTime[userID] = *user.LastNotificationTime
+		}
+		if user.HasMoves || user.HasMoveNumbers {
+			data.Games[userID] = make(map[int]*GameRecord)
+		}
+	}
+	for key, game := range rows.Games {
+		if data.Games[key.UserID] == nil {
+			continue
+		}
+		record := &GameRecord{}
+		if meta := metadata[key.UserID][key.GameID]; meta != nil {
+			record = meta
+		}
+		if game.LastMove != nil {
+			record.LastMove = *game.LastMove
+		}
+		if game.MoveNumber != nil {
+			record.MoveNumber = *game.MoveNumber
+		}
+		data.Games[key.UserID][key.GameID] = record
+	}
+	for userID, token := range rows.Devices {
+		data.DeviceTokens[userID] = token
+	}
+
+	return data, nil
+}
+
+// sqlBackend stores state in PostgreSQL or SQLite using the same tables. It
+// remembers the rows it last wrote, so each save only touches rows that
+// changed, all in one transaction.
+type sqlBackend struct {
+	name string
+	db   *sql.DB
+
+	mu    sync.Mutex
+	saved *pgRows
+}
+
+func newPostgresBackend(dsn string) (*sqlBackend, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=postgres requires DATABASE_URL")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot connect to postgres: %v", err)
+	}
+	if _, err := db.Exec(postgresSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create postgres schema: %v", err)
+	}
+
+	return &sqlBackend{name: "postgres", db: db}, nil
+}
+
+func (b *sqlBackend) Name() string {
+	return b.name
+}
+
+func (b *sqlBackend) Load() (*storageFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows := newPGRows()
+
+	userRows, err := b.db.Query(`SELECT user_id, last_notification_time, has_moves, has_move_numbers FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	for userRows.Next() {
+		var userID string
+		var user pgUser
+		if err := userRows.Scan(&userID, &user.LastNotificationTime, &user.HasMoves, &user.HasMoveNumbers); err != nil {
+			userRows.Close()
+			return nil, err
+		}
+		rows.Users[userID] = user
+	}
+	userRows.Close()
+
+	deviceRows, err := b.db.Query(`SELECT user_id, device_token FROM devices`)
+	if err != nil {
+		return nil, err
+	}
+	for deviceRows.Next() {
+		var userID, token string
+		if err := deviceRows.Scan(&userID, &token); err != nil {
+			deviceRows.Close()
+			return nil, err
+		}
+		rows.Devices[userID] = token
+	}
+	deviceRows.Close()
+
+	gameRows, err := b.db.Query(`SELECT user_id, game_id, last_move, move_number FROM game_moves`)
+	if err != nil {
+		return nil, err
+	}
+	for gameRows.Next() {
+		var key pgGameKey
+		var game pgGame
+		if err := gameRows.Scan(&key.UserID, &key.GameID, &game.LastMove, &game.MoveNumber); err != nil {
+			gameRows.Close()
+			return nil, err
+		}
+		rows.Games[key] = game
+	}
+	gameRows.Close()
+
+	err = b.db.QueryRow(`SELECT value FROM server_state WHERE key = 'state'`).Scan(&rows.Extra)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	data, err := fromPGRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	b.saved = rows
+	return data, nil
+}
+
+func (b *sqlBackend) Save(data *storageFile) error {
+	rows, err := toPGRows(data)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	saved := b.saved
+	if saved == nil {
+		saved = newPGRows()
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for userID, user := range rows.Users {
+		if old, exists := saved.Users[userID]; exists && pgUserEqual(old, user) {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO users (user_id, last_notification_time, has_moves, has_move_numbers)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO UPDATE SET last_notification_time = $2, has_moves = $3, has_move_numbers = $4`,
+			userID, user.LastNotificationTime, user.HasMoves, user.HasMoveNumbers); err != nil {
+			return err
+		}
+		if user.LastNotificationTime != nil {
+			if _, err := tx.Exec(`INSERT INTO notification_history (user_id, sent_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+				userID, *user.LastNotificationTime); err != nil {
+				return err
+			}
+		}
+	}
+	for userID := range saved.Users {
+		if _, exists := rows.Users[userID]; !exists {
+			if _, err := tx.Exec(`DELETE FROM users WHERE user_id = $1`, userID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for userID, token := range rows.Devices {
+		if saved.Devices[userID] == token {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO devices (user_id, device_token) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET device_token = $2`, userID, token); err != nil {
+			return err
+		}
+	}
+	for userID := range saved.Devices {
+		if _, exists := rows.Devices[userID]; !exists {
+			if _, err := tx.Exec(`DELETE FROM devices WHERE user_id = $1`, userID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, game := range rows.Games {
+		if old, exists := saved.Games[key]; exists && pgGameEqual(old, game) {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO game_moves (user_id, game_id, last_move, move_number) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, game_id) DO UPDATE SET last_move = $3, move_number = $4`,
+			key.UserID, key.GameID, game.LastMove, game.MoveNumber); err != nil {
+			return err
+		}
+	}
+	for key := range saved.Games {
+		if _, exists := rows.Games[key]; !exists {
+			if _, err := tx.Exec(`DELETE FROM game_moves WHERE user_id = $1 AND game_id = $2`, key.UserID, key.GameID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rows.Extra != saved.Extra {
+		if _, err := tx.Exec(`INSERT INTO server_state (key, value) VALUES ('state', $1)
+			ON CONFLICT (key) DO UPDATE SET value = $1`, rows.Extra); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.saved = rows
+	return nil
+}
+
+func pgUserEqual(a, b pgUser) bool {
+	return int64PtrEqual(a.LastNotificationTime, b.LastNotificationTime) &&
+		a.HasMoves == b.HasMoves && a.HasMoveNumbers == b.HasMoveNumbers
+}
+
+func pgGameEqual(a, b pgGame) bool {
+	if !int64PtrEqual(a.LastMove, b.LastMove) {
+		return false
+	}
+	if a.MoveNumber == nil || b.MoveNumber == nil {
+		return a.MoveNumber == b.MoveNumber
+	}
+	return *a.MoveNumber == *b.MoveNumber
+}
+
+func int64PtrEqual(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
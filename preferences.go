@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxDailyNotificationCap bounds the per-user cap to something sensible
+const maxDailyNotificationCap = 1000
+
+// UserPreferences are per-user notification settings set by the app
+type UserPreferences struct {
+	// DailyNotificationCap limits pushes per day; 0 means unlimited
+	DailyNotificationCap int `json:"daily_notification_cap"`
+	// HighVolumeMode groups pushes into batch windows: "auto" (default,
+	// above the active game threshold), "on" or "off"
+	HighVolumeMode string `json:"high_volume_mode,omitempty"`
+	// BatchWindowMinutes is the minimum time between grouped pushes
+	BatchWindowMinutes int `json:"batch_window_minutes,omitempty"`
+	// PresenceHints opts in to low-priority opponent activity events
+	PresenceHints bool `json:"presence_hints,omitempty"`
+	// ChatMuted turns off pushes for chat messages in the user's games
+	ChatMuted bool `json:"chat_muted,omitempty"`
+	// Timezone is an IANA name (e.g. "Europe/Paris") used for local-time
+	// scheduling; empty means UTC
+	Timezone string `json:"timezone,omitempty"`
+	// LabelRules sets the priority of games by the labels the user gave them:
+	// "urgent", "normal", "digest" or "mute"
+	LabelRules map[string]string `json:"label_rules,omitempty"`
+	// OpponentRules sets the priority of every game against an opponent,
+	// by opponent user ID
+	OpponentRules map[int]string `json:"opponent_rules,omitempty"`
+	// BotGames is the priority of games against bots with no other rule;
+	// empty means "digest"
+	BotGames string `json:"bot_games,omitempty"`
+	// LiveGames is how turns in real-time games are handled: "immediate"
+	// (default) skips batch windows, "suppress" never pushes them
+	LiveGames string `json:"live_games,omitempty"`
+	// Routing overrides the operator's routing rule for event types
+	Routing map[string]RouteRule `json:"routing,omitempty"`
+	// TurnTemplate replaces the text of pushes about a new turn in one game;
+	// empty means the default
+	TurnTemplate string `json:"turn_template,omitempty"`
+}
+
+// preferencesFor returns a copy of the user's preferences, or defaults
+func (srv *Server) preferencesFor(userID string) UserPreferences {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if prefs := shard.preferences[userID]; prefs != nil {
+		return *prefs
+	}
+	return UserPreferences{}
+}
+
+func (p UserPreferences) validate() string {
+	if p.DailyNotificationCap < 0 || p.DailyNotificationCap > maxDailyNotificationCap {
+		return "daily_notification_cap must be between 0 and 1000"
+	}
+	switch p.HighVolumeMode {
+	case "", "auto", "on", "off":
+	default:
+		return "high_volume_mode must be auto, on or off"
+	}
+	if p.BatchWindowMinutes < 0 || p.BatchWindowMinutes > 24*60 {
+		return "batch_window_minutes must be between 0 and 1440"
+	}
+	if _, err := loadTimezone(p.Timezone); err != nil {
+		return err.Error()
+	}
+	for label, priority := range p.LabelRules {
+		if normalized, problem := normalizeLabels([]string{label}); problem != "" || normalized[0] != label {
+			return "label_rules keys must be lowercase labels"
+		}
+		if problem := validatePriority("label_rules values", priority); problem != "" {
+			return problem
+		}
+	}
+	for event, rule := range p.Routing {
+		if problem := rule.validate(event); problem != "" {
+			return "routing: " + problem
+		}
+	}
+	if problem := validateTurnTemplate(p.TurnTemplate); problem != "" {
+		return problem
+	}
+	switch p.LiveGames {
+	case "", liveGamesImmediate, liveGamesSuppress:
+	default:
+		return "live_games must be immediate or suppress"
+	}
+	if p.BotGames != "" {
+		if problem := validatePriority("bot_games", p.BotGames); problem != "" {
+			return problem
+		}
+	}
+	for opponentID, priority := range p.OpponentRules {
+		if opponentID <= 0 {
+			return "opponent_rules keys must be user IDs"
+		}
+		if problem := validatePriority("opponent_rules values", priority); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+func (srv *Server) getPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(srv.preferencesFor(userID))
+}
+
+func (srv *Server) updatePreferences(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var prefs UserPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if problem := prefs.validate(); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.preferences[userID] = &prefs
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	log.Printf("Updated preferences for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const presenceKeepAlive = 30 * time.Second
+
+// PresenceEvent is a low-priority hint about an opponent's activity: coming
+// online while the user has a game with them. Events are fed by the OGS
+// real-time connection, which monitors the opponents of users who opted in.
+type PresenceEvent struct {
+	Type       string `json:"type"` // opponent_online
+	GameID     int    `json:"game_id,omitempty"`
+	OpponentID int    `json:"opponent_id"`
+	At         int64  `json:"at"`
+}
+
+// presenceHub fans presence events out to connected SSE streams
+type presenceHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan PresenceEvent]struct{}
+}
+
+func newPresenceHub() *presenceHub {
+	return &presenceHub{subscribers: make(map[string]map[chan PresenceEvent]struct{})}
+}
+
+func (h *presenceHub) subscribe(userID string) chan PresenceEvent {
+	ch := make(chan PresenceEvent, 16)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan PresenceEvent]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *presenceHub) unsubscribe(userID string, ch chan PresenceEvent) {
+	h.mu.Lock()
+	delete(h.subscribers[userID], ch)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+	h.mu.Unlock()
+}
+
+// publishPresenceEvent delivers an event to the user's open streams. Slow
+// streams drop events rather than block the publisher; these are only hints.
+// Returns the number of streams the event was delivered to.
+func (srv *Server) publishPresenceEvent(userID string, event PresenceEvent) int {
+	if !srv.preferencesFor(userID).PresenceHints || !srv.notificationsEnabled(userID) {
+		return 0
+	}
+	if event.At == 0 {
+		event.At = time.Now().Unix()
+	}
+
+	srv.presence.mu.Lock()
+	defer srv.presence.mu.Unlock()
+
+	delivered := 0
+	for ch := range srv.presence.subscribers[userID] {
+		select {
+		case ch <- event:
+			delivered++
+		default:
+			presenceEventsDropped.Add(1)
+		}
+	}
+	return delivered
+}
+
+// streamPresenceEvents serves a user's presence hints as server-sent events
+func (srv *Server) streamPresenceEvents(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if !srv.preferencesFor(userID).PresenceHints {
+		http.Error(w, "Presence hints are not enabled for this user", http.StatusForbidden)
+		return
+	}
+	if !srv.featureEnabled(userID, featureEventStream, time.Now()) {
+		http.Error(w, "The event stream is a premium feature", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := srv.presence.subscribe(userID)
+	defer srv.presence.unsubscribe(userID, events)
+
+	log.Printf("Presence stream opened for user %s", userID)
+
+	keepAlive := time.NewTicker(presenceKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Presence stream closed for user %s", userID)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: presence\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// realtimeGamedata is the part of a game/{id}/gamedata event presence needs.
+// OGS sends it when a game is subscribed.
+type realtimeGamedata struct {
+	BlackPlayerID int `json:"black_player_id"`
+	WhitePlayerID int `json:"white_player_id"`
+}
+
+// realtimeGamedataEvent parses the players out of a game/{id}/gamedata event
+func realtimeGamedataEvent(message string) (int, []int, bool) {
+	event, data, ok := parseRealtimeFrame(message)
+	if !ok {
+		return 0, nil, false
+	}
+	gameID, ok := gameEventID(event, "gamedata")
+	var gamedata realtimeGamedata
+	if !ok || json.Unmarshal(data, &gamedata) != nil {
+		return 0, nil, false
+	}
+	return gameID, []int{gamedata.BlackPlayerID, gamedata.WhitePlayerID}, true
+}
+
+// realtimeUserState parses a user/state event: whether each monitored player
+// is online
+func realtimeUserState(message string) (map[int]bool, bool) {
+	event, data, ok := parseRealtimeFrame(message)
+	if !ok || event != "user/state" {
+		return nil, false
+	}
+	var raw map[string]bool
+	if json.Unmarshal(data, &raw) != nil {
+		return nil, false
+	}
+	states := make(map[int]bool, len(raw))
+	for id, online := range raw {
+		if playerID, err := strconv.Atoi(id); err == nil {
+			states[playerID] = online
+		}
+	}
+	return states, true
+}
+
+// handleGamedata records a subscribed game's players and monitors the new
+// opponent
+func (rt *ogsRealtime) handleGamedata(gameID int, players []int) {
+	rt.mu.Lock()
+	rt.gamePlayers[gameID] = players
+	rt.mu.Unlock()
+
+	if err := rt.monitorOpponents(); err != nil {
+		log.Printf("Error monitoring opponents in game %d: %v", gameID, err)
+	}
+}
+
+// monitorOpponents asks OGS for the online state of the opponents of users
+// with presence hints on, in their subscribed games. OGS keeps monitoring a
+// player for the rest of the connection, so only new ones are sent.
+func (rt *ogsRealtime) monitorOpponents() error {
+	rt.mu.Lock()
+	players := rt.players // replaced on sync, never changed in place
+	gamePlayers := maps.Clone(rt.gamePlayers)
+	rt.mu.Unlock()
+
+	hints := make(map[string]bool)
+	wanted := make(map[int]bool)
+	for gameID, userIDs := range players {
+		for _, userID := range userIDs {
+			if _, known := hints[userID]; !known {
+				hints[userID] = rt.srv.preferencesFor(userID).PresenceHints
+			}
+			if !hints[userID] {
+				continue
+			}
+			for _, playerID := range gamePlayers[gameID] {
+				if playerID != 0 && strconv.Itoa(playerID) != userID {
+					wanted[playerID] = true
+				}
+			}
+		}
+	}
+
+	rt.mu.Lock()
+	var monitor []int
+	for playerID := range wanted {
+		if !rt.monitored[playerID] {
+			rt.monitored[playerID] = true
+			monitor = append(monitor, playerID)
+		}
+	}
+	rt.mu.Unlock()
+	if len(monitor) == 0 {
+		return nil
+	}
+	sort.Ints(monitor)
+	return rt.send("user/monitor", monitor)
+}
+
+// handleUserState tells the users who have a game with a player that they
+// came online, once per user. A player's first state is only recorded: they
+// may have been online all along.
+func (rt *ogsRealtime) handleUserState(states map[int]bool) {
+	rt.mu.Lock()
+	var cameOnline []int
+	for playerID, online := range states {
+		if was, known := rt.online[playerID]; known && !was && online {
+			cameOnline = append(cameOnline, playerID)
+		}
+		rt.online[playerID] = online
+	}
+	players := rt.players
+	gamePlayers := maps.Clone(rt.gamePlayers)
+	rt.mu.Unlock()
+
+	gameIDs := slices.Sorted(maps.Keys(gamePlayers))
+	for _, opponentID := range cameOnline {
+		told := make(map[string]bool)
+		for _, gameID := range gameIDs {
+			if !slices.Contains(gamePlayers[gameID], opponentID) {
+				continue
+			}
+			for _, userID := range players[gameID] {
+				if told[userID] || userID == strconv.Itoa(opponentID) {
+					continue
+				}
+				told[userID] = true
+				rt.srv.publishPresenceEvent(userID, PresenceEvent{Type: "opponent_online", GameID: gameID, OpponentID: opponentID})
+			}
+		}
+	}
+}
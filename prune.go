@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// staleUserTTL reads STALE_USER_DAYS, defaulting to 30 days. 0 disables pruning.
+func staleUserTTL() time.Duration {
+	if daysStr := os.Getenv("STALE_USER_DAYS"); daysStr != "" {
+		if days, err := strconv.Atoi(daysStr); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return 30 * 24 * time.Hour
+}
+
+// notificationTimeTTL reads NOTIFICATION_TIME_TTL_DAYS, defaulting to 7 days.
+// 0 keeps notification times forever.
+func notificationTimeTTL() time.Duration {
+	if daysStr := os.Getenv("NOTIFICATION_TIME_TTL_DAYS"); daysStr != "" {
+		if days, err := strconv.Atoi(daysStr); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return 7 * 24 * time.Hour
+}
+
+// staleUsers lists users whose state can be dropped: registered users whose
+// pushes have failed for longer than ttl (typically the app was uninstalled),
+// and users with nowhere to deliver notifications who haven't been checked
+// within ttl (left behind by /check or an unregistered device). Callers must
+// hold every lock, from lockAll or rlockAll.
+func (s *MoveStorage) staleUsers(now time.Time, ttl time.Duration) []string {
+	cutoff := now.Add(-ttl).Unix()
+	notified := s.notifiedUsers()
+
+	seen := make(map[string]bool)
+	var stale []string
+	for _, shard := range s.shards {
+		consider := func(userID string) {
+			if seen[userID] || isCanaryUser(userID) {
+				return
+			}
+			seen[userID] = true
+
+			if notified[userID] {
+				if failingSince, failing := shard.pushFailingSince[userID]; failing && failingSince < cutoff {
+					stale = append(stale, userID)
+				}
+				return
+			}
+
+			var lastSeen int64
+			if health := shard.checkHealth[userID]; health != nil {
+				lastSeen = health.LastSuccess
+			}
+			if funnel := shard.onboarding[userID]; funnel != nil && funnel.RegisteredAt > lastSeen {
+				lastSeen = funnel.RegisteredAt
+			}
+			if lastSeen < cutoff {
+				stale = append(stale, userID)
+			}
+		}
+
+		for userID := range shard.games {
+			consider(userID)
+		}
+		for userID := range shard.pendingNotifications {
+			consider(userID)
+		}
+		for userID := range shard.finishedGames {
+			consider(userID)
+		}
+		for userID := range shard.checkHealth {
+			consider(userID)
+		}
+		for userID := range shard.pushFailingSince {
+			consider(userID)
+		}
+	}
+	return stale
+}
+
+// pruneStaleState removes every trace of stale users. Games that leave a
+// user's active list are already dropped when they're checked.
+func (srv *Server) pruneStaleState(now time.Time) int {
+	ttl := staleUserTTL()
+	if ttl <= 0 {
+		return 0
+	}
+
+	srv.storage.lockAll()
+	stale := srv.storage.staleUsers(now, ttl)
+	if len(stale) == 0 {
+		srv.storage.unlockAll()
+		return 0
+	}
+
+	removed := make(map[string]string, len(stale))
+	for _, userID := range stale {
+		removed[userID] = ""
+	}
+	err := srv.storage.replaceDocs(storageDocs{Users: removed})
+	srv.storage.unlockAll()
+
+	if err != nil {
+		log.Printf("Error pruning %d stale users: %v", len(stale), err)
+		return 0
+	}
+
+	log.Printf("Pruned %d stale users not reachable or checked in %v", len(stale), ttl)
+	srv.saveStorage()
+	return len(stale)
+}
+
+// expireNotificationTimes drops last-notification times older than the TTL.
+// They only matter for batch windows, which are at most a day, so an expired
+// entry behaves the same as a missing one.
+func (srv *Server) expireNotificationTimes(now time.Time) int {
+	ttl := notificationTimeTTL()
+	if ttl <= 0 {
+		return 0
+	}
+	cutoff := now.Add(-ttl).Unix()
+
+	expired := 0
+	for _, shard := range srv.storage.shards {
+		shard.mu.Lock()
+		for userID, notifiedAt := range shard.lastNotificationTime {
+			if notifiedAt < cutoff {
+				delete(shard.lastNotificationTime, userID)
+				expired++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	if expired > 0 {
+		log.Printf("Expired %d notification times older than %v", expired, ttl)
+		srv.saveStorage()
+	}
+	return expired
+}
+
+// startPruning removes stale users, gone accounts, expired notification
+// times and snoozes every six hours
+func (srv *Server) startPruning() {
+	ticker := time.NewTicker(6 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		srv.pruneStaleState(time.Now())
+		srv.pruneGoneAccounts(time.Now())
+		srv.expireNotificationTimes(time.Now())
+		srv.expireSnoozes(time.Now())
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A push that fails because APNs is briefly unreachable, throttling or having
+// a bad moment would otherwise be lost: game events aren't detected twice.
+// Such pushes are kept in storage and retried with exponential backoff.
+// Turn notifications don't need this; their moves stay pending and are
+// retried by the next check.
+
+const (
+	pushRetryCheckInterval = 15 * time.Second
+	maxPushRetriesPerUser  = 20
+	maxPushRetryDelay      = time.Hour
+)
+
+// errPushQueued is returned when a push failed but will be retried
+var errPushQueued = errors.New("push queued for retry")
+
+// transientPushError marks a send failure that may succeed if tried again
+type transientPushError struct {
+	err error
+}
+
+func (e transientPushError) Error() string { return e.err.Error() }
+func (e transientPushError) Unwrap() error { return e.err }
+
+// isTransientPush reports whether a failed send is worth retrying
+func isTransientPush(err error) bool {
+	var transient transientPushError
+	return errors.As(err, &transient)
+}
+
+// transientAPNsStatus reports whether APNs rejected a push only for now:
+// throttled, or failing on its side
+func transientAPNsStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// PushRetry is a failed push waiting to be sent again
+type PushRetry struct {
+	Title         string                 `json:"title"`
+	Body          string                 `json:"body"`
+	Action        string                 `json:"action"`
+	Custom        map[string]interface{} `json:"custom,omitempty"`
+	Attempts      int                    `json:"attempts"`
+	FailedAt      int64                  `json:"failed_at"`       // unix time of the first failure
+	NextAttemptAt int64                  `json:"next_attempt_at"` // unix time
+	LastError     string                 `json:"last_error,omitempty"`
+}
+
+var (
+	pushRetriesDelivered atomic.Int64
+	pushRetriesDropped   atomic.Int64
+)
+
+// pushRetryMaxAttempts reads PUSH_RETRY_MAX_ATTEMPTS, how many times a push
+// is tried in all, including the first (default 5; 0 or 1 turns retries off)
+func pushRetryMaxAttempts() int {
+	if value := os.Getenv("PUSH_RETRY_MAX_ATTEMPTS"); value != "" {
+		if attempts, err := strconv.Atoi(value); err == nil && attempts >= 0 {
+			return attempts
+		}
+	}
+	return 5
+}
+
+// pushRetryBaseDelay reads PUSH_RETRY_BASE_SECONDS, the wait before the first
+// retry, which doubles with each one after it (default 30 seconds)
+func pushRetryBaseDelay() time.Duration {
+	if value := os.Getenv("PUSH_RETRY_BASE_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 30 * time.Second
+}
+
+// pushRetryDelay returns the wait after the given number of failed attempts
+func pushRetryDelay(attempts int) time.Duration {
+	delay := pushRetryBaseDelay()
+	for i := 1; i < attempts && delay < maxPushRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxPushRetryDelay)
+}
+
+// queuePushRetry keeps a push whose first attempt failed, to be retried. It
+// reports whether the push was queued.
+func (srv *Server) queuePushRetry(userID string, retry PushRetry, failure error, now time.Time) bool {
+	if pushRetryMaxAttempts() <= 1 {
+		return false
+	}
+	retry.Attempts = 1
+	retry.FailedAt = now.Unix()
+	retry.NextAttemptAt = now.Add(pushRetryDelay(1)).Unix()
+	retry.LastError = failure.Error()
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	retries := append(shard.pushRetries[userID], &retry)
+	if len(retries) > maxPushRetriesPerUser {
+		log.Printf("Retry queue full for user %s, dropping the oldest %s push", userID, retries[0].Action)
+		pushRetriesDropped.Add(1)
+		retries = retries[1:]
+	}
+	shard.pushRetries[userID] = retries
+	shard.mu.Unlock()
+
+	log.Printf("%s push for user %s failed (%v), retrying in %v", retry.Action, userID, failure, pushRetryDelay(1))
+	srv.saveStorage()
+	return true
+}
+
+func (srv *Server) startPushRetryScheduler() {
+	ticker := time.NewTicker(pushRetryCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		srv.processDuePushRetries(now, srv.retryUserPush)
+	}
+}
+
+// processDuePushRetries tries every push due at or before now, using send.
+// Delivered pushes are removed, as are pushes that fail for good or have
+// used up their attempts. Returns the number delivered.
+func (srv *Server) processDuePushRetries(now time.Time, send func(userID string, retry PushRetry) error) int {
+	type dueRetry struct {
+		userID string
+		retry  *PushRetry
+	}
+
+	var due []dueRetry
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for userID, retries := range shard.pushRetries {
+			if !srv.partition.owns(userID) {
+				continue
+			}
+			for _, retry := range retries {
+				if retry.NextAttemptAt <= now.Unix() {
+					due = append(due, dueRetry{userID, retry})
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	if len(due) == 0 {
+		return 0
+	}
+
+	delivered := 0
+	maxAttempts := pushRetryMaxAttempts()
+	for _, d := range due {
+		shard := srv.storage.shard(d.userID)
+		shard.mu.RLock()
+		retry := *d.retry
+		shard.mu.RUnlock()
+		err := send(d.userID, retry)
+
+		shard.mu.Lock()
+		switch {
+		case err == nil:
+			delivered++
+			pushRetriesDelivered.Add(1)
+			log.Printf("%s push for user %s delivered on attempt %d", retry.Action, d.userID, retry.Attempts+1)
+			shard.removePushRetry(d.userID, d.retry)
+		case !isTransientPush(err) || retry.Attempts+1 >= maxAttempts:
+			pushRetriesDropped.Add(1)
+			log.Printf("Dropping %s push for user %s after %d attempts: %v", retry.Action, d.userID, retry.Attempts+1, err)
+			shard.removePushRetry(d.userID, d.retry)
+		default:
+			d.retry.Attempts++
+			d.retry.NextAttemptAt = now.Add(pushRetryDelay(d.retry.Attempts)).Unix()
+			d.retry.LastError = err.Error()
+		}
+		shard.mu.Unlock()
+	}
+
+	srv.saveStorage()
+	return delivered
+}
+
+// removePushRetry deletes a queued push. Callers must hold mu.
+func (s *storageShard) removePushRetry(userID string, retry *PushRetry) {
+	retries := s.pushRetries[userID]
+	for i, queued := range retries {
+		if queued == retry {
+			s.pushRetries[userID] = append(retries[:i], retries[i+1:]...)
+			break
+		}
+	}
+	if len(s.pushRetries[userID]) == 0 {
+		delete(s.pushRetries, userID)
+	}
+}
+
+// retryUserPush sends a queued push again. The user's switch, their snooze
+// and their tenant's quota are checked as for a first attempt.
+func (srv *Server) retryUserPush(userID string, retry PushRetry) error {
+	if !srv.notificationsEnabled(userID) {
+		return fmt.Errorf("notifications disabled by user")
+	}
+	if srv.snoozedPush(userID, retry.Custom, time.Now()) {
+		return errPushSnoozed
+	}
+	if srv.tenantQuotaReached(userID, time.Now()) {
+		return fmt.Errorf("tenant notification quota reached")
+	}
+	return srv.deliverUserPush(userID, retry.Title, retry.Body, retry.Action, retry.Custom)
+}
+
+// writePushRetryMetrics writes retry queue counts in the Prometheus text format
+func (srv *Server) writePushRetryMetrics(w http.ResponseWriter) {
+	queued := 0
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for _, retries := range shard.pushRetries {
+			queued += len(retries)
+		}
+		shard.mu.RUnlock()
+	}
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_push_retries_queued Failed pushes waiting to be retried.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_push_retries_queued gauge")
+	fmt.Fprintf(w, "ogs_notifications_push_retries_queued %d\n", queued)
+	fmt.Fprintln(w, "# HELP ogs_notifications_push_retries_total Queued pushes by how their retries ended.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_push_retries_total counter")
+	fmt.Fprintf(w, "ogs_notifications_push_retries_total{outcome=\"delivered\"} %d\n", pushRetriesDelivered.Load())
+	fmt.Fprintf(w, "ogs_notifications_push_retries_total{outcome=\"dropped\"} %d\n", pushRetriesDropped.Load())
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBackend stores one JSON document per user in a Redis hash, and the
+// shared maps in another, so several instances can share state. Each save
+// publishes the documents it changed, and the other instances reload just
+// those.
+type redisBackend struct {
+	client   *redis.Client
+	prefix   string
+	instance string
+
+	mu    sync.Mutex
+	saved storageDocs
+}
+
+// redisChange is published on the changes channel after every save
+type redisChange struct {
+	Instance string   `json:"instance"`
+	Users    []string `json:"users"`
+	Shared   []string `json:"shared,omitempty"`
+}
+
+func newRedisBackend(url, prefix string) (*redisBackend, error) {
+	if url == "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=redis requires REDIS_URL")
+	}
+	if prefix == "" {
+		prefix = "ogs-notifications"
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot connect to redis: %v", err)
+	}
+
+	instance := make([]byte, 8)
+	if _, err := rand.Read(instance); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisBackend{client: client, prefix: prefix, instance: hex.EncodeToString(instance)}, nil
+}
+
+func (b *redisBackend) usersKey() string   { return b.prefix + ":users" }
+func (b *redisBackend) sharedKey() string  { return b.prefix + ":shared" }
+func (b *redisBackend) changesKey() string { return b.prefix + ":changes" }
+
+// leaseKey names the check lease for a scope, or the single lease if it's empty
+func (b *redisBackend) leaseKey(scope string) string {
+	if scope == "" {
+		return b.prefix + ":check-lease"
+	}
+	return b.prefix + ":check-lease:" + scope
+}
+
+func (b *redisBackend) Name() string {
+	return "redis/" + b.usersKey()
+}
+
+func (b *redisBackend) Load() (*storageFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	users, err := b.client.HGetAll(ctx, b.usersKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := b.client.HGetAll(ctx, b.sharedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	docs := storageDocs{Users: users, Shared: shared}
+	data, err := joinUsers(docs)
+	if err != nil {
+		return nil, err
+	}
+	b.saved = docs
+	return data, nil
+}
+
+func (b *redisBackend) Save(data *storageFile) error {
+	docs, err := splitByUser(data)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changedUsers, removedUsers := changedDocs(b.saved.Users, docs.Users)
+	changedShared, removedShared := changedDocs(b.saved.Shared, docs.Shared)
+	if len(changedUsers)+len(removedUsers)+len(changedShared)+len(removedShared) == 0 {
+		return nil
+	}
+
+	message, err := json.Marshal(redisChange{
+		Instance: b.instance,
+		Users:    append(changedUsers, removedUsers...),
+		Shared:   append(changedShared, removedShared...),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		writeHash(ctx, pipe, b.usersKey(), docs.Users, changedUsers, removedUsers)
+		writeHash(ctx, pipe, b.sharedKey(), docs.Shared, changedShared, removedShared)
+		pipe.Publish(ctx, b.changesKey(), message)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.saved = docs
+	return nil
+}
+
+// writeHash queues setting the changed documents in the hash at key and
+// deleting the removed ones
+func writeHash(ctx context.Context, pipe redis.Pipeliner, key string, docs map[string]string, changed, removed []string) {
+	if len(changed) > 0 {
+		values := make([]interface{}, 0, 2*len(changed))
+		for _, id := range changed {
+			values = append(values, id, docs[id])
+		}
+		pipe.HSet(ctx, key, values...)
+	}
+	if len(removed) > 0 {
+		pipe.HDel(ctx, key, removed...)
+	}
+}
+
+// subscribe reloads documents changed by other instances into srv's storage.
+// The client reconnects on its own, so this runs for the life of the process.
+func (b *redisBackend) subscribe(srv *Server) {
+	pubsub := b.client.Subscribe(context.Background(), b.changesKey())
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var change redisChange
+		if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+			log.Printf("Ignoring invalid redis change message: %v", err)
+			continue
+		}
+		if change.Instance == b.instance || len(change.Users)+len(change.Shared) == 0 {
+			continue
+		}
+		if err := b.reload(srv, change); err != nil {
+			log.Printf("Error reloading %d users and %d shared maps changed by instance %s: %v",
+				len(change.Users), len(change.Shared), change.Instance, err)
+		}
+	}
+}
+
+// reload replaces the documents named in change with what's stored in Redis
+func (b *redisBackend) reload(srv *Server, change redisChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	users, err := b.readHash(ctx, b.usersKey(), change.Users)
+	if err != nil {
+		return err
+	}
+	shared, err := b.readHash(ctx, b.sharedKey(), change.Shared)
+	if err != nil {
+		return err
+	}
+	docs := storageDocs{Users: users, Shared: shared}
+
+	// Same lock order as writeStorage: saves, storage, then the backend. Holding
+	// off saves keeps a snapshot copied before this reload from overwriting it.
+	srv.saves.Lock()
+	defer srv.saves.Unlock()
+	srv.storage.lockAll()
+	defer srv.storage.unlockAll()
+	if err := srv.storage.replaceDocs(docs); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.saved.Users == nil {
+		b.saved.Users = make(map[string]string)
+	}
+	if b.saved.Shared == nil {
+		b.saved.Shared = make(map[string]string)
+	}
+	replaceEach(b.saved.Users, docs.Users)
+	replaceEach(b.saved.Shared, docs.Shared)
+	return nil
+}
+
+// readHash reads the given documents from the hash at key, with an empty one
+// for each that's gone
+func (b *redisBackend) readHash(ctx context.Context, key string, ids []string) (map[string]string, error) {
+	docs := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return docs, nil
+	}
+	values, err := b.client.HMGet(ctx, key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		doc, _ := values[i].(string)
+		docs[id] = doc
+	}
+	return docs, nil
+}
+
+// claimCheck takes or renews the lease on running the periodic check, so only
+// one instance checks OGS and sends turn notifications at a time
+func (b *redisBackend) claimCheck(scope string, ttl time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claimed, err := b.client.SetNX(ctx, b.leaseKey(scope), b.instance, ttl).Result()
+	if err != nil {
+		log.Printf("Error claiming check lease: %v", err)
+		return false
+	}
+	if claimed {
+		return true
+	}
+
+	holder, err := b.client.Get(ctx, b.leaseKey(scope)).Result()
+	if err != nil {
+		return false
+	}
+	if holder != b.instance {
+		return false
+	}
+	return b.client.PExpire(ctx, b.leaseKey(scope), ttl).Err() == nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sideshow/apns2"
+)
+
+// regionPartition divides users between the regions of a multi-region
+// deployment. Every instance sharing a storage backend computes the same
+// owner for a user, so each user is checked (and pushed to) by one region.
+type regionPartition struct {
+	region  string   // this instance's region
+	regions []string // every region, sorted
+}
+
+// regionConfig reads REGION (this instance's region) and REGIONS (a comma-
+// separated list of all regions). With fewer than two regions, this instance
+// owns every user.
+func regionConfig() (regionPartition, error) {
+	partition := regionPartition{region: strings.TrimSpace(os.Getenv("REGION"))}
+
+	seen := make(map[string]bool)
+	for _, region := range strings.Split(os.Getenv("REGIONS"), ",") {
+		region = strings.TrimSpace(region)
+		if region != "" && !seen[region] {
+			seen[region] = true
+			partition.regions = append(partition.regions, region)
+		}
+	}
+	sort.Strings(partition.regions)
+
+	if len(partition.regions) > 1 && !seen[partition.region] {
+		return partition, fmt.Errorf("REGION %q is not one of REGIONS %v", partition.region, partition.regions)
+	}
+	return partition, nil
+}
+
+// multiRegion reports whether users are split between regions
+func (p regionPartition) multiRegion() bool {
+	return len(p.regions) > 1
+}
+
+// regionFor returns the region that owns a user, by hash of the user ID
+func (p regionPartition) regionFor(userID string) string {
+	if !p.multiRegion() {
+		return p.region
+	}
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return p.regions[h.Sum32()%uint32(len(p.regions))]
+}
+
+// owns reports whether this instance's region handles the user
+func (p regionPartition) owns(userID string) bool {
+	return !p.multiRegion() || p.regionFor(userID) == p.region
+}
+
+// leaseScope names the check lease for this instance: one lease per region,
+// so each region has one instance checking its users
+func (p regionPartition) leaseScope() string {
+	if !p.multiRegion() {
+		return ""
+	}
+	return p.region
+}
+
+// apnsConnections reads APNS_CONNECTIONS, the number of APNs connections
+// this instance keeps open, defaulting to 1
+func apnsConnections() int {
+	if connectionsStr := os.Getenv("APNS_CONNECTIONS"); connectionsStr != "" {
+		if connections, err := strconv.Atoi(connectionsStr); err == nil && connections > 0 && connections <= 32 {
+			return connections
+		}
+	}
+	return 1
+}
+
+// apnsPool spreads pushes over several APNs clients, each with its own
+// connection, so a burst of sends isn't limited to one connection's streams
+type apnsPool struct {
+	clients []*apns2.Client
+	next    atomic.Uint64
+}
+
+func newAPNSPool(clients ...*apns2.Client) *apnsPool {
+	return &apnsPool{clients: clients}
+}
+
+// client returns the next client in turn
+func (p *apnsPool) client() *apns2.Client {
+	return p.clients[(p.next.Add(1)-1)%uint64(len(p.clients))]
+}
+
+// Push sends a notification on the next connection. A device in another APNs
+// environment than the client's is sent to that environment's host, on the
+// same credentials and HTTP client.
+func (p *apnsPool) Push(notification *apns2.Notification, environment string) (*apns2.Response, error) {
+	client := p.client()
+	if host, known := apnsHosts[environment]; known && host != client.Host {
+		other := *client
+		other.Host = host
+		client = &other
+	}
+	return client.Push(notification)
+}
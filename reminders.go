@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	reminderCheckInterval = time.Minute
+	maxRemindersPerUser   = 50
+	maxReminderAttempts   = 3
+	maxReminderNoteLength = 200
+)
+
+// Reminder is a user-scheduled push about a game at a specific time
+type Reminder struct {
+	ID        string `json:"id"`
+	GameID    int    `json:"game_id"`
+	RemindAt  int64  `json:"remind_at"` // unix timestamp
+	Note      string `json:"note,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Attempts  int    `json:"attempts,omitempty"`
+	// Deadline is when the game's clock runs out, on the final low-clock
+	// warning the server schedules as a reminder. Its note is the game's name.
+	Deadline int64 `json:"deadline,omitempty"`
+}
+
+// ReminderRequest schedules a reminder either at an absolute remind_at or at
+// the next occurrence of local_time ("HH:MM") in the user's timezone
+type ReminderRequest struct {
+	GameID    int    `json:"game_id"`
+	RemindAt  int64  `json:"remind_at"`
+	LocalTime string `json:"local_time"`
+	Note      string `json:"note"`
+}
+
+func newReminderID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// createReminder handles POST /reminders/{userID}
+func (srv *Server) createReminder(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ReminderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.GameID <= 0 {
+		http.Error(w, "game_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.LocalTime != "" {
+		at, err := parseDailyTime(req.LocalTime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.RemindAt = nextOccurrence(time.Now(), srv.userLocation(userID), at).Unix()
+	}
+	if req.RemindAt <= time.Now().Unix() {
+		http.Error(w, "remind_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if len(req.Note) > maxReminderNoteLength {
+		http.Error(w, "note is too long", http.StatusBadRequest)
+		return
+	}
+
+	reminder := &Reminder{
+		ID:        newReminderID(),
+		GameID:    req.GameID,
+		RemindAt:  req.RemindAt,
+		Note:      req.Note,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if len(shard.reminders[userID]) >= maxRemindersPerUser {
+		shard.mu.Unlock()
+		http.Error(w, "Too many reminders", http.StatusConflict)
+		return
+	}
+	shard.reminders[userID] = append(shard.reminders[userID], reminder)
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	log.Printf("Created reminder %s for user %s in game %d at %d", reminder.ID, userID, req.GameID, req.RemindAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reminder)
+}
+
+func (srv *Server) listReminders(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	reminders := make([]Reminder, 0, len(shard.reminders[userID]))
+	for _, reminder := range shard.reminders[userID] {
+		reminders = append(reminders, *reminder)
+	}
+	shard.mu.RUnlock()
+
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i].RemindAt < reminders[j].RemindAt })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminders)
+}
+
+func (srv *Server) deleteReminder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, reminderID := vars["userID"], vars["reminderID"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	removed := shard.removeReminder(userID, reminderID)
+	shard.mu.Unlock()
+
+	if !removed {
+		http.Error(w, "Reminder not found", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeReminder deletes a reminder by ID. Callers must hold mu.
+func (s *storageShard) removeReminder(userID, reminderID string) bool {
+	reminders := s.reminders[userID]
+	for i, reminder := range reminders {
+		if reminder.ID == reminderID {
+			s.reminders[userID] = append(reminders[:i], reminders[i+1:]...)
+			if len(s.reminders[userID]) == 0 {
+				delete(s.reminders, userID)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) startReminderScheduler() {
+	log.Printf("Starting reminder scheduler every %v", reminderCheckInterval)
+
+	ticker := time.NewTicker(reminderCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		srv.processDueReminders(now, srv.sendReminderNotification)
+	}
+}
+
+// processDueReminders delivers every reminder due at or before now. Delivered
+// reminders are removed; failed ones are retried on the next tick up to
+// maxReminderAttempts. Returns the number delivered.
+func (srv *Server) processDueReminders(now time.Time, send func(userID string, reminder Reminder) error) int {
+	type dueReminder struct {
+		userID   string
+		reminder Reminder
+	}
+
+	var due []dueReminder
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for userID, reminders := range shard.reminders {
+			if !srv.partition.owns(userID) {
+				continue
+			}
+			for _, reminder := range reminders {
+				if reminder.RemindAt <= now.Unix() {
+					due = append(due, dueReminder{userID, *reminder})
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	if len(due) == 0 {
+		return 0
+	}
+
+	delivered := 0
+	for _, d := range due {
+		err := send(d.userID, d.reminder)
+
+		shard := srv.storage.shard(d.userID)
+		shard.mu.Lock()
+		if err == nil || errors.Is(err, errPushQueued) {
+			// A queued push is retried by the push retry queue instead
+			delivered++
+			shard.removeReminder(d.userID, d.reminder.ID)
+		} else {
+			log.Printf("Reminder %s for user %s failed: %v", d.reminder.ID, d.userID, err)
+			for _, reminder := range shard.reminders[d.userID] {
+				if reminder.ID == d.reminder.ID {
+					reminder.Attempts++
+					if reminder.Attempts >= maxReminderAttempts {
+						log.Printf("Dropping reminder %s for user %s after %d attempts", reminder.ID, d.userID, reminder.Attempts)
+						shard.removeReminder(d.userID, reminder.ID)
+					}
+					break
+				}
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	srv.saveStorage()
+	return delivered
+}
+
+func (srv *Server) sendReminderNotification(userID string, reminder Reminder) error {
+	if reminder.Deadline != 0 {
+		return srv.sendFinalClockWarning(userID, reminder)
+	}
+	body := fmt.Sprintf("Reminder for game %d", reminder.GameID)
+	if reminder.Note != "" {
+		body = reminder.Note
+	}
+	return srv.sendGamePushNotification(userID, reminder.GameID, "Go reminder", body, "reminder")
+}
@@ -0,0 +1,102 @@
+package main
+
+// In rengo games two teams play, and each team's players take turns making
+// its moves, in the order OGS lists them. OGS's clock names the side to move,
+// not the team member, so the player whose move it is comes from how many
+// moves their team has played.
+
+// RengoTeams lists each team's players in the order they move
+type RengoTeams struct {
+	Black []GamePlayer `json:"black"`
+	White []GamePlayer `json:"white"`
+}
+
+// IsRengo reports whether the game is played by teams
+func (g Game) IsRengo() bool {
+	return g.JSON.Rengo && len(g.JSON.RengoTeams.Black) > 0 && len(g.JSON.RengoTeams.White) > 0
+}
+
+// colorOf reports whether the player plays black. ok is false if they're not
+// in the game.
+func (g Game) colorOf(playerID int) (black, ok bool) {
+	if playerID == 0 {
+		return false, false
+	}
+	switch playerID {
+	case g.JSON.Clock.BlackPlayerID, g.Black.ID:
+		return true, true
+	case g.JSON.Clock.WhitePlayerID, g.White.ID:
+		return false, true
+	}
+	if !g.IsRengo() {
+		return false, false
+	}
+	for _, player := range g.JSON.RengoTeams.Black {
+		if player.ID == playerID {
+			return true, true
+		}
+	}
+	for _, player := range g.JSON.RengoTeams.White {
+		if player.ID == playerID {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// teamMoves returns how many moves black or white has played. Free handicap
+// stones are black moves; with fixed handicap stones, white moves first.
+func (g Game) teamMoves(black bool) int {
+	moves := g.MoveNumber()
+	handicapMoves := 0
+	if g.JSON.Handicap > 1 && g.JSON.FreeHandicapPlacement {
+		handicapMoves = min(moves, g.JSON.Handicap)
+	}
+	alternating := moves - handicapMoves
+	firstMoves, secondMoves := (alternating+1)/2, alternating/2
+
+	if g.JSON.Handicap > 1 {
+		// White moves first once the handicap stones are down
+		if black {
+			return handicapMoves + secondMoves
+		}
+		return firstMoves
+	}
+	if black {
+		return firstMoves
+	}
+	return secondMoves
+}
+
+// PlayerToMove returns the ID of the player whose move it is
+func (g Game) PlayerToMove() int {
+	current := g.JSON.Clock.CurrentPlayer
+	if !g.IsRengo() {
+		return current
+	}
+	black, ok := g.colorOf(current)
+	if !ok {
+		return current
+	}
+	team := g.JSON.RengoTeams.White
+	if black {
+		team = g.JSON.RengoTeams.Black
+	}
+	return team[g.teamMoves(black)%len(team)].ID
+}
+
+// IsTurnOf reports whether it's the user's move
+func (g Game) IsTurnOf(userID int) bool {
+	return userID != 0 && g.PlayerToMove() == userID
+}
+
+// sideToMove reports whether the player is on the side whose clock is
+// running: they're to move, or in rengo, their team is
+func (g Game) sideToMove(playerID int) bool {
+	black, ok := g.colorOf(playerID)
+	if !ok {
+		return false
+	}
+	currentBlack, ok := g.colorOf(g.JSON.Clock.CurrentPlayer)
+	return ok && black == currentBlack
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RenotifyRequest selects the users to re-notify after an incident: those
+// whose sends failed between From and To (Unix seconds), plus any listed in
+// UserIDs, for failures that left no record (e.g. APNs credentials that never
+// loaded, so turns were committed as seen without a push).
+type RenotifyRequest struct {
+	From    int64    `json:"from"`
+	To      int64    `json:"to"`
+	UserIDs []string `json:"user_ids,omitempty"`
+	DryRun  bool     `json:"dry_run,omitempty"`
+}
+
+// RenotifyResult is what happened for one user
+type RenotifyResult struct {
+	UserID string `json:"user_id"`
+	Games  []int  `json:"games,omitempty"`
+	Result string `json:"result"` // no_pending_turns, would_notify, sent, failed, in_flight, error
+	Error  string `json:"error,omitempty"`
+}
+
+// RenotifyReport summarizes a re-notify run
+type RenotifyReport struct {
+	From    int64            `json:"from"`
+	To      int64            `json:"to"`
+	DryRun  bool             `json:"dry_run"`
+	Sent    int              `json:"sent"`
+	Failed  int              `json:"failed"`
+	Results []RenotifyResult `json:"results"`
+}
+
+// renotifyCandidates lists users with a send that failed within the window:
+// their retry is still pending or their pushes have been failing since then.
+// Each shard is locked in turn, so callers must hold no shard's lock.
+func (s *MoveStorage) renotifyCandidates(from, to int64) []string {
+	within := func(at int64) bool { return at >= from && at <= to }
+
+	seen := make(map[string]bool)
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for userID, pending := range shard.pendingNotifications {
+			if pending.LastError != "" && within(pending.ReservedAt) {
+				seen[userID] = true
+			}
+		}
+		for userID, failingSince := range shard.pushFailingSince {
+			if within(failingSince) {
+				seen[userID] = true
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	users := make([]string, 0, len(seen))
+	for userID := range seen {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// turnsAwaitingSince returns the started games where it's still the user's
+// turn and the opponent moved at or after from, or whose failed notification
+// is still pending. Turns from before the incident were already notified.
+func turnsAwaitingSince(userID int, games []Game, from int64, pending *PendingNotification) []Game {
+	var turns []Game
+	for _, game := range games {
+		if !game.IsTurnOf(userID) || !game.Started() {
+			continue
+		}
+		wasPending := false
+		if pending != nil {
+			_, wasPending = pending.Games[game.ID]
+		}
+		if game.JSON.Clock.LastMove >= from*1000 || wasPending {
+			turns = append(turns, game)
+		}
+	}
+	return turns
+}
+
+// renotify re-dispatches a notification for each user's turns still awaiting
+// a move from the incident window. Sends go through the normal path, so the
+// kill switch, daily cap and delivery channels all apply.
+func (srv *Server) renotify(req RenotifyRequest) RenotifyReport {
+	users := srv.storage.renotifyCandidates(req.From, req.To)
+
+	for _, userID := range req.UserIDs {
+		if !slices.Contains(users, userID) {
+			users = append(users, userID)
+		}
+	}
+
+	report := RenotifyReport{From: req.From, To: req.To, DryRun: req.DryRun, Results: make([]RenotifyResult, 0, len(users))}
+	for _, userIDStr := range users {
+		result := RenotifyResult{UserID: userIDStr}
+
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil || isCanaryUser(userIDStr) {
+			continue
+		}
+
+		games, err := srv.getActiveGames(userID)
+		if err != nil {
+			result.Result, result.Error = "error", err.Error()
+			report.Results = append(report.Results, result)
+			continue
+		}
+
+		shard := srv.storage.shard(userIDStr)
+		shard.mu.RLock()
+		var pending *PendingNotification
+		if p := shard.pendingNotifications[userIDStr]; p != nil {
+			pending = p.clone()
+		}
+		shard.mu.RUnlock()
+
+		turns := turnsAwaitingSince(userID, games, req.From, pending)
+		for _, game := range turns {
+			result.Games = append(result.Games, game.ID)
+		}
+
+		switch {
+		case len(turns) == 0:
+			result.Result = "no_pending_turns"
+		case req.DryRun:
+			result.Result = "would_notify"
+		default:
+			reserved := srv.reserveNotification(userIDStr, turns)
+			if len(reserved) == 0 {
+				result.Result = "in_flight"
+				break
+			}
+
+			waiting := 0
+			if srv.highVolumeModeActive(userIDStr, len(games)) {
+				waiting = len(turns)
+			}
+			srv.sendConsolidatedPushNotification(userIDStr, reserved, waiting)
+
+			shard.mu.RLock()
+			_, stillPending := shard.pendingNotifications[userIDStr]
+			shard.mu.RUnlock()
+			if stillPending {
+				result.Result = "failed"
+				report.Failed++
+			} else {
+				result.Result = "sent"
+				report.Sent++
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	return report
+}
+
+// renotifyUsers handles POST /admin/renotify
+func (srv *Server) renotifyUsers(w http.ResponseWriter, r *http.Request) {
+	var req RenotifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.To == 0 {
+		req.To = time.Now().Unix()
+	}
+	if req.From <= 0 || req.From > req.To {
+		http.Error(w, "from must be a Unix time before to", http.StatusBadRequest)
+		return
+	}
+	for _, userID := range req.UserIDs {
+		if _, err := strconv.Atoi(userID); err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Admin re-notify for failures between %d and %d (dry run: %v) from %s", req.From, req.To, req.DryRun, r.RemoteAddr)
+	report := srv.renotify(req)
+	log.Printf("Re-notify finished: %d users considered, %d sent, %d failed", len(report.Results), report.Sent, report.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
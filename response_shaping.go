@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxListLimit bounds ?limit= on list responses
+const maxListLimit = 500
+
+// ListOptions are the response shaping parameters shared by endpoints that
+// return lists: ?limit=&offset= page the list, ?fields= picks what to return.
+type ListOptions struct {
+	Limit  int // 0 means no limit
+	Offset int
+	Fields []string
+}
+
+// parseListOptions reads limit, offset and fields from the query string
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	var opts ListOptions
+	query := r.URL.Query()
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		opts.Limit = limit
+	}
+
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return opts, fmt.Errorf("offset must be a non-negative integer")
+		}
+		opts.Offset = offset
+	}
+
+	if value := query.Get("fields"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				opts.Fields = append(opts.Fields, field)
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+// page returns the [start, end) bounds of the requested page of a list of
+// length n, and the offset of the next page (0 when this is the last)
+func (o ListOptions) page(n int) (start, end, next int) {
+	start = min(o.Offset, n)
+	end = n
+	if o.Limit > 0 && start+o.Limit < n {
+		end = start + o.Limit
+		next = end
+	}
+	return start, end, next
+}
+
+// selectFields reduces v to the requested JSON fields. A field is either a
+// top-level key ("total_active_games") or a key of the objects in a
+// top-level list ("monitored_games.game_id"). Unknown fields are an error so
+// typos don't silently return nothing.
+func selectFields(v interface{}, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return v, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var full map[string]interface{}
+	if err := json.Unmarshal(data, &full); err != nil {
+		return nil, err
+	}
+
+	known := jsonFieldNames(v)
+	selected := make(map[string]interface{})
+	nested := make(map[string][]string) // list field -> keys to keep in each item
+
+	for _, field := range fields {
+		parent, child, isNested := strings.Cut(field, ".")
+		value := full[parent]
+		if !known[parent] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if !isNested {
+			selected[parent] = value
+			delete(nested, parent)
+			continue
+		}
+		if _, whole := selected[parent]; whole {
+			continue
+		}
+		nested[parent] = append(nested[parent], child)
+	}
+
+	for parent, keys := range nested {
+		items, ok := full[parent].([]interface{})
+		if !ok {
+			if full[parent] == nil {
+				continue
+			}
+			return nil, fmt.Errorf("field %q is not a list", parent)
+		}
+		reduced := make([]map[string]interface{}, 0, len(items))
+		for _, item := range items {
+			object, _ := item.(map[string]interface{})
+			kept := make(map[string]interface{}, len(keys))
+			for _, key := range keys {
+				if value, ok := object[key]; ok {
+					kept[key] = value
+				}
+			}
+			reduced = append(reduced, kept)
+		}
+		selected[parent] = reduced
+	}
+
+	return selected, nil
+}
+
+// jsonFieldNames returns the JSON names of a struct's fields, including ones
+// a particular response may leave out through omitempty
+func jsonFieldNames(v interface{}) map[string]bool {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	names := make(map[string]bool)
+	if t.Kind() != reflect.Struct {
+		return names
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// resyncUser handles POST /resync/{userID}, the recovery path when the app
+// and the server disagree about which moves have been seen. It drops the
+// user's stored moves and any pending notification, fetches their games from
+// OGS without the cached copy, and stores every game's current position, so
+// each turn is reported as old and nothing is pushed. It returns the fresh
+// turn status.
+func (srv *Server) resyncUser(w http.ResponseWriter, r *http.Request) {
+	userIDStr := mux.Vars(r)["userID"]
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	srv.resetIdleBackoff(userIDStr)
+	srv.playerGames.Delete(userID)
+	games, err := srv.fetchActiveGames(userID)
+	srv.recordUserCheckOutcome(userIDStr, err, time.Now())
+	if errors.Is(err, errAccountGone) {
+		http.Error(w, "OGS account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resyncing user %d: %v", userID, err)
+		http.Error(w, "Failed to fetch turn status", http.StatusServiceUnavailable)
+		return
+	}
+
+	shard := srv.storage.shard(userIDStr)
+	shard.mu.Lock()
+	shard.resetMoveState(userIDStr, games)
+	shard.mu.Unlock()
+
+	srv.recordActiveGameCount(userIDStr, len(games), time.Now())
+	status, _ := srv.classifyTurns(userID, games)
+	addTurnUrgency(status, userID, games, srv.ogsNow(time.Now()))
+	srv.recordCheckResult(userIDStr, status, nil)
+	srv.recordTurnSummary(userIDStr, status, games, time.Now())
+
+	srv.saveStorage()
+	log.Printf("Resynced user %d: %d active games, stored as seen", userID, len(games))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// resetMoveState replaces the user's stored moves with the current position
+// of each game and drops their pending notification. Labels, mutes and
+// notification counts are kept. Callers must hold mu for writing.
+func (s *storageShard) resetMoveState(userID string, games []Game) {
+	for gameID, record := range s.games[userID] {
+		record.LastMove, record.MoveNumber = 0, 0
+		s.deleteGameIfEmpty(userID, gameID)
+	}
+	for _, game := range games {
+		record := s.gameRecord(userID, game.ID)
+		record.LastMove = game.JSON.Clock.LastMove
+		record.MoveNumber = game.MoveNumber()
+	}
+	delete(s.pendingNotifications, userID)
+}
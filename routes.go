@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// newRouter builds the server's routes in groups. Every route gets logging
+// and panic recovery; each group adds the checks its routes share, so a new
+// endpoint picks them up by being registered in the right group.
+//
+//   - public: device registration and health, rate limited
+//   - user: routes scoped to one {userID}, rate limited, ID-validated and
+//     only served to the user
+//   - userscript: polled cross-origin by browser userscripts, CORS enabled
+//   - webpush: browser push subscriptions, CORS enabled, ID-validated and
+//     only served to the user
+//   - admin: under /admin, behind ADMIN_TOKEN
+//   - internal: operator tooling like metrics scrapes, and webhooks that
+//     carry their own signatures, not rate limited
+//
+// Public, user and userscript routes act for the tenant whose X-API-Key is
+// given, if any, and only reach that tenant's users.
+func (srv *Server) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(recoveryMiddleware, loggingMiddleware)
+
+	internal := r.NewRoute().Subrouter()
+	internal.HandleFunc("/metrics", srv.getMetrics).Methods("GET").Name("metrics")
+	internal.HandleFunc("/slo/alert-rules", getAlertRules).Methods("GET").Name("alert-rules")
+	internal.HandleFunc("/app-store/notifications", srv.receiveAppStoreNotification).Methods("POST").Name("app-store-notifications")
+	internal.HandleFunc("/telegram/webhook", srv.receiveTelegramUpdate).Methods("POST").Name("telegram-webhook")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminMiddleware)
+	admin.HandleFunc("/view-as/{userID}", srv.viewAsUser).Methods("GET").Name("admin-view-as")
+	admin.HandleFunc("/decisions", srv.getDecisionTraces).Methods("GET").Name("admin-decisions")
+	admin.HandleFunc("/funnel", srv.getFunnelStats).Methods("GET").Name("admin-funnel")
+	admin.HandleFunc("/cycles", srv.getCycles).Methods("GET").Name("admin-cycles")
+	admin.HandleFunc("/renotify", srv.renotifyUsers).Methods("POST").Name("admin-renotify")
+	admin.HandleFunc("/export", srv.exportState).Methods("GET").Name("admin-export")
+	admin.HandleFunc("/import", srv.importState).Methods("POST").Name("admin-import")
+	admin.HandleFunc("/tenants", srv.createTenant).Methods("POST").Name("admin-tenant-create")
+	admin.HandleFunc("/tenants", srv.listTenants).Methods("GET").Name("admin-tenants")
+	admin.HandleFunc("/tenants/{tenantID}/usage", srv.getTenantUsage).Methods("GET").Name("admin-tenant-usage")
+	admin.HandleFunc("/entitlements", srv.listEntitlements).Methods("GET").Name("admin-entitlements")
+	admin.HandleFunc("/entitlements/{userID}", srv.setEntitlementOverride).Methods("PUT").Name("admin-entitlement-set")
+	admin.HandleFunc("/entitlements/{userID}", srv.deleteEntitlementOverride).Methods("DELETE").Name("admin-entitlement-delete")
+	admin.HandleFunc("/discord-clubs", srv.listDiscordClubs).Methods("GET").Name("admin-discord-clubs")
+	admin.HandleFunc("/discord-clubs/{clubID:[a-z0-9-]{1,64}}", srv.setDiscordClub).Methods("PUT").Name("admin-discord-club-set")
+	admin.HandleFunc("/discord-clubs/{clubID:[a-z0-9-]{1,64}}", srv.deleteDiscordClub).Methods("DELETE").Name("admin-discord-club-delete")
+
+	userscript := r.PathPrefix("/userscript").Subrouter()
+	userscript.Use(srv.rateLimitMiddleware, corsMiddleware, userMiddleware, srv.tenantMiddleware)
+	userscript.HandleFunc("/token", srv.createUserscriptToken).Methods("POST").Name("userscript-token")
+	userscript.HandleFunc("/{userID}/turns", srv.getTurnSummary).Methods("GET", "OPTIONS").Name("userscript-turns")
+
+	webpush := r.PathPrefix("/webpush").Subrouter()
+	webpush.Use(srv.rateLimitMiddleware, webPushCORSMiddleware, userMiddleware, srv.tenantMiddleware, srv.userAuthMiddleware)
+	webpush.HandleFunc("/key", srv.getVAPIDPublicKey).Methods("GET", "OPTIONS").Name("webpush-key")
+	webpush.HandleFunc("/{userID}", srv.setWebPushSubscription).Methods("PUT", "OPTIONS").Name("webpush-set")
+	webpush.HandleFunc("/{userID}", srv.deleteWebPushSubscription).Methods("DELETE").Name("webpush-delete")
+
+	public := r.NewRoute().Subrouter()
+	public.Use(srv.rateLimitMiddleware, srv.tenantMiddleware)
+	public.HandleFunc("/health", srv.healthCheck).Methods("GET").Name("health")
+	public.HandleFunc("/status", srv.getStatus).Methods("GET").Name("status")
+	public.HandleFunc("/register", srv.registerDevice).Methods("POST").Name("register")
+	public.HandleFunc("/register/validate", srv.validateDeviceToken).Methods("POST").Name("register-validate")
+	public.HandleFunc("/users-by-token/{deviceToken}", srv.getUsersByDeviceToken).Methods("GET").Name("users-by-token")
+	public.HandleFunc("/board/{gameID:[0-9]+}.png", srv.getBoardImage).Methods("GET").Name("board-image")
+	public.HandleFunc("/preview-notification", previewNotification).Methods("POST").Name("preview-notification")
+	public.HandleFunc("/check-game", srv.checkGame).Methods("POST").Name("check-game")
+	public.HandleFunc("/tenant/usage", srv.getTenantUsage).Methods("GET").Name("tenant-usage")
+
+	user := r.NewRoute().Subrouter()
+	user.Use(srv.rateLimitMiddleware, userMiddleware, srv.tenantMiddleware, srv.userAuthMiddleware)
+	user.HandleFunc("/check/{userID}", srv.checkUserTurn).Methods("GET").Name("check")
+	user.HandleFunc("/resync/{userID}", srv.resyncUser).Methods("POST").Name("resync")
+	user.HandleFunc("/diagnostics/{userID}", srv.getUserDiagnostics).Methods("GET").Name("diagnostics")
+	user.HandleFunc("/preferences/{userID}", srv.getPreferences).Methods("GET").Name("preferences-get")
+	user.HandleFunc("/preferences/{userID}", srv.updatePreferences).Methods("PUT").Name("preferences-update")
+	user.HandleFunc("/events/{userID}", srv.streamPresenceEvents).Methods("GET").Name("events")
+	user.HandleFunc("/settings/{userID}", srv.getSettings).Methods("GET").Name("settings-get")
+	user.HandleFunc("/settings/{userID}", srv.updateSettings).Methods("PUT").Name("settings-update")
+	user.HandleFunc("/notifications/{userID}", srv.getNotificationsEnabled).Methods("GET").Name("notifications-get")
+	user.HandleFunc("/notifications/{userID}", srv.setNotificationsEnabled).Methods("PUT").Name("notifications-set")
+	user.HandleFunc("/ntfy/{userID}", srv.setNtfyTopic).Methods("PUT").Name("ntfy-set")
+	user.HandleFunc("/ntfy/{userID}", srv.deleteNtfyTopic).Methods("DELETE").Name("ntfy-delete")
+	user.HandleFunc("/telegram/{userID}", srv.setTelegramChat).Methods("PUT").Name("telegram-set")
+	user.HandleFunc("/telegram/{userID}", srv.deleteTelegramChat).Methods("DELETE").Name("telegram-delete")
+	user.HandleFunc("/discord/{userID}", srv.setDiscordWebhook).Methods("PUT").Name("discord-set")
+	user.HandleFunc("/discord/{userID}", srv.deleteDiscordWebhook).Methods("DELETE").Name("discord-delete")
+	user.HandleFunc("/webhook/{userID}", srv.setUserWebhook).Methods("PUT").Name("webhook-set")
+	user.HandleFunc("/webhook/{userID}", srv.deleteUserWebhook).Methods("DELETE").Name("webhook-delete")
+	user.HandleFunc("/slack/{userID}", srv.setSlackDestination).Methods("PUT").Name("slack-set")
+	user.HandleFunc("/slack/{userID}", srv.deleteSlackDestination).Methods("DELETE").Name("slack-delete")
+	user.HandleFunc("/snooze/{userID}", srv.getSnooze).Methods("GET").Name("snooze-get")
+	user.HandleFunc("/snooze/{userID}", srv.snoozeNotifications).Methods("POST").Name("snooze")
+	user.HandleFunc("/snooze/{userID}", srv.cancelSnooze).Methods("DELETE").Name("snooze-cancel")
+	user.HandleFunc("/snooze/{userID}/{gameID:[0-9]+}", srv.snoozeNotifications).Methods("POST").Name("snooze-game")
+	user.HandleFunc("/snooze/{userID}/{gameID:[0-9]+}", srv.cancelSnooze).Methods("DELETE").Name("snooze-game-cancel")
+	user.HandleFunc("/ack/{userID}", srv.acknowledgeNotification).Methods("POST").Name("ack")
+	user.HandleFunc("/heartbeat/{userID}", srv.heartbeat).Methods("POST").Name("heartbeat")
+	user.HandleFunc("/challenges/{userID}", srv.setChallengeToken).Methods("PUT").Name("challenges-set")
+	user.HandleFunc("/challenges/{userID}", srv.deleteChallengeToken).Methods("DELETE").Name("challenges-delete")
+	user.HandleFunc("/labels/{userID}", srv.getGameLabels).Methods("GET").Name("labels-list")
+	user.HandleFunc("/labels/{userID}/{gameID:[0-9]+}", srv.setGameLabels).Methods("POST").Name("game-labels-set")
+	user.HandleFunc("/opponent-rules/{userID}", srv.getOpponentRules).Methods("GET").Name("opponent-rules-list")
+	user.HandleFunc("/opponent-rules/{userID}/{opponentID}", srv.setOpponentRule).Methods("PUT").Name("opponent-rule-set")
+	user.HandleFunc("/opponent-rules/{userID}/{opponentID}", srv.deleteOpponentRule).Methods("DELETE").Name("opponent-rule-delete")
+	user.HandleFunc("/features/{userID}", srv.getFeatures).Methods("GET").Name("features")
+	user.HandleFunc("/app-account-token/{userID}", srv.getAppAccountToken).Methods("GET").Name("app-account-token")
+	user.HandleFunc("/reminders/{userID}", srv.listReminders).Methods("GET").Name("reminders-list")
+	user.HandleFunc("/reminders/{userID}", srv.createReminder).Methods("POST").Name("reminder-create")
+	user.HandleFunc("/reminders/{userID}/{reminderID}", srv.deleteReminder).Methods("DELETE").Name("reminder-delete")
+	user.HandleFunc("/live-activities/{userID}/{gameID:[0-9]+}", srv.setLiveActivityToken).Methods("PUT").Name("live-activity-set")
+	user.HandleFunc("/live-activities/{userID}/{gameID:[0-9]+}", srv.deleteLiveActivityToken).Methods("DELETE").Name("live-activity-delete")
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not found", http.StatusNotFound)
+	})
+
+	return r
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Delivery channels a route can use
+const (
+	channelAPNs     = "apns"
+	channelNtfy     = "ntfy"
+	channelWebPush  = "webpush"
+	channelTelegram = "telegram"
+	channelDiscord  = "discord"
+	channelWebhook  = "webhook"
+	channelSlack    = "slack"
+)
+
+// eventTurn is the consolidated turn notification; the other event types are
+// the actions of single pushes
+const eventTurn = "turn"
+
+// routingEvents are the event types a route can be configured for
+var routingEvents = map[string]bool{
+	eventTurn:        true,
+	"final_period":   true,
+	"clock_resumed":  true,
+	"game_result":    true,
+	"reminder":       true,
+	"checks_overdue": true,
+	"account_gone":   true,
+	eventChat:        true,
+	eventChallenge:   true,
+	eventLowClock:    true,
+}
+
+// RouteRule decides how one event type is delivered: on every channel in the
+// list, or with fallback, on the first one that accepts it. A throttle sets
+// the minimum time between deliveries of the event to a user.
+type RouteRule struct {
+	Channels        []string `yaml:"channels" json:"channels"`
+	Fallback        bool     `yaml:"fallback" json:"fallback,omitempty"`
+	ThrottleMinutes int      `yaml:"throttle_minutes" json:"throttle_minutes,omitempty"`
+}
+
+// defaultRoute sends everywhere the user can receive, unthrottled
+var defaultRoute = RouteRule{Channels: []string{channelAPNs, channelNtfy, channelWebPush, channelTelegram, channelDiscord, channelWebhook, channelSlack}}
+
+// RoutingConfig is the operator's routing file. Events without a rule use
+// the default rule.
+type RoutingConfig struct {
+	Default *RouteRule           `yaml:"default"`
+	Events  map[string]RouteRule `yaml:"events"`
+}
+
+// validate reports the first problem with a rule, or ""
+func (rule RouteRule) validate(event string) string {
+	if !routingEvents[event] {
+		return fmt.Sprintf("unknown event type %q", event)
+	}
+	if len(rule.Channels) == 0 {
+		return fmt.Sprintf("%s: channels must not be empty", event)
+	}
+	seen := make(map[string]bool)
+	for _, channel := range rule.Channels {
+		if _, registered := channelSenders[channel]; channel != channelAPNs && !registered {
+			return fmt.Sprintf("%s: channel must be apns, ntfy, webpush, telegram, discord, webhook or slack, got %q", event, channel)
+		}
+		if seen[channel] {
+			return fmt.Sprintf("%s: channel %s is listed twice", event, channel)
+		}
+		seen[channel] = true
+	}
+	if rule.ThrottleMinutes < 0 || rule.ThrottleMinutes > 24*60 {
+		return fmt.Sprintf("%s: throttle_minutes must be between 0 and 1440", event)
+	}
+	return ""
+}
+
+// loadRoutingConfig reads the YAML routing file at path. An empty path means
+// the built-in routing.
+func loadRoutingConfig(path string) (RoutingConfig, error) {
+	var config RoutingConfig
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid routing config %s: %v", path, err)
+	}
+
+	if config.Default != nil {
+		if problem := config.Default.validate(eventTurn); problem != "" {
+			return config, fmt.Errorf("routing config %s: default %s", path, problem)
+		}
+	}
+	for event, rule := range config.Events {
+		if problem := rule.validate(event); problem != "" {
+			return config, fmt.Errorf("routing config %s: %s", path, problem)
+		}
+	}
+	return config, nil
+}
+
+// routeFor returns the rule for an event: the user's own, then the
+// operator's, then the default
+func (srv *Server) routeFor(userID, event string) RouteRule {
+	if rule, exists := srv.preferencesFor(userID).Routing[event]; exists {
+		return rule
+	}
+	if rule, exists := srv.routing.Events[event]; exists {
+		return rule
+	}
+	if srv.routing.Default != nil {
+		return *srv.routing.Default
+	}
+	return defaultRoute
+}
+
+// routeAllows reports whether the rule's throttle lets the event be delivered
+// to the user now
+func (srv *Server) routeAllows(userID, event string, rule RouteRule, now time.Time) bool {
+	if rule.ThrottleMinutes <= 0 {
+		return true
+	}
+	last, sent := srv.routeThrottles.Load(userID + "/" + event)
+	return !sent || now.Sub(last) >= time.Duration(rule.ThrottleMinutes)*time.Minute
+}
+
+// recordRouteDelivery starts the throttle window for a delivered event
+func (srv *Server) recordRouteDelivery(userID, event string, rule RouteRule, now time.Time) {
+	if rule.ThrottleMinutes <= 0 {
+		return
+	}
+	srv.routeThrottles.Store(userID+"/"+event, now)
+}
+
+// deliverOnRoute sends through each of the rule's channels the user has, in
+// order, using send. With fallback it stops at the first delivery. It
+// reports whether any channel delivered, and the last failure otherwise.
+func deliverOnRoute(rule RouteRule, available map[string]bool, send func(channel string) error) (bool, error) {
+	delivered := false
+	var lastErr error
+	for _, channel := range rule.Channels {
+		if !available[channel] {
+			continue
+		}
+		if err := send(channel); err != nil {
+			lastErr = err
+			continue
+		}
+		delivered = true
+		if rule.Fallback {
+			break
+		}
+	}
+	if !delivered && lastErr == nil {
+		lastErr = fmt.Errorf("no channel on the route is set up")
+	}
+	return delivered, lastErr
+}
+
+// channelMessage is a notification as the channels besides APNs send it
+type channelMessage struct {
+	Event   string // the routing event: eventTurn or a push action
+	Action  string // what a browser notification does when clicked
+	Title   string
+	Body    string
+	URL     string
+	GameID  int
+	GameIDs []int // for turns, every game with a new turn
+}
+
+// channelSender is a delivery channel besides APNs, whose notifications turn
+// pushes and single pushes build differently. lookup binds a send to the
+// user's destination, reporting whether they have the channel set up.
+type channelSender struct {
+	name    string // as logged
+	failure string // recorded when a turn push fails on the channel
+	lookup  func(srv *Server, userID, event string) (func(channelMessage) error, bool)
+}
+
+// channelSenders are the channels besides APNs, shared by turn pushes and
+// single pushes
+var channelSenders = map[string]channelSender{
+	channelNtfy: {name: "ntfy", failure: "ntfy error", lookup: func(srv *Server, userID, _ string) (func(channelMessage) error, bool) {
+		topicURL, ok := srv.ntfyTopicFor(userID)
+		return func(m channelMessage) error { return publishNtfy(topicURL, m.Title, m.Body, m.URL) }, ok
+	}},
+	channelWebPush: {name: "web push", failure: "web push error", lookup: func(srv *Server, userID, _ string) (func(channelMessage) error, bool) {
+		subscription, ok := srv.webPushSubscriptionFor(userID)
+		return func(m channelMessage) error {
+			return srv.sendWebPush(userID, subscription, WebPushMessage{Title: m.Title, Body: m.Body, URL: m.URL, Action: m.Action, GameID: m.GameID})
+		}, ok
+	}},
+	channelTelegram: {name: "Telegram", failure: "telegram error", lookup: func(srv *Server, userID, _ string) (func(channelMessage) error, bool) {
+		chatID, ok := srv.telegramChatFor(userID)
+		return func(m channelMessage) error { return srv.sendTelegram(userID, chatID, m.Title, m.Body, m.URL) }, ok
+	}},
+	channelDiscord: {name: "Discord", failure: "discord error", lookup: func(srv *Server, userID, event string) (func(channelMessage) error, bool) {
+		targets := srv.discordTargetsFor(userID, event)
+		return func(m channelMessage) error { return srv.sendDiscord(userID, targets, m.Title, m.Body, m.URL) }, len(targets) > 0
+	}},
+	channelWebhook: {name: "webhook", failure: "webhook error", lookup: func(srv *Server, userID, _ string) (func(channelMessage) error, bool) {
+		webhook, ok := srv.userWebhookFor(userID)
+		return func(m channelMessage) error {
+			return srv.sendUserWebhook(userID, webhook, WebhookEvent{Event: m.Event, Title: m.Title, Body: m.Body, URL: m.URL, GameID: m.GameID, GameIDs: m.GameIDs})
+		}, ok
+	}},
+	channelSlack: {name: "Slack", failure: "slack error", lookup: func(srv *Server, userID, _ string) (func(channelMessage) error, bool) {
+		destination, ok := srv.slackDestinationFor(userID)
+		return func(m channelMessage) error { return srv.sendSlack(userID, destination, m.Title, m.Body, m.URL) }, ok
+	}},
+}
+
+// userChannels are a user's channels besides APNs, bound to their destinations
+type userChannels map[string]func(channelMessage) error
+
+// userChannelsFor looks up the channels besides APNs the user has set up for
+// the event
+func (srv *Server) userChannelsFor(userID, event string) userChannels {
+	channels := make(userChannels)
+	for channel, sender := range channelSenders {
+		if send, ok := sender.lookup(srv, userID, event); ok {
+			channels[channel] = send
+		}
+	}
+	return channels
+}
+
+// available reports which channels the user can be reached on, for
+// deliverOnRoute
+func (c userChannels) available(hasAPNs bool) map[string]bool {
+	available := map[string]bool{channelAPNs: hasAPNs}
+	for channel := range c {
+		available[channel] = true
+	}
+	return available
+}
+
+// send delivers a message on one of the channels, logging the outcome
+func (c userChannels) send(userID, channel string, message channelMessage) error {
+	name := channelSenders[channel].name
+	if err := c[channel](message); err != nil {
+		log.Printf("%s %s notification failed for user %s: %v", message.Event, name, userID, err)
+		return err
+	}
+	log.Printf("%s %s notification sent to user %s", message.Event, name, userID)
+	return nil
+}
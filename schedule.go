@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // embed zone data so minimal containers can resolve user timezones
+)
+
+// Scheduling primitives shared by features that act on a user's local time:
+// the daily notification budget and reminders.
+
+// DailyTime is a wall-clock time of day in a user's timezone
+type DailyTime struct {
+	Hour   int
+	Minute int
+}
+
+// parseDailyTime parses "HH:MM" (24 hour)
+func parseDailyTime(value string) (DailyTime, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return DailyTime{}, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return DailyTime{Hour: parsed.Hour(), Minute: parsed.Minute()}, nil
+}
+
+func (d DailyTime) String() string {
+	return fmt.Sprintf("%02d:%02d", d.Hour, d.Minute)
+}
+
+func (d DailyTime) minutes() int {
+	return d.Hour*60 + d.Minute
+}
+
+// loadTimezone validates an IANA timezone name. Empty means UTC.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// userLocation returns the user's configured timezone, or UTC
+func (srv *Server) userLocation(userID string) *time.Location {
+	loc, err := loadTimezone(srv.preferencesFor(userID).Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// localDayKey identifies the calendar day of t in loc as YYYY-MM-DD
+func localDayKey(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02")
+}
+
+// nextOccurrence returns the first instant strictly after `after` at which the
+// wall clock in loc reads at. If weekdays is non-empty, only those days count.
+//
+// Across DST transitions the wall-clock time is kept: 09:00 stays 09:00 local.
+// A time that doesn't exist on a spring-forward day (e.g. 02:30) is moved
+// forward by the length of the gap.
+func nextOccurrence(after time.Time, loc *time.Location, at DailyTime, weekdays ...time.Weekday) time.Time {
+	local := after.In(loc)
+
+	allowed := make(map[time.Weekday]bool, len(weekdays))
+	for _, day := range weekdays {
+		allowed[day] = true
+	}
+
+	// Two weeks covers every weekday even if today's slot has already passed
+	for offset := 0; offset <= 14; offset++ {
+		candidate := wallClockTime(local.Year(), local.Month(), local.Day()+offset, at, loc)
+		if !candidate.After(after) {
+			continue
+		}
+		if len(allowed) > 0 && !allowed[candidate.Weekday()] {
+			continue
+		}
+		return candidate
+	}
+
+	// Unreachable for valid input, but never return a time in the past
+	return after.Add(24 * time.Hour)
+}
+
+// wallClockTime builds the instant at which loc's clock reads at on the given
+// day. time.Date doesn't define which side of a DST gap a nonexistent time
+// lands on, so such times are resolved forward past the gap.
+func wallClockTime(year int, month time.Month, day int, at DailyTime, loc *time.Location) time.Time {
+	candidate := time.Date(year, month, day, at.Hour, at.Minute, 0, 0, loc)
+	if candidate.Hour() == at.Hour && candidate.Minute() == at.Minute {
+		return candidate
+	}
+
+	// Reading the wall time with the pre-transition offset lands the same
+	// distance past the transition as the requested time was into the gap
+	_, offsetBefore := candidate.Add(-3 * time.Hour).Zone()
+	return time.Date(year, month, day, at.Hour, at.Minute, 0, 0, time.FixedZone("", offsetBefore)).In(loc)
+}
+
+// TimeWindow is a daily local time range. End before Start wraps past
+// midnight, e.g. 22:00-07:00.
+type TimeWindow struct {
+	Start DailyTime
+	End   DailyTime
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM"
+func parseTimeWindow(value string) (TimeWindow, error) {
+	if len(value) != len("00:00-00:00") || value[5] != '-' {
+		return TimeWindow{}, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", value)
+	}
+	start, err := parseDailyTime(value[:5])
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	end, err := parseDailyTime(value[6:])
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	return TimeWindow{Start: start, End: end}, nil
+}
+
+func (w TimeWindow) String() string {
+	return w.Start.String() + "-" + w.End.String()
+}
+
+// Contains reports whether t falls inside the window in loc. The start is
+// inclusive and the end exclusive; an empty window (start == end) contains
+// nothing.
+func (w TimeWindow) Contains(t time.Time, loc *time.Location) bool {
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	start, end := w.Start.minutes(), w.End.minutes()
+
+	if start == end {
+		return false
+	}
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// NextEnd returns when the window containing t ends. Only meaningful when
+// Contains(t, loc) is true.
+func (w TimeWindow) NextEnd(t time.Time, loc *time.Location) time.Time {
+	return nextOccurrence(t, loc, w.End)
+}
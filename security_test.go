@@ -2,28 +2,36 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // Test helpers
-func setupTestStorage() {
-	storage = &MoveStorage{
-		moves:                make(map[string]map[int]int64),
-		deviceTokens:         make(map[string]string),
-		lastNotificationTime: make(map[string]int64),
-	}
-}
 
-func cleanupTestStorage() {
-	os.Remove("moves.json")
+// newTestServer returns a server of its own for a test, saving to a file in
+// the test's temporary directory
+func newTestServer(tb testing.TB) *Server {
+	return newServer(fileBackend{path: filepath.Join(tb.TempDir(), "moves.json")}, nil)
 }
 
 // Valid test device token (64 hex chars)
@@ -33,8 +41,8 @@ const testDeviceToken = "1234567890abcdef1234567890abcdef1234567890abcdef1234567
 
 // Test: Input validation and sanitization
 func TestInputValidation_SQLInjection(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	tests := []struct {
 		name     string
@@ -48,7 +56,7 @@ func TestInputValidation_SQLInjection(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/check/{userID}", checkUserTurn).Methods("GET")
+	r.HandleFunc("/check/{userID}", srv.checkUserTurn).Methods("GET")
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,8 +75,8 @@ func TestInputValidation_SQLInjection(t *testing.T) {
 
 // Test: Error response sanitization
 func TestErrorResponseSanitization(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	tests := []struct {
 		name       string
@@ -101,8 +109,8 @@ func TestErrorResponseSanitization(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/check/{userID}", checkUserTurn).Methods("GET")
-	r.HandleFunc("/register", registerDevice).Methods("POST")
+	r.HandleFunc("/check/{userID}", srv.checkUserTurn).Methods("GET")
+	r.HandleFunc("/register", srv.registerDevice).Methods("POST")
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -127,8 +135,8 @@ func TestErrorResponseSanitization(t *testing.T) {
 
 // Test: XSS prevention
 func TestXSSPrevention(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	xssPayloads := []struct {
 		name    string
@@ -141,7 +149,7 @@ func TestXSSPrevention(t *testing.T) {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/register", registerDevice).Methods("POST")
+	r.HandleFunc("/register", srv.registerDevice).Methods("POST")
 
 	for _, xss := range xssPayloads {
 		t.Run(xss.name, func(t *testing.T) {
@@ -163,4 +171,450 @@ func TestXSSPrevention(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+// Test: Admin endpoints require the admin token
+func TestAdminAuthentication(t *testing.T) {
+	srv := newTestServer(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/view-as/{userID}", requireAdmin(srv.viewAsUser)).Methods("GET")
+
+	request := func(authorization string) int {
+		req := httptest.NewRequest("GET", "/admin/view-as/invalid", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Disabled without ADMIN_TOKEN
+	t.Setenv("ADMIN_TOKEN", "")
+	if code := request("Bearer anything"); code != http.StatusNotFound {
+		t.Errorf("Expected admin API to be disabled without ADMIN_TOKEN, got %d", code)
+	}
+
+	t.Setenv("ADMIN_TOKEN", "secret-admin-token")
+
+	if code := request(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", code)
+	}
+	if code := request("Bearer wrong-token"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", code)
+	}
+	// Valid token reaches the handler, which rejects the invalid user ID
+	if code := request("Bearer secret-admin-token"); code != http.StatusBadRequest {
+		t.Errorf("Expected handler to run with valid token, got %d", code)
+	}
+}
+
+// Test: Tenant API keys only reach their own users, within their quotas
+func TestTenantIsolationAndQuotas(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	router := srv.newRouter()
+
+	createTenant := func(body string) string {
+		w := httptest.NewRecorder()
+		srv.createTenant(w, httptest.NewRequest("POST", "/admin/tenants", strings.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected tenant to be created, got %d", w.Code)
+		}
+		var created struct {
+			APIKey string `json:"api_key"`
+		}
+		json.NewDecoder(w.Body).Decode(&created)
+		return created.APIKey
+	}
+	acme := createTenant(`{"name": "Acme", "max_users": 1, "max_notifications_per_day": 2}`)
+	other := createTenant(`{"name": "Other"}`)
+
+	request := func(method, path, apiKey, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	register := func(userID, apiKey string) int {
+		return request("POST", "/register", apiKey, `{"user_id": "`+userID+`", "device_token": "`+testDeviceToken+`"}`)
+	}
+
+	if code := register("111", acme); code != http.StatusOK {
+		t.Fatalf("Expected registration with a tenant key to succeed, got %d", code)
+	}
+	if code := register("222", acme); code != http.StatusForbidden {
+		t.Errorf("Expected the tenant's user limit to be enforced, got %d", code)
+	}
+	if code := register("111", other); code != http.StatusForbidden {
+		t.Errorf("Expected another tenant not to claim the user, got %d", code)
+	}
+	if code := register("333", "not-a-key"); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown API key to be rejected, got %d", code)
+	}
+
+	if code := request("GET", "/preferences/111", acme, ""); code != http.StatusOK {
+		t.Errorf("Expected the tenant to reach its user, got %d", code)
+	}
+	for _, apiKey := range []string{other, ""} {
+		if code := request("GET", "/preferences/111", apiKey, ""); code != http.StatusNotFound {
+			t.Errorf("Expected the user to be hidden from other tenants, got %d", code)
+		}
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if srv.tenantQuotaReached("111", now) {
+			t.Fatalf("Expected quota to remain after %d notifications", i)
+		}
+		srv.meterTenantNotification("111", now)
+	}
+	if !srv.tenantQuotaReached("111", now) {
+		t.Error("Expected the daily notification quota to be reached")
+	}
+	if srv.tenantQuotaReached("111", now.Add(24*time.Hour)) {
+		t.Error("Expected the quota to reset the next day")
+	}
+
+	req := httptest.NewRequest("GET", "/tenant/usage", nil)
+	req.Header.Set("X-API-Key", acme)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var usage TenantUsage
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil || usage.Users != 1 || usage.NotificationsToday != 2 || len(usage.Days) != 1 {
+		t.Errorf("Expected metered usage, got %+v (%v)", usage, err)
+	}
+	if code := request("GET", "/tenant/usage", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected usage to require an API key, got %d", code)
+	}
+}
+
+func TestRegistrationAccountLink(t *testing.T) {
+	srv := newTestServer(t)
+
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer token-111":
+			w.Write([]byte(`{"id": 111, "username": "owner"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsMeURL = url }(ogsMeURL)
+	ogsMeURL = ogs.URL
+
+	register := func(userID, deviceToken, accessToken, proof string) int {
+		body := `{"user_id": "` + userID + `", "device_token": "` + deviceToken + `", "ogs_access_token": "` + accessToken + `"}`
+		req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+		if proof != "" {
+			req.Header.Set(deviceTokenHeader, proof)
+		}
+		w := httptest.NewRecorder()
+		srv.registerDevice(w, req)
+		return w.Code
+	}
+	otherDevice := strings.Repeat("f", 64)
+
+	if code := register("222", testDeviceToken, "token-111", ""); code != http.StatusForbidden {
+		t.Errorf("Expected a token for another player to be refused, got %d", code)
+	}
+	if code := register("111", testDeviceToken, "stolen", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected an invalid token to be refused, got %d", code)
+	}
+	if code := register("333", testDeviceToken, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a token to be required by default, got %d", code)
+	}
+	if code := register("111", testDeviceToken, "token-111", ""); code != http.StatusOK {
+		t.Fatalf("Expected the owner's token to link the account, got %d", code)
+	}
+	if _, linked := srv.storage.shard("111").linkedAccounts["111"]; !linked {
+		t.Error("Expected the account to be recorded as linked")
+	}
+
+	// Without a token, only the registered device can register again or move
+	// the user to a new one
+	if code := register("111", otherDevice, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unverified registration of another device to be refused, got %d", code)
+	}
+	if code := register("111", otherDevice, "", otherDevice); code != http.StatusUnauthorized {
+		t.Errorf("Expected proof with another device token to be refused, got %d", code)
+	}
+	if code := register("111", testDeviceToken, "", ""); code != http.StatusOK {
+		t.Errorf("Expected the registered device to register again, got %d", code)
+	}
+	if code := register("111", otherDevice, "", testDeviceToken); code != http.StatusOK {
+		t.Errorf("Expected the registered device to move the user to a new one, got %d", code)
+	}
+	if srv.storage.shard("111").deviceTokens["111"] != otherDevice {
+		t.Error("Expected the new device to be registered")
+	}
+
+	// With links not required, a new account registers without a token, but
+	// can't take over a registered device
+	t.Setenv("REQUIRE_OGS_ACCOUNT_LINK", "false")
+	if code := register("333", testDeviceToken, "", ""); code != http.StatusOK {
+		t.Errorf("Expected an unlinked account to register without a token, got %d", code)
+	}
+	if code := register("333", otherDevice, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unverified registration not to replace the device, got %d", code)
+	}
+	if srv.storage.shard("333").deviceTokens["333"] != testDeviceToken {
+		t.Error("Expected the first device to stay registered")
+	}
+	if code := register("111", testDeviceToken, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a linked account to still need proof, got %d", code)
+	}
+}
+
+// fakeOGSAccount points ogsMeURL at a fake OGS for the duration of the test
+// and returns an access token for userID. Its tokens are "token-" and the
+// player's ID.
+func fakeOGSAccount(t *testing.T, userID string) string {
+	t.Helper()
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		playerID, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer token-")
+		if _, err := strconv.Atoi(playerID); !ok || err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id": ` + playerID + `}`))
+	}))
+	original := ogsMeURL
+	ogsMeURL = ogs.URL
+	t.Cleanup(func() {
+		ogsMeURL = original
+		ogs.Close()
+	})
+	return "token-" + userID
+}
+
+// Test: Per-user routes only serve requests that prove they come from the user
+func TestUserRoutesRequireOwnership(t *testing.T) {
+	srv := newTestServer(t)
+
+	lookups := 0
+	ogs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		switch r.Header.Get("Authorization") {
+		case "Bearer token-12345":
+			w.Write([]byte(`{"id": 12345}`))
+		case "Bearer token-999":
+			w.Write([]byte(`{"id": 999}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ogs.Close()
+	defer func(url string) { ogsMeURL = url }(ogsMeURL)
+	ogsMeURL = ogs.URL
+
+	srv.limiters = newClientLimiters(1000)
+
+	srv.storage.shard("12345").setDevice("12345", testDeviceToken, "")
+	router := srv.newRouter()
+	serve := func(method, path string, header map[string]string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		req.RemoteAddr = "10.9.0.1:1234"
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Every route scoped to a user refuses requests without proof, with the
+	// wrong device token, or with another player's OGS token
+	pathVars := regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+	values := map[string]string{"userID": "12345", "gameID": "1", "opponentID": "2", "reminderID": "r1"}
+	checked := make(map[string]bool)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		if err != nil || !strings.Contains(template, "{userID}") || strings.HasPrefix(template, "/admin/") || strings.HasPrefix(template, "/userscript/") {
+			return nil
+		}
+		path := pathVars.ReplaceAllStringFunc(template, func(v string) string {
+			return values[pathVars.FindStringSubmatch(v)[1]]
+		})
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			checked[method+" "+template] = true
+			if code := serve(method, path, nil); code != http.StatusUnauthorized {
+				t.Errorf("%s %s: expected 401 without proof, got %d", method, template, code)
+			}
+			if code := serve(method, path, map[string]string{deviceTokenHeader: strings.Repeat("0", 64)}); code != http.StatusUnauthorized {
+				t.Errorf("%s %s: expected 401 with another device token, got %d", method, template, code)
+			}
+			if code := serve(method, path, map[string]string{ogsAccessTokenHeader: "token-999"}); code != http.StatusForbidden {
+				t.Errorf("%s %s: expected 403 with another player's token, got %d", method, template, code)
+			}
+		}
+		return nil
+	})
+	if len(checked) < 30 {
+		t.Errorf("Expected every per-user route to be checked, checked %d", len(checked))
+	}
+	for _, route := range []string{
+		"PUT /ntfy/{userID}", "PUT /webpush/{userID}", "DELETE /webpush/{userID}",
+		"PUT /telegram/{userID}", "PUT /discord/{userID}", "PUT /webhook/{userID}", "PUT /slack/{userID}",
+		"PUT /live-activities/{userID}/{gameID:[0-9]+}", "POST /snooze/{userID}", "DELETE /snooze/{userID}",
+		"GET /events/{userID}", "PUT /notifications/{userID}",
+	} {
+		if !checked[route] {
+			t.Errorf("Expected %s to be checked", route)
+		}
+	}
+
+	// The registered device token or the user's OGS token is let through,
+	// and the token is only looked up once
+	if code := serve("GET", "/preferences/12345", map[string]string{deviceTokenHeader: testDeviceToken}); code != http.StatusOK {
+		t.Errorf("Expected the registered device token to be accepted, got %d", code)
+	}
+	lookups = 0
+	for i := 0; i < 2; i++ {
+		if code := serve("GET", "/preferences/12345", map[string]string{ogsAccessTokenHeader: "token-12345"}); code != http.StatusOK {
+			t.Errorf("Expected the user's OGS token to be accepted, got %d", code)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected a verified token to be remembered, got %d lookups", lookups)
+	}
+}
+
+// testAppleSigner issues a certificate chain shaped like Apple's and signs
+// JWS with it, so App Store notifications can be verified end to end
+type testAppleSigner struct {
+	key   *ecdsa.PrivateKey
+	chain []string // base64 DER, leaf first
+}
+
+func newTestAppleSigner(t *testing.T, rootPath string) *testAppleSigner {
+	issue := func(template, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %v", err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return key
+	}
+	ca := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+
+	rootKey, intermediateKey, leafKey := newKey(), newKey(), newKey()
+	root := issue(ca(1, "Test Root"), ca(1, "Test Root"), rootKey, rootKey)
+	intermediate := issue(ca(2, "Test Intermediate"), root, intermediateKey, rootKey)
+	leaf := issue(&x509.Certificate{
+		SerialNumber:    big.NewInt(3),
+		Subject:         pkix.Name{CommonName: "Test App Store Signing"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: appleLeafOID, Value: []byte{0x05, 0x00}}},
+	}, intermediate, leafKey, intermediateKey)
+
+	os.WriteFile(rootPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0600)
+	return &testAppleSigner{key: leafKey, chain: []string{
+		base64.StdEncoding.EncodeToString(leaf.Raw),
+		base64.StdEncoding.EncodeToString(intermediate.Raw),
+	}}
+}
+
+func (s *testAppleSigner) sign(t *testing.T, payload interface{}) string {
+	header, _ := json.Marshal(map[string]interface{}{"alg": "ES256", "x5c": s.chain})
+	body, _ := json.Marshal(payload)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAppStoreNotifications(t *testing.T) {
+	srv := newTestServer(t)
+
+	rootPath := filepath.Join(t.TempDir(), "root.pem")
+	signer := newTestAppleSigner(t, rootPath)
+	os.Setenv("APP_STORE_ROOT_CA", rootPath)
+	defer os.Unsetenv("APP_STORE_ROOT_CA")
+
+	w := httptest.NewRecorder()
+	srv.getAppAccountToken(w, mux.SetURLVars(httptest.NewRequest("GET", "/app-account-token/12345", nil), map[string]string{"userID": "12345"}))
+	var tokenResponse map[string]string
+	json.NewDecoder(w.Body).Decode(&tokenResponse)
+	accountToken := tokenResponse["app_account_token"]
+	if len(accountToken) != 36 {
+		t.Fatalf("Expected a UUID app account token, got %q", accountToken)
+	}
+
+	notify := func(signedDate int64, transaction map[string]interface{}) int {
+		payload := map[string]interface{}{
+			"notificationType": "SUBSCRIBED",
+			"notificationUUID": "test",
+			"signedDate":       signedDate,
+			"data":             map[string]interface{}{"signedTransactionInfo": signer.sign(t, transaction)},
+		}
+		body, _ := json.Marshal(map[string]string{"signedPayload": signer.sign(t, payload)})
+		w := httptest.NewRecorder()
+		srv.receiveAppStoreNotification(w, httptest.NewRequest("POST", "/app-store/notifications", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	now := time.Now()
+	expires := now.Add(30 * 24 * time.Hour).UnixMilli()
+	if code := notify(now.UnixMilli(), map[string]interface{}{"appAccountToken": accountToken, "productId": "premium.monthly", "expiresDate": expires}); code != http.StatusOK {
+		t.Fatalf("Expected the notification to be accepted, got %d", code)
+	}
+	if !srv.hasPremium("12345", now) {
+		t.Fatal("Expected the subscription to grant premium")
+	}
+	if srv.hasPremium("12345", now.Add(31*24*time.Hour)) {
+		t.Error("Expected premium to end when the subscription expires")
+	}
+
+	// An older notification arriving late doesn't undo a newer one
+	notify(now.Add(-time.Hour).UnixMilli(), map[string]interface{}{"appAccountToken": accountToken, "expiresDate": now.Add(-time.Minute).UnixMilli()})
+	if !srv.hasPremium("12345", now) {
+		t.Error("Expected an out-of-order notification to be ignored")
+	}
+
+	// A refund revokes premium
+	notify(now.Add(time.Minute).UnixMilli(), map[string]interface{}{"appAccountToken": accountToken, "expiresDate": expires, "revocationDate": now.UnixMilli()})
+	if srv.hasPremium("12345", now) {
+		t.Error("Expected a refund to revoke premium")
+	}
+
+	// A payload not signed by the trusted chain is refused
+	forged := newTestAppleSigner(t, filepath.Join(t.TempDir(), "other.pem"))
+	body, _ := json.Marshal(map[string]string{"signedPayload": forged.sign(t, map[string]interface{}{"notificationType": "SUBSCRIBED"})})
+	w = httptest.NewRecorder()
+	srv.receiveAppStoreNotification(w, httptest.NewRequest("POST", "/app-store/notifications", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a forged notification to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server holds the dependencies handlers and background jobs share: the
+// in-memory storage, the backend it's persisted to, and the APNs client,
+// along with the state that goes with them, such as the storage writer and
+// caches of OGS responses. Tests build their own with newServer instead of
+// swapping package globals.
+type Server struct {
+	storage   *MoveStorage
+	backend   StorageBackend
+	apns      *apnsPool       // nil when APNs isn't configured
+	webPush   *webPushSender  // nil unless WEB_PUSH is set
+	telegram  *telegramSender // nil unless TELEGRAM is set
+	snapshots *gcsSnapshots   // nil unless GCS_SNAPSHOT_BUCKET is set
+	partition regionPartition // which users this instance's region handles
+	routing   RoutingConfig   // the operator's ROUTING_CONFIG, if any
+	realtime  *ogsRealtime    // nil unless OGS_REALTIME is set
+	// components holds how optional components started. It's written before
+	// the HTTP listener serves and read-only after.
+	components map[string]ComponentStatus
+
+	lastSaveAt atomic.Int64 // unix time of the last successful save
+	sizeCache  storageSizeCache
+
+	writer storageWriter
+	wal    storageWAL
+	// saves serializes writes to the backend, so an older snapshot is never
+	// saved over a newer one. It's taken before any storage lock.
+	saves sync.Mutex
+
+	limiters       *clientLimiters                  // per client IP, for rateLimitMiddleware
+	verifiedTokens *syncMap[string, verifiedToken]  // each user's last OGS access token that proved ownership
+	presence       *presenceHub                     // open presence event streams
+	ogsBreaker     *circuitBreaker                  // fails OGS requests fast while OGS is down
+	playerGames    *syncMap[int, cachedPlayerGames] // players' last profiles, by player ID
+	gameStates     *syncMap[int, cachedGameState]   // games fetched this check cycle, by game ID
+	boardImages    *syncMap[int, boardImage]        // rendered board thumbnails, by game ID
+	ogsHealth      *ogsHealthTracker                // recent OGS latency and errors
+	clockSkew      *skewTracker                     // how far the server's clock is behind OGS
+	canary         *canaryState                     // the canary game and its last run
+	decisions      *decisionTraceBuffer             // recent decision traces, for admins
+	pushSLO        *sloTracker                      // push outcomes for the latency SLO
+	ogsSlots       chan struct{}                    // caps simultaneous OGS requests across the checker and all handlers
+	ogsPause       ogsPauseState                    // set while OGS has asked us to slow down
+
+	// Per-user state below is kept in memory only: after a restart every user
+	// is checked again, the first throttled event goes out and each live
+	// activity gets one update with its current state.
+	lastChecks     *syncMap[string, CheckRecord]
+	idleUsers      *syncMap[string, idleState]
+	userBackoff    *syncMap[string, userBackoff] // users whose checks are backed off
+	routeThrottles *syncMap[string, time.Time]   // userID + "/" + event -> last delivery
+	turnSummaries  *syncMap[string, TurnSummary] // polling payloads for the userscript
+	liveActivities *syncMap[string, string]      // "userID/gameID" -> last state pushed
+}
+
+// newServer returns a server with empty storage persisted to backend.
+// Backends shared between instances start applying other instances' changes
+// to it.
+func newServer(backend StorageBackend, apnsClient *apnsPool) *Server {
+	srv := &Server{
+		storage:        newMoveStorage(),
+		backend:        backend,
+		apns:           apnsClient,
+		components:     make(map[string]ComponentStatus),
+		limiters:       newClientLimiters(rateLimitPerMinute()),
+		verifiedTokens: newSyncMap[string, verifiedToken](),
+		presence:       newPresenceHub(),
+		ogsBreaker:     &circuitBreaker{},
+		playerGames:    newSyncMap[int, cachedPlayerGames](),
+		gameStates:     newSyncMap[int, cachedGameState](),
+		boardImages:    newSyncMap[int, boardImage](),
+		ogsHealth:      &ogsHealthTracker{},
+		clockSkew:      &skewTracker{},
+		canary:         &canaryState{},
+		decisions:      newDecisionTraceBuffer(decisionTraceSize()),
+		pushSLO:        newSLOTracker(),
+		ogsSlots:       make(chan struct{}, ogsMaxConcurrent()),
+		lastChecks:     newSyncMap[string, CheckRecord](),
+		idleUsers:      newSyncMap[string, idleState](),
+		userBackoff:    newSyncMap[string, userBackoff](),
+		routeThrottles: newSyncMap[string, time.Time](),
+		turnSummaries:  newSyncMap[string, TurnSummary](),
+		liveActivities: newSyncMap[string, string](),
+	}
+	if subscriber, ok := backend.(changeSubscriber); ok {
+		go subscriber.subscribe(srv)
+	}
+	return srv
+}
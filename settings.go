@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UserSettings combines everything a user can configure into one document, so
+// a settings screen can load and save it in a single request. Version
+// increases with every change, through this endpoint or the individual ones.
+//
+// The browser, Telegram, Discord, webhook and Slack channels and the snooze
+// are shown but read-only: each is set through its own endpoint, which
+// checks the destination with a test message or, for a webhook, returns the
+// signing secret once.
+type UserSettings struct {
+	Version              int  `json:"version"`
+	NotificationsEnabled bool `json:"notifications_enabled"`
+	// DeviceRegistered is read-only; send DeviceToken to register a device
+	DeviceRegistered bool            `json:"device_registered"`
+	DeviceToken      string          `json:"device_token,omitempty"`
+	APNsEnvironment  string          `json:"apns_environment,omitempty"` // sent with device_token, as with /register
+	OGSAccessToken   string          `json:"ogs_access_token,omitempty"` // links the account, as with /register
+	NtfyTopic        string          `json:"ntfy_topic"`
+	Preferences      UserPreferences `json:"preferences"`
+
+	WebPushSubscribed bool    `json:"web_push_subscribed"`
+	TelegramLinked    bool    `json:"telegram_linked"`
+	DiscordWebhookSet bool    `json:"discord_webhook_set"`
+	WebhookURL        string  `json:"webhook_url,omitempty"` // never the secret
+	SlackConnected    bool    `json:"slack_connected"`
+	Snooze            *Snooze `json:"snooze,omitempty"` // unversioned: a snooze ending doesn't change the version
+}
+
+// bumpSettingsVersion records a change to the user's settings. Callers must
+// hold mu.
+func (s *storageShard) bumpSettingsVersion(userID string) {
+	s.settingsVersions[userID]++
+}
+
+// settingsFor assembles the user's settings document. Callers must hold mu.
+func (s *storageShard) settingsFor(userID string) UserSettings {
+	settings := UserSettings{
+		Version:   s.settingsVersions[userID],
+		NtfyTopic: s.ntfyTopics[userID],
+	}
+	_, disabled := s.notificationsDisabled[userID]
+	settings.NotificationsEnabled = !disabled
+	_, settings.DeviceRegistered = s.deviceTokens[userID]
+	if prefs := s.preferences[userID]; prefs != nil {
+		settings.Preferences = *prefs
+	}
+
+	_, settings.WebPushSubscribed = s.webPushSubscriptions[userID]
+	_, settings.TelegramLinked = s.telegramChats[userID]
+	_, settings.DiscordWebhookSet = s.discordWebhooks[userID]
+	if webhook := s.userWebhooks[userID]; webhook != nil {
+		settings.WebhookURL = webhook.URL
+	}
+	_, settings.SlackConnected = s.slackDestinations[userID]
+	if snooze := s.snoozes[userID]; snooze != nil {
+		if snooze = snooze.copy(); snooze.expire(time.Now().Unix()) {
+			settings.Snooze = snooze
+		}
+	}
+	return settings
+}
+
+func (srv *Server) getSettings(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	settings := shard.settingsFor(userID)
+	shard.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// updateSettings replaces the user's settings. The request's version must
+// match the stored one, so a client saving stale settings gets 409 and the
+// current document instead of overwriting changes made elsewhere.
+func (srv *Server) updateSettings(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var settings UserSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if problem := settings.Preferences.validate(); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+	if !validAPNsEnvironment(settings.APNsEnvironment) {
+		http.Error(w, "apns_environment must be sandbox or production", http.StatusBadRequest)
+		return
+	}
+
+	topicURL := ""
+	if settings.NtfyTopic != "" {
+		var err error
+		if topicURL, err = ntfyTopicURL(settings.NtfyTopic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	current := shard.settingsFor(userID)
+	shard.mu.RUnlock()
+	if settings.Version != current.Version {
+		writeSettingsConflict(w, current)
+		return
+	}
+
+	// The request has already proven it comes from the user, so it may
+	// register a device. An OGS access token with it links the account.
+	linked := settings.DeviceToken != "" && settings.OGSAccessToken != ""
+	if linked {
+		if err := srv.verifyAccountLink(userID, settings.OGSAccessToken); err != nil {
+			log.Printf("Settings for user %s not saved: OGS account link: %v", userID, err)
+			writeAccountLinkError(w, err)
+			return
+		}
+	}
+
+	// A new topic gets a test notification, as with PUT /ntfy
+	if topicURL != "" && topicURL != current.NtfyTopic {
+		if err := publishNtfy(topicURL, "OGS notifications", "You'll get a notification here when it's your turn.", ""); err != nil {
+			log.Printf("ntfy test notification for user %s failed: %v", userID, err)
+			http.Error(w, "Could not publish to ntfy topic", http.StatusBadGateway)
+			return
+		}
+	}
+
+	shard.mu.Lock()
+	// The version is checked again in case another save landed meanwhile
+	if shard.settingsVersions[userID] != settings.Version {
+		current = shard.settingsFor(userID)
+		shard.mu.Unlock()
+		writeSettingsConflict(w, current)
+		return
+	}
+
+	if settings.NotificationsEnabled {
+		delete(shard.notificationsDisabled, userID)
+	} else if _, disabled := shard.notificationsDisabled[userID]; !disabled {
+		shard.notificationsDisabled[userID] = time.Now().Unix()
+	}
+	registered := false
+	if settings.DeviceToken != "" && (shard.deviceTokens[userID] != settings.DeviceToken || shard.deviceEnvironments[userID] != settings.APNsEnvironment) {
+		srv.logStorageChange(walEntry{Op: walRegister, UserID: userID, DeviceToken: settings.DeviceToken, APNsEnvironment: settings.APNsEnvironment})
+		shard.setDevice(userID, settings.DeviceToken, settings.APNsEnvironment)
+		registered = true
+	}
+	if linked {
+		shard.recordAccountLink(userID, time.Now())
+	}
+	if topicURL != "" {
+		shard.ntfyTopics[userID] = topicURL
+	} else {
+		delete(shard.ntfyTopics, userID)
+	}
+	prefs := settings.Preferences
+	shard.preferences[userID] = &prefs
+	shard.bumpSettingsVersion(userID)
+	updated := shard.settingsFor(userID)
+	shard.mu.Unlock()
+
+	if registered || topicURL != "" {
+		srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	}
+	srv.saveStorage()
+	log.Printf("Updated settings for user %s (version %d)", userID, updated.Version)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func writeSettingsConflict(w http.ResponseWriter, current UserSettings) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Slack notifications go to a channel or DM, either through an incoming
+// webhook, which posts to the one channel it was created for, or through a
+// bot token and a channel ID, which can also reach a user's DMs. Clubs and
+// workplaces can point their members at a shared channel.
+
+// slackWebhookPrefix is where Slack's incoming webhooks live. Nothing else is
+// accepted, so the server can't be pointed at other hosts.
+var slackWebhookPrefix = "https://hooks.slack.com/services/"
+
+// slackAPIURL is the Web API the bot token is used with
+var slackAPIURL = "https://slack.com/api"
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+// slackChannelID matches channel, DM and user IDs, which chat.postMessage
+// takes as a channel
+var slackChannelID = regexp.MustCompile(`^[CDGU][A-Z0-9]{6,20}$`)
+
+// errSlackGone is returned when Slack won't take the destination again: the
+// webhook or token was revoked, or the channel archived or deleted
+var errSlackGone = errors.New("slack destination is gone")
+
+// slackGoneErrors are the Web API errors that mean errSlackGone
+var slackGoneErrors = map[string]bool{
+	"invalid_auth":      true,
+	"account_inactive":  true,
+	"token_revoked":     true,
+	"channel_not_found": true,
+	"is_archived":       true,
+}
+
+// SlackDestination is where a user's Slack notifications are posted: an
+// incoming webhook, or a bot token and channel
+type SlackDestination struct {
+	WebhookURL string `json:"webhook_url,omitempty"`
+	BotToken   string `json:"bot_token,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+}
+
+// validate reports the first problem with the destination, or ""
+func (d SlackDestination) validate() string {
+	switch {
+	case d.WebhookURL != "" && d.BotToken != "":
+		return "set webhook_url or bot_token, not both"
+	case d.WebhookURL != "":
+		rest, ok := strings.CutPrefix(d.WebhookURL, slackWebhookPrefix)
+		if !ok || rest == "" || strings.ContainsAny(rest, "?#") || len(d.WebhookURL) > 512 {
+			return "webhook_url must be a Slack incoming webhook URL"
+		}
+		if d.Channel != "" {
+			return "channel is set by the webhook"
+		}
+	case d.BotToken != "":
+		if !strings.HasPrefix(d.BotToken, "xoxb-") || len(d.BotToken) > 256 {
+			return "bot_token must be a bot token (xoxb-...)"
+		}
+		if !slackChannelID.MatchString(d.Channel) {
+			return "channel must be a channel, DM or user ID"
+		}
+	default:
+		return "webhook_url or bot_token is required"
+	}
+	return ""
+}
+
+// slackEscape escapes the characters Slack reads as markup
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// slackMessage builds a message with an "Open game" button for gameURL, if set
+func slackMessage(title, body, gameURL string) map[string]interface{} {
+	text := "*" + slackEscape(title) + "*\n" + slackEscape(body)
+	blocks := []interface{}{
+		map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+	}
+	if gameURL != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "actions",
+			"elements": []interface{}{map[string]interface{}{
+				"type": "button",
+				"text": map[string]string{"type": "plain_text", "text": "Open game"},
+				"url":  gameURL,
+			}},
+		})
+	}
+	// text is the fallback for notifications and clients without blocks
+	return map[string]interface{}{"text": title + ": " + body, "blocks": blocks}
+}
+
+// postSlack posts a notification to the destination
+func postSlack(destination *SlackDestination, title, body, gameURL string) error {
+	message := slackMessage(title, body, gameURL)
+	target := destination.WebhookURL
+	if destination.BotToken != "" {
+		message["channel"] = destination.Channel
+		target = slackAPIURL + "/chat.postMessage"
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if destination.BotToken != "" {
+		req.Header.Set("Authorization", "Bearer "+destination.BotToken)
+	}
+
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		// The error's URL carries the webhook's secret path
+		return fmt.Errorf("slack request failed")
+	}
+	defer resp.Body.Close()
+
+	if destination.BotToken == "" {
+		// Webhooks answer 404 or 410 once removed, or 403 if posting is no
+		// longer allowed
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusForbidden:
+			return errSlackGone
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("slack returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	// The Web API answers 200 with ok false for errors
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch {
+	case result.OK:
+		return nil
+	case slackGoneErrors[result.Error]:
+		return fmt.Errorf("%w: %s", errSlackGone, result.Error)
+	default:
+		return fmt.Errorf("slack returned status %d: %s", resp.StatusCode, result.Error)
+	}
+}
+
+// slackDestinationFor returns the user's Slack destination, if they've set one
+func (srv *Server) slackDestinationFor(userID string) (*SlackDestination, bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	destination, exists := shard.slackDestinations[userID]
+	if !exists {
+		return nil, false
+	}
+	copied := *destination
+	return &copied, true
+}
+
+// sendSlack posts a notification to the user's destination. One Slack won't
+// take any more is removed, so it isn't tried again.
+func (srv *Server) sendSlack(userID string, destination *SlackDestination, title, body, gameURL string) error {
+	err := postSlack(destination, title, body, gameURL)
+	if !errors.Is(err, errSlackGone) {
+		return err
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if current := shard.slackDestinations[userID]; current != nil && *current == *destination {
+		delete(shard.slackDestinations, userID)
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+	srv.saveStorage()
+	log.Printf("Removed Slack destination for user %s: %v", userID, err)
+	return err
+}
+
+// setSlackDestination handles PUT /slack/{userID}. A test message is posted
+// first, so a destination that doesn't work is rejected rather than silently
+// dropping turns.
+func (srv *Server) setSlackDestination(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var destination SlackDestination
+	if err := json.NewDecoder(r.Body).Decode(&destination); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if problem := destination.validate(); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	if err := postSlack(&destination, "OGS notifications", "You'll get a message here when it's your turn.", ""); err != nil {
+		log.Printf("Slack test message for user %s failed: %v", userID, err)
+		http.Error(w, "Could not post to Slack", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.slackDestinations[userID] = &destination
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Set Slack destination for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSlackDestination handles DELETE /slack/{userID}
+func (srv *Server) deleteSlackDestination(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.slackDestinations[userID]
+	delete(shard.slackDestinations, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No Slack destination set", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Removed Slack destination for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Notification delivery SLO: a push is "good" when APNs accepts it within the
+// latency target of the turn being detected. Outcomes are kept in per-minute
+// buckets so burn rates can be computed over the standard alerting windows.
+
+const sloBucketCount = 6 * 60 // six hours of one-minute buckets
+
+var pushLatencyBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 900}
+
+var sloWindows = []struct {
+	label   string
+	minutes int
+}{
+	{"5m", 5},
+	{"1h", 60},
+	{"6h", 360},
+}
+
+type sloBucket struct {
+	minute int64 // unix minute this bucket holds
+	total  int
+	good   int
+}
+
+type sloTracker struct {
+	mu            sync.Mutex
+	buckets       [sloBucketCount]sloBucket
+	successTotal  int
+	failureTotal  int
+	latencyCounts []int // cumulative histogram counts per pushLatencyBuckets
+	latencySum    float64
+	latencyCount  int
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{latencyCounts: make([]int, len(pushLatencyBuckets))}
+}
+
+// sloObjective is the target fraction of good pushes (SLO_OBJECTIVE, default 0.99)
+func sloObjective() float64 {
+	if value := os.Getenv("SLO_OBJECTIVE"); value != "" {
+		if objective, err := strconv.ParseFloat(value, 64); err == nil && objective > 0 && objective < 1 {
+			return objective
+		}
+	}
+	return 0.99
+}
+
+// sloLatencyTarget is how soon after detection a push must be accepted
+// (SLO_LATENCY_TARGET_SECONDS, default 60)
+func sloLatencyTarget() time.Duration {
+	if value := os.Getenv("SLO_LATENCY_TARGET_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 60 * time.Second
+}
+
+// record counts one push attempt detected at detectedAt and finished at now
+func (s *sloTracker) record(detectedAt, now time.Time, success bool) {
+	latency := now.Sub(detectedAt)
+	good := success && latency <= sloLatencyTarget()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	minute := now.Unix() / 60
+	bucket := &s.buckets[minute%sloBucketCount]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	bucket.total++
+	if good {
+		bucket.good++
+	}
+
+	if !success {
+		s.failureTotal++
+		return
+	}
+
+	s.successTotal++
+	seconds := latency.Seconds()
+	s.latencySum += seconds
+	s.latencyCount++
+	for i, bound := range pushLatencyBuckets {
+		if seconds <= bound {
+			s.latencyCounts[i]++
+		}
+	}
+}
+
+// burnRate is the rate the error budget is being spent over the last minutes:
+// 1 means exactly on budget, 14.4 over an hour exhausts a 30 day budget in
+// about two days. Returns 0 when there were no pushes in the window.
+func (s *sloTracker) burnRate(now time.Time, minutes int) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := now.Unix() / 60
+	total, good := 0, 0
+	for _, bucket := range s.buckets {
+		if bucket.total > 0 && bucket.minute > current-int64(minutes) && bucket.minute <= current {
+			total += bucket.total
+			good += bucket.good
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	errorRate := float64(total-good) / float64(total)
+	return errorRate / (1 - sloObjective())
+}
+
+// recordPushOutcome feeds the SLO for a push whose turns were detected at detectedAt
+func (srv *Server) recordPushOutcome(detectedAt time.Time, success bool) {
+	srv.pushSLO.record(detectedAt, time.Now(), success)
+}
+
+// writeSLOMetrics writes SLO metrics in the Prometheus text format
+func (srv *Server) writeSLOMetrics(w http.ResponseWriter, now time.Time) {
+	srv.pushSLO.mu.Lock()
+	successTotal, failureTotal := srv.pushSLO.successTotal, srv.pushSLO.failureTotal
+	latencyCounts := append([]int(nil), srv.pushSLO.latencyCounts...)
+	latencySum, latencyCount := srv.pushSLO.latencySum, srv.pushSLO.latencyCount
+	srv.pushSLO.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_push_total Push notification attempts by result.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_push_total counter")
+	fmt.Fprintf(w, "ogs_notifications_push_total{result=\"success\"} %d\n", successTotal)
+	fmt.Fprintf(w, "ogs_notifications_push_total{result=\"failure\"} %d\n", failureTotal)
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_push_latency_seconds Time from turn detection to APNs acceptance.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_push_latency_seconds histogram")
+	for i, bound := range pushLatencyBuckets {
+		fmt.Fprintf(w, "ogs_notifications_push_latency_seconds_bucket{le=\"%g\"} %d\n", bound, latencyCounts[i])
+	}
+	fmt.Fprintf(w, "ogs_notifications_push_latency_seconds_bucket{le=\"+Inf\"} %d\n", latencyCount)
+	fmt.Fprintf(w, "ogs_notifications_push_latency_seconds_sum %g\n", latencySum)
+	fmt.Fprintf(w, "ogs_notifications_push_latency_seconds_count %d\n", latencyCount)
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_slo_objective Target fraction of pushes delivered within the latency target.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_slo_objective gauge")
+	fmt.Fprintf(w, "ogs_notifications_slo_objective %g\n", sloObjective())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_slo_latency_target_seconds Latency target for a good push.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_slo_latency_target_seconds gauge")
+	fmt.Fprintf(w, "ogs_notifications_slo_latency_target_seconds %g\n", sloLatencyTarget().Seconds())
+
+	fmt.Fprintln(w, "# HELP ogs_notifications_slo_burn_rate Error budget burn rate over the window.")
+	fmt.Fprintln(w, "# TYPE ogs_notifications_slo_burn_rate gauge")
+	for _, window := range sloWindows {
+		fmt.Fprintf(w, "ogs_notifications_slo_burn_rate{window=%q} %g\n", window.label, srv.pushSLO.burnRate(now, window.minutes))
+	}
+}
+
+// getMetrics serves server metrics in the Prometheus text format
+func (srv *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.writeSLOMetrics(w, time.Now())
+	srv.writeCanaryMetrics(w)
+	srv.writeClockSkewMetrics(w)
+	srv.writeCheckHealthMetrics(w, time.Now())
+	writeAPNsFaultMetrics(w)
+	writeAPNsTokenMetrics(w)
+	srv.writePushRetryMetrics(w)
+	srv.writeAsyncMetrics(w)
+}
+
+// getAlertRules serves Prometheus alerting rules for the push SLO, using the
+// multi-window, multi-burn-rate pattern: page on fast burn, ticket on slow burn
+func getAlertRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	fmt.Fprintf(w, `groups:
+  - name: ogs-notifications-slo
+    rules:
+      - alert: OGSNotificationsFastBurn
+        expr: ogs_notifications_slo_burn_rate{window="5m"} > 14.4 and ogs_notifications_slo_burn_rate{window="1h"} > 14.4
+        for: 2m
+        labels:
+          severity: page
+        annotations:
+          summary: Push notification SLO is burning error budget fast
+          description: More than %[1]g%% of pushes are failing or slower than %[2]gs; at this rate the monthly budget is gone in about two days.
+      - alert: OGSNotificationsSlowBurn
+        expr: ogs_notifications_slo_burn_rate{window="1h"} > 6 and ogs_notifications_slo_burn_rate{window="6h"} > 6
+        for: 15m
+        labels:
+          severity: ticket
+        annotations:
+          summary: Push notification SLO is burning error budget
+          description: Pushes are missing the %[2]gs latency target or failing at six times the budgeted rate.
+      - alert: OGSNotificationsPushFailures
+        expr: increase(ogs_notifications_push_total{result="failure"}[15m]) > 0 and increase(ogs_notifications_push_total{result="success"}[15m]) == 0
+        for: 15m
+        labels:
+          severity: page
+        annotations:
+          summary: No push notifications are being delivered
+          description: Every push in the last 15 minutes failed; check APNs credentials and connectivity.
+      - alert: OGSNotificationsClockSkew
+        expr: ogs_notifications_clock_skew_seconds > 30
+        for: 10m
+        labels:
+          severity: ticket
+        annotations:
+          summary: Server clock is behind OGS
+          description: OGS reports moves more than 30s in the server's future; check NTP on the server.
+      - alert: OGSNotificationsCanaryFailing
+        expr: ogs_notifications_canary_last_run_timestamp_seconds - ogs_notifications_canary_last_success_timestamp_seconds > %[3]g
+        labels:
+          severity: page
+        annotations:
+          summary: Canary pushes are not being delivered
+          description: The canary has not had a push accepted for two of its turns; the detection to APNs pipeline is broken.
+      - alert: OGSNotificationsGoroutineLeak
+        expr: min_over_time(deriv(ogs_notifications_goroutines[30m])[6h:30m]) > 0
+        labels:
+          severity: ticket
+        annotations:
+          summary: Goroutine count has grown for six hours
+          description: The number of goroutines has only increased over the last six hours, which usually means a background task is leaking goroutines.
+      - alert: OGSNotificationsRetryQueueGrowing
+        expr: min_over_time(deriv(sum(ogs_notifications_pending_notifications)[30m:])[2h:30m]) > 0
+        labels:
+          severity: ticket
+        annotations:
+          summary: Undelivered push queue has grown for two hours
+          description: More users are waiting on a push retry every half hour; pushes are failing faster than they are retried.
+      - alert: OGSNotificationsRequestsDropped
+        expr: increase(ogs_notifications_dropped_total{source="ogs_request"}[15m]) > 0
+        for: 15m
+        labels:
+          severity: ticket
+        annotations:
+          summary: OGS requests are being dropped
+          description: Requests waited over 10s for an OGS concurrency slot; raise OGS_MAX_CONCURRENT_REQUESTS or check OGS latency.
+`, 14.4*(1-sloObjective())*100, sloLatencyTarget().Seconds(), (4 * canaryInterval()).Seconds())
+}
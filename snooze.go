@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A snooze holds a user's notifications, for all their games or a single
+// one, until it expires. It's what the app's "Snooze 1h" action on a turn
+// notification sets. New turns in snoozed games are held like a batch window,
+// so they stay new and are pushed once the snooze ends if it's still the
+// user's turn. Other notifications during a snooze are skipped, except urgent
+// ones like the final low-clock warning.
+
+const (
+	defaultSnoozeMinutes = 60
+	maxSnoozeMinutes     = 7 * 24 * 60
+)
+
+// Snooze is when a user's snoozes end, as unix times
+type Snooze struct {
+	Until int64         `json:"until,omitempty"` // every game
+	Games map[int]int64 `json:"games,omitempty"` // gameID -> until
+}
+
+func (s *Snooze) copy() *Snooze {
+	copied := *s
+	copied.Games = maps.Clone(s.Games)
+	return &copied
+}
+
+// expire drops the snoozes over by now, reporting whether any are left
+func (s *Snooze) expire(now int64) bool {
+	if s.Until <= now {
+		s.Until = 0
+	}
+	maps.DeleteFunc(s.Games, func(_ int, until int64) bool { return until <= now })
+	return s.Until != 0 || len(s.Games) > 0
+}
+
+// SnoozeRequest sets how long to snooze for, defaulting to an hour
+type SnoozeRequest struct {
+	Minutes int `json:"minutes"`
+}
+
+// snoozed reports whether the user's notifications about the game are
+// snoozed at now. gameID 0 asks about notifications not about a game.
+// Callers must hold mu.
+func (s *storageShard) snoozed(userID string, gameID int, now time.Time) bool {
+	snooze := s.snoozes[userID]
+	if snooze == nil {
+		return false
+	}
+	return snooze.Until > now.Unix() || (gameID != 0 && snooze.Games[gameID] > now.Unix())
+}
+
+// errPushSnoozed is returned for a push the user's snooze holds
+var errPushSnoozed = errors.New("notifications snoozed by user")
+
+// snoozedPush reports whether the user's snooze holds a push, going by the
+// game in its custom data. Urgent pushes, like the final low-clock warning,
+// aren't snoozed.
+func (srv *Server) snoozedPush(userID string, custom map[string]interface{}, now time.Time) bool {
+	if urgent, _ := custom["urgent"].(bool); urgent {
+		return false
+	}
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.snoozed(userID, customGameID(custom), now)
+}
+
+// splitSnoozed separates new turns in snoozed games from the rest
+func (srv *Server) splitSnoozed(userID string, games []Game, now time.Time) (awake, snoozed []Game) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	for _, game := range games {
+		if shard.snoozed(userID, game.ID, now) {
+			snoozed = append(snoozed, game)
+		} else {
+			awake = append(awake, game)
+		}
+	}
+	return awake, snoozed
+}
+
+// snoozeNotifications handles POST /snooze/{userID} and
+// /snooze/{userID}/{gameID}, snoozing every game or one. Snoozing again
+// replaces the end time. The response is the user's snoozes.
+func (srv *Server) snoozeNotifications(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["userID"]
+	gameID := 0
+	if value, exists := vars["gameID"]; exists {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid game ID", http.StatusBadRequest)
+			return
+		}
+		gameID = id
+	}
+
+	// The notification action may send no body at all
+	req := SnoozeRequest{Minutes: defaultSnoozeMinutes}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Minutes <= 0 || req.Minutes > maxSnoozeMinutes {
+		http.Error(w, "minutes must be between 1 and 10080", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	until := now.Add(time.Duration(req.Minutes) * time.Minute).Unix()
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	snooze := shard.snoozes[userID]
+	if snooze == nil {
+		snooze = &Snooze{}
+		shard.snoozes[userID] = snooze
+	}
+	snooze.expire(now.Unix())
+	if gameID == 0 {
+		snooze.Until = until
+	} else {
+		if snooze.Games == nil {
+			snooze.Games = make(map[int]int64)
+		}
+		snooze.Games[gameID] = until
+	}
+	shard.bumpSettingsVersion(userID)
+	response := snooze.copy()
+	shard.mu.Unlock()
+
+	srv.saveStorage()
+	if gameID == 0 {
+		log.Printf("Snoozed notifications for user %s for %d minutes", userID, req.Minutes)
+	} else {
+		log.Printf("Snoozed game %d for user %s for %d minutes", gameID, userID, req.Minutes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// cancelSnooze handles DELETE /snooze/{userID} and /snooze/{userID}/{gameID},
+// ending the snooze of every game or of one. Turns held by it are pushed on
+// the next check.
+func (srv *Server) cancelSnooze(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["userID"]
+	gameID, _ := strconv.Atoi(vars["gameID"])
+
+	now := time.Now().Unix()
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	cancelled := false
+	if snooze := shard.snoozes[userID]; snooze != nil {
+		if gameID == 0 {
+			cancelled = snooze.Until > now
+			snooze.Until = 0
+		} else {
+			cancelled = snooze.Games[gameID] > now
+			delete(snooze.Games, gameID)
+		}
+		if !snooze.expire(now) {
+			delete(shard.snoozes, userID)
+		}
+	}
+	if cancelled {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !cancelled {
+		http.Error(w, "Not snoozed", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Ended snooze for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSnooze handles GET /snooze/{userID}
+func (srv *Server) getSnooze(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	response := &Snooze{}
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	if snooze := shard.snoozes[userID]; snooze != nil {
+		response = snooze.copy()
+	}
+	shard.mu.RUnlock()
+	response.expire(time.Now().Unix())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// expireSnoozes drops snoozes that are over
+func (srv *Server) expireSnoozes(now time.Time) int {
+	expired := 0
+	for _, shard := range srv.storage.shards {
+		shard.mu.Lock()
+		for userID, snooze := range shard.snoozes {
+			if !snooze.expire(now.Unix()) {
+				delete(shard.snoozes, userID)
+				expired++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	if expired > 0 {
+		log.Printf("Expired snoozes of %d users", expired)
+		srv.saveStorage()
+	}
+	return expired
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema mirrors postgresSchema; server_state holds JSON as text
+var sqliteSchema = strings.Replace(postgresSchema, "value JSONB NOT NULL", "value TEXT NOT NULL", 1)
+
+// newSQLiteBackend opens (or creates) a SQLite database file. Writes go
+// through the write-ahead log with full syncs, so a crash mid-save leaves the
+// previous state intact.
+func newSQLiteBackend(path string) (*sqlBackend, error) {
+	if path == "" {
+		path = dataFilePath("state.db")
+	}
+
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema in %s: %v", path, err)
+	}
+
+	return &sqlBackend{name: "sqlite:" + path, db: db}, nil
+}
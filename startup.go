@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// Startup runs in a fixed order: configuration, storage, push providers, the
+// HTTP listener, then the background scheduler. A required component that
+// fails aborts startup before anything later runs, so the server never checks
+// turns it can't persist or deliver. Optional components that fail leave the
+// server running, and /health reports them as degraded.
+
+// Component states reported by /health
+const (
+	componentOK       = "ok"
+	componentDegraded = "degraded"
+)
+
+// ComponentStatus is the state of one component in /health
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startupConfig is the configuration read before anything starts
+type startupConfig struct {
+	dataDir      string // the -data-dir flag
+	backend      string // STORAGE_BACKEND
+	partition    regionPartition
+	routing      RoutingConfig
+	apnsRequired bool
+	realtimeURL  string
+	addr         string
+}
+
+// configureLogging reads LOG_FORMAT. With "json", every log line, including
+// those from the log package, is written as a JSON object by slog for log
+// aggregators; by default lines are plain text.
+func configureLogging() {
+	if os.Getenv("LOG_FORMAT") == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+}
+
+// apnsRequired reads APNS_REQUIRED. APNs is required unless it's "false", for
+// ntfy-only deployments and development.
+func apnsRequired() bool {
+	return os.Getenv("APNS_REQUIRED") != "false"
+}
+
+// loadStartupConfig reads and validates the configuration
+func loadStartupConfig(dataDirFlag string) (startupConfig, error) {
+	base := ogsBaseURL()
+	if demoModeEnabled() {
+		var err error
+		if base, err = startDemoOGS(demoMoveInterval()); err != nil {
+			return startupConfig{}, fmt.Errorf("demo OGS: %v", err)
+		}
+		log.Printf("Demo mode: using synthetic OGS games served at %s", base)
+	}
+	useOGSBaseURL(base)
+
+	cfg := startupConfig{
+		dataDir:      dataDirFlag,
+		backend:      os.Getenv("STORAGE_BACKEND"),
+		apnsRequired: apnsRequired(),
+		realtimeURL:  ogsRealtimeURL(),
+		addr:         ":8080",
+	}
+	if demoModeEnabled() && cfg.realtimeURL != "" {
+		log.Println("Demo mode has no real-time API; polling instead")
+		cfg.realtimeURL = ""
+	}
+
+	var err error
+	if cfg.partition, err = regionConfig(); err != nil {
+		return cfg, fmt.Errorf("region configuration: %v", err)
+	}
+	if cfg.routing, err = loadRoutingConfig(os.Getenv("ROUTING_CONFIG")); err != nil {
+		return cfg, fmt.Errorf("routing configuration: %v", err)
+	}
+	if rate, reasons := apnsFaultConfig(); rate > 0 {
+		log.Printf("WARNING: APNs fault injection enabled, %.0f%% of sends fail with %v", rate*100, reasons)
+	}
+	return cfg, nil
+}
+
+// openStorage opens the storage backend and returns a server with its state
+// loaded. A backend that can't be read aborts startup rather than starting
+// empty and overwriting it.
+func openStorage(cfg startupConfig) (*Server, error) {
+	if err := configureDataDir(cfg.dataDir); err != nil {
+		return nil, fmt.Errorf("storage directory: %v", err)
+	}
+	backend, err := newStorageBackend(cfg.backend)
+	if err != nil {
+		return nil, fmt.Errorf("storage backend: %v", err)
+	}
+	if err := migrateLegacyJSON(backend); err != nil {
+		return nil, fmt.Errorf("legacy storage migration: %v", err)
+	}
+
+	srv := newServer(backend, nil)
+	srv.partition = cfg.partition
+	srv.routing = cfg.routing
+	if cfg.partition.multiRegion() {
+		log.Printf("Running in region %s of %v; checking only this region's users", cfg.partition.region, cfg.partition.regions)
+	}
+	if err := srv.loadStorage(); err != nil {
+		return nil, fmt.Errorf("loading storage: %v", err)
+	}
+
+	if srv.snapshots, err = newGCSSnapshots(srv); err != nil {
+		return nil, fmt.Errorf("storage snapshots: %v", err)
+	}
+	if srv.snapshots != nil {
+		srv.components["snapshots"] = ComponentStatus{Status: componentOK}
+		if err := srv.snapshots.restoreIfEmpty(); err != nil {
+			log.Printf("Error restoring storage snapshot: %v", err)
+			srv.components["snapshots"] = ComponentStatus{Status: componentDegraded, Error: "restore failed"}
+		}
+	}
+
+	if storageWALEnabled() {
+		if err := srv.openStorageWAL(dataFilePath("storage.wal")); err != nil {
+			return nil, fmt.Errorf("write-ahead log: %v", err)
+		}
+	}
+
+	srv.startStorageWriter(storageFlushInterval())
+	go srv.flushStorageOnShutdown()
+	return srv, nil
+}
+
+// startPushProviders connects to APNs. Unless APNS_REQUIRED is false, a
+// failure aborts startup instead of running without pushes. Web Push and
+// Telegram are optional: without their keys, users just can't link them.
+func (srv *Server) startPushProviders(cfg startupConfig) error {
+	if webPushEnabled() {
+		sender, err := configureWebPush()
+		if err != nil {
+			slog.Warn("Web Push configuration error; browser notifications are disabled", "component", "webpush", "error", err)
+			srv.components["webpush"] = ComponentStatus{Status: componentDegraded, Error: "not configured"}
+		} else {
+			srv.webPush = sender
+			srv.components["webpush"] = ComponentStatus{Status: componentOK}
+		}
+	}
+
+	if telegramEnabled() {
+		sender, err := configureTelegram()
+		if err != nil {
+			slog.Warn("Telegram configuration error; Telegram notifications are disabled", "component", "telegram", "error", err)
+			srv.components["telegram"] = ComponentStatus{Status: componentDegraded, Error: "not configured"}
+		} else {
+			srv.telegram = sender
+			srv.components["telegram"] = ComponentStatus{Status: componentOK}
+		}
+	}
+
+	pool, err := configureAPNs()
+	if err == nil {
+		srv.apns = pool
+		srv.components["apns"] = ComponentStatus{Status: componentOK}
+		return nil
+	}
+	if cfg.apnsRequired {
+		return fmt.Errorf("APNs: %v (set APNS_REQUIRED=false to run without it)", err)
+	}
+	slog.Warn("APNs configuration error; push notifications are disabled", "component", "apns", "error", err)
+	srv.components["apns"] = ComponentStatus{Status: componentDegraded, Error: "not configured"}
+	return nil
+}
+
+// listen binds the HTTP listener, so a port that's taken stops startup before
+// the scheduler runs
+func listen(cfg startupConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP listener: %v", err)
+	}
+	return listener, nil
+}
+
+// startScheduler starts the background jobs
+func (srv *Server) startScheduler(cfg startupConfig) {
+	if srv.snapshots != nil {
+		go srv.snapshots.start(gcsSnapshotInterval())
+	}
+	if cfg.realtimeURL != "" {
+		srv.realtime = newOGSRealtime(srv, cfg.realtimeURL)
+		go srv.realtime.run()
+	}
+
+	go srv.startPeriodicChecking()
+	go srv.startReminderScheduler()
+	go srv.startPushRetryScheduler()
+	go srv.startPruning()
+	go srv.startCanary()
+	log.Println("Automatic turn checking enabled")
+}
+
+// componentHealth returns the state of the server's optional components
+func (srv *Server) componentHealth() map[string]ComponentStatus {
+	components := make(map[string]ComponentStatus, len(srv.components)+1)
+	for name, status := range srv.components {
+		components[name] = status
+	}
+	if srv.realtime != nil {
+		if srv.realtime.connected.Load() {
+			components["realtime"] = ComponentStatus{Status: componentOK}
+		} else {
+			components["realtime"] = ComponentStatus{Status: componentDegraded, Error: "not connected"}
+		}
+	}
+	return components
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// stateExportVersion is bumped if the export format changes incompatibly
+const stateExportVersion = 1
+
+// maxStateImportBytes bounds the size of an imported document
+const maxStateImportBytes = 256 << 20
+
+// StateExport is the complete server state as one document: registrations,
+// move history, notification times, preferences, userscript tokens and the
+// rest of storage. The checksum and counts let an import detect a truncated
+// or hand-edited file.
+type StateExport struct {
+	Version    int            `json:"version"`
+	ExportedAt int64          `json:"exported_at"`
+	Backend    string         `json:"backend"`
+	Counts     map[string]int `json:"counts"`
+	Checksum   string         `json:"checksum"`
+	State      *storageFile   `json:"state"`
+}
+
+// exportState handles GET /admin/export
+func (srv *Server) exportState(w http.ResponseWriter, r *http.Request) {
+	srv.storage.rlockAll()
+	state := srv.storage.snapshot().copy()
+	srv.storage.runlockAll()
+
+	checksum, err := storageChecksum(state)
+	if err != nil {
+		log.Printf("Error exporting state: %v", err)
+		http.Error(w, "Failed to export state", http.StatusInternalServerError)
+		return
+	}
+
+	export := StateExport{
+		Version:    stateExportVersion,
+		ExportedAt: time.Now().Unix(),
+		Backend:    srv.backend.Name(),
+		Counts:     storageCounts(state),
+		Checksum:   checksum,
+		State:      state,
+	}
+	log.Printf("Admin state export from %s: %v", r.RemoteAddr, export.Counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="ogs-notifications-state.json"`)
+	json.NewEncoder(w).Encode(export)
+}
+
+// importState handles POST /admin/import. The document replaces all state
+// and is written to the backend before responding. Importing over existing
+// state requires ?replace=true.
+func (srv *Server) importState(w http.ResponseWriter, r *http.Request) {
+	var export StateExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxStateImportBytes)).Decode(&export); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if export.Version != stateExportVersion || export.State == nil {
+		http.Error(w, "Unsupported export version", http.StatusBadRequest)
+		return
+	}
+
+	checksum, err := storageChecksum(export.State)
+	if err != nil || checksum != export.Checksum {
+		http.Error(w, "Checksum mismatch; the export is incomplete or was modified", http.StatusBadRequest)
+		return
+	}
+
+	counts := storageCounts(export.State)
+
+	srv.storage.lockAll()
+	if !isEmptyState(srv.storage.snapshot()) && r.URL.Query().Get("replace") != "true" {
+		srv.storage.unlockAll()
+		http.Error(w, "Server already has state; use ?replace=true to overwrite it", http.StatusConflict)
+		return
+	}
+	srv.storage.reset()
+	srv.storage.apply(export.State)
+	srv.storage.unlockAll()
+
+	if err := srv.writeStorage(); err != nil {
+		srv.retryStorageWrite()
+	}
+	log.Printf("Admin state import from %s (exported %d from %s): %v", r.RemoteAddr, export.ExportedAt, export.Backend, counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "imported", "counts": counts})
+}
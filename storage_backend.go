@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// StorageBackend persists the full server state. The in-memory MoveStorage is
+// authoritative at runtime; backends load it at startup and save snapshots.
+type StorageBackend interface {
+	Name() string
+	// Load returns the stored state, or an empty state if nothing is stored yet
+	Load() (*storageFile, error)
+	Save(data *storageFile) error
+}
+
+// checkCoordinator is implemented by backends shared between instances, so
+// only one of them runs the periodic check at a time
+type checkCoordinator interface {
+	// claimCheck takes or renews the check lease for ttl, reporting whether
+	// this instance holds it. Leases with different scopes (regions) are
+	// independent.
+	claimCheck(scope string, ttl time.Duration) bool
+}
+
+// changeSubscriber is implemented by backends shared between instances, which
+// apply the changes other instances save to the server's storage
+type changeSubscriber interface {
+	subscribe(srv *Server)
+}
+
+// newStorageBackend returns the backend for a STORAGE_BACKEND value
+func newStorageBackend(name string) (StorageBackend, error) {
+	switch name {
+	case "", "file":
+		return fileBackend{}, nil
+	case "postgres":
+		return newPostgresBackend(os.Getenv("DATABASE_URL"))
+	case "firestore":
+		return newFirestoreBackend(os.Getenv("GOOGLE_CLOUD_PROJECT"), os.Getenv("FIRESTORE_COLLECTION"))
+	case "redis":
+		return newRedisBackend(os.Getenv("REDIS_URL"), os.Getenv("REDIS_KEY_PREFIX"))
+	case "sqlite":
+		return newSQLiteBackend(os.Getenv("SQLITE_PATH"))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", name)
+	}
+}
+
+// fileBackend stores state as moves.json in the data directory, or in path
+// if it's set
+type fileBackend struct {
+	path string
+}
+
+func (b fileBackend) Name() string {
+	if b.path != "" {
+		return b.path
+	}
+	return dataFilePath("moves.json")
+}
+
+func (b fileBackend) Load() (*storageFile, error) {
+	return readStorageFile(b.Name())
+}
+
+// Save replaces moves.json whole, so a crash mid-save leaves the previous
+// file rather than a torn one
+func (b fileBackend) Save(data *storageFile) error {
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal storage: %v", err)
+	}
+	return replaceFile(b.Name(), encoded)
+}
+
+// readStorageFile parses a moves.json file in either the current format or
+// the original moves-only format. A missing file yields an empty state.
+func readStorageFile(path string) (*storageFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No existing %s file, starting fresh", path)
+		return &storageFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to load new format first (with device tokens and notification times)
+	var storageData storageFile
+	if err := json.Unmarshal(data, &storageData); err == nil && (storageData.Games != nil || storageData.Moves != nil) {
+		storageData.upgradeLegacyGames()
+		return &storageData, nil
+	}
+
+	// Fallback to old format (just moves)
+	var moves map[string]map[int]int64
+	if err := json.Unmarshal(data, &moves); err != nil {
+		return nil, err
+	}
+	legacy := &storageFile{Moves: moves}
+	legacy.upgradeLegacyGames()
+	return legacy, nil
+}
+
+// storageCounts summarizes a state for migration verification
+func storageCounts(data *storageFile) map[string]int {
+	games := 0
+	for _, userGames := range data.Games {
+		games += len(userGames)
+	}
+	cycles := 0
+	for _, summaries := range data.CycleLog {
+		cycles += len(summaries)
+	}
+	return map[string]int{
+		"users":                 len(data.Games),
+		"games":                 games,
+		"device_tokens":         len(data.DeviceTokens),
+		"notification_times":    len(data.LastNotificationTime),
+		"pending_notifications": len(data.PendingNotifications),
+		"finished_game_users":   len(data.FinishedGames),
+		"paused_game_users":     len(data.PausedGames),
+		"period_warning_users":  len(data.PeriodWarnings),
+		"tenants":               len(data.Tenants),
+		"cycle_summaries":       cycles,
+		"discord_clubs":         len(data.DiscordClubs),
+	}
+}
+
+// storageChecksum is a stable digest of a state. encoding/json sorts map
+// keys, so equal states produce equal checksums regardless of backend.
+func storageChecksum(data *storageFile) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func isEmptyState(data *storageFile) bool {
+	for _, count := range storageCounts(data) {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateLegacyJSON imports moves.json into a non-file backend. The import is
+// verified by comparing per-collection counts and a checksum of the state read
+// back from the backend, after which the file is renamed to moves.json.imported.
+// If both the file and the backend hold data, it refuses to guess which is
+// authoritative.
+func migrateLegacyJSON(backend StorageBackend) error {
+	if _, isFile := backend.(fileBackend); isFile {
+		return nil
+	}
+
+	legacyPath := dataFilePath("moves.json")
+	if _, err := os.Stat(legacyPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	legacy, err := readStorageFile(legacyPath)
+	if err != nil {
+		return fmt.Errorf("legacy file %s is unreadable (%v); fix or remove it before starting with %s", legacyPath, err, backend.Name())
+	}
+
+	if isEmptyState(legacy) {
+		log.Printf("Legacy file %s is empty, marking it as imported", legacyPath)
+		return os.Rename(legacyPath, legacyPath+".imported")
+	}
+
+	existing, err := backend.Load()
+	if err != nil {
+		return fmt.Errorf("failed to read %s before import: %v", backend.Name(), err)
+	}
+	if !isEmptyState(existing) {
+		return fmt.Errorf("both %s and %s contain data; if %s is authoritative, rename %s to %s.imported, otherwise clear the backend and restart to import it",
+			legacyPath, backend.Name(), backend.Name(), legacyPath, legacyPath)
+	}
+
+	log.Printf("Importing legacy state from %s into %s...", legacyPath, backend.Name())
+
+	if err := backend.Save(legacy); err != nil {
+		return fmt.Errorf("import into %s failed: %v", backend.Name(), err)
+	}
+
+	imported, err := backend.Load()
+	if err != nil {
+		return fmt.Errorf("failed to read back %s after import: %v", backend.Name(), err)
+	}
+
+	expectedCounts, importedCounts := storageCounts(legacy), storageCounts(imported)
+	for name, expected := range expectedCounts {
+		if importedCounts[name] != expected {
+			return fmt.Errorf("import verification failed: %s count is %d in %s but %d in %s",
+				name, importedCounts[name], backend.Name(), expected, legacyPath)
+		}
+	}
+
+	expectedSum, err := storageChecksum(legacy)
+	if err != nil {
+		return err
+	}
+	importedSum, err := storageChecksum(imported)
+	if err != nil {
+		return err
+	}
+	if expectedSum != importedSum {
+		return fmt.Errorf("import verification failed: checksum mismatch between %s and %s", legacyPath, backend.Name())
+	}
+
+	if err := os.Rename(legacyPath, legacyPath+".imported"); err != nil {
+		return fmt.Errorf("imported successfully but could not rename %s: %v", legacyPath, err)
+	}
+
+	log.Printf("Imported %s into %s (%v), renamed to %s.imported", legacyPath, backend.Name(), expectedCounts, legacyPath)
+	return nil
+}
+
+// storageDocs is a state split into JSON documents: one per user, holding
+// that user's entry from every map keyed by user ID, and one per shared map,
+// such as tenants, keyed by its field name in storageFile. Document stores
+// keep the two apart so a user ID can never name a shared document, and only
+// rewrite the documents that changed.
+type storageDocs struct {
+	Users  map[string]string
+	Shared map[string]string
+}
+
+// sharedStorageFields are the storageFile maps not keyed by user ID: tenants
+// by tenant ID, the cycle log by day and Discord clubs by club ID
+var sharedStorageFields = map[string]bool{
+	"tenants":       true,
+	"cycle_log":     true,
+	"discord_clubs": true,
+}
+
+// splitByUser regroups a state into storageDocs
+func splitByUser(data *storageFile) (storageDocs, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return storageDocs{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return storageDocs{}, err
+	}
+
+	docs := storageDocs{Users: make(map[string]string), Shared: make(map[string]string)}
+	users := make(map[string]map[string]json.RawMessage)
+	for field, raw := range fields {
+		if sharedStorageFields[field] {
+			docs.Shared[field] = string(raw)
+			continue
+		}
+		var byUser map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &byUser); err != nil {
+			return storageDocs{}, fmt.Errorf("storage field %s is not keyed by user: %v", field, err)
+		}
+		for userID, value := range byUser {
+			if users[userID] == nil {
+				users[userID] = make(map[string]json.RawMessage)
+			}
+			users[userID][field] = value
+		}
+	}
+
+	for userID, userFields := range users {
+		encoded, err := json.Marshal(userFields)
+		if err != nil {
+			return storageDocs{}, err
+		}
+		docs.Users[userID] = string(encoded)
+	}
+	return docs, nil
+}
+
+// joinUsers reverses splitByUser
+func joinUsers(docs storageDocs) (*storageFile, error) {
+	byField := make(map[string]map[string]json.RawMessage)
+	for userID, doc := range docs.Users {
+		var userFields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(doc), &userFields); err != nil {
+			return nil, fmt.Errorf("invalid state for user %s: %v", userID, err)
+		}
+		for field, value := range userFields {
+			if byField[field] == nil {
+				byField[field] = make(map[string]json.RawMessage)
+			}
+			byField[field][userID] = value
+		}
+	}
+
+	fields := make(map[string]json.RawMessage, len(byField)+len(docs.Shared))
+	for field, byUser := range byField {
+		encoded, err := json.Marshal(byUser)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = encoded
+	}
+	for field, doc := range docs.Shared {
+		if !json.Valid([]byte(doc)) {
+			return nil, fmt.Errorf("invalid state for %s", field)
+		}
+		fields[field] = json.RawMessage(doc)
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	data := &storageFile{}
+	if err := json.Unmarshal(encoded, data); err != nil {
+		return nil, err
+	}
+
+	data.upgradeLegacyGames()
+	if data.Games == nil {
+		data.Games = make(map[string]map[int]*GameRecord)
+	}
+	if data.DeviceTokens == nil {
+		data.DeviceTokens = make(map[string]string)
+	}
+	if data.LastNotificationTime == nil {
+		data.LastNotificationTime = make(map[string]int64)
+	}
+	return data, nil
+}
+
+// changedDocs lists the documents in docs that differ from saved, and those in
+// saved that docs no longer has
+func changedDocs(saved, docs map[string]string) (changed, removed []string) {
+	for id, doc := range docs {
+		if old, exists := saved[id]; exists && old == doc {
+			continue
+		}
+		changed = append(changed, id)
+	}
+	for id := range saved {
+		if _, exists := docs[id]; !exists {
+			removed = append(removed, id)
+		}
+	}
+	return changed, removed
+}
+
+// replaceDocs swaps in the given documents from splitByUser, leaving the rest
+// untouched. An empty document removes the user, or empties the shared map.
+// Callers must hold every lock, from lockAll.
+func (s *MoveStorage) replaceDocs(docs storageDocs) error {
+	local, err := splitByUser(s.snapshot())
+	if err != nil {
+		return err
+	}
+	replaceEach(local.Users, docs.Users)
+	replaceEach(local.Shared, docs.Shared)
+
+	data, err := joinUsers(local)
+	if err != nil {
+		return err
+	}
+	s.reset()
+	s.apply(data)
+	return nil
+}
+
+// replaceEach sets each document in dst to the one in docs, deleting it if
+// that's empty
+func replaceEach(dst, docs map[string]string) {
+	for id, doc := range docs {
+		if doc == "" {
+			delete(dst, id)
+		} else {
+			dst[id] = doc
+		}
+	}
+}
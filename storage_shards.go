@@ -0,0 +1,70 @@
+package main
+
+import "hash/fnv"
+
+// storageShards is how many shards users' state is split across. A request or
+// check locks only its user's shard, so with thousands of users few of them
+// wait on each other, and a save holds each lock only while it's copied.
+const storageShards = 32
+
+// shardIndex returns the shard that holds a user's state
+func shardIndex(userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return int(h.Sum32() % storageShards)
+}
+
+// shard returns the shard that holds a user's state
+func (s *MoveStorage) shard(userID string) *storageShard {
+	return s.shards[shardIndex(userID)]
+}
+
+// lockAll locks every shard for writing, in lock order, for changes that span
+// users such as loading a new state
+func (s *MoveStorage) lockAll() {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+	}
+}
+
+func (s *MoveStorage) unlockAll() {
+	for i := len(s.shards) - 1; i >= 0; i-- {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// rlockAll locks every shard for reading, in lock order, for a view of all
+// users that's consistent with the write-ahead log
+func (s *MoveStorage) rlockAll() {
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+	}
+}
+
+func (s *MoveStorage) runlockAll() {
+	for i := len(s.shards) - 1; i >= 0; i-- {
+		s.shards[i].mu.RUnlock()
+	}
+}
+
+// ownedBy returns the entries of m whose user owns reports true
+func ownedBy[V any](m map[string]V, owns func(userID string) bool) map[string]V {
+	owned := make(map[string]V)
+	for userID, value := range m {
+		if owns(userID) {
+			owned[userID] = value
+		}
+	}
+	return owned
+}
+
+// mergeInto adds the entries of src to dst, making dst if it's nil
+func mergeInto[V any](dst, src map[string]V) map[string]V {
+	if dst == nil {
+		dst = make(map[string]V, len(src))
+	}
+	for userID, value := range src {
+		dst[userID] = value
+	}
+	return dst
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// storageSizeTTL is how long a backend size measurement is reused, so health
+// probes don't query the backend every time. A save makes it stale sooner.
+const storageSizeTTL = time.Minute
+
+// StorageStats is reported on /health so operators can spot unbounded growth
+type StorageStats struct {
+	Backend      string           `json:"backend"`
+	Users        int              `json:"users"`
+	Games        int              `json:"games"`
+	DeviceTokens int              `json:"device_tokens"`
+	LastSaveAt   int64            `json:"last_save_at"` // 0 until the first successful save
+	SizeBytes    int64            `json:"size_bytes,omitempty"`
+	Rows         map[string]int64 `json:"rows,omitempty"`
+}
+
+// StorageSize is how much space a backend's state takes: bytes for files, row
+// counts for databases
+type StorageSize struct {
+	Bytes int64
+	Rows  map[string]int64
+}
+
+// storageSizer is implemented by backends that can measure their state
+type storageSizer interface {
+	storageSize() (StorageSize, error)
+}
+
+// storageSizeCache is the backend's last measured size
+type storageSizeCache struct {
+	mu       sync.Mutex
+	savedAt  int64
+	measured time.Time
+	size     StorageSize
+}
+
+// backendSize measures the server's backend, reusing a measurement taken
+// since the last save. Backends that can't be measured report an empty size.
+func (srv *Server) backendSize(now time.Time) StorageSize {
+	sizer, ok := srv.backend.(storageSizer)
+	if !ok {
+		return StorageSize{}
+	}
+	savedAt := srv.lastSaveAt.Load()
+
+	cache := &srv.sizeCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.savedAt == savedAt && now.Sub(cache.measured) < storageSizeTTL {
+		return cache.size
+	}
+	size, err := sizer.storageSize()
+	if err != nil {
+		return StorageSize{}
+	}
+	cache.savedAt, cache.measured, cache.size = savedAt, now, size
+	return size
+}
+
+// storageStats counts what storage holds
+func (srv *Server) storageStats(now time.Time) StorageStats {
+	users := make(map[string]bool)
+	games, deviceTokens := 0, 0
+	for _, shard := range srv.storage.shards {
+		shard.mu.RLock()
+		for userID, userGames := range shard.games {
+			users[userID] = true
+			games += len(userGames)
+		}
+		for userID := range shard.deviceTokens {
+			users[userID] = true
+		}
+		for userID := range shard.ntfyTopics {
+			users[userID] = true
+		}
+		for userID := range shard.webPushSubscriptions {
+			users[userID] = true
+		}
+		for userID := range shard.telegramChats {
+			users[userID] = true
+		}
+		for userID := range shard.discordWebhooks {
+			users[userID] = true
+		}
+		for userID := range shard.userWebhooks {
+			users[userID] = true
+		}
+		for userID := range shard.slackDestinations {
+			users[userID] = true
+		}
+		deviceTokens += len(shard.deviceTokens)
+		shard.mu.RUnlock()
+	}
+	stats := StorageStats{
+		Backend:      srv.backend.Name(),
+		Users:        len(users),
+		Games:        games,
+		DeviceTokens: deviceTokens,
+		LastSaveAt:   srv.lastSaveAt.Load(),
+	}
+
+	size := srv.backendSize(now)
+	stats.SizeBytes = size.Bytes
+	stats.Rows = size.Rows
+	return stats
+}
+
+// healthCheck handles GET /health
+func (srv *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
+	components := srv.componentHealth()
+	status := componentOK
+	for _, component := range components {
+		if component.Status == componentDegraded {
+			status = componentDegraded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"storage":    srv.storageStats(time.Now()),
+		"components": components,
+	})
+}
+
+func (b fileBackend) storageSize() (StorageSize, error) {
+	info, err := os.Stat(b.Name())
+	if os.IsNotExist(err) {
+		return StorageSize{}, nil
+	}
+	if err != nil {
+		return StorageSize{}, err
+	}
+	return StorageSize{Bytes: info.Size()}, nil
+}
+
+func (b *sqlBackend) storageSize() (StorageSize, error) {
+	rows := make(map[string]int64)
+	for _, table := range []string{"users", "devices", "game_moves", "notification_history", "server_state"} {
+		var count int64
+		if err := b.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			return StorageSize{}, err
+		}
+		rows[table] = count
+	}
+	return StorageSize{Rows: rows}, nil
+}
+
+func (b *redisBackend) storageSize() (StorageSize, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users, err := b.client.HLen(ctx, b.usersKey()).Result()
+	if err != nil {
+		return StorageSize{}, err
+	}
+	return StorageSize{Rows: map[string]int64{"users": users}}, nil
+}
@@ -1,64 +1,107 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // STORAGE AND PERSISTENCE TESTS
 
+// gameRecords builds a user's game records from their last moves
+func gameRecords(moves map[int]int64) map[int]*GameRecord {
+	records := make(map[int]*GameRecord, len(moves))
+	for gameID, lastMove := range moves {
+		records[gameID] = &GameRecord{LastMove: lastMove}
+	}
+	return records
+}
+
+// setMoveNumbers sets the move numbers of a test user's games
+func setMoveNumbers(srv *Server, userID string, moveNumbers map[int]int) {
+	for gameID, moveNumber := range moveNumbers {
+		srv.storage.shard(userID).gameRecord(userID, gameID).MoveNumber = moveNumber
+	}
+}
+
+// storedMove returns the stored last move of a test user's game, or 0
+func storedMove(srv *Server, userID string, gameID int) int64 {
+	if record := srv.storage.shard(userID).game(userID, gameID); record != nil {
+		return record.LastMove
+	}
+	return 0
+}
+
+// storedMoveNumber returns the stored move number of a test user's game, or 0
+func storedMoveNumber(srv *Server, userID string, gameID int) int {
+	if record := srv.storage.shard(userID).game(userID, gameID); record != nil {
+		return record.MoveNumber
+	}
+	return 0
+}
+
 // Test: Storage persistence
 func TestStoragePersistence(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	// Add test data
-	storage.mu.Lock()
-	storage.deviceTokens["user1"] = testDeviceToken
-	storage.moves["user1"] = map[int]int64{123: 1000}
-	storage.lastNotificationTime["user1"] = 2000
-	storage.mu.Unlock()
+	srv.storage.lockAll()
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.shard("user1").games["user1"] = gameRecords(map[int]int64{123: 1000})
+	srv.storage.shard("user1").lastNotificationTime["user1"] = 2000
+	srv.storage.unlockAll()
 
 	// Save storage
-	saveStorage()
+	srv.saveStorage()
 
 	// Clear in-memory storage
-	setupTestStorage()
+	srv = newServer(srv.backend, nil)
 
 	// Load storage
-	loadStorage()
+	srv.loadStorage()
 
 	// Verify data was persisted
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if token, exists := storage.deviceTokens["user1"]; !exists || token != testDeviceToken {
+	if token, exists := srv.storage.shard("user1").deviceTokens["user1"]; !exists || token != testDeviceToken {
 		t.Errorf("Device token not persisted correctly")
 	}
 
-	if moves, exists := storage.moves["user1"]; !exists || moves[123] != 1000 {
+	if storedMove(srv, "user1", 123) != 1000 {
 		t.Errorf("Moves not persisted correctly")
 	}
 
-	if time, exists := storage.lastNotificationTime["user1"]; !exists || time != 2000 {
+	if time, exists := srv.storage.shard("user1").lastNotificationTime["user1"]; !exists || time != 2000 {
 		t.Errorf("Last notification time not persisted correctly")
 	}
 }
 
 // Test: File permissions
 func TestFilePermissions(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
+	path := srv.backend.Name()
 
 	// Save storage to create file
-	saveStorage()
+	srv.saveStorage()
 
 	// Check file permissions
-	info, err := os.Stat("moves.json")
+	info, err := os.Stat(path)
 	if err != nil {
 		t.Fatalf("Failed to stat moves.json: %v", err)
 	}
@@ -69,12 +112,21 @@ func TestFilePermissions(t *testing.T) {
 	if mode.Perm() != expectedMode {
 		t.Errorf("Expected file permissions %o, got %o", expectedMode, mode.Perm())
 	}
+
+	// Saves replace the file through a temporary one, which doesn't linger
+	srv.saveStorage()
+	if leftovers, _ := filepath.Glob(path + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files after saving, got %v", leftovers)
+	}
+	if _, err := readStorageFile(path); err != nil {
+		t.Errorf("Expected the replaced file to load, got %v", err)
+	}
 }
 
 // Test: Concurrent access protection
 func TestConcurrentAccess(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	const numGoroutines = 100
 	const numOperations = 50
@@ -90,19 +142,16 @@ func TestConcurrentAccess(t *testing.T) {
 
 			for j := 0; j < numOperations; j++ {
 				// Write operation
-				storage.mu.Lock()
-				storage.deviceTokens[userID] = fmt.Sprintf("token%d", j)
-				if storage.moves[userID] == nil {
-					storage.moves[userID] = make(map[int]int64)
-				}
-				storage.moves[userID][j] = int64(j)
-				storage.mu.Unlock()
+				srv.storage.lockAll()
+				srv.storage.shard(userID).deviceTokens[userID] = fmt.Sprintf("token%d", j)
+				srv.storage.shard(userID).gameRecord(userID, j).LastMove = int64(j)
+				srv.storage.unlockAll()
 
 				// Read operation
-				storage.mu.RLock()
-				_ = storage.deviceTokens[userID]
-				_ = storage.moves[userID]
-				storage.mu.RUnlock()
+				srv.storage.rlockAll()
+				_ = srv.storage.shard(userID).deviceTokens[userID]
+				_ = srv.storage.shard(userID).games[userID]
+				srv.storage.runlockAll()
 			}
 		}(i)
 	}
@@ -110,17 +159,17 @@ func TestConcurrentAccess(t *testing.T) {
 	wg.Wait()
 
 	// Verify no data corruption
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if len(storage.deviceTokens) != numGoroutines {
-		t.Errorf("Expected %d users, got %d", numGoroutines, len(storage.deviceTokens))
+	if len(srv.storage.snapshot().DeviceTokens) != numGoroutines {
+		t.Errorf("Expected %d users, got %d", numGoroutines, len(srv.storage.snapshot().DeviceTokens))
 	}
 }
 
 // Test: Storage migration from old to new format
 func TestStorageMigration(t *testing.T) {
-	defer cleanupTestStorage()
+	defer os.Remove("moves.json")
 
 	// Create old format storage (just moves)
 	oldFormat := map[string]map[int]int64{
@@ -135,34 +184,34 @@ func TestStorageMigration(t *testing.T) {
 	}
 
 	// Initialize storage (should handle migration)
-	setupTestStorage()
-	loadStorage()
+	srv := newServer(fileBackend{}, nil)
+	srv.loadStorage()
 
 	// Verify old data was loaded
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if len(storage.moves) != 2 {
-		t.Errorf("Expected 2 users in moves, got %d", len(storage.moves))
+	if len(srv.storage.snapshot().Games) != 2 {
+		t.Errorf("Expected 2 users in games, got %d", len(srv.storage.snapshot().Games))
 	}
 
-	if storage.moves["user1"][123] != 1000 {
+	if storedMove(srv, "user1", 123) != 1000 {
 		t.Error("Old format data not correctly migrated")
 	}
 
 	// Verify new fields are initialized
-	if storage.deviceTokens == nil {
+	if srv.storage.snapshot().DeviceTokens == nil {
 		t.Error("Device tokens map not initialized after migration")
 	}
 
-	if storage.lastNotificationTime == nil {
+	if srv.storage.snapshot().LastNotificationTime == nil {
 		t.Error("Last notification time map not initialized after migration")
 	}
 }
 
 // Test: Corrupted storage file handling
 func TestCorruptedStorageHandling(t *testing.T) {
-	defer cleanupTestStorage()
+	defer os.Remove("moves.json")
 
 	// Create corrupted JSON file
 	err := os.WriteFile("moves.json", []byte("not valid json{]"), 0600)
@@ -171,44 +220,42 @@ func TestCorruptedStorageHandling(t *testing.T) {
 	}
 
 	// Should handle corrupted file gracefully
-	setupTestStorage()
-	loadStorage()
+	srv := newServer(fileBackend{}, nil)
+	srv.loadStorage()
 
 	// Verify storage is initialized to empty state
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if storage.moves == nil || storage.deviceTokens == nil || storage.lastNotificationTime == nil {
+	if srv.storage.snapshot().Games == nil || srv.storage.snapshot().DeviceTokens == nil || srv.storage.snapshot().LastNotificationTime == nil {
 		t.Error("Storage not properly initialized after corrupted file")
 	}
 }
 
 // Test: Large storage handling performance
 func TestLargeStoragePerformance(t *testing.T) {
-	setupTestStorage()
-	defer cleanupTestStorage()
+	t.Parallel()
+	srv := newTestServer(t)
 
 	const numUsers = 1000
 	const numGamesPerUser = 10
 
 	// Create large dataset
-	storage.mu.Lock()
+	srv.storage.lockAll()
 	for i := 0; i < numUsers; i++ {
 		userID := fmt.Sprintf("user%d", i)
-		storage.deviceTokens[userID] = fmt.Sprintf("%064d", i)
-		storage.moves[userID] = make(map[int]int64)
-
+		srv.storage.shard(userID).deviceTokens[userID] = fmt.Sprintf("%064d", i)
 		for j := 0; j < numGamesPerUser; j++ {
-			storage.moves[userID][j] = int64(i * 1000 + j)
+			srv.storage.shard(userID).gameRecord(userID, j).LastMove = int64(i * 1000 + j)
 		}
 
-		storage.lastNotificationTime[userID] = int64(i * 10000)
+		srv.storage.shard(userID).lastNotificationTime[userID] = int64(i * 10000)
 	}
-	storage.mu.Unlock()
+	srv.storage.unlockAll()
 
 	// Test save performance
 	start := time.Now()
-	saveStorage()
+	srv.saveStorage()
 	saveDuration := time.Since(start)
 
 	if saveDuration > 5*time.Second {
@@ -216,9 +263,9 @@ func TestLargeStoragePerformance(t *testing.T) {
 	}
 
 	// Test load performance
-	setupTestStorage()
+	srv = newServer(srv.backend, nil)
 	start = time.Now()
-	loadStorage()
+	srv.loadStorage()
 	loadDuration := time.Since(start)
 
 	if loadDuration > 5*time.Second {
@@ -226,15 +273,1000 @@ func TestLargeStoragePerformance(t *testing.T) {
 	}
 
 	// Verify data integrity
-	storage.mu.RLock()
-	defer storage.mu.RUnlock()
+	srv.storage.rlockAll()
+	defer srv.storage.runlockAll()
 
-	if len(storage.deviceTokens) != numUsers {
-		t.Errorf("Expected %d users, got %d", numUsers, len(storage.deviceTokens))
+	if len(srv.storage.snapshot().DeviceTokens) != numUsers {
+		t.Errorf("Expected %d users, got %d", numUsers, len(srv.storage.snapshot().DeviceTokens))
 	}
 
 	// Spot check some data
-	if storage.moves["user500"][5] != 500005 {
+	if storedMove(srv, "user500", 5) != 500005 {
 		t.Error("Data corruption in large dataset")
 	}
-}
\ No newline at end of file
+}
+
+// Test: Configurable data directory
+func TestStorageDataDirectory(t *testing.T) {
+	srv := newServer(fileBackend{}, nil)
+	defer func() { dataDir = "" }()
+
+	// Explicit directory is created and used for moves.json
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := configureDataDir(dir); err != nil {
+		t.Fatalf("Failed to configure data directory: %v", err)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.unlockAll()
+	srv.saveStorage()
+
+	if _, err := os.Stat(filepath.Join(dir, "moves.json")); err != nil {
+		t.Errorf("moves.json not written to data directory: %v", err)
+	}
+
+	// DATA_DIR is used when no flag is given
+	envDir := t.TempDir()
+	t.Setenv("DATA_DIR", envDir)
+	if err := configureDataDir(""); err != nil || dataDir != envDir {
+		t.Errorf("Expected DATA_DIR %s to be used, got %s (err %v)", envDir, dataDir, err)
+	}
+
+	// XDG data home is the default
+	t.Setenv("DATA_DIR", "")
+	xdgHome := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", xdgHome)
+	if err := configureDataDir(""); err != nil || dataDir != filepath.Join(xdgHome, appDirName) {
+		t.Errorf("Expected XDG data directory, got %s (err %v)", dataDir, err)
+	}
+
+	// Unwritable directories fail fast
+	if os.Geteuid() != 0 {
+		readOnly := t.TempDir()
+		os.Chmod(readOnly, 0500)
+		defer os.Chmod(readOnly, 0700)
+		if err := configureDataDir(readOnly); err == nil {
+			t.Error("Expected an error for a read-only data directory")
+		}
+	}
+}
+
+// memoryBackend is an in-memory StorageBackend for migration tests. The
+// dropTokens flag simulates a lossy import, and saveErr a failing backend.
+type memoryBackend struct {
+	data       *storageFile
+	dropTokens bool
+	saveErr    error
+}
+
+func (m *memoryBackend) Name() string { return "memory" }
+
+func (m *memoryBackend) Load() (*storageFile, error) {
+	if m.data == nil {
+		return &storageFile{}, nil
+	}
+	encoded, _ := json.Marshal(m.data)
+	var copied storageFile
+	json.Unmarshal(encoded, &copied)
+	return &copied, nil
+}
+
+func (m *memoryBackend) Save(data *storageFile) error {
+	if m.saveErr != nil {
+		return m.saveErr
+	}
+	encoded, _ := json.Marshal(data)
+	var copied storageFile
+	json.Unmarshal(encoded, &copied)
+	if m.dropTokens {
+		copied.DeviceTokens = nil
+	}
+	m.data = &copied
+	return nil
+}
+
+// Test: Legacy moves.json import into a new backend
+func TestMigrationFromLegacyJSON(t *testing.T) {
+	defer os.Remove("moves.json")
+	defer os.Remove("moves.json.imported")
+
+	writeLegacy := func() {
+		srv := newServer(fileBackend{}, nil)
+		srv.storage.lockAll()
+		srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+		srv.storage.shard("user1").games["user1"] = gameRecords(map[int]int64{123: 1000})
+		srv.storage.unlockAll()
+		srv.saveStorage()
+	}
+
+	// Successful import renames the legacy file
+	writeLegacy()
+	backend := &memoryBackend{}
+	if err := migrateLegacyJSON(backend); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if _, err := os.Stat("moves.json"); !os.IsNotExist(err) {
+		t.Error("moves.json should be renamed after import")
+	}
+	if _, err := os.Stat("moves.json.imported"); err != nil {
+		t.Error("moves.json.imported not created")
+	}
+	if backend.data.DeviceTokens["user1"] != testDeviceToken || backend.data.Games["user1"][123].LastMove != 1000 {
+		t.Error("Imported data doesn't match legacy file")
+	}
+	os.Remove("moves.json.imported")
+
+	// Both populated is refused and leaves the file in place
+	writeLegacy()
+	if err := migrateLegacyJSON(backend); err == nil {
+		t.Error("Expected import to refuse when both legacy file and backend have data")
+	}
+	if _, err := os.Stat("moves.json"); err != nil {
+		t.Error("Legacy file should be left alone when import is refused")
+	}
+
+	// Verification catches a lossy import
+	if err := migrateLegacyJSON(&memoryBackend{dropTokens: true}); err == nil {
+		t.Error("Expected verification to fail for a lossy import")
+	}
+	if _, err := os.Stat("moves.json"); err != nil {
+		t.Error("Legacy file should be kept when verification fails")
+	}
+
+	// The file backend never migrates
+	if err := migrateLegacyJSON(fileBackend{}); err != nil {
+		t.Errorf("File backend should skip migration: %v", err)
+	}
+}
+
+// sampleBackendState is a state exercising every part of the relational layout
+func sampleBackendState() *storageFile {
+	return &storageFile{
+		Games: map[string]map[int]*GameRecord{
+			"user1": {
+				123: {LastMove: 1000, MoveNumber: 42, LastNotifiedAt: 1700000000, NotifyCount: 3, Labels: []string{"league"}},
+				456: {LastMove: 2000},
+			},
+			"user2": {},
+		},
+		DeviceTokens:         map[string]string{"user1": testDeviceToken},
+		LastNotificationTime: map[string]int64{"user1": 1700000000, "user3": 1700000100},
+		PendingNotifications: map[string]*PendingNotification{
+			"user1": {Games: map[int]MoveState{456: {LastMove: 2000, MoveNumber: 7}}, ReservedAt: 1700000000, Attempts: 1},
+		},
+		Preferences: map[string]*UserPreferences{"user1": {DailyNotificationCap: 5}},
+	}
+}
+
+// TestPostgresRowMapping tests that state round-trips through the relational layout
+func TestPostgresRowMapping(t *testing.T) {
+	t.Parallel()
+	state := sampleBackendState()
+
+	rows, err := toPGRows(state)
+	if err != nil {
+		t.Fatalf("toPGRows failed: %v", err)
+	}
+	if len(rows.Games) != 2 || len(rows.Users) != 3 || len(rows.Devices) != 1 {
+		t.Errorf("Unexpected row counts: %d games, %d users, %d devices", len(rows.Games), len(rows.Users), len(rows.Devices))
+	}
+
+	restored, err := fromPGRows(rows)
+	if err != nil {
+		t.Fatalf("fromPGRows failed: %v", err)
+	}
+
+	expected, _ := storageChecksum(state)
+	actual, _ := storageChecksum(restored)
+	if expected != actual {
+		t.Error("State changed after round-tripping through rows")
+	}
+}
+
+// TestPostgresBackend runs against a real database when POSTGRES_TEST_DSN is set
+func TestPostgresBackend(t *testing.T) {
+	t.Parallel()
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+
+	backend, err := newPostgresBackend(dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for _, table := range []string{"users", "devices", "game_moves", "notification_history", "server_state"} {
+		backend.db.Exec("DELETE FROM " + table)
+	}
+
+	testSQLBackend(t, backend)
+}
+
+// TestSQLiteBackend tests the embedded SQLite backend
+func TestSQLiteBackend(t *testing.T) {
+	t.Parallel()
+	backend, err := newSQLiteBackend(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer backend.db.Close()
+
+	testSQLBackend(t, backend)
+}
+
+// testSQLBackend saves, updates and reloads state through an empty backend
+func testSQLBackend(t *testing.T, backend *sqlBackend) {
+	state := sampleBackendState()
+	if err := backend.Save(state); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Changes are applied incrementally, including deletions
+	delete(state.Games["user1"], 456)
+	state.DeviceTokens["user2"] = "another-token"
+	if err := backend.Save(state); err != nil {
+		t.Fatalf("Second save failed: %v", err)
+	}
+
+	loaded, err := (&sqlBackend{name: backend.name, db: backend.db}).Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	expected, _ := storageChecksum(state)
+	actual, _ := storageChecksum(loaded)
+	if expected != actual {
+		t.Error("Loaded state doesn't match saved state")
+	}
+}
+
+// TestSplitByUser tests the per-user document layout used by document stores
+func TestSplitByUser(t *testing.T) {
+	t.Parallel()
+	state := sampleBackendState()
+	// A tenant whose ID is also a user ID stays out of that user's document
+	state.Tenants = map[string]*Tenant{"user1": {ID: "user1", Name: "Club"}}
+	state.CycleLog = map[string][]CycleSummary{"2024-01-01": {{UsersChecked: 2}}}
+
+	docs, err := splitByUser(state)
+	if err != nil {
+		t.Fatalf("splitByUser failed: %v", err)
+	}
+	if len(docs.Users) != 3 {
+		t.Errorf("Expected 3 user documents, got %d", len(docs.Users))
+	}
+	if len(docs.Shared) != 2 || docs.Shared["tenants"] == "" || docs.Shared["cycle_log"] == "" {
+		t.Errorf("Expected tenants and the cycle log in shared documents, got %v", docs.Shared)
+	}
+	if strings.Contains(docs.Users["user1"], "Club") {
+		t.Errorf("Expected the tenant kept out of user1's document, got %s", docs.Users["user1"])
+	}
+
+	restored, err := joinUsers(docs)
+	if err != nil {
+		t.Fatalf("joinUsers failed: %v", err)
+	}
+	expected, _ := storageChecksum(state)
+	actual, _ := storageChecksum(restored)
+	if expected != actual {
+		t.Error("State changed after round-tripping through user documents")
+	}
+
+	// A change to one user only changes that user's document
+	state.Games["user2"][789] = &GameRecord{LastMove: 3000}
+	changed, _ := splitByUser(state)
+	users, removed := changedDocs(docs.Users, changed.Users)
+	shared, _ := changedDocs(docs.Shared, changed.Shared)
+	if len(users) != 1 || users[0] != "user2" || len(removed) != 0 || len(shared) != 0 {
+		t.Errorf("Expected only user2's document to change, got %v %v %v", users, removed, shared)
+	}
+}
+
+// TestReplaceDocs tests applying other instances' changes to a few documents
+func TestReplaceDocs(t *testing.T) {
+	t.Parallel()
+	s := newMoveStorage()
+	s.apply(sampleBackendState())
+
+	remote := sampleBackendState()
+	remote.Games["user2"] = map[int]*GameRecord{789: {LastMove: 3000}}
+	remote.DeviceTokens["user2"] = "user2-token"
+	remote.Tenants = map[string]*Tenant{"club": {ID: "club"}}
+	docs, err := splitByUser(remote)
+	if err != nil {
+		t.Fatalf("splitByUser failed: %v", err)
+	}
+
+	err = s.replaceDocs(storageDocs{
+		Users:  map[string]string{"user2": docs.Users["user2"], "user3": ""},
+		Shared: map[string]string{"tenants": docs.Shared["tenants"]},
+	})
+	if err != nil {
+		t.Fatalf("replaceDocs failed: %v", err)
+	}
+
+	if s.shard("user2").games["user2"][789].LastMove != 3000 || s.shard("user2").deviceTokens["user2"] != "user2-token" {
+		t.Error("Expected user2's remote state to be applied")
+	}
+	if _, exists := s.shard("user3").lastNotificationTime["user3"]; exists {
+		t.Error("Expected user3 to be removed")
+	}
+	if s.shard("user1").games["user1"][123].LastMove != 1000 || s.shard("user1").preferences["user1"].DailyNotificationCap != 5 {
+		t.Error("Expected user1 to be untouched")
+	}
+	if _, exists := s.tenants.Load("club"); !exists {
+		t.Error("Expected the remote tenant to be applied")
+	}
+}
+
+// TestDeferredStorageWrites tests that saves wait for the background writer
+func TestDeferredStorageWrites(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	path := srv.backend.Name()
+	os.Remove(path)
+
+	srv.writer.mu.Lock()
+	srv.writer.started = true
+	srv.writer.mu.Unlock()
+	defer func() {
+		srv.writer.mu.Lock()
+		srv.writer.started, srv.writer.dirty = false, false
+		srv.writer.mu.Unlock()
+	}()
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.unlockAll()
+	srv.saveStorage()
+	srv.saveStorage()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected the write to wait for a flush")
+	}
+
+	srv.flushStorage()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected flush to write storage: %v", err)
+	}
+
+	// Nothing changed since, so the next flush doesn't write
+	os.Remove(path)
+	srv.flushStorage()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected a clean flush to skip writing")
+	}
+
+	// A failed write is retried on the next flush without further changes
+	backend := &memoryBackend{saveErr: fmt.Errorf("backend unavailable")}
+	srv.backend = backend
+	srv.saveStorage()
+	srv.flushStorage()
+	backend.saveErr = nil
+	srv.flushStorage()
+	if backend.data == nil || backend.data.DeviceTokens["user1"] != testDeviceToken {
+		t.Error("Expected the failed write to be retried")
+	}
+}
+
+// TestPruneStaleState tests dropping unreachable and abandoned users
+func TestPruneStaleState(t *testing.T) {
+	srv := newTestServer(t)
+
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour).Unix()
+	recent := now.Add(-time.Hour).Unix()
+
+	// Registered and healthy, registered but failing for 40 days, failing briefly
+	srv.storage.shard("healthy").deviceTokens["healthy"] = testDeviceToken
+	srv.storage.shard("healthy").games["healthy"] = gameRecords(map[int]int64{1: 100})
+	srv.storage.shard("uninstalled").deviceTokens["uninstalled"] = testDeviceToken
+	srv.storage.shard("uninstalled").games["uninstalled"] = gameRecords(map[int]int64{2: 100})
+	srv.storage.shard("uninstalled").pushFailingSince["uninstalled"] = old
+	srv.storage.shard("flaky").deviceTokens["flaky"] = testDeviceToken
+	srv.storage.shard("flaky").pushFailingSince["flaky"] = recent
+
+	// Never registered: checked long ago, and checked recently
+	srv.storage.shard("abandoned").games["abandoned"] = gameRecords(map[int]int64{3: 100})
+	srv.storage.shard("abandoned").checkHealth["abandoned"] = &CheckHealth{LastSuccess: old}
+	srv.storage.shard("browsing").games["browsing"] = gameRecords(map[int]int64{4: 100})
+	srv.storage.shard("browsing").checkHealth["browsing"] = &CheckHealth{LastSuccess: recent}
+
+	if pruned := srv.pruneStaleState(now); pruned != 2 {
+		t.Errorf("Expected 2 users pruned, got %d", pruned)
+	}
+	for _, userID := range []string{"uninstalled", "abandoned"} {
+		if _, exists := srv.storage.shard(userID).games[userID]; exists {
+			t.Errorf("Expected %s to be pruned", userID)
+		}
+	}
+	if _, exists := srv.storage.shard("uninstalled").deviceTokens["uninstalled"]; exists {
+		t.Error("Expected the failing device to be removed")
+	}
+	if storedMove(srv, "healthy", 1) != 100 || srv.storage.shard("flaky").deviceTokens["flaky"] == "" || storedMove(srv, "browsing", 4) != 100 {
+		t.Error("Expected active users to be kept")
+	}
+
+	t.Setenv("STALE_USER_DAYS", "0")
+	srv.storage.shard("flaky").pushFailingSince["flaky"] = old
+	if pruned := srv.pruneStaleState(now); pruned != 0 {
+		t.Errorf("Expected pruning to be disabled, got %d", pruned)
+	}
+}
+
+// TestNotificationTimeExpiry tests that old last-notification times are dropped
+func TestNotificationTimeExpiry(t *testing.T) {
+	srv := newTestServer(t)
+
+	now := time.Now()
+	srv.storage.shard("old").lastNotificationTime["old"] = now.Add(-8 * 24 * time.Hour).Unix()
+	srv.storage.shard("recent").lastNotificationTime["recent"] = now.Add(-time.Hour).Unix()
+
+	if expired := srv.expireNotificationTimes(now); expired != 1 {
+		t.Errorf("Expected 1 notification time expired, got %d", expired)
+	}
+	if _, exists := srv.storage.shard("old").lastNotificationTime["old"]; exists {
+		t.Error("Expected the old notification time to be dropped")
+	}
+	if srv.storage.shard("recent").lastNotificationTime["recent"] == 0 {
+		t.Error("Expected the recent notification time to be kept")
+	}
+
+	t.Setenv("NOTIFICATION_TIME_TTL_DAYS", "0")
+	srv.storage.shard("old").lastNotificationTime["old"] = now.Add(-100 * 24 * time.Hour).Unix()
+	if expired := srv.expireNotificationTimes(now); expired != 0 {
+		t.Errorf("Expected expiry to be disabled, got %d", expired)
+	}
+}
+
+// TestStorageWAL tests that changes lost in a crash before a write are replayed
+func TestStorageWAL(t *testing.T) {
+	srv := newTestServer(t)
+
+	path := srv.backend.Name()
+	os.Remove(path)
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+
+	// Saves wait for a flush that never comes, as in a crash
+	srv.writer.mu.Lock()
+	srv.writer.started = true
+	srv.writer.mu.Unlock()
+	defer func() {
+		srv.writer.mu.Lock()
+		srv.writer.started, srv.writer.dirty = false, false
+		srv.writer.mu.Unlock()
+	}()
+	defer func() {
+		srv.wal.mu.Lock()
+		srv.wal.file.Close()
+		srv.wal.file = nil
+		srv.wal.mu.Unlock()
+	}()
+
+	if err := srv.openStorageWAL(walPath); err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").pendingNotifications["user1"] = &PendingNotification{Games: map[int]MoveState{7: {LastMove: 5000, MoveNumber: 12}}}
+	srv.storage.unlockAll()
+	srv.writeStorage()
+
+	t.Setenv("REQUIRE_OGS_ACCOUNT_LINK", "false")
+	registration := `{"user_id":"user1","device_token":"` + testDeviceToken + `"}`
+	rr := httptest.NewRecorder()
+	srv.registerDevice(rr, httptest.NewRequest("POST", "/register", strings.NewReader(registration)))
+	srv.commitNotification("user1", true)
+
+	// Crash: memory is lost, and storage still holds the reservation
+	srv.wal.mu.Lock()
+	srv.wal.file.Close()
+	srv.wal.file = nil
+	srv.wal.mu.Unlock()
+	srv.storage = newMoveStorage()
+	srv.loadStorage()
+	if srv.storage.shard("user1").pendingNotifications["user1"] == nil || srv.storage.shard("user1").deviceTokens["user1"] != "" {
+		t.Fatal("Expected storage to predate the logged changes")
+	}
+
+	if err := srv.openStorageWAL(walPath); err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if srv.storage.shard("user1").pendingNotifications["user1"] != nil {
+		t.Error("Expected the delivered notification not to be pending again")
+	}
+	if storedMove(srv, "user1", 7) != 5000 || storedMoveNumber(srv, "user1", 7) != 12 {
+		t.Errorf("Expected replayed moves, got %d %d", storedMove(srv, "user1", 7), storedMoveNumber(srv, "user1", 7))
+	}
+	if srv.storage.shard("user1").deviceTokens["user1"] != testDeviceToken {
+		t.Error("Expected the registration to be replayed")
+	}
+
+	// Replay writes storage, which empties the log
+	if info, err := os.Stat(walPath); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty WAL after replay, got %v %v", info, err)
+	}
+	srv.storage = newMoveStorage()
+	srv.loadStorage()
+	if srv.storage.shard("user1").deviceTokens["user1"] != testDeviceToken {
+		t.Error("Expected replayed changes to be written to storage")
+	}
+}
+
+// TestStorageSnapshots tests snapshot encoding and retention
+func TestStorageSnapshots(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.shard("user1").games["user1"] = gameRecords(map[int]int64{123: 5000})
+	encoded, err := encodeSnapshot(srv.storage.snapshot())
+	srv.storage.unlockAll()
+	if err != nil {
+		t.Fatalf("Failed to encode snapshot: %v", err)
+	}
+
+	data, err := decodeSnapshot(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to decode snapshot: %v", err)
+	}
+	if data.DeviceTokens["user1"] != testDeviceToken || data.Games["user1"][123].LastMove != 5000 {
+		t.Errorf("Snapshot did not round-trip: %+v", data)
+	}
+
+	if _, err := decodeSnapshot(strings.NewReader(`{"device_tokens":{}}`)); err == nil {
+		t.Error("Expected an uncompressed object to be rejected")
+	}
+
+	// Names sort by time, so the oldest are expired first
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 4; i >= 0; i-- {
+		names = append(names, "snapshots/"+at.Add(time.Duration(i)*time.Hour).Format(snapshotTimeFormat)+".json.gz")
+	}
+	expired := expiredSnapshots(names, 3)
+	if len(expired) != 2 || expired[0] != "snapshots/20260301T120000Z.json.gz" || expired[1] != "snapshots/20260301T130000Z.json.gz" {
+		t.Errorf("Expected the two oldest snapshots to expire, got %v", expired)
+	}
+	if expiredSnapshots(names[:2], 3) != nil {
+		t.Error("Expected nothing to expire under the limit")
+	}
+}
+
+// blockingBackend holds every save until released
+type blockingBackend struct {
+	saving  chan *storageFile
+	release chan struct{}
+}
+
+func (b blockingBackend) Name() string                 { return "blocking" }
+func (b blockingBackend) Load() (*storageFile, error)  { return &storageFile{}, nil }
+func (b blockingBackend) Save(data *storageFile) error { b.saving <- data; <-b.release; return nil }
+
+// TestSlowSaveDoesNotBlockStorage tests that storage can change while a save
+// is in progress, and that the WAL keeps entries the save didn't include
+func TestSlowSaveDoesNotBlockStorage(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	backend := blockingBackend{saving: make(chan *storageFile), release: make(chan struct{})}
+	srv.backend = backend
+
+	walPath := filepath.Join(t.TempDir(), "storage.wal")
+	if err := srv.openStorageWAL(walPath); err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer func() {
+		srv.wal.mu.Lock()
+		srv.wal.file.Close()
+		srv.wal.file = nil
+		srv.wal.mu.Unlock()
+	}()
+
+	srv.storage.lockAll()
+	srv.logStorageChange(walEntry{Op: walRegister, UserID: "user1", DeviceToken: testDeviceToken})
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.unlockAll()
+
+	done := make(chan struct{})
+	go func() {
+		srv.writeStorage()
+		close(done)
+	}()
+	saved := <-backend.saving
+
+	// The save is stuck in the backend; storage still accepts changes
+	locked := make(chan struct{})
+	go func() {
+		shard := srv.storage.shard("user2")
+		shard.mu.Lock()
+		srv.logStorageChange(walEntry{Op: walRegister, UserID: "user2", DeviceToken: testDeviceToken})
+		shard.deviceTokens["user2"] = testDeviceToken
+		shard.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Storage stayed locked during a slow save")
+	}
+
+	close(backend.release)
+	<-done
+
+	if _, included := saved.DeviceTokens["user2"]; included {
+		t.Error("Expected the save to hold a copy taken before the change")
+	}
+	entries, err := readWAL(walPath)
+	if err != nil || len(entries) != 1 || entries[0].UserID != "user2" {
+		t.Errorf("Expected only the unsaved change left in the WAL, got %+v %v", entries, err)
+	}
+
+	// The log was replaced rather than cut in place, and new entries go to it
+	shard := srv.storage.shard("user3")
+	shard.mu.Lock()
+	srv.logStorageChange(walEntry{Op: walRegister, UserID: "user3", DeviceToken: testDeviceToken})
+	shard.mu.Unlock()
+	entries, err = readWAL(walPath)
+	if err != nil || len(entries) != 2 || entries[1].UserID != "user3" {
+		t.Errorf("Expected new entries appended to the replaced WAL, got %+v %v", entries, err)
+	}
+	if leftovers, _ := filepath.Glob(walPath + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files left, got %v", leftovers)
+	}
+}
+
+// TestStorageShards tests that users are spread across shards and that state
+// round-trips through them
+func TestStorageShards(t *testing.T) {
+	t.Parallel()
+	used := make(map[int]bool)
+	for userID := 1; userID <= 1000; userID++ {
+		index := shardIndex(strconv.Itoa(userID))
+		if index < 0 || index >= storageShards || index != shardIndex(strconv.Itoa(userID)) {
+			t.Fatalf("Unexpected shard %d for user %d", index, userID)
+		}
+		used[index] = true
+	}
+	if len(used) != storageShards {
+		t.Errorf("Expected users in all %d shards, got %d", storageShards, len(used))
+	}
+
+	s := newMoveStorage()
+	s.apply(sampleBackendState())
+	for userID := range sampleBackendState().Games {
+		for i, shard := range s.shards {
+			if _, held := shard.games[userID]; held != (i == shardIndex(userID)) {
+				t.Errorf("Expected %s's games only in shard %d, found held=%v in shard %d", userID, shardIndex(userID), held, i)
+			}
+		}
+	}
+	want, got := sampleBackendState(), s.snapshot()
+	if !reflect.DeepEqual(got.Games, want.Games) || !reflect.DeepEqual(got.LastNotificationTime, want.LastNotificationTime) || !reflect.DeepEqual(got.Preferences, want.Preferences) {
+		t.Errorf("Expected the snapshot to gather every shard's users, got %+v", got)
+	}
+}
+
+// TestStateExportImport tests moving the complete state between servers
+func TestSyncMap(t *testing.T) {
+	t.Parallel()
+	m := newSyncMap[string, int]()
+	if _, ok := m.Load("a"); ok {
+		t.Fatal("Empty map should load nothing")
+	}
+
+	m.Store("a", 1)
+	if value, ok := m.Load("a"); !ok || value != 1 {
+		t.Errorf("Load after Store = %d, %v, want 1, true", value, ok)
+	}
+	m.Store("a", 2)
+	if value, _ := m.Load("a"); value != 2 {
+		t.Errorf("Store should replace the value, got %d", value)
+	}
+
+	// Update sees whether the key exists, and keeps what it returns
+	m.Update("b", func(value int, exists bool) (int, bool) {
+		if exists {
+			t.Error("Update of a missing key should report it doesn't exist")
+		}
+		return value + 10, true
+	})
+	m.Update("a", func(value int, exists bool) (int, bool) {
+		if !exists || value != 2 {
+			t.Errorf("Update got %d, %v, want 2, true", value, exists)
+		}
+		return value + 1, true
+	})
+	if value, _ := m.Load("a"); value != 3 {
+		t.Errorf("Updated a = %d, want 3", value)
+	}
+	if value, _ := m.Load("b"); value != 10 {
+		t.Errorf("Updated b = %d, want 10", value)
+	}
+
+	// Returning false removes the key
+	m.Update("b", func(value int, _ bool) (int, bool) { return value, false })
+	if _, ok := m.Load("b"); ok {
+		t.Error("Update returning false should remove the key")
+	}
+	m.Update("missing", func(value int, _ bool) (int, bool) { return value, false })
+	if m.Len() != 1 {
+		t.Errorf("Len = %d, want 1", m.Len())
+	}
+
+	// Concurrent updates of one key don't lose any
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Update("count", func(value int, _ bool) (int, bool) { return value + 1, true })
+		}()
+	}
+	wg.Wait()
+	if value, _ := m.Load("count"); value != 50 {
+		t.Errorf("Concurrent updates counted %d, want 50", value)
+	}
+
+	clone := m.Clone()
+	m.Delete("a")
+	if clone["a"] != 3 {
+		t.Error("Clone should be unaffected by later changes")
+	}
+	m.DeleteFunc(func(key string, _ int) bool { return key == "count" })
+	if m.Len() != 0 {
+		t.Errorf("Len after deletes = %d, want 0", m.Len())
+	}
+}
+
+func TestStateExportImport(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").deviceTokens["user1"] = testDeviceToken
+	srv.storage.shard("user1").games["user1"] = gameRecords(map[int]int64{123: 5000})
+	srv.storage.shard("user1").userscriptTokens["user1"] = "token-hash"
+	srv.storage.unlockAll()
+
+	rr := httptest.NewRecorder()
+	srv.exportState(rr, httptest.NewRequest("GET", "/admin/export", nil))
+	exported := rr.Body.String()
+
+	importDoc := func(body, query string) int {
+		rr := httptest.NewRecorder()
+		srv.importState(rr, httptest.NewRequest("POST", "/admin/import"+query, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	// Refuses to overwrite state unless asked
+	if code := importDoc(exported, ""); code != http.StatusConflict {
+		t.Errorf("Expected 409 importing over existing state, got %d", code)
+	}
+
+	tampered := strings.Replace(exported, "5000", "6000", 1)
+	srv.storage = newMoveStorage()
+	if code := importDoc(tampered, ""); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a modified export, got %d", code)
+	}
+
+	if code := importDoc(exported, ""); code != http.StatusOK {
+		t.Fatalf("Expected import to succeed, got %d", code)
+	}
+	if srv.storage.shard("user1").deviceTokens["user1"] != testDeviceToken || storedMove(srv, "user1", 123) != 5000 || srv.storage.shard("user1").userscriptTokens["user1"] != "token-hash" {
+		t.Error("Expected the imported state to be loaded")
+	}
+
+	// And written to the backend
+	srv.storage = newMoveStorage()
+	srv.loadStorage()
+	if storedMove(srv, "user1", 123) != 5000 {
+		t.Error("Expected the imported state to be saved")
+	}
+}
+
+func TestServersHaveIndependentStorage(t *testing.T) {
+	fakeOGSAccount(t, "")
+	for _, userID := range []string{"1001", "1002"} {
+		userID := userID
+		t.Run(userID, func(t *testing.T) {
+			t.Parallel()
+			backend := &memoryBackend{}
+			srv := newServer(backend, nil)
+
+			body := `{"user_id": "` + userID + `", "device_token": "` + testDeviceToken + `", "ogs_access_token": "token-` + userID + `"}`
+			rr := httptest.NewRecorder()
+			srv.registerDevice(rr, httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected registration to succeed, got %d", rr.Code)
+			}
+
+			if len(srv.storage.snapshot().DeviceTokens) != 1 || srv.storage.shard(userID).deviceTokens[userID] != testDeviceToken {
+				t.Errorf("Expected only user %s in this server's storage, got %v", userID, srv.storage.snapshot().DeviceTokens)
+			}
+			if len(backend.data.DeviceTokens) != 1 {
+				t.Errorf("Expected only this server's registration to be saved, got %v", backend.data.DeviceTokens)
+			}
+		})
+	}
+}
+
+// TestHealthStorageStats tests the storage counts reported on /health
+func TestHealthStorageStats(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+
+	srv.storage.shard("111").deviceTokens["111"] = testDeviceToken
+	srv.storage.shard("111").games["111"] = gameRecords(map[int]int64{1: 100, 2: 200})
+	srv.storage.shard("222").games["222"] = gameRecords(map[int]int64{3: 300})
+	srv.storage.shard("333").ntfyTopics["333"] = "https://ntfy.sh/topic"
+
+	before := time.Now().Unix()
+	srv.writeStorage()
+
+	rr := httptest.NewRecorder()
+	srv.healthCheck(rr, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Status  string       `json:"status"`
+		Storage StorageStats `json:"storage"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&health); err != nil {
+		t.Fatalf("Failed to decode health response: %v", err)
+	}
+
+	stats := health.Storage
+	if health.Status != "ok" || stats.Users != 3 || stats.Games != 3 || stats.DeviceTokens != 1 {
+		t.Errorf("Unexpected storage counts: %+v", stats)
+	}
+	if stats.LastSaveAt < before {
+		t.Errorf("Expected the last save time to be reported, got %d", stats.LastSaveAt)
+	}
+	if stats.SizeBytes == 0 {
+		t.Error("Expected the storage file size to be reported")
+	}
+}
+
+// TestGameRecords tests that per-game state from older versions is folded
+// into game records, and that commits count notifications per game
+func TestGameRecords(t *testing.T) {
+	srv := newTestServer(t)
+
+	legacy := `{"moves": {"user1": {"123": 1000}}, "device_tokens": {}, "last_notification_time": {},
+		"move_numbers": {"user1": {"123": 42}}, "game_labels": {"user1": {"456": ["league"]}}}`
+	os.WriteFile("legacy.json", []byte(legacy), 0600)
+	defer os.Remove("legacy.json")
+	data, err := readStorageFile("legacy.json")
+	if err != nil {
+		t.Fatalf("Failed to read legacy state: %v", err)
+	}
+	if data.Moves != nil || data.Games["user1"][123].MoveNumber != 42 || data.Games["user1"][456].Labels[0] != "league" {
+		t.Errorf("Expected the legacy maps to be folded into records, got %+v", data.Games["user1"])
+	}
+
+	// Databases written before records may hold move numbers without a last move
+	moveNumber := 9
+	rows := newPGRows()
+	rows.Users["user2"] = pgUser{HasMoveNumbers: true}
+	rows.Games[pgGameKey{"user2", 7}] = pgGame{MoveNumber: &moveNumber}
+	restored, err := fromPGRows(rows)
+	if err != nil || restored.Games["user2"][7] == nil || restored.Games["user2"][7].MoveNumber != 9 {
+		t.Errorf("Expected a record from the legacy row, got %v %v", restored, err)
+	}
+
+	srv.storage.lockAll()
+	srv.storage.shard("user1").applyCommit("user1", map[int]MoveState{123: {LastMove: 2000, MoveNumber: 43}}, true, 1700000000)
+	srv.storage.shard("user1").applyCommit("user1", map[int]MoveState{123: {LastMove: 3000, MoveNumber: 44}}, true, 1700000100)
+	record := *srv.storage.shard("user1").game("user1", 123)
+	srv.storage.unlockAll()
+	if record.NotifyCount != 2 || record.LastNotifiedAt != 1700000100 || record.MoveNumber != 44 {
+		t.Errorf("Expected two notifications recorded on the game, got %+v", record)
+	}
+}
+
+// TestStorageSnapshotCopy checks that saves copy every persisted field and
+// that the copy shares nothing with live state
+func TestStorageSnapshotCopy(t *testing.T) {
+	t.Parallel()
+	legacy := map[string]bool{"Moves": true, "MoveNumbers": true, "GameLabels": true}
+	empty := &storageFile{}
+	fields := reflect.ValueOf(empty).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		fields.Field(i).Set(reflect.MakeMap(fields.Field(i).Type()))
+	}
+	copied := reflect.ValueOf(empty.copy()).Elem()
+	for i := 0; i < copied.NumField(); i++ {
+		name := copied.Type().Field(i).Name
+		if copied.Field(i).IsNil() != legacy[name] {
+			t.Errorf("Field %s not copied as expected", name)
+		}
+	}
+
+	srv := newServer(&memoryBackend{}, nil)
+	srv.storage.shard("12345").gameRecord("12345", 1).Labels = []string{"club"}
+	srv.storage.shard("12345").preferences["12345"] = &UserPreferences{LabelRules: map[string]string{"club": "urgent"}}
+	srv.storage.shard("12345").pendingNotifications["12345"] = &PendingNotification{Games: map[int]MoveState{1: {LastMove: 1000}}, inFlight: true}
+	data := srv.storage.snapshot().copy()
+
+	srv.storage.shard("12345").game("12345", 1).Labels[0] = "ladder"
+	srv.storage.shard("12345").preferences["12345"].LabelRules["club"] = "mute"
+	srv.storage.shard("12345").pendingNotifications["12345"].Games[2] = MoveState{LastMove: 2000}
+	if got := data.Games["12345"][1].Labels[0]; got != "club" {
+		t.Errorf("Copied labels changed with live state: %q", got)
+	}
+	if got := data.Preferences["12345"].LabelRules["club"]; got != "urgent" {
+		t.Errorf("Copied preferences changed with live state: %q", got)
+	}
+	if pending := data.PendingNotifications["12345"]; len(pending.Games) != 1 || pending.inFlight {
+		t.Errorf("Expected the pending notification copied as persisted, got %+v", pending)
+	}
+}
+
+// BenchmarkStorageContention measures handler-like reads and checker-like
+// commits on a large state while storage is saved continuously, each taking
+// its user's shard lock or, for comparison, every lock as a single lock would
+func BenchmarkStorageContention(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const users, gamesPerUser = 5000, 20
+	srv := newServer(&memoryBackend{}, nil)
+	for i := 0; i < users; i++ {
+		userID := strconv.Itoa(i)
+		srv.storage.shard(userID).deviceTokens[userID] = testDeviceToken
+		srv.storage.shard(userID).preferences[userID] = &UserPreferences{DailyNotificationCap: 5}
+		for gameID := 0; gameID < gamesPerUser; gameID++ {
+			srv.storage.shard(userID).gameRecord(userID, gameID).LastMove = int64(gameID)
+		}
+	}
+
+	stop := make(chan struct{})
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.writeStorage()
+			}
+		}
+	}()
+
+	for _, global := range []bool{false, true} {
+		name := "shard lock"
+		if global {
+			name = "all locks"
+		}
+		b.Run(name, func(b *testing.B) {
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(n.Add(1))
+					userID := strconv.Itoa(i % users)
+					shard := srv.storage.shard(userID)
+					switch {
+					case i%10 != 0 && global:
+						srv.storage.rlockAll()
+						shard.game(userID, i%gamesPerUser)
+						srv.storage.runlockAll()
+					case i%10 != 0:
+						srv.isNewTurnAt(userID, i%gamesPerUser, 0, int64(i))
+					case global:
+						srv.storage.lockAll()
+						shard.applyCommit(userID, map[int]MoveState{i % gamesPerUser: {LastMove: int64(i)}}, true, int64(i))
+						srv.storage.unlockAll()
+					default:
+						shard.mu.Lock()
+						shard.applyCommit(userID, map[int]MoveState{i % gamesPerUser: {LastMove: int64(i)}}, true, int64(i))
+						shard.mu.Unlock()
+					}
+				}
+			})
+		})
+	}
+	close(stop)
+	<-saved
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// storageWriter batches saves: saveStorage marks storage dirty and a
+// background goroutine writes it at most once per flush interval, so request
+// handlers and checks never wait on the backend. Until the writer is started
+// (and in tests), saves are written immediately.
+type storageWriter struct {
+	mu      sync.Mutex
+	started bool
+	dirty   bool
+}
+
+// storageFlushInterval reads STORAGE_FLUSH_INTERVAL_SECONDS, defaulting to 2
+// seconds. 0 writes on every save.
+func storageFlushInterval() time.Duration {
+	if intervalStr := os.Getenv("STORAGE_FLUSH_INTERVAL_SECONDS"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval >= 0 {
+			return time.Duration(interval) * time.Second
+		}
+	}
+	return 2 * time.Second
+}
+
+// saveStorage persists storage, in the background once the writer is running
+func (srv *Server) saveStorage() {
+	srv.writer.mu.Lock()
+	if srv.writer.started {
+		srv.writer.dirty = true
+		srv.writer.mu.Unlock()
+		return
+	}
+	srv.writer.mu.Unlock()
+
+	if err := srv.writeStorage(); err != nil {
+		srv.retryStorageWrite()
+	}
+}
+
+// retryStorageWrite has the background writer save storage again on its next
+// flush after a write failed, even if nothing else changes meanwhile. Before
+// the writer starts, its first flush does.
+func (srv *Server) retryStorageWrite() {
+	srv.writer.mu.Lock()
+	srv.writer.dirty = true
+	srv.writer.mu.Unlock()
+}
+
+// startStorageWriter starts flushing dirty storage every interval
+func (srv *Server) startStorageWriter(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Storage writes are synchronous (STORAGE_FLUSH_INTERVAL_SECONDS=0)")
+		return
+	}
+
+	srv.writer.mu.Lock()
+	srv.writer.started = true
+	srv.writer.mu.Unlock()
+
+	log.Printf("Flushing storage changes every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			srv.flushStorage()
+		}
+	}()
+}
+
+// flushStorage writes storage now if it has unsaved changes. Changes made
+// during the write, or the write failing, mark it dirty again for the next
+// flush.
+func (srv *Server) flushStorage() {
+	srv.writer.mu.Lock()
+	dirty := srv.writer.dirty
+	srv.writer.dirty = false
+	srv.writer.mu.Unlock()
+
+	if dirty {
+		if err := srv.writeStorage(); err != nil {
+			srv.retryStorageWrite()
+		}
+	}
+}
+
+// flushStorageOnShutdown writes pending changes, and a final snapshot when
+// snapshots are enabled, before the process exits on SIGINT or SIGTERM (sent
+// by Cloud Run and most process managers)
+func (srv *Server) flushStorageOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("Received %v, flushing storage before exit", sig)
+	srv.flushStorage()
+	if srv.snapshots != nil {
+		if err := srv.snapshots.upload(time.Now()); err != nil {
+			log.Printf("Error uploading final storage snapshot: %v", err)
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"maps"
+	"sync"
+)
+
+// syncMap is a map with its own lock, for state shared between checks and
+// handlers: caches, throttles and backoffs, and the parts of MoveStorage that
+// aren't a user's, like tenants and Discord clubs. Values are replaced rather
+// than changed in place, so a value loaded or cloned stays safe to read.
+type syncMap[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]V
+}
+
+func newSyncMap[K comparable, V any]() *syncMap[K, V] {
+	return &syncMap[K, V]{m: make(map[K]V)}
+}
+
+// Load returns the value stored for key, if any
+func (s *syncMap[K, V]) Load(key K) (V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.m[key]
+	return value, ok
+}
+
+// Store sets the value for key
+func (s *syncMap[K, V]) Store(key K, value V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = value
+}
+
+// Delete removes key
+func (s *syncMap[K, V]) Delete(key K) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+}
+
+// Update replaces the value for key with what update returns, given the
+// current value, under one lock. Returning false removes the key.
+func (s *syncMap[K, V]) Update(key K, update func(value V, exists bool) (V, bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.m[key]
+	if value, keep := update(current, exists); keep {
+		s.m[key] = value
+	} else {
+		delete(s.m, key)
+	}
+}
+
+// DeleteFunc removes every key del returns true for, under one lock
+func (s *syncMap[K, V]) DeleteFunc(del func(key K, value V) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.DeleteFunc(s.m, del)
+}
+
+// Range calls f for each key and value until it returns false. The map is
+// read-locked throughout, so f mustn't change it.
+func (s *syncMap[K, V]) Range(f func(key K, value V) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, value := range s.m {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys
+func (s *syncMap[K, V]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
+
+// Clone returns a copy of the map. The values are shared.
+func (s *syncMap[K, V]) Clone() map[K]V {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.m)
+}
+
+// Replace swaps in m as the map's contents
+func (s *syncMap[K, V]) Replace(m map[K]V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = m
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Telegram delivers notifications through a bot, for players who'd rather
+// get them in a chat than from the iOS app. The user links the chat the bot
+// should write to by its chat ID, which the bot tells them when they send it
+// /start (with the webhook set up). Messages about a game have an "Open game"
+// button. With TELEGRAM=true the bot token is read from TELEGRAM_BOT_TOKEN,
+// or from the telegram-bot-token secret in Secret Manager.
+
+// telegramAPIURL is the Bot API server
+var telegramAPIURL = "https://api.telegram.org"
+
+// errTelegramChatGone is returned when the bot can no longer write to the
+// chat, because the user blocked it or deleted the chat
+var errTelegramChatGone = errors.New("telegram chat is gone")
+
+// telegramEnabled reads TELEGRAM
+func telegramEnabled() bool {
+	return os.Getenv("TELEGRAM") == "true"
+}
+
+// telegramSender sends messages as the server's bot
+type telegramSender struct {
+	token  string
+	client *http.Client
+}
+
+// configureTelegram loads the bot token from TELEGRAM_BOT_TOKEN, or from
+// Secret Manager when it isn't set
+func configureTelegram() (*telegramSender, error) {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		log.Println("Loading Telegram bot token from Secret Manager...")
+		var err error
+		if token, err = getSecret("telegram-bot-token"); err != nil {
+			return nil, fmt.Errorf("failed to load Telegram bot token")
+		}
+	}
+	return &telegramSender{token: token, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// TelegramLink is the chat a user's notifications are sent to
+type TelegramLink struct {
+	ChatID int64 `json:"chat_id"`
+}
+
+// telegramMessage is the Bot API's sendMessage request
+type telegramMessage struct {
+	ChatID      int64                `json:"chat_id"`
+	Text        string               `json:"text"`
+	ParseMode   string               `json:"parse_mode"`
+	ReplyMarkup *telegramReplyMarkup `json:"reply_markup,omitempty"`
+}
+
+type telegramReplyMarkup struct {
+	InlineKeyboard [][]telegramButton `json:"inline_keyboard"`
+}
+
+type telegramButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// send writes a notification to the chat, with an "Open game" button for
+// gameURL if it's set
+func (s *telegramSender) send(chatID int64, title, body, gameURL string) error {
+	message := telegramMessage{
+		ChatID:    chatID,
+		Text:      "<b>" + html.EscapeString(title) + "</b>\n" + html.EscapeString(body),
+		ParseMode: "HTML",
+	}
+	if gameURL != "" {
+		message.ReplyMarkup = &telegramReplyMarkup{InlineKeyboard: [][]telegramButton{{{Text: "Open game", URL: gameURL}}}}
+	}
+	return s.call("sendMessage", message)
+}
+
+// call makes a Bot API request. Telegram answers 403 once the user blocks the
+// bot, and 400 "chat not found" for a chat it can't write to.
+func (s *telegramSender) call(method string, request interface{}) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(fmt.Sprintf("%s/bot%s/%s", telegramAPIURL, s.token, method), "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		// The error's URL carries the token
+		return fmt.Errorf("telegram request failed")
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch {
+	case result.OK:
+		return nil
+	case resp.StatusCode == http.StatusForbidden || (resp.StatusCode == http.StatusBadRequest && result.Description == "Bad Request: chat not found"):
+		return fmt.Errorf("%w: %s", errTelegramChatGone, result.Description)
+	default:
+		return fmt.Errorf("telegram returned status %d: %s", resp.StatusCode, result.Description)
+	}
+}
+
+// telegramChatFor returns the user's linked chat, if any
+func (srv *Server) telegramChatFor(userID string) (int64, bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	chatID, exists := shard.telegramChats[userID]
+	return chatID, exists && srv.telegram != nil
+}
+
+// sendTelegram writes a notification to the user's chat. A chat the bot can
+// no longer write to is unlinked, so it isn't tried again.
+func (srv *Server) sendTelegram(userID string, chatID int64, title, body, gameURL string) error {
+	err := srv.telegram.send(chatID, title, body, gameURL)
+	if !errors.Is(err, errTelegramChatGone) {
+		return err
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if current, exists := shard.telegramChats[userID]; exists && current == chatID {
+		delete(shard.telegramChats, userID)
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+	srv.saveStorage()
+	log.Printf("Unlinked Telegram chat for user %s: %v", userID, err)
+	return err
+}
+
+// setTelegramChat handles PUT /telegram/{userID}. A test message is sent
+// first, so a wrong chat ID, or a chat that hasn't started the bot, is
+// rejected rather than silently dropping turns.
+func (srv *Server) setTelegramChat(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if srv.telegram == nil {
+		http.Error(w, "Telegram is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var link TelegramLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if link.ChatID == 0 {
+		http.Error(w, "chat_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := srv.telegram.send(link.ChatID, "OGS notifications", "You'll get a message here when it's your turn.", ""); err != nil {
+		log.Printf("Telegram test message for user %s failed: %v", userID, err)
+		http.Error(w, "Could not send to this chat", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.telegramChats[userID] = link.ChatID
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Linked Telegram chat for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTelegramChat handles DELETE /telegram/{userID}
+func (srv *Server) deleteTelegramChat(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.telegramChats[userID]
+	delete(shard.telegramChats, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No Telegram chat linked", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Unlinked Telegram chat for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiveTelegramUpdate handles the bot's webhook, answering every message
+// with the chat ID to link. Telegram signs its calls with the secret token
+// given to setWebhook, TELEGRAM_WEBHOOK_SECRET; without one the webhook is off.
+func (srv *Server) receiveTelegramUpdate(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("TELEGRAM_WEBHOOK_SECRET")
+	given := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if srv.telegram == nil || secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var update struct {
+		Message *struct {
+			Chat struct {
+				ID int64 `json:"id"`
+			} `json:"chat"`
+		} `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Anything other than a message is acknowledged and ignored
+	if update.Message != nil {
+		chatID := update.Message.Chat.ID
+		reply := fmt.Sprintf("Your chat ID is %d. Enter it in the app to get your OGS notifications here.", chatID)
+		if err := srv.telegram.send(chatID, "OGS notifications", reply, ""); err != nil {
+			log.Printf("Telegram reply to chat %d failed: %v", chatID, err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
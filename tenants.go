@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tenantUsageDays is how many days of notification counts a tenant keeps
+const tenantUsageDays = 31
+
+// tenantIDPrefix starts every tenant ID. Per-user storage backends keep each
+// top-level key as its own document, so the prefix keeps tenants apart from
+// OGS user IDs there.
+const tenantIDPrefix = "tenant-"
+
+// Tenant is an app developer using the hosted service. Requests carrying the
+// tenant's API key act for it, and only reach users registered with that key.
+// Users registered without a key belong to the service's own app.
+type Tenant struct {
+	ID                     string         `json:"id"`
+	Name                   string         `json:"name"`
+	APIKeyHash             string         `json:"api_key_hash"`
+	MaxUsers               int            `json:"max_users"`                 // 0 = unlimited
+	MaxNotificationsPerDay int            `json:"max_notifications_per_day"` // 0 = unlimited
+	CreatedAt              int64          `json:"created_at"`
+	Notifications          map[string]int `json:"notifications,omitempty"` // UTC day -> pushes delivered
+}
+
+// TenantUsage is a tenant's quotas and metered usage
+type TenantUsage struct {
+	TenantID               string           `json:"tenant_id"`
+	Name                   string           `json:"name"`
+	Users                  int              `json:"users"`
+	MaxUsers               int              `json:"max_users"`
+	NotificationsToday     int              `json:"notifications_today"`
+	MaxNotificationsPerDay int              `json:"max_notifications_per_day"`
+	Days                   []TenantUsageDay `json:"days"`
+}
+
+type TenantUsageDay struct {
+	Day           string `json:"day"`
+	Notifications int    `json:"notifications"`
+}
+
+type tenantContextKey struct{}
+
+// usageDay is the UTC day tenant usage is counted against
+func usageDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// tenantFromRequest returns the tenant the request acts for, or "" for the
+// service's own app
+func tenantFromRequest(r *http.Request) string {
+	tenantID, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenantID
+}
+
+// tenantForAPIKey returns the ID of the tenant holding key
+func (s *MoveStorage) tenantForAPIKey(key string) (string, bool) {
+	hash := hashUserscriptToken(key)
+	found := ""
+	s.tenants.Range(func(tenantID string, tenant *Tenant) bool {
+		if subtle.ConstantTimeCompare([]byte(tenant.APIKeyHash), []byte(hash)) == 1 {
+			found = tenantID
+			return false
+		}
+		return true
+	})
+	return found, found != ""
+}
+
+// tenantUserCount counts the users registered with a tenant, locking each
+// shard in turn. Callers must hold no shard's lock.
+func (s *MoveStorage) tenantUserCount(tenantID string) int {
+	count := 0
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for _, userTenant := range shard.userTenants {
+			if userTenant == tenantID {
+				count++
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
+// userTenant returns the tenant the user registered with, or "" for the
+// service's own app
+func (srv *Server) userTenant(userID string) string {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.userTenants[userID]
+}
+
+// tenantMiddleware resolves the X-API-Key header to a tenant and keeps the
+// request to that tenant's users: a {userID} registered with another tenant
+// (or with none, when a key is given) is not found.
+func (srv *Server) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID := ""
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			found, ok := srv.storage.tenantForAPIKey(key)
+			if !ok {
+				log.Printf("Rejected unknown API key from %s", r.RemoteAddr)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			tenantID = found
+		}
+
+		if userID, ok := mux.Vars(r)["userID"]; ok {
+			if srv.userTenant(userID) != tenantID {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenantID)))
+	})
+}
+
+// requestReachesUser reports whether the request's tenant may act for the
+// user, for endpoints that take the user ID in the body rather than the path
+func (srv *Server) requestReachesUser(r *http.Request, userID string) bool {
+	return srv.userTenant(userID) == tenantFromRequest(r)
+}
+
+// claimUserForTenant records that a user registered through the tenant,
+// enforcing its user quota. A user already registered with a different
+// tenant can't be claimed. Callers must hold claims, which keeps claims one at
+// a time, and no shard's lock.
+func (s *MoveStorage) claimUserForTenant(userID, tenantID string) error {
+	shard := s.shard(userID)
+	shard.mu.RLock()
+	current, registered := shard.userTenants[userID]
+	if !registered && shard.deviceTokens[userID] == "" && shard.ntfyTopics[userID] == "" && shard.webPushSubscriptions[userID] == nil && shard.telegramChats[userID] == 0 && shard.discordWebhooks[userID] == "" && shard.userWebhooks[userID] == nil && shard.slackDestinations[userID] == nil {
+		current = tenantID
+	}
+	shard.mu.RUnlock()
+	if current != tenantID {
+		return fmt.Errorf("user %s belongs to another tenant", userID)
+	}
+	if tenantID == "" || registered {
+		return nil
+	}
+
+	tenant, _ := s.tenants.Load(tenantID)
+	if tenant.MaxUsers > 0 && s.tenantUserCount(tenantID) >= tenant.MaxUsers {
+		return fmt.Errorf("tenant %s has reached its limit of %d users", tenantID, tenant.MaxUsers)
+	}
+	shard.mu.Lock()
+	shard.userTenants[userID] = tenantID
+	shard.mu.Unlock()
+	return nil
+}
+
+// tenantQuotaReached reports whether the user's tenant has used today's
+// notification quota
+func (srv *Server) tenantQuotaReached(userID string, now time.Time) bool {
+	tenantID := srv.userTenant(userID)
+	if tenantID == "" {
+		return false
+	}
+	tenant, _ := srv.storage.tenants.Load(tenantID)
+	if tenant == nil || tenant.MaxNotificationsPerDay <= 0 {
+		return false
+	}
+	return tenant.Notifications[usageDay(now)] >= tenant.MaxNotificationsPerDay
+}
+
+// meterTenantNotification counts a delivered push against the user's tenant
+func (srv *Server) meterTenantNotification(userID string, now time.Time) {
+	tenantID := srv.userTenant(userID)
+	if tenantID == "" {
+		return
+	}
+	srv.storage.tenants.Update(tenantID, func(tenant *Tenant, exists bool) (*Tenant, bool) {
+		if !exists {
+			return nil, false
+		}
+
+		today := usageDay(now)
+		counts := make(map[string]int, len(tenant.Notifications)+1)
+		oldest := usageDay(now.AddDate(0, 0, -tenantUsageDays+1))
+		for day, count := range tenant.Notifications {
+			if day >= oldest {
+				counts[day] = count
+			}
+		}
+		counts[today]++
+
+		// Replaced rather than changed in place: snapshots share the tenant
+		metered := *tenant
+		metered.Notifications = counts
+		return &metered, true
+	})
+}
+
+// tenantUsage reports a tenant's quotas and usage. Callers must hold no
+// shard's lock.
+func (s *MoveStorage) tenantUsage(tenant *Tenant, now time.Time) TenantUsage {
+	usage := TenantUsage{
+		TenantID:               tenant.ID,
+		Name:                   tenant.Name,
+		Users:                  s.tenantUserCount(tenant.ID),
+		MaxUsers:               tenant.MaxUsers,
+		NotificationsToday:     tenant.Notifications[usageDay(now)],
+		MaxNotificationsPerDay: tenant.MaxNotificationsPerDay,
+		Days:                   []TenantUsageDay{},
+	}
+	for day, count := range tenant.Notifications {
+		usage.Days = append(usage.Days, TenantUsageDay{Day: day, Notifications: count})
+	}
+	sort.Slice(usage.Days, func(i, j int) bool { return usage.Days[i].Day > usage.Days[j].Day })
+	return usage
+}
+
+// CreateTenantRequest is the body of POST /admin/tenants
+type CreateTenantRequest struct {
+	Name                   string `json:"name"`
+	MaxUsers               int    `json:"max_users"`
+	MaxNotificationsPerDay int    `json:"max_notifications_per_day"`
+}
+
+// createTenant handles POST /admin/tenants. The API key is only ever
+// returned here; the server keeps its hash.
+func (srv *Server) createTenant(w http.ResponseWriter, r *http.Request) {
+	var req CreateTenantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "name is required (at most 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUsers < 0 || req.MaxNotificationsPerDay < 0 {
+		http.Error(w, "Quotas must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 4)
+	key := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Failed to create tenant", http.StatusInternalServerError)
+		return
+	}
+	if _, err := rand.Read(key); err != nil {
+		http.Error(w, "Failed to create tenant", http.StatusInternalServerError)
+		return
+	}
+	apiKey := hex.EncodeToString(key)
+
+	tenant := &Tenant{
+		ID:                     tenantIDPrefix + hex.EncodeToString(id),
+		Name:                   req.Name,
+		APIKeyHash:             hashUserscriptToken(apiKey),
+		MaxUsers:               req.MaxUsers,
+		MaxNotificationsPerDay: req.MaxNotificationsPerDay,
+		CreatedAt:              time.Now().Unix(),
+	}
+
+	srv.storage.tenants.Store(tenant.ID, tenant)
+	srv.saveStorage()
+
+	log.Printf("Created tenant %s (%s): max %d users, %d notifications/day", tenant.ID, tenant.Name, tenant.MaxUsers, tenant.MaxNotificationsPerDay)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"tenant": tenant, "api_key": apiKey})
+}
+
+// listTenants handles GET /admin/tenants
+func (srv *Server) listTenants(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	// Counting users locks shards, so not while ranging over the tenants
+	tenants := make([]TenantUsage, 0, srv.storage.tenants.Len())
+	for _, tenant := range srv.storage.tenants.Clone() {
+		tenants = append(tenants, srv.storage.tenantUsage(tenant, now))
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].TenantID < tenants[j].TenantID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenants)
+}
+
+// getTenantUsage handles GET /admin/tenants/{tenantID}/usage, and GET
+// /tenant/usage for the tenant whose API key is given
+func (srv *Server) getTenantUsage(w http.ResponseWriter, r *http.Request) {
+	tenantID, ok := mux.Vars(r)["tenantID"]
+	if !ok {
+		tenantID = tenantFromRequest(r)
+		if tenantID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	tenant, _ := srv.storage.tenants.Load(tenantID)
+	var usage TenantUsage
+	if tenant != nil {
+		usage = srv.storage.tenantUsage(tenant, time.Now())
+	}
+
+	if tenant == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
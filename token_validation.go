@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+type TokenValidationRequest struct {
+	DeviceToken     string `json:"device_token"`
+	APNsEnvironment string `json:"apns_environment,omitempty"`
+}
+
+type TokenValidationResult struct {
+	Valid      bool   `json:"valid"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+}
+
+// tokenReasonHints explains the APNs rejections onboarding most often hits
+var tokenReasonHints = map[string]string{
+	apns2.ReasonBadDeviceToken:         "token is malformed or from the other APNs environment (sandbox vs production)",
+	apns2.ReasonUnregistered:           "app was uninstalled or notifications were revoked on the device",
+	apns2.ReasonDeviceTokenNotForTopic: "token belongs to a different app bundle",
+	apns2.ReasonMissingDeviceToken:     "device token is empty",
+}
+
+// validateDeviceToken checks a token by sending it a silent background push:
+// APNs runs its full token checks, but nothing is shown on the device
+func (srv *Server) validateDeviceToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenValidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.DeviceToken == "" {
+		http.Error(w, "device_token is required", http.StatusBadRequest)
+		return
+	}
+	if !validAPNsEnvironment(req.APNsEnvironment) {
+		http.Error(w, "apns_environment must be sandbox or production", http.StatusBadRequest)
+		return
+	}
+
+	if srv.apns == nil {
+		http.Error(w, "Push notifications unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	notification := &apns2.Notification{
+		DeviceToken: req.DeviceToken,
+		Topic:       apnsTopic(),
+		// Background pushes must use priority 5; expiration 0 tells APNs
+		// not to store it if the device is offline
+		PushType:   apns2.PushTypeBackground,
+		Priority:   apns2.PriorityLow,
+		Expiration: time.Unix(0, 0),
+		Payload:    payload.NewPayload().ContentAvailable().Custom("action", "validate_token"),
+	}
+
+	res, err := srv.pushAPNs(notification, req.APNsEnvironment)
+	if err != nil {
+		log.Printf("Token validation push failed (token length: %d): %v", len(req.DeviceToken), err)
+		http.Error(w, "Failed to reach APNs", http.StatusBadGateway)
+		return
+	}
+
+	result := TokenValidationResult{
+		Valid:      res.Sent(),
+		StatusCode: res.StatusCode,
+		Reason:     res.Reason,
+		Hint:       tokenReasonHints[res.Reason],
+	}
+
+	log.Printf("Validated device token (length: %d): valid=%t status=%d reason=%s",
+		len(req.DeviceToken), result.Valid, result.StatusCode, result.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
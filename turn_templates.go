@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A turn template is the user's own wording for the push about a new turn in
+// one game, e.g. "⚫ {{opponent}} played — your move in {{game}}". Only the
+// placeholders below are replaced, in a single pass, so text coming from OGS
+// is inserted as it is and never read as a placeholder itself.
+
+const maxTurnTemplateLength = 200
+
+// turnTemplatePlaceholders are the names a template can use
+var turnTemplatePlaceholders = map[string]bool{
+	"opponent": true,
+	"game":     true,
+	"move":     true,
+}
+
+// validateTurnTemplate checks a template's length, characters and
+// placeholders, returning the problem or ""
+func validateTurnTemplate(template string) string {
+	if utf8.RuneCountInString(template) > maxTurnTemplateLength {
+		return "turn_template must be at most 200 characters"
+	}
+	if !utf8.ValidString(template) || strings.IndexFunc(template, unicode.IsControl) >= 0 {
+		return "turn_template must be plain text on one line"
+	}
+	rest := template
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return "turn_template has an unclosed {{"
+		}
+		if name := rest[start+2 : start+end]; !turnTemplatePlaceholders[name] {
+			return "turn_template placeholders must be {{opponent}}, {{game}} or {{move}}"
+		}
+		rest = rest[start+end+2:]
+	}
+	return ""
+}
+
+// renderTurnTemplate fills in a template for a new turn in the game
+func renderTurnTemplate(template string, userID int, game Game) string {
+	opponent := game.Opponent(userID).Username
+	if opponent == "" {
+		opponent = "your opponent"
+	}
+	name := game.Name
+	if name == "" {
+		name = "game " + strconv.Itoa(game.ID)
+	}
+	return strings.NewReplacer(
+		"{{opponent}}", opponent,
+		"{{game}}", name,
+		"{{move}}", strconv.Itoa(game.MoveNumber()),
+	).Replace(template)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// timeoutSoonWithin is how close to running out of time a game must be to be
+// flagged as approaching timeout
+const timeoutSoonWithin = 24 * time.Hour
+
+// TurnAgeBuckets groups games by how long they've been waiting on the user
+type TurnAgeBuckets struct {
+	UnderOneDay    []int `json:"under_1d"`
+	OneToThreeDays []int `json:"1d_to_3d"`
+	OverThreeDays  []int `json:"over_3d"`
+}
+
+// addTurnUrgency buckets the user's older turns by waiting time and flags
+// games where the user's clock runs out within timeoutSoonWithin. now should
+// be on OGS's clock.
+func addTurnUrgency(status *TurnStatus, userID int, games []Game, now time.Time) {
+	byID := make(map[int]Game, len(games))
+	for _, game := range games {
+		byID[game.ID] = game
+	}
+
+	buckets := &TurnAgeBuckets{UnderOneDay: []int{}, OneToThreeDays: []int{}, OverThreeDays: []int{}}
+	for _, gameID := range status.YourTurnOld {
+		lastMove := byID[gameID].JSON.Clock.LastMove
+		waiting := time.Duration(0)
+		if lastMove > 0 {
+			waiting = now.Sub(time.UnixMilli(lastMove))
+		}
+
+		switch {
+		case waiting < 24*time.Hour:
+			buckets.UnderOneDay = append(buckets.UnderOneDay, gameID)
+		case waiting <= 72*time.Hour:
+			buckets.OneToThreeDays = append(buckets.OneToThreeDays, gameID)
+		default:
+			buckets.OverThreeDays = append(buckets.OverThreeDays, gameID)
+		}
+	}
+	status.YourTurnOldByAge = buckets
+
+	status.TimeoutSoon = []int{}
+	for _, game := range games {
+		if !game.IsTurnOf(userID) || game.IsPaused() {
+			continue
+		}
+		// OGS sets expiration to when the player to move runs out of time
+		expiration := game.JSON.Clock.Expiration
+		if expiration > 0 && time.UnixMilli(expiration).Sub(now) <= timeoutSoonWithin {
+			status.TimeoutSoon = append(status.TimeoutSoon, game.ID)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A user webhook receives every notification as a JSON event, for automations
+// of the user's own. Each event is signed with a secret the server generates
+// when the webhook is set: the X-OGS-Signature header is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">", so the
+// receiver can check the event came from here and isn't a replay.
+
+// errUserWebhookGone is returned when the receiver answers 410 Gone, asking
+// not to be called again
+var errUserWebhookGone = errors.New("webhook is gone")
+
+// UserWebhook is where a user's events are posted, and the secret they're
+// signed with
+type UserWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// WebhookEvent is the body of a webhook call
+type WebhookEvent struct {
+	Event   string `json:"event"` // "turn", another event type, or "ping" when the webhook is set
+	UserID  string `json:"user_id"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	URL     string `json:"url,omitempty"`
+	GameID  int    `json:"game_id,omitempty"`
+	GameIDs []int  `json:"game_ids,omitempty"` // for turns, every game with a new turn
+	SentAt  int64  `json:"sent_at"`
+}
+
+// webhookClient calls user webhooks
+var webhookClient = newPublicClient()
+
+// newPublicClient returns a client for URLs users give. It only connects to
+// public addresses and doesn't follow redirects, so a URL can't reach the
+// server's own network.
+func newPublicClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddressOnly}).DialContext,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// publicAddressOnly refuses connections to loopback, private, link-local and
+// unspecified addresses
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+// validateUserWebhookURL checks the URL is https, without credentials
+func validateUserWebhookURL(webhookURL string) error {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" || parsed.User != nil || len(webhookURL) > 2048 {
+		return fmt.Errorf("url must be an https URL")
+	}
+	return nil
+}
+
+// signWebhook returns the X-OGS-Signature header for a body sent at now
+func signWebhook(secret string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postUserWebhook sends a signed event to the webhook
+func postUserWebhook(webhook *UserWebhook, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ogs-notifications-server")
+	req.Header.Set("X-OGS-Event", event.Event)
+	req.Header.Set("X-OGS-Signature", signWebhook(webhook.Secret, body, time.Unix(event.SentAt, 0)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errUserWebhookGone
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// userWebhookFor returns the user's webhook, if they've set one
+func (srv *Server) userWebhookFor(userID string) (*UserWebhook, bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	webhook, exists := shard.userWebhooks[userID]
+	if !exists {
+		return nil, false
+	}
+	copied := *webhook
+	return &copied, true
+}
+
+// sendUserWebhook posts an event to the user's webhook. A webhook that
+// answers 410 is removed, so it isn't called again.
+func (srv *Server) sendUserWebhook(userID string, webhook *UserWebhook, event WebhookEvent) error {
+	event.UserID = userID
+	event.SentAt = time.Now().Unix()
+	err := postUserWebhook(webhook, event)
+	if !errors.Is(err, errUserWebhookGone) {
+		return err
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if current := shard.userWebhooks[userID]; current != nil && current.URL == webhook.URL {
+		delete(shard.userWebhooks, userID)
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+	srv.saveStorage()
+	log.Printf("Removed webhook for user %s: it answered 410", userID)
+	return err
+}
+
+// setUserWebhook handles PUT /webhook/{userID}. A ping event is sent first,
+// so a webhook that doesn't answer is rejected rather than silently dropping
+// turns. The response has the new signing secret; setting the webhook again
+// replaces it.
+func (srv *Server) setUserWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateUserWebhookURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	webhook := &UserWebhook{URL: req.URL, Secret: hex.EncodeToString(secret)}
+
+	ping := WebhookEvent{Event: "ping", UserID: userID, Title: "OGS notifications", Body: "You'll get an event here when it's your turn.", SentAt: time.Now().Unix()}
+	if err := postUserWebhook(webhook, ping); err != nil {
+		log.Printf("Webhook ping for user %s failed: %v", userID, err)
+		http.Error(w, "Could not call this webhook", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.userWebhooks[userID] = webhook
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Set webhook for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// deleteUserWebhook handles DELETE /webhook/{userID}
+func (srv *Server) deleteUserWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.userWebhooks[userID]
+	delete(shard.userWebhooks, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No webhook set", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Removed webhook for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Browser userscripts poll a small per-user summary to drive a badge on
+// online-go.com. They run on another origin and can't keep secrets in
+// headers easily, so the endpoint allows CORS and accepts its access token in
+// the query string. The summary is served from the last background check and
+// never triggers an OGS request.
+
+// TurnSummary is the userscript polling payload
+type TurnSummary struct {
+	UserID      string      `json:"user_id"`
+	YourTurn    int         `json:"your_turn"`
+	YourTurnNew int         `json:"your_turn_new"`
+	NewestGame  *NewestTurn `json:"newest_game,omitempty"`
+	CheckedAt   int64       `json:"checked_at"`
+}
+
+// NewestTurn is the game that most recently became the user's turn
+type NewestTurn struct {
+	GameID int    `json:"game_id"`
+	Name   string `json:"name,omitempty"`
+	URL    string `json:"url"`
+	Since  int64  `json:"since"` // unix ms of the opponent's move
+}
+
+// recordTurnSummary caches the polling payload after a successful check
+func (srv *Server) recordTurnSummary(userID string, status *TurnStatus, games []Game, now time.Time) {
+	summary := TurnSummary{
+		UserID:      userID,
+		YourTurn:    len(status.YourTurnNew) + len(status.YourTurnOld),
+		YourTurnNew: len(status.YourTurnNew),
+		CheckedAt:   now.Unix(),
+	}
+
+	yourTurn := make(map[int]bool, summary.YourTurn)
+	for _, gameID := range append(append([]int{}, status.YourTurnNew...), status.YourTurnOld...) {
+		yourTurn[gameID] = true
+	}
+	for _, game := range games {
+		if !yourTurn[game.ID] {
+			continue
+		}
+		if summary.NewestGame == nil || game.JSON.Clock.LastMove > summary.NewestGame.Since {
+			summary.NewestGame = &NewestTurn{
+				GameID: game.ID,
+				Name:   game.Name,
+				URL:    ogsGameLink(game.ID),
+				Since:  game.JSON.Clock.LastMove,
+			}
+		}
+	}
+
+	srv.turnSummaries.Store(userID, summary)
+}
+
+func hashUserscriptToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type UserscriptTokenRequest struct {
+	UserID      string `json:"user_id"`
+	DeviceToken string `json:"device_token"`
+}
+
+// createUserscriptToken issues a userscript access token to the holder of the
+// user's registered device token. Issuing a new token revokes the old one.
+func (srv *Server) createUserscriptToken(w http.ResponseWriter, r *http.Request) {
+	var req UserscriptTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.DeviceToken == "" {
+		http.Error(w, "user_id and device_token are required", http.StatusBadRequest)
+		return
+	}
+
+	shard := srv.storage.shard(req.UserID)
+	shard.mu.RLock()
+	registered := shard.deviceTokens[req.UserID]
+	shard.mu.RUnlock()
+
+	if registered == "" || subtle.ConstantTimeCompare([]byte(registered), []byte(req.DeviceToken)) != 1 {
+		log.Printf("Rejected userscript token request for user %s", req.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(raw)
+
+	shard.mu.Lock()
+	shard.userscriptTokens[req.UserID] = hashUserscriptToken(token)
+	shard.mu.Unlock()
+	srv.saveStorage()
+
+	log.Printf("Issued userscript token for user %s", req.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// userscriptTokenValid checks a token from ?token= or an Authorization bearer header
+func (srv *Server) userscriptTokenValid(userID string, r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	expected := shard.userscriptTokens[userID]
+	shard.mu.RUnlock()
+
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(hashUserscriptToken(token))) == 1
+}
+
+// corsMiddleware lets browser scripts on any origin call the wrapped routes.
+// They're token-authenticated and never use cookies, so a wildcard is safe.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getTurnSummary serves the polling payload. The ETag changes only when the
+// counts or newest game do, so scripts can poll cheaply with If-None-Match.
+func (srv *Server) getTurnSummary(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	if !srv.userscriptTokenValid(userID, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	summary, exists := srv.turnSummaries.Load(userID)
+
+	if !exists {
+		summary = TurnSummary{UserID: userID}
+	}
+
+	newestID := 0
+	if summary.NewestGame != nil {
+		newestID = summary.NewestGame.GameID
+	}
+	etag := fmt.Sprintf(`"%d-%d-%d"`, summary.YourTurn, summary.YourTurnNew, newestID)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WAL operations
+const (
+	walCommit   = "commit"   // a notification was delivered (or skipped) and its moves stored
+	walRegister = "register" // a device token was registered
+)
+
+// walEntry is one change appended to the write-ahead log
+type walEntry struct {
+	Op              string            `json:"op"`
+	UserID          string            `json:"user_id"`
+	At              int64             `json:"at"`
+	Games           map[int]MoveState `json:"games,omitempty"`
+	Notified        bool              `json:"notified,omitempty"`
+	DeviceToken     string            `json:"device_token,omitempty"`
+	APNsEnvironment string            `json:"apns_environment,omitempty"`
+}
+
+// storageWAL records move-state and registration changes before they're
+// applied, so a crash before the next storage write neither re-sends a
+// delivered push nor loses a registration. Entries are appended while holding
+// the user's shard lock for writing, and snapshots are copied holding every
+// shard's lock, so the log's length when a snapshot is copied marks exactly
+// the entries that snapshot includes. Once it's written, only those entries
+// are dropped.
+type storageWAL struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// storageWALEnabled reads STORAGE_WAL, defaulting to enabled
+func storageWALEnabled() bool {
+	return os.Getenv("STORAGE_WAL") != "false"
+}
+
+// openStorageWAL replays any entries left by a crash onto the loaded storage,
+// writes the result, and starts logging new changes to path
+func (srv *Server) openStorageWAL(path string) error {
+	entries, err := readWAL(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	srv.storage.lockAll()
+	for _, entry := range entries {
+		srv.storage.applyWALEntry(entry)
+	}
+	srv.storage.unlockAll()
+
+	srv.wal.mu.Lock()
+	srv.wal.path = path
+	srv.wal.file = file
+	srv.wal.mu.Unlock()
+
+	if len(entries) > 0 {
+		log.Printf("Replayed %d storage changes from %s", len(entries), path)
+		if err := srv.writeStorage(); err != nil {
+			srv.retryStorageWrite()
+		}
+	}
+	return nil
+}
+
+// readWAL reads the entries in path. A torn final line from a crash
+// mid-append ends the log; that change was never applied.
+func readWAL(path string) ([]walEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []walEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Ignoring incomplete write-ahead log entry after %d entries: %v", len(entries), err)
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// logStorageChange appends an entry and syncs it to disk. Callers must hold
+// the user's shard lock for writing and apply the change afterwards.
+func (srv *Server) logStorageChange(entry walEntry) {
+	srv.wal.mu.Lock()
+	defer srv.wal.mu.Unlock()
+
+	if srv.wal.file == nil {
+		return
+	}
+	if entry.At == 0 {
+		entry.At = time.Now().Unix()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding write-ahead log entry: %v", err)
+		return
+	}
+	if _, err := srv.wal.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error appending to write-ahead log: %v", err)
+		return
+	}
+	if err := srv.wal.file.Sync(); err != nil {
+		log.Printf("Error syncing write-ahead log: %v", err)
+	}
+}
+
+// storageWALOffset returns the log's current length. Callers must hold every
+// shard's lock, from rlockAll.
+func (srv *Server) storageWALOffset() int64 {
+	srv.wal.mu.Lock()
+	defer srv.wal.mu.Unlock()
+
+	if srv.wal.file == nil {
+		return 0
+	}
+	info, err := srv.wal.file.Stat()
+	if err != nil {
+		log.Printf("Error reading write-ahead log size: %v", err)
+		return 0
+	}
+	return info.Size()
+}
+
+// truncateStorageWAL drops the first offset bytes of the log once the
+// storage they describe has been written. Entries appended since are kept.
+// The rest is written to a new file that replaces the log, so a crash part
+// way through leaves either the old log or the new one, never a cut log.
+func (srv *Server) truncateStorageWAL(offset int64) {
+	srv.wal.mu.Lock()
+	defer srv.wal.mu.Unlock()
+
+	if srv.wal.file == nil || offset <= 0 {
+		return
+	}
+
+	info, err := srv.wal.file.Stat()
+	if err != nil {
+		log.Printf("Error reading write-ahead log size: %v", err)
+		return
+	}
+	tail := make([]byte, info.Size()-offset)
+	if len(tail) > 0 {
+		if _, err := srv.wal.file.ReadAt(tail, offset); err != nil {
+			log.Printf("Error reading write-ahead log: %v", err)
+			return
+		}
+	}
+
+	if err := replaceFile(srv.wal.path, tail); err != nil {
+		log.Printf("Error rewriting write-ahead log: %v", err)
+		return
+	}
+	file, err := os.OpenFile(srv.wal.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Error reopening write-ahead log: %v", err)
+		return
+	}
+	srv.wal.file.Close()
+	srv.wal.file = file
+}
+
+// replaceFile atomically replaces path with data: it's written and synced to
+// a temporary file in the same directory, which is renamed over path. The
+// file is only readable by the server.
+func replaceFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// applyWALEntry replays a logged change. Replaying a change that already
+// reached storage leaves it unchanged. Callers must hold the user's shard
+// lock for writing.
+func (s *MoveStorage) applyWALEntry(entry walEntry) {
+	shard := s.shard(entry.UserID)
+	switch entry.Op {
+	case walCommit:
+		shard.applyCommit(entry.UserID, entry.Games, entry.Notified, entry.At)
+	case walRegister:
+		shard.setDevice(entry.UserID, entry.DeviceToken, entry.APNsEnvironment)
+	default:
+		log.Printf("Ignoring unknown write-ahead log operation %q", entry.Op)
+	}
+}
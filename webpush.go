@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Web Push delivers notifications to browsers, so players can get turn
+// notifications without the iOS app. A page subscribes with the browser's
+// push service using the server's VAPID public key, then registers the
+// subscription here. Payloads are encrypted for the browser (RFC 8291) and
+// requests are signed with the VAPID key (RFC 8292), so only this server can
+// push to its subscriptions. With WEB_PUSH=true the key is read from
+// VAPID_PRIVATE_KEY, or from the vapid-private-key secret in Secret Manager.
+
+// webPushRecordSize is the record size declared in encrypted payloads. A
+// notification always fits in one record.
+const webPushRecordSize = 4096
+
+// errWebPushGone is returned when the push service no longer knows the
+// subscription, because the user unsubscribed or cleared the site's data
+var errWebPushGone = errors.New("web push subscription expired")
+
+// WebPushSubscription is a browser's PushSubscription, as its toJSON() gives it
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// webPushEnabled reads WEB_PUSH
+func webPushEnabled() bool {
+	return os.Getenv("WEB_PUSH") == "true"
+}
+
+// webPushSender signs and encrypts pushes with the server's VAPID key
+type webPushSender struct {
+	key       *ecdsa.PrivateKey
+	publicKey []byte       // uncompressed P-256 point, as browsers take it
+	subject   string       // contact for push services, a mailto: or https: URL
+	client    *http.Client // endpoints come from browsers, so only public addresses
+}
+
+// newWebPushSender loads a VAPID private key, base64url-encoded as web-push
+// libraries generate it
+func newWebPushSender(privateKey, subject string) (*webPushSender, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(privateKey), "="))
+	if err != nil {
+		return nil, fmt.Errorf("VAPID private key is not base64url")
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("VAPID private key is not a P-256 key")
+	}
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, fmt.Errorf("VAPID_SUBJECT must be a mailto: or https: URL")
+	}
+
+	publicKey := key.PublicKey().Bytes()
+	return &webPushSender{
+		key: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(publicKey[1:33]),
+				Y:     new(big.Int).SetBytes(publicKey[33:]),
+			},
+			D: new(big.Int).SetBytes(raw),
+		},
+		publicKey: publicKey,
+		subject:   subject,
+		client:    newPublicClient(),
+	}, nil
+}
+
+// configureWebPush loads the VAPID key from VAPID_PRIVATE_KEY, or from
+// Secret Manager when it isn't set
+func configureWebPush() (*webPushSender, error) {
+	privateKey := os.Getenv("VAPID_PRIVATE_KEY")
+	if privateKey == "" {
+		log.Println("Loading VAPID key from Secret Manager...")
+		var err error
+		if privateKey, err = getSecret("vapid-private-key"); err != nil {
+			return nil, fmt.Errorf("failed to load VAPID key")
+		}
+	}
+	return newWebPushSender(privateKey, os.Getenv("VAPID_SUBJECT"))
+}
+
+// vapidAuthorization is the Authorization header for a push to endpoint: a
+// JWT for the push service's origin, signed with the VAPID key
+func (s *webPushSender) vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": parsed.Scheme + "://" + parsed.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": s.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, sigS, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sigS.FillBytes(signature[32:])
+
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(signature),
+		base64.RawURLEncoding.EncodeToString(s.publicKey)), nil
+}
+
+// hkdfSHA256 derives length bytes (at most 32) from ikm, as RFC 5869 does
+func hkdfSHA256(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// encryptWebPush encrypts a payload for the subscription with the aes128gcm
+// content encoding (RFC 8291)
+func encryptWebPush(subscription *WebPushSubscription, plaintext []byte) ([]byte, error) {
+	decode := func(value string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	}
+	uaPublicBytes, err := decode(subscription.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key")
+	}
+	authSecret, err := decode(subscription.Keys.Auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, fmt.Errorf("invalid auth secret")
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key")
+	}
+
+	// A new key pair and salt for every message
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublicBytes...), asPublic...)
+	ikm := hkdfSHA256(authSecret, sharedSecret, keyInfo, 32)
+	contentKey := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record
+	ciphertext := gcm.Seal(nil, nonce, append(plaintext, 2), nil)
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(ciphertext)
+	return body.Bytes(), nil
+}
+
+// WebPushMessage is the payload a page's service worker receives
+type WebPushMessage struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	URL    string `json:"url,omitempty"`
+	Action string `json:"action,omitempty"`
+	GameID int    `json:"game_id,omitempty"`
+}
+
+// send pushes a message to the subscription. A subscription the push service
+// no longer knows returns errWebPushGone.
+func (s *webPushSender) send(subscription *WebPushSubscription, message WebPushMessage) error {
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(subscription, plaintext)
+	if err != nil {
+		return err
+	}
+	authorization, err := s.vapidAuthorization(subscription.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", "high")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errWebPushGone
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webPushSubscriptionFor returns the user's browser subscription, if any
+func (srv *Server) webPushSubscriptionFor(userID string) (*WebPushSubscription, bool) {
+	shard := srv.storage.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	subscription, exists := shard.webPushSubscriptions[userID]
+	return subscription, exists && srv.webPush != nil
+}
+
+// sendWebPush pushes a message to the user's browser. An expired
+// subscription is removed, so it isn't tried again.
+func (srv *Server) sendWebPush(userID string, subscription *WebPushSubscription, message WebPushMessage) error {
+	err := srv.webPush.send(subscription, message)
+	if !errors.Is(err, errWebPushGone) {
+		return err
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	if current := shard.webPushSubscriptions[userID]; current != nil && current.Endpoint == subscription.Endpoint {
+		delete(shard.webPushSubscriptions, userID)
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+	srv.saveStorage()
+	log.Printf("Removed expired web push subscription for user %s", userID)
+	return err
+}
+
+// webPushCORSMiddleware lets pages on any origin subscribe their browser.
+// They prove they act for the user with an OGS access token header rather
+// than cookies, so a wildcard is safe.
+func webPushCORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+ogsAccessTokenHeader)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getVAPIDPublicKey handles GET /webpush/key, the applicationServerKey pages
+// subscribe with
+func (srv *Server) getVAPIDPublicKey(w http.ResponseWriter, r *http.Request) {
+	if srv.webPush == nil {
+		http.Error(w, "Web Push is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": base64.RawURLEncoding.EncodeToString(srv.webPush.publicKey)})
+}
+
+// setWebPushSubscription handles PUT /webpush/{userID}. A test notification
+// is pushed first, so a subscription that can't be delivered to is rejected
+// rather than silently dropping turns.
+func (srv *Server) setWebPushSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if srv.webPush == nil {
+		http.Error(w, "Web Push is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var subscription WebPushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" || endpoint.User != nil {
+		http.Error(w, "endpoint must be an https URL", http.StatusBadRequest)
+		return
+	}
+	if subscription.Keys.P256dh == "" || subscription.Keys.Auth == "" {
+		http.Error(w, "keys.p256dh and keys.auth are required", http.StatusBadRequest)
+		return
+	}
+
+	test := WebPushMessage{Title: "OGS notifications", Body: "You'll get a notification here when it's your turn."}
+	if err := srv.webPush.send(&subscription, test); err != nil {
+		log.Printf("Web push test notification for user %s failed: %v", userID, err)
+		http.Error(w, "Could not push to this subscription", http.StatusBadGateway)
+		return
+	}
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	shard.webPushSubscriptions[userID] = &subscription
+	shard.bumpSettingsVersion(userID)
+	shard.mu.Unlock()
+
+	srv.recordFunnelStep(userID, funnelRegistered, time.Now())
+	srv.saveStorage()
+	log.Printf("Set web push subscription for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteWebPushSubscription handles DELETE /webpush/{userID}
+func (srv *Server) deleteWebPushSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+
+	shard := srv.storage.shard(userID)
+	shard.mu.Lock()
+	_, exists := shard.webPushSubscriptions[userID]
+	delete(shard.webPushSubscriptions, userID)
+	if exists {
+		shard.bumpSettingsVersion(userID)
+	}
+	shard.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "No web push subscription set", http.StatusNotFound)
+		return
+	}
+
+	srv.saveStorage()
+	log.Printf("Removed web push subscription for user %s", userID)
+	w.WriteHeader(http.StatusNoContent)
+}